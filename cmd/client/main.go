@@ -2,13 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/logging"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
 	"io/ioutil"
 	"log/slog"
 	"os"
+	"strconv"
 
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/cmd/client/src"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/payload"
 )
 
 func loadConfig(path string) (*src.ClientConfig, error) {
@@ -30,7 +34,59 @@ func loadConfig(path string) (*src.ClientConfig, error) {
 	return &config, nil
 }
 
+const usage = "usage: client <config> [status|fetch <clientId> <requestId>]"
+
+// retrieveRequest answers the status and fetch commands, used to get the
+// results of a request whose connection was lost
+func retrieveRequest(client *src.Client, args []string) error {
+	if len(args) != 3 {
+		return errors.New(usage)
+	}
+	clientId, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid client id %s: %w", args[1], err)
+	}
+	requestId, err := strconv.ParseUint(args[2], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid request id %s: %w", args[2], err)
+	}
+
+	var status *payload.Status
+	switch args[0] {
+	case "status":
+		status, err = client.Status(uint32(clientId), uint32(requestId))
+	case "fetch":
+		status, err = client.Fetch(uint32(clientId), uint32(requestId))
+	default:
+		return errors.New(usage)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "request %d of client %d: %s, %d of 8 queries finished\n",
+		requestId, clientId, requestStateName(status.State), status.FinishedCount())
+	return nil
+}
+
+func requestStateName(state payload.RequestState) string {
+	switch state {
+	case payload.RequestRunning:
+		return "running"
+	case payload.RequestFinished:
+		return "finished"
+	case payload.RequestAborted:
+		return "aborted"
+	default:
+		return "unknown"
+	}
+}
+
 func main() {
+	if len(os.Args) < 2 {
+		fmt.Println(usage)
+		return
+	}
+
 	clientConfig, err := loadConfig(os.Args[1])
 	if err != nil {
 		fmt.Println(err)
@@ -51,12 +107,33 @@ func main() {
 	client, deleteClient := src.NewClient(clientConfig)
 	defer deleteClient()
 
+	if len(os.Args) > 2 {
+		if err := retrieveRequest(client, os.Args[2:]); err != nil {
+			slog.Error("error retrieving request:", "error", err)
+		}
+		return
+	}
+
 	if err := client.Connect(); err != nil {
 		slog.Error("error connecting to server:", "error", err)
 		return
 	}
-	if err := client.Execute(); err != nil {
-		slog.Error("error executing command:", "error", err)
-		return
+
+	signal := utils.MakeSignalHandler()
+	executeErr := make(chan error, 1)
+	go func() { executeErr <- client.Execute() }()
+
+	select {
+	case s := <-signal:
+		slog.Info("cancelling request", "signal", s)
+		if err := client.Cancel(); err != nil {
+			slog.Error("error cancelling request:", "error", err)
+		}
+	case err := <-executeErr:
+		if err != nil {
+			clientId, requestId := client.RequestIds()
+			slog.Error("error executing command:", "error", err)
+			slog.Info("results can be fetched later", "clientId", clientId, "requestId", requestId)
+		}
 	}
 }
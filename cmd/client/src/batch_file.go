@@ -21,9 +21,15 @@ type BatchFile struct {
 	fileReader   *FileLinesReader
 	deleteReader func()
 	taskQueue    *utils.BlockingQueue[*message.DataMessageConfig]
+
+	// Batching is deterministic, so re-reading the file yields the same
+	// sequence numbers and the ones the server already acknowledged can
+	// be skipped when resuming
+	sequence     uint32
+	acknowledged uint32
 }
 
-func NewBatchFile(config *BatchFileConfig, taskQueue *utils.BlockingQueue[*message.DataMessageConfig]) (*BatchFile, func(), error) {
+func NewBatchFile(config *BatchFileConfig, taskQueue *utils.BlockingQueue[*message.DataMessageConfig], acknowledged uint32) (*BatchFile, func(), error) {
 	fileReader, deleteFileLinesReader, err := NewFileLinesReader(config.Path, config.NlinesFromDisk)
 	if err != nil {
 		return nil, nil, err
@@ -34,6 +40,7 @@ func NewBatchFile(config *BatchFileConfig, taskQueue *utils.BlockingQueue[*messa
 		deleteReader: deleteFileLinesReader,
 		taskQueue:    taskQueue,
 		config:       config,
+		acknowledged: acknowledged,
 	}
 	cleanup := func() { deleteBatchFile(batchFile) }
 	return batchFile, cleanup, nil
@@ -44,7 +51,7 @@ func deleteBatchFile(bf *BatchFile) {
 }
 
 func (bf *BatchFile) Run(join chan error) {
-	slog.Info("Start sending file", "file", bf.config.Path)
+	slog.Info("Start sending file", "file", bf.config.Path, "acknowledged", bf.acknowledged)
 	bf.pushStart()
 	if err := bf.pushDataMessages(); err != nil {
 		join <- err
@@ -55,10 +62,22 @@ func (bf *BatchFile) Run(join chan error) {
 	join <- nil
 }
 
+// pushStart sends the header of the file, the columns are found by their
+// name
 func (bf *BatchFile) pushStart() {
 	dataConfig := &message.DataMessageConfig{
 		Start:    true,
 		DataType: bf.config.DataType,
+		Data:     []byte(bf.fileReader.Text()),
+	}
+	bf.push(dataConfig)
+}
+
+func (bf *BatchFile) push(dataConfig *message.DataMessageConfig) {
+	dataConfig.Sequence = bf.sequence
+	bf.sequence++
+	if dataConfig.Sequence < bf.acknowledged {
+		return
 	}
 	bf.taskQueue.Push(dataConfig)
 }
@@ -66,13 +85,12 @@ func (bf *BatchFile) pushStart() {
 func (bf *BatchFile) pushDataMessages() error {
 	batchLines := NewBatchLines("", bf.config.BatchSize, bf.config.MaxBytes)
 	callback := func(data string) {
-		bf.taskQueue.Push(&message.DataMessageConfig{
+		bf.push(&message.DataMessageConfig{
 			DataType: bf.config.DataType,
 			Data:     []byte(data),
 		})
 	}
 
-	bf.fileReader.Text()
 	for sliceOfLines, err := range bf.fileReader.Lines() {
 		if err != nil {
 			return err
@@ -92,5 +110,5 @@ func (bf *BatchFile) pushEnd() {
 		End:      true,
 		DataType: bf.config.DataType,
 	}
-	bf.taskQueue.Push(dataConfig)
+	bf.push(dataConfig)
 }
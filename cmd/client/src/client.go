@@ -2,8 +2,11 @@ package src
 
 import (
 	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/payload"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/network"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
 )
@@ -15,13 +18,27 @@ type ClientConfig struct {
 	TaskQueueSize int              `json:"TaskQueueSize"`
 	ReviewsBatch  *BatchFileConfig `json:"ReviewsBatch"`
 	GamesBatch    *BatchFileConfig `json:"GamesBatch"`
+	// Timeouts and heartbeat interval are expressed in seconds, a zero
+	// timeout disables the deadline
+	ReadTimeout       int `json:"ReadTimeout"`
+	WriteTimeout      int `json:"WriteTimeout"`
+	HeartbeatInterval int `json:"HeartbeatInterval"`
+	// How many times the client reconnects to resume an interrupted
+	// upload, waiting ReconnectBackoff seconds times the attempt number
+	MaxReconnects    int `json:"MaxReconnects"`
+	ReconnectBackoff int `json:"ReconnectBackoff"`
 }
 
+const defaultHeartbeatInterval = 5 * time.Second
+
 type Client struct {
 	socket       *network.SocketTcp
 	deleteSocket func()
 	protocol     *communication.Protocol
 	clientConfig *ClientConfig
+
+	clientId  uint32
+	requestId uint32
 }
 
 func NewClient(clientConfig *ClientConfig) (*Client, func()) {
@@ -44,15 +61,119 @@ func (c *Client) setSocket(clientConfig *ClientConfig) {
 	c.deleteSocket = deleteSocket
 }
 
-func (c *Client) Connect() error {
+func (c *Client) connectSocket() error {
 	if err := c.socket.Connect(); err != nil {
 		return err
 	}
+	c.socket.SetTimeouts(
+		time.Duration(c.clientConfig.ReadTimeout)*time.Second,
+		time.Duration(c.clientConfig.WriteTimeout)*time.Second,
+	)
 	c.protocol = communication.NewProtocol(c.socket)
-	return c.protocol.Sync()
+	return nil
+}
+
+func (c *Client) Connect() error {
+	if err := c.connectSocket(); err != nil {
+		return err
+	}
+	if err := c.protocol.Sync(); err != nil {
+		return err
+	}
+	c.clientId = c.protocol.ClientId()
+	c.requestId = c.protocol.RequestId()
+	return nil
+}
+
+// reconnect opens a new connection and resumes the previous session
+func (c *Client) reconnect() error {
+	c.deleteSocket()
+	c.setSocket(c.clientConfig)
+	if err := c.connectSocket(); err != nil {
+		return err
+	}
+	checkpoint, err := c.protocol.Resume(c.clientId, c.requestId)
+	if err != nil {
+		return err
+	}
+	slog.Info("session resumed",
+		"clientId", c.clientId,
+		"requestId", c.requestId,
+		"gamesAcknowledged", checkpoint.Games,
+		"reviewsAcknowledged", checkpoint.Reviews,
+	)
+	return nil
+}
+
+// Status connects only to ask how far a previous request got
+func (c *Client) Status(clientId uint32, requestId uint32) (*payload.Status, error) {
+	if err := c.connectSocket(); err != nil {
+		return nil, err
+	}
+	return c.protocol.Status(clientId, requestId)
+}
+
+// Fetch connects only to print the finished results of a previous
+// request, and its rejected lines if it finished. It returns the request
+// status.
+func (c *Client) Fetch(clientId uint32, requestId uint32) (*payload.Status, error) {
+	if err := c.connectSocket(); err != nil {
+		return nil, err
+	}
+	status, err := c.protocol.Fetch(clientId, requestId)
+	if err != nil {
+		return nil, err
+	}
+	messages := status.FinishedCount()
+	if status.State == payload.RequestFinished {
+		messages++
+	}
+	for i := 0; i < messages; i++ {
+		result, err := c.protocol.RecvResultMessage()
+		if err != nil {
+			return nil, err
+		}
+		printResult(result.Payload.Header.Type, result.Payload.Payload.Data)
+	}
+	return status, nil
+}
+
+// RequestIds returns the ids needed to ask for the results of the
+// request later
+func (c *Client) RequestIds() (uint32, uint32) {
+	return c.clientId, c.requestId
+}
+
+// Cancel aborts the request, the server drops everything it processed
+// for it
+func (c *Client) Cancel() error {
+	return c.protocol.SendCancel()
+}
+
+func (c *Client) heartbeatInterval() time.Duration {
+	if c.clientConfig.HeartbeatInterval <= 0 {
+		return defaultHeartbeatInterval
+	}
+	return time.Duration(c.clientConfig.HeartbeatInterval) * time.Second
 }
 
 func (c *Client) Execute() error {
+	err := c.execute()
+	for attempt := 1; err != nil && attempt <= c.clientConfig.MaxReconnects; attempt++ {
+		slog.Warn("connection lost, resuming upload", "attempt", attempt, "error", err)
+		time.Sleep(time.Duration(c.clientConfig.ReconnectBackoff*attempt) * time.Second)
+		if err = c.reconnect(); err != nil {
+			continue
+		}
+		err = c.execute()
+	}
+	return err
+}
+
+func (c *Client) execute() error {
+	stopHeartbeat := c.protocol.StartHeartbeat(c.heartbeatInterval())
+	defer stopHeartbeat()
+
 	sender := NewSender(c.clientConfig, c.protocol)
 	receiver := NewReceiver(c.clientConfig, c.protocol)
 	senderThread := utils.NewThread(sender)
@@ -61,6 +182,9 @@ func (c *Client) Execute() error {
 	receiverThread.Run()
 
 	if err := senderThread.Join(); err != nil {
+		// Unblock the receiver, the connection is unusable anyway
+		c.socket.GetConnection().Close()
+		receiverThread.Join()
 		return err
 	}
 	if err := receiverThread.Join(); err != nil {
@@ -19,11 +19,19 @@ func NewFileSender(protocol *communication.Protocol, taskQueue *utils.BlockingQu
 }
 
 func (fs *DataMessageSender) Run(join chan error) {
+	var sendErr error
 	for dataConfig := range fs.taskQueue.Iter() {
-		if err := fs.protocol.SendDataMessage(dataConfig); err != nil {
-			join <- err
-			return
+		if sendErr != nil {
+			// Keep draining so the batch files aren't blocked
+			// pushing into a queue nobody reads
+			continue
 		}
+		// The server hands out credits as the pipeline keeps up,
+		// without one we wait instead of flooding it
+		if sendErr = fs.protocol.AcquireCredit(); sendErr != nil {
+			continue
+		}
+		sendErr = fs.protocol.SendDataMessage(dataConfig)
 	}
-	join <- nil
+	join <- sendErr
 }
@@ -20,71 +20,118 @@ func NewReceiver(clientConfig *ClientConfig, protocol *communication.Protocol) *
 }
 
 func (r *Receiver) Run(join chan error) {
-	if err := r.receive(); err != nil {
-		join <- err
-	}
-	join <- nil
+	join <- r.receive()
 }
 
 func (r *Receiver) receive() error {
 	var received int
-	for received < 5 {
+	// The rejected lines are sent after every query
+	var rejections bool
+	for received < 8 || !rejections {
 		result, err := r.protocol.RecvResultMessage()
 		if err != nil {
 			return err
 		}
 
-		if result.Payload.Header.Type == uint8(message.Query1) {
-			query1 := strings.Split(string(result.Payload.Payload.Data), ",")
-			windows := query1[0]
-			mac := query1[1]
-			linux := query1[2]
-			fmt.Fprintf(os.Stdout, "===========\n")
-			fmt.Fprintf(os.Stdout, "Query 1:\n")
-			fmt.Fprintf(os.Stdout, "===========\n")
-			fmt.Fprintf(os.Stdout, "windows: %s\n", windows)
-			fmt.Fprintf(os.Stdout, "mac: %s\n", mac)
-			fmt.Fprintf(os.Stdout, "linux: %s\n", linux)
-			received += 1
-		} else if result.Payload.Header.Type == uint8(message.Query2) {
-			query2 := strings.Split(string(result.Payload.Payload.Data), "\n")
-			fmt.Fprintf(os.Stdout, "===========\n")
-			fmt.Fprintf(os.Stdout, "Query 2:\n")
-			fmt.Fprintf(os.Stdout, "===========\n")
-			for i, s := range query2 {
-				fmt.Fprintf(os.Stdout, "%d: %s\n", i+1, s)
-			}
-			received += 1
-		} else if result.Payload.Header.Type == uint8(message.Query3) {
-			query3 := strings.Split(string(result.Payload.Payload.Data), "\n")
-			fmt.Fprintf(os.Stdout, "===========\n")
-			fmt.Fprintf(os.Stdout, "Query 3:\n")
-			fmt.Fprintf(os.Stdout, "===========\n")
-			for i, s := range query3 {
-				fmt.Fprintf(os.Stdout, "%d: %s\n", i+1, s)
-			}
-			received += 1
-		} else if result.Payload.Header.Type == uint8(message.Query4) {
-			query4 := strings.Split(string(result.Payload.Payload.Data), "\n")
-			fmt.Fprintf(os.Stdout, "===========\n")
-			fmt.Fprintf(os.Stdout, "Query 4:\n")
-			fmt.Fprintf(os.Stdout, "===========\n")
-			for i, s := range query4 {
-				fmt.Fprintf(os.Stdout, "%d: %s\n", i+1, s)
-			}
-			received += 1
-		} else if result.Payload.Header.Type == uint8(message.Query5) {
-			query5 := strings.Split(string(result.Payload.Payload.Data), "\n")
-			fmt.Fprintf(os.Stdout, "===========\n")
-			fmt.Fprintf(os.Stdout, "Query 5:\n")
-			fmt.Fprintf(os.Stdout, "===========\n")
-			for i, s := range query5 {
-				fmt.Fprintf(os.Stdout, "%d: %s\n", i+1, s)
-			}
-			received += 1
+		resultType := result.Payload.Header.Type
+		if !printResult(resultType, result.Payload.Payload.Data) {
+			continue
+		}
+		if resultType == uint8(message.Rejections) {
+			rejections = true
 		} else {
-			slog.Debug(fmt.Sprintf("Unknown query type: %d\n", result.Payload.Header.Type))
+			received += 1
 		}
 	}
 	return nil
 }
+
+// printResult writes the results of a query to stdout, it returns false
+// for unknown queries
+func printResult(resultType uint8, data []byte) bool {
+	if resultType == uint8(message.Query1) {
+		query1 := strings.Split(string(data), ",")
+		windows := query1[0]
+		mac := query1[1]
+		linux := query1[2]
+		fmt.Fprintf(os.Stdout, "===========\n")
+		fmt.Fprintf(os.Stdout, "Query 1:\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		fmt.Fprintf(os.Stdout, "windows: %s\n", windows)
+		fmt.Fprintf(os.Stdout, "mac: %s\n", mac)
+		fmt.Fprintf(os.Stdout, "linux: %s\n", linux)
+		return true
+	} else if resultType == uint8(message.Query2) {
+		query2 := strings.Split(string(data), "\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		fmt.Fprintf(os.Stdout, "Query 2:\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		for i, s := range query2 {
+			fmt.Fprintf(os.Stdout, "%d: %s\n", i+1, s)
+		}
+		return true
+	} else if resultType == uint8(message.Query3) {
+		query3 := strings.Split(string(data), "\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		fmt.Fprintf(os.Stdout, "Query 3:\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		for i, s := range query3 {
+			fmt.Fprintf(os.Stdout, "%d: %s\n", i+1, s)
+		}
+		return true
+	} else if resultType == uint8(message.Query4) {
+		query4 := strings.Split(string(data), "\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		fmt.Fprintf(os.Stdout, "Query 4:\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		for i, s := range query4 {
+			fmt.Fprintf(os.Stdout, "%d: %s\n", i+1, s)
+		}
+		return true
+	} else if resultType == uint8(message.Query5) {
+		query5 := strings.Split(string(data), "\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		fmt.Fprintf(os.Stdout, "Query 5:\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		for i, s := range query5 {
+			fmt.Fprintf(os.Stdout, "%d: %s\n", i+1, s)
+		}
+		return true
+	} else if resultType == uint8(message.Query6) {
+		query6 := strings.Split(string(data), "\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		fmt.Fprintf(os.Stdout, "Query 6:\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		for i, s := range query6 {
+			fmt.Fprintf(os.Stdout, "%d: %s\n", i+1, s)
+		}
+		return true
+	} else if resultType == uint8(message.Query7) {
+		query7 := strings.Split(string(data), "\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		fmt.Fprintf(os.Stdout, "Query 7:\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		for i, s := range query7 {
+			fmt.Fprintf(os.Stdout, "%d: %s\n", i+1, s)
+		}
+		return true
+	} else if resultType == uint8(message.Query8) {
+		query8 := strings.Split(string(data), "\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		fmt.Fprintf(os.Stdout, "Query 8:\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		for i, s := range query8 {
+			fmt.Fprintf(os.Stdout, "%d: %s\n", i+1, s)
+		}
+		return true
+	} else if resultType == uint8(message.Rejections) {
+		fmt.Fprintf(os.Stdout, "===========\n")
+		fmt.Fprintf(os.Stdout, "Rejected lines:\n")
+		fmt.Fprintf(os.Stdout, "===========\n")
+		fmt.Fprintf(os.Stdout, "%s\n", data)
+		return true
+	} else {
+		slog.Debug(fmt.Sprintf("Unknown query type: %d\n", resultType))
+		return false
+	}
+}
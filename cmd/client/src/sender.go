@@ -16,21 +16,18 @@ func NewSender(clientConfig *ClientConfig, protocol *communication.Protocol) *Se
 }
 
 func (s *Sender) Run(join chan error) {
-	if err := s.send(); err != nil {
-		join <- err
-	}
-	join <- nil
+	join <- s.send()
 }
 
 func (s *Sender) send() error {
 	taskQueue := utils.NewBlockingQueue[*message.DataMessageConfig](s.clientConfig.TaskQueueSize)
 
-	reviewsBatch, deleteReviewsBatch, err := NewBatchFile(s.clientConfig.ReviewsBatch, taskQueue)
+	reviewsBatch, deleteReviewsBatch, err := NewBatchFile(s.clientConfig.ReviewsBatch, taskQueue, s.protocol.Acknowledged(message.Reviews))
 	if err != nil {
 		return err
 	}
 	defer deleteReviewsBatch()
-	gamesBatch, deleteGamesBatch, err := NewBatchFile(s.clientConfig.GamesBatch, taskQueue)
+	gamesBatch, deleteGamesBatch, err := NewBatchFile(s.clientConfig.GamesBatch, taskQueue, s.protocol.Acknowledged(message.Games))
 	if err != nil {
 		return err
 	}
@@ -4,6 +4,7 @@ import (
 	"context"
 	coordinator2 "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/coordinator"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/logging"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
 	"log/slog"
 )
@@ -35,7 +36,16 @@ func main() {
 		return
 	}
 
-	coordinator, err := coordinator2.NewEndCoordinator(outputType, expectedGames, expectedReviews)
+	outputs := map[string]client.OutputType{"": outputType}
+	// The filters that forward their rejected records need the END there too
+	rejectedType, err := client.GetRejectedOutputType()
+	if err != nil {
+		slog.Error("error getting rejected output type", "error", err.Error())
+		return
+	}
+	outputs[client.RejectedOutput] = rejectedType
+
+	coordinator, err := coordinator2.NewEndCoordinator(outputs, expectedGames, expectedReviews)
 	defer coordinator.Close()
 	if err != nil {
 		slog.Error("error creating coordinator", "error", err.Error())
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/controllers"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/logging"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
+)
+
+func main() {
+	err := logging.InitLoggerWithEnv()
+	if err != nil {
+		slog.Error("error creating logger", "error", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signal := utils.MakeSignalHandler()
+
+	const nKeyName = "N_VALUE"
+	n, err := utils.GetFromEnvUint(nKeyName)
+	if err != nil {
+		slog.Error("error parsing N_VALUE env var", "error", err)
+		return
+	}
+	const minReviewsKeyName = "MIN_REVIEWS"
+	minReviews, err := utils.GetFromEnvUint(minReviewsKeyName)
+	if err != nil {
+		slog.Error("error parsing MIN_REVIEWS env var", "error", err)
+		return
+	}
+
+	disagreement, err := controllers.NewDisagreement(*n, *minReviews)
+	if err != nil {
+		slog.Error("error creating disagreement", "error", err)
+		return
+	}
+	defer disagreement.Destroy()
+
+	slog.Info("disagreement started")
+	go func() {
+		err = disagreement.Run(ctx)
+		if err != nil {
+			slog.Error("error running disagreement", "error", err.Error())
+			return
+		}
+	}()
+
+	utils.BlockUntilSignal(signal, disagreement.Done(), cancel)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/logging"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/env"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const requeueTimeout = 5 * time.Second
+
+const usage = `usage:
+	dlq list <queue>...             number of messages parked for each queue
+	dlq inspect <queue> [max]       print the parked messages, they stay parked
+	dlq requeue <queue> [max]       send the parked messages back to their queue`
+
+func main() {
+	if err := logging.InitLoggerWithEnv(); err != nil {
+		slog.Error("error creating logger", "error", err.Error())
+		return
+	}
+
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	conn, err := env.GetConnection()
+	if err != nil {
+		slog.Error("error connecting to rabbitmq", "error", err.Error())
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	ch, err := conn.GetConnection().Channel()
+	if err != nil {
+		slog.Error("error opening channel", "error", err.Error())
+		os.Exit(1)
+	}
+	defer ch.Close()
+
+	command, queue := os.Args[1], os.Args[2]
+	switch command {
+	case "list":
+		err = list(ch, os.Args[2:])
+	case "inspect":
+		err = inspect(ch, queue, parseMax(os.Args[3:]))
+	case "requeue":
+		err = requeue(ch, queue, parseMax(os.Args[3:]))
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		slog.Error("error running command", "command", command, "error", err.Error())
+		os.Exit(1)
+	}
+}
+
+// parseMax returns the optional limit of messages to handle, 0 means all
+func parseMax(args []string) int {
+	if len(args) == 0 {
+		return 0
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	return n
+}
+
+func list(ch *amqp091.Channel, queues []string) error {
+	for _, queue := range queues {
+		q, err := ch.QueueDeclarePassive(rabbitmq.DeadLetterQueue(queue), true, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("couldn't find dead letter queue of %s: %w", queue, err)
+		}
+		fmt.Printf("%s\t%d\n", queue, q.Messages)
+	}
+	return nil
+}
+
+func inspect(ch *amqp091.Channel, queue string, max int) error {
+	var deliveries []amqp091.Delivery
+	// Nothing is acknowledged until the end so every message is seen once,
+	// then all of them go back to the dead letter queue
+	defer func() {
+		if len(deliveries) > 0 {
+			deliveries[len(deliveries)-1].Nack(true, true)
+		}
+	}()
+
+	for max == 0 || len(deliveries) < max {
+		delivery, ok, err := ch.Get(rabbitmq.DeadLetterQueue(queue), false)
+		if err != nil {
+			return fmt.Errorf("couldn't get message: %w", err)
+		}
+		if !ok {
+			break
+		}
+		deliveries = append(deliveries, delivery)
+		printDelivery(len(deliveries), delivery)
+	}
+	fmt.Printf("%d messages parked\n", len(deliveries))
+	return nil
+}
+
+func printDelivery(n int, delivery amqp091.Delivery) {
+	fmt.Printf("#%d retries=%d", n, rabbitmq.RetryCount(delivery.Headers))
+	if reason, ok := delivery.Headers[rabbitmq.RetryReasonHeader].(string); ok {
+		fmt.Printf(" reason=%q", reason)
+	}
+	fmt.Println()
+
+	var msg protocol.Message
+	if err := msg.Unmarshal(delivery.Body); err != nil {
+		fmt.Printf("\tundecodable message (%d bytes): %v\n", len(delivery.Body), err)
+		return
+	}
+	fmt.Printf("\ttype=%s client=%d request=%d message=%d\n",
+		messageTypeName(msg.GetMessageType()),
+		msg.GetClientID(),
+		msg.GetRequestID(),
+		msg.GetMessageID(),
+	)
+	switch msg.GetMessageType() {
+	case protocol.Data, protocol.End:
+		if msg.HasGameData() {
+			fmt.Println("\tdata=games")
+		} else {
+			fmt.Println("\tdata=reviews")
+		}
+	case protocol.Results:
+		if query, err := msg.GetQueryNumber(); err != nil {
+			fmt.Printf("\tquery=%v\n", err)
+		} else {
+			fmt.Printf("\tquery=%d\n", query)
+		}
+	}
+}
+
+func messageTypeName(t protocol.MessageType) string {
+	switch t {
+	case protocol.End:
+		return "end"
+	case protocol.Data:
+		return "data"
+	case protocol.Results:
+		return "results"
+	case protocol.Cancel:
+		return "cancel"
+	default:
+		return "unknown"
+	}
+}
+
+// requeue publishes the parked messages to their queue again with the
+// retry count reset, each one is removed from the dead letter queue only
+// once the broker confirmed it
+func requeue(ch *amqp091.Channel, queue string, max int) error {
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("couldn't enable publisher confirms: %w", err)
+	}
+
+	count := 0
+	for max == 0 || count < max {
+		delivery, ok, err := ch.Get(rabbitmq.DeadLetterQueue(queue), false)
+		if err != nil {
+			return fmt.Errorf("couldn't get message: %w", err)
+		}
+		if !ok {
+			break
+		}
+
+		headers := amqp091.Table{}
+		for k, v := range delivery.Headers {
+			headers[k] = v
+		}
+		delete(headers, rabbitmq.RetryCountHeader)
+		delete(headers, rabbitmq.RetryReasonHeader)
+
+		if err := publish(ch, queue, headers, delivery); err != nil {
+			delivery.Nack(false, true)
+			return err
+		}
+		if err := delivery.Ack(false); err != nil {
+			return fmt.Errorf("couldn't remove message from the dead letter queue: %w", err)
+		}
+		count++
+	}
+	fmt.Printf("%d messages requeued to %s\n", count, queue)
+	return nil
+}
+
+func publish(ch *amqp091.Channel, queue string, headers amqp091.Table, delivery amqp091.Delivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requeueTimeout)
+	defer cancel()
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, "", queue, false, false, amqp091.Publishing{
+		Headers:      headers,
+		DeliveryMode: amqp091.Persistent,
+		ContentType:  delivery.ContentType,
+		Body:         delivery.Body,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't publish message: %w", err)
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("no confirmation from the broker: %w", err)
+	}
+	if !acked {
+		return rabbitmq.ErrPublishNacked
+	}
+	return nil
+}
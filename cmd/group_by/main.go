@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/controllers"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/logging"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
+)
+
+func main() {
+	err := logging.InitLoggerWithEnv()
+	if err != nil {
+		slog.Error("error creating logger", "error", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signal := utils.MakeSignalHandler()
+
+	key, err := controllers.GetGroupKey()
+	if err != nil {
+		slog.Error("error parsing GROUP_BY env var", "error", err)
+		return
+	}
+	const nKeyName = "N_VALUE"
+	n, err := utils.GetFromEnvUint(nKeyName)
+	if err != nil {
+		slog.Error("error parsing N_VALUE env var", "error", err)
+		return
+	}
+	const minGamesKeyName = "MIN_GAMES"
+	minGames, err := utils.GetFromEnvUint(minGamesKeyName)
+	if err != nil {
+		slog.Error("error parsing MIN_GAMES env var", "error", err)
+		return
+	}
+
+	groupBy, err := controllers.NewGroupBy(key, *n, *minGames)
+	if err != nil {
+		slog.Error("error creating group by", "error", err)
+		return
+	}
+	defer groupBy.Destroy()
+
+	slog.Info("group by started")
+	go func() {
+		err = groupBy.Run(ctx)
+		if err != nil {
+			slog.Error("error running group by", "error", err.Error())
+			return
+		}
+	}()
+
+	utils.BlockUntilSignal(signal, groupBy.Done(), cancel)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/controllers"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/logging"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
+)
+
+func main() {
+	err := logging.InitLoggerWithEnv()
+	if err != nil {
+		slog.Error("error creating logger", "error", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signal := utils.MakeSignalHandler()
+
+	key, err := controllers.GetGroupKey()
+	if err != nil {
+		slog.Error("error parsing GROUP_BY env var", "error", err)
+		return
+	}
+
+	groupKeys, err := controllers.NewGroupKeys(key)
+	if err != nil {
+		slog.Error("error creating group keys", "error", err)
+		return
+	}
+	defer groupKeys.Close()
+
+	slog.Info("group keys started")
+	go func() {
+		err = groupKeys.Run(ctx)
+		if err != nil {
+			slog.Error("error running group keys", "error", err.Error())
+			return
+		}
+	}()
+
+	utils.BlockUntilSignal(signal, groupKeys.Done(), cancel)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/controllers"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/logging"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
+	"log/slog"
+)
+
+func main() {
+	err := logging.InitLoggerWithEnv()
+	if err != nil {
+		slog.Error("error creating logger", "error", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signal := utils.MakeSignalHandler()
+
+	counter, err := controllers.NewLanguageCounter()
+	if err != nil {
+		slog.Error("error creating language counter", "error", err)
+		return
+	}
+	defer counter.Destroy()
+
+	slog.Info("language counter started")
+	go func() {
+		err = counter.Run(ctx)
+		if err != nil {
+			slog.Error("error running language counter", "error", err.Error())
+			return
+		}
+	}()
+
+	utils.BlockUntilSignal(signal, counter.Done(), cancel)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/logging"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/env"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
+)
+
+const usage = `usage:
+	rescale <exchange> <from-client> <tag>[,<tag>...]
+
+Changes the tags the routers writing to exchange spread keys over, for
+the clients from from-client on. The replicas bound to the new tags must
+be running before the first of those clients arrives.`
+
+func main() {
+	if err := logging.InitLoggerWithEnv(); err != nil {
+		slog.Error("error creating logger", "error", err.Error())
+		return
+	}
+
+	if len(os.Args) != 4 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	fromClient, err := strconv.ParseUint(os.Args[2], 10, 32)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	update := rabbitmq.RouterUpdate{
+		Exchange:   os.Args[1],
+		Tags:       strings.Split(os.Args[3], ","),
+		FromClient: uint32(fromClient),
+	}
+
+	if err := publish(update); err != nil {
+		slog.Error("error publishing router update", "error", err.Error())
+		os.Exit(1)
+	}
+	slog.Info("routers rescaled", "exchange", update.Exchange, "tags", update.Tags, "from_client", update.FromClient)
+}
+
+// publish appends update to the router control log, the routers that
+// are running apply it right away and the ones that start later replay it
+func publish(update rabbitmq.RouterUpdate) error {
+	config, err := env.GetRouterControlConfig()
+	if err != nil {
+		return err
+	}
+
+	conn, err := env.GetConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	control := rabbitmq.NewControlStream(*config)
+	if err := control.Connect(conn); err != nil {
+		return err
+	}
+	defer control.Close()
+
+	return control.Publish(update)
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/logging"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/results"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
 
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/cmd/server/src"
@@ -39,7 +40,13 @@ func main() {
 		return
 	}
 
-	server, deleteServer := src.NewServer(serverConfig, &inputManager, &outputManager)
+	store, err := results.NewStore(serverConfig.ResultsDir)
+	if err != nil {
+		slog.Error("error creating results store", "error", err.Error())
+		return
+	}
+
+	server, deleteServer := src.NewServer(serverConfig, store, &inputManager, &outputManager)
 	defer deleteServer()
 
 	slog.Info("starting server")
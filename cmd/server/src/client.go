@@ -3,35 +3,57 @@ package src
 import (
 	"fmt"
 	"log/slog"
+	"slices"
+	"time"
 
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/message"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/payload"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/utils"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
+	models "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/model"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/network"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
 )
 
+// SessionResolver returns the session a handshake belongs to, either a
+// brand new one or the one a resuming client asks for
+type SessionResolver func(handshake *message.Message[*payload.Empty]) (*Session, error)
+
 type Client struct {
 	socket       *network.SocketTcp
 	deleteSocket func()
 	protocol     *communication.Protocol
-
-	msgIdCounter uint32
-	clientId     uint32
+	session      *Session
 }
 
-func NewClient(socket *network.SocketTcp, clientId uint32, deleteSocket func()) (*Client, func(), error) {
+func NewClient(
+	socket *network.SocketTcp,
+	clientProtocol *communication.Protocol,
+	handshake *message.Message[*payload.Empty],
+	resolveSession SessionResolver,
+	deleteSocket func(),
+) (*Client, func(), error) {
 	client := &Client{
 		socket:       socket,
 		deleteSocket: deleteSocket,
-		msgIdCounter: 0,
-		clientId:     clientId,
+		protocol:     clientProtocol,
+	}
+
+	session, err := resolveSession(handshake)
+	if err != nil {
+		return nil, nil, err
 	}
-	client.protocol = communication.NewProtocol(socket)
-	if err := client.protocol.SyncAck(clientId); err != nil {
+	syncAckMsgConf := &message.SyncAckMessageConfig{
+		ClientId:   session.clientId,
+		RequestId:  session.requestId,
+		Checkpoint: session.Checkpoint(),
+	}
+	if err := client.protocol.SendSyncAck(syncAckMsgConf); err != nil {
 		return nil, nil, err
 	}
+	client.session = session
+
 	cleanup := func() {
 		deleteClient(client)
 	}
@@ -43,111 +65,157 @@ func deleteClient(c *Client) {
 }
 
 func (c *Client) GetMessageId() uint32 {
-	defer func() { c.msgIdCounter++ }()
-	return c.msgIdCounter
+	return c.session.GetMessageId()
 }
 
 // TODO(fede) - Parte 2 - Validar esta comunicación con el IOManager es thread safe
-func (c *Client) Execute(ioManager *client.IOManager) error {
-	isEndReviews := false
-	isEndGames := false
-	for {
+func (c *Client) Execute(ioManager *client.IOManager, flow *FlowController) error {
+	if err := c.protocol.GrantCredit(flow.InitialWindow()); err != nil {
+		return err
+	}
+
+	for !c.session.IsUploadFinished() {
 		msgData, err := c.protocol.RecvDataMessage()
 		if err != nil {
 			return err
 		}
 
-		if msgData.Header.Optype == message.Data {
-			// This payload contains data
-			if msgData.Payload.Header.Start == utils.StartNotSet && msgData.Payload.Header.End == utils.EndNotSet {
-				if msgData.Payload.Header.Type == uint8(message.Games) {
-					payloadBuffer := protocol.NewPayloadBuffer(1)
-					payloadBuffer.BeginPayloadElement()
-					payloadBuffer.WriteBytes(msgData.Payload.Payload.Marshall())
-					payloadBuffer.EndPayloadElement()
-
-					internalMsg := protocol.NewDataMessage(protocol.Games,
-						payloadBuffer.Bytes(),
-						protocol.MessageOptions{
-							ClientID:  msgData.Header.ClientId,
-							RequestID: msgData.Header.RequestId,
-							MessageID: c.GetMessageId(),
-						},
-					)
-
-					err = ioManager.Write(internalMsg.Marshal(), "")
-					if err != nil {
-						return fmt.Errorf("cannot send data to client: %w - %v", err, internalMsg)
-					}
-				} else if msgData.Payload.Header.Type == uint8(message.Reviews) {
-					payloadBuffer := protocol.NewPayloadBuffer(1)
-					payloadBuffer.BeginPayloadElement()
-					payloadBuffer.WriteBytes(msgData.Payload.Payload.Marshall())
-					payloadBuffer.EndPayloadElement()
-
-					internalMsg := protocol.NewDataMessage(protocol.Reviews,
-						payloadBuffer.Bytes(),
-						protocol.MessageOptions{
-							ClientID:  msgData.Header.ClientId,
-							RequestID: msgData.Header.RequestId,
-							MessageID: c.GetMessageId(),
-						},
-					)
-
-					err = ioManager.Write(internalMsg.Marshal(), "")
-					if err != nil {
-						return fmt.Errorf("cannot send data to client: %w - %v", err, internalMsg)
-					}
-				}
-			} else if msgData.Payload.Header.Start == utils.StartSet && msgData.Payload.Header.End == utils.EndNotSet {
-				// Handle start
-				slog.Info("Received start message",
-					"clientId", msgData.Header.ClientId,
-					"requestId", msgData.Header.RequestId,
-					"type", msgData.Payload.Header.Type,
-				)
-			} else if msgData.Payload.Header.End == utils.EndSet && msgData.Payload.Header.Start == utils.StartNotSet {
-				if msgData.Payload.Header.Type == uint8(message.Games) {
-					// Handle games
-					internalMsg := protocol.NewEndMessage(protocol.Games, protocol.MessageOptions{
-						ClientID:  msgData.Header.ClientId,
-						RequestID: msgData.Header.RequestId,
-						MessageID: 1, // TODO(fede) - Check if matters
-					})
-
-					err = ioManager.Write(internalMsg.Marshal(), "")
-					if err != nil {
-						return fmt.Errorf("cannot send data to client: %w - %v", err, internalMsg)
-					}
-					isEndGames = true
-					slog.Info("Received End message",
-						"clientId", msgData.Header.ClientId,
-						"requestId", msgData.Header.RequestId,
-						"type", msgData.Payload.Header.Type,
-					)
-				} else if msgData.Payload.Header.Type == uint8(message.Reviews) {
-					// Handle reviews
-					internalMsg := protocol.NewEndMessage(protocol.Reviews, protocol.MessageOptions{
-						ClientID:  msgData.Header.ClientId,
-						RequestID: msgData.Header.RequestId,
-						MessageID: 1, // TODO(fede) - Check if matters
-					})
-
-					err = ioManager.Write(internalMsg.Marshal(), "")
-					if err != nil {
-						return fmt.Errorf("cannot send data to client: %w - %v", err, internalMsg)
-					}
-					isEndReviews = true
-					slog.Info("Received End message",
-						"clientId", msgData.Header.ClientId,
-						"requestId", msgData.Header.RequestId,
-						"type", msgData.Payload.Header.Type,
-					)
-				}
-				if isEndGames && isEndReviews {
-					return nil
-				}
+		if msgData.Header.Optype != message.Data {
+			continue
+		}
+
+		dataType := message.DataType(msgData.Payload.Header.Type)
+		sequence := msgData.Payload.Header.Sequence
+		switch c.session.checkSequence(dataType, sequence) {
+		case sequenceDuplicated:
+			// Already pushed into the pipeline before a
+			// reconnection, acknowledge it again and move on
+			slog.Debug("skipping duplicated message", "session", c.session, "type", dataType, "sequence", sequence)
+			if err := c.protocol.SendAck(dataType, sequence); err != nil {
+				return err
+			}
+			if err := c.protocol.GrantCredit(1); err != nil {
+				return err
+			}
+			continue
+		case sequenceGap:
+			return fmt.Errorf("missing messages of type %d: expected sequence %d got %d",
+				dataType, c.session.expectedSequence(dataType), sequence)
+		}
+
+		publishStart := time.Now()
+		if err := c.handleDataMessage(ioManager, msgData); err != nil {
+			return err
+		}
+		flow.ObservePublish(time.Since(publishStart))
+
+		c.session.acknowledge(dataType, sequence)
+		if err := c.protocol.SendAck(dataType, sequence); err != nil {
+			return err
+		}
+
+		// Give the credit back only once the pipeline can take it
+		flow.WaitForPipeline()
+		if err := c.protocol.GrantCredit(1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) handleDataMessage(ioManager *client.IOManager, msgData *message.Message[*payload.Data]) error {
+	// This payload contains data
+	if msgData.Payload.Header.Start == utils.StartNotSet && msgData.Payload.Header.End == utils.EndNotSet {
+		var dataType protocol.DataType
+		if msgData.Payload.Header.Type == uint8(message.Games) {
+			dataType = protocol.Games
+		} else if msgData.Payload.Header.Type == uint8(message.Reviews) {
+			dataType = protocol.Reviews
+		} else {
+			return nil
+		}
+		header, ok := c.session.headers[message.DataType(msgData.Payload.Header.Type)]
+		if !ok {
+			return fmt.Errorf("received data of type %d before its header", msgData.Payload.Header.Type)
+		}
+
+		payloadBuffer := protocol.NewPayloadBuffer(2)
+		payloadBuffer.BeginPayloadElement()
+		payloadBuffer.WriteBytes(header)
+		payloadBuffer.EndPayloadElement()
+		payloadBuffer.BeginPayloadElement()
+		payloadBuffer.WriteBytes(msgData.Payload.Payload.Marshall())
+		payloadBuffer.EndPayloadElement()
+
+		internalMsg := protocol.NewDataMessage(dataType,
+			payloadBuffer.Bytes(),
+			protocol.MessageOptions{
+				ClientID:  msgData.Header.ClientId,
+				RequestID: msgData.Header.RequestId,
+				MessageID: c.GetMessageId(),
+			},
+		)
+
+		err := ioManager.Write(internalMsg.Marshal(), "")
+		if err != nil {
+			return fmt.Errorf("cannot send data to client: %w - %v", err, internalMsg)
+		}
+	} else if msgData.Payload.Header.Start == utils.StartSet && msgData.Payload.Header.End == utils.EndNotSet {
+		// Handle start
+		slog.Info("Received start message",
+			"clientId", msgData.Header.ClientId,
+			"requestId", msgData.Header.RequestId,
+			"type", msgData.Payload.Header.Type,
+		)
+		header := slices.Clone(msgData.Payload.Payload.Data)
+		var err error
+		if msgData.Payload.Header.Type == uint8(message.Games) {
+			_, err = models.NewGameSchema(string(header))
+		} else if msgData.Payload.Header.Type == uint8(message.Reviews) {
+			_, err = models.NewReviewSchema(string(header))
+		}
+		if err != nil {
+			return fmt.Errorf("invalid header of type %d: %w", msgData.Payload.Header.Type, err)
+		}
+		c.session.headers[message.DataType(msgData.Payload.Header.Type)] = header
+	} else if msgData.Payload.Header.End == utils.EndSet && msgData.Payload.Header.Start == utils.StartNotSet {
+		if msgData.Payload.Header.Type == uint8(message.Games) {
+			// Handle games
+			internalMsg := protocol.NewEndMessage(protocol.Games, protocol.MessageOptions{
+				ClientID:  msgData.Header.ClientId,
+				RequestID: msgData.Header.RequestId,
+				MessageID: 1, // TODO(fede) - Check if matters
+			})
+
+			err := ioManager.Write(internalMsg.Marshal(), "")
+			if err != nil {
+				return fmt.Errorf("cannot send data to client: %w - %v", err, internalMsg)
+			}
+			c.session.isEndGames = true
+			slog.Info("Received End message",
+				"clientId", msgData.Header.ClientId,
+				"requestId", msgData.Header.RequestId,
+				"type", msgData.Payload.Header.Type,
+			)
+		} else if msgData.Payload.Header.Type == uint8(message.Reviews) {
+			// Handle reviews
+			internalMsg := protocol.NewEndMessage(protocol.Reviews, protocol.MessageOptions{
+				ClientID:  msgData.Header.ClientId,
+				RequestID: msgData.Header.RequestId,
+				MessageID: 1, // TODO(fede) - Check if matters
+			})
+
+			err := ioManager.Write(internalMsg.Marshal(), "")
+			if err != nil {
+				return fmt.Errorf("cannot send data to client: %w - %v", err, internalMsg)
 			}
+			c.session.isEndReviews = true
+			slog.Info("Received End message",
+				"clientId", msgData.Header.ClientId,
+				"requestId", msgData.Header.RequestId,
+				"type", msgData.Payload.Header.Type,
+			)
 		}
 	}
+	return nil
 }
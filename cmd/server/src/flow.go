@@ -0,0 +1,108 @@
+package src
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
+)
+
+// flowPollInterval is how often the pipeline depth is read from the
+// broker, the batches uploaded in between use the last one read
+const flowPollInterval = 200 * time.Millisecond
+
+// latencyWeight is how much a publish moves the average latency, a single
+// slow publish doesn't throttle the client but a run of them does
+const latencyWeight = 0.2
+
+type FlowControlConfig struct {
+	// Credits the client starts with, how many stream messages it may
+	// have in flight
+	Window uint32
+	// Queue depth at which the server stops granting credits and the
+	// depth it must drain to before granting again
+	HighWatermark int
+	LowWatermark  int
+	// Publishes slower than this also throttle the client, zero
+	// disables the check
+	MaxPublishLatency time.Duration
+}
+
+// FlowController decides when the server gives credits back to the
+// client, holding them while the pipeline falls behind
+type FlowController struct {
+	config    *FlowControlConfig
+	io        *client.IOManager
+	throttled bool
+	// latency is the exponentially weighted moving average of the
+	// publish latencies
+	latency time.Duration
+	// depth is the pipeline depth read at polledAt
+	depth    int
+	polledAt time.Time
+}
+
+func NewFlowController(config *FlowControlConfig, io *client.IOManager) *FlowController {
+	return &FlowController{config: config, io: io}
+}
+
+func (f *FlowController) InitialWindow() uint32 {
+	return f.config.Window
+}
+
+func (f *FlowController) ObservePublish(latency time.Duration) {
+	f.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(f.latency))
+}
+
+// PublishLatency returns the average latency of the recent publishes
+func (f *FlowController) PublishLatency() time.Duration {
+	return f.latency
+}
+
+// WaitForPipeline blocks until the pipeline has room for more messages
+func (f *FlowController) WaitForPipeline() {
+	if f.config.MaxPublishLatency > 0 && f.latency > f.config.MaxPublishLatency {
+		slog.Debug("publish latency too high, throttling client", "latency", f.latency)
+		time.Sleep(flowPollInterval)
+	}
+
+	for {
+		depth, err := f.pipelineDepth()
+		if errors.Is(err, client.ErrDepthNotSupported) {
+			return
+		}
+		if err != nil {
+			slog.Error("couldn't inspect pipeline depth", "error", err)
+			return
+		}
+
+		if f.throttled && depth <= f.config.LowWatermark {
+			slog.Debug("pipeline caught up, granting credits again", "depth", depth)
+			f.throttled = false
+		} else if !f.throttled && depth >= f.config.HighWatermark {
+			slog.Debug("pipeline falling behind, holding credits", "depth", depth)
+			f.throttled = true
+		}
+
+		if !f.throttled {
+			return
+		}
+		time.Sleep(flowPollInterval)
+	}
+}
+
+// pipelineDepth returns how many messages wait in the pipeline, the
+// broker is asked at most once every flowPollInterval
+func (f *FlowController) pipelineDepth() (int, error) {
+	if !f.polledAt.IsZero() && time.Since(f.polledAt) < flowPollInterval {
+		return f.depth, nil
+	}
+	depth, err := f.io.OutputDepth()
+	if err != nil {
+		return 0, err
+	}
+	f.depth = depth
+	f.polledAt = time.Now()
+	return depth, nil
+}
@@ -0,0 +1,160 @@
+package src_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/cmd/server/src"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/memory"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
+)
+
+func newPipeline(t *testing.T) (*client.IOManager, *memory.Broker) {
+	t.Helper()
+	t.Setenv("OUTPUT_WORKER_QUEUE", "pipeline")
+	t.Setenv("OUTPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("OUTPUT_WORKER_QUEUE_COUNT", "1")
+
+	broker := memory.NewBroker()
+	io := &client.IOManager{Memory: broker}
+	if err := io.Connect(client.NoneInput, client.OutputWorker); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(io.Close)
+	return io, broker
+}
+
+func TestFlowControllerSmoothsThePublishLatency(t *testing.T) {
+	io, _ := newPipeline(t)
+	flow := src.NewFlowController(&src.FlowControlConfig{Window: 1, HighWatermark: 10, LowWatermark: 5}, io)
+
+	for range 10 {
+		flow.ObservePublish(time.Millisecond)
+	}
+	flow.ObservePublish(100 * time.Millisecond)
+	if latency := flow.PublishLatency(); latency > 25*time.Millisecond {
+		t.Errorf("a single slow publish moved the latency to %v", latency)
+	}
+
+	for range 20 {
+		flow.ObservePublish(100 * time.Millisecond)
+	}
+	if latency := flow.PublishLatency(); latency < 90*time.Millisecond {
+		t.Errorf("a run of slow publishes only moved the latency to %v", latency)
+	}
+}
+
+func TestFlowControllerHoldsCreditsUntilThePipelineDrains(t *testing.T) {
+	io, broker := newPipeline(t)
+	flow := src.NewFlowController(&src.FlowControlConfig{Window: 1, HighWatermark: 6, LowWatermark: 2}, io)
+
+	for range 6 {
+		if err := io.Write([]byte("batch"), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	granted := make(chan struct{})
+	go func() {
+		flow.WaitForPipeline()
+		close(granted)
+	}()
+
+	select {
+	case <-granted:
+		t.Fatal("granted credits with the pipeline over the high watermark")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// Draining below the high watermark isn't enough, it must reach the
+	// low one
+	pipeline := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: "pipeline"})
+	deliveries, err := pipeline.GetConsumer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	(<-deliveries).Ack()
+	select {
+	case <-granted:
+		t.Fatal("granted credits over the low watermark")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	for range 2 {
+		(<-deliveries).Ack()
+	}
+	select {
+	case <-granted:
+	case <-time.After(time.Second):
+		t.Fatal("credits weren't granted once the pipeline drained")
+	}
+}
+
+func TestFlowControllerGrantsCreditsWithRoomInThePipeline(t *testing.T) {
+	io, _ := newPipeline(t)
+	flow := src.NewFlowController(&src.FlowControlConfig{Window: 1, HighWatermark: 4, LowWatermark: 2}, io)
+
+	if err := io.Write([]byte("batch"), ""); err != nil {
+		t.Fatal(err)
+	}
+	granted := make(chan struct{})
+	go func() {
+		flow.WaitForPipeline()
+		close(granted)
+	}()
+	select {
+	case <-granted:
+	case <-time.After(time.Second):
+		t.Fatal("credits weren't granted")
+	}
+}
+
+func TestFlowControllerReadsTheDepthOncePerPollInterval(t *testing.T) {
+	io, broker := newPipeline(t)
+	flow := src.NewFlowController(&src.FlowControlConfig{Window: 1, HighWatermark: 2, LowWatermark: 0}, io)
+	flow.WaitForPipeline()
+
+	// The batches uploaded right after a poll don't ask the broker again
+	for range 3 {
+		if err := io.Write([]byte("batch"), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	granted := make(chan struct{})
+	go func() {
+		flow.WaitForPipeline()
+		close(granted)
+	}()
+	select {
+	case <-granted:
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("expected the depth of the last poll to be used")
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	granted = make(chan struct{})
+	go func() {
+		flow.WaitForPipeline()
+		close(granted)
+	}()
+	select {
+	case <-granted:
+		t.Fatal("granted credits with the pipeline over the high watermark")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pipeline := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: "pipeline"})
+	deliveries, err := pipeline.GetConsumer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		(<-deliveries).Ack()
+	}
+	select {
+	case <-granted:
+	case <-time.After(time.Second):
+		t.Fatal("credits weren't granted once the pipeline drained")
+	}
+}
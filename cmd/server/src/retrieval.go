@@ -0,0 +1,84 @@
+package src
+
+import (
+	"fmt"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/message"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/payload"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/results"
+)
+
+func isRetrieval(handshake *message.Message[*payload.Empty]) bool {
+	return handshake.Header.Optype == message.Status || handshake.Header.Optype == message.Fetch
+}
+
+// requestStatus tells how far a request got from its session, if it is
+// still around, and from the results stored on disk
+func (s *Server) requestStatus(clientId uint32, requestId uint32) (payload.Status, error) {
+	finished, stored, err := s.store.Finished(clientId, requestId)
+	if err != nil {
+		return payload.Status{}, fmt.Errorf("couldn't read stored results: %w", err)
+	}
+
+	s.sessionsMutex.Lock()
+	session, ok := s.sessions[clientId]
+	active := ok && session.requestId == requestId
+	s.sessionsMutex.Unlock()
+
+	status := payload.Status{Finished: finished}
+	switch {
+	case finished == results.AllQueriesFinished:
+		status.State = payload.RequestFinished
+	case active:
+		status.State = payload.RequestRunning
+	case stored:
+		// Neither running nor complete, the request was cancelled
+		// or the server went down while it ran
+		status.State = payload.RequestAborted
+	default:
+		status.State = payload.RequestUnknown
+	}
+	return status, nil
+}
+
+// serveRetrieval answers a status message with the request status, and a
+// fetch message with the status followed by every finished query. The
+// rejected lines follow the queries of a finished request.
+func (s *Server) serveRetrieval(clientProtocol *communication.Protocol, handshake *message.Message[*payload.Empty]) error {
+	clientId := handshake.Header.ClientId
+	requestId := handshake.Header.RequestId
+	clientProtocol.Attach(clientId, requestId)
+
+	status, err := s.requestStatus(clientId, requestId)
+	if err != nil {
+		return err
+	}
+	if err := clientProtocol.SendStatusReport(status); err != nil {
+		return err
+	}
+	if handshake.Header.Optype != message.Fetch {
+		return nil
+	}
+
+	for query := message.Query1; query <= message.Rejections; query++ {
+		if query == message.Rejections && status.State != payload.RequestFinished {
+			continue
+		}
+		if query != message.Rejections && !status.IsFinished(uint8(query)) {
+			continue
+		}
+		data, err := s.store.Load(clientId, requestId, query)
+		if err != nil {
+			return err
+		}
+		resultMsgConf := &message.ResultMessageConfig{
+			ResultType: query,
+			Data:       data,
+		}
+		if err := clientProtocol.SendResultMessage(resultMsgConf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
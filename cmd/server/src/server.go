@@ -2,21 +2,59 @@ package src
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/message"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/payload"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/results"
 
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/network"
 )
 
 const ServerPortEnv = "SERVER_PORT"
+const ServerReadTimeoutEnv = "SERVER_READ_TIMEOUT"
+const ServerWriteTimeoutEnv = "SERVER_WRITE_TIMEOUT"
+const ServerHeartbeatIntervalEnv = "SERVER_HEARTBEAT_INTERVAL"
+const ServerCreditWindowEnv = "SERVER_CREDIT_WINDOW"
+const ServerQueueHighWatermarkEnv = "SERVER_QUEUE_HIGH_WATERMARK"
+const ServerQueueLowWatermarkEnv = "SERVER_QUEUE_LOW_WATERMARK"
+const ServerMaxPublishLatencyEnv = "SERVER_MAX_PUBLISH_LATENCY_MS"
+const ServerResumeGraceEnv = "SERVER_RESUME_GRACE"
+const ServerResultsDirEnv = "SERVER_RESULTS_DIR"
+
+const (
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultHeartbeatInterval = 5 * time.Second
+	defaultCreditWindow      = 64
+	defaultHighWatermark     = 10000
+	defaultLowWatermark      = 5000
+	defaultResumeGrace       = 30 * time.Second
+	defaultResultsDir        = "results"
+)
 
 type ServerConfig struct {
-	ServicePort int
+	ServicePort       int
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	HeartbeatInterval time.Duration
+	FlowControl       FlowControlConfig
+	// How long an interrupted upload waits for the client to resume it
+	// before the request is cancelled in the pipeline
+	ResumeGrace time.Duration
+	// Where the results of every request are stored so clients can
+	// fetch them later
+	ResultsDir string
 }
 
 func GetServerConfigFromEnv() (*ServerConfig, error) {
@@ -30,23 +68,150 @@ func GetServerConfigFromEnv() (*ServerConfig, error) {
 		return nil, fmt.Errorf("environment variable %s is not a number", ServerPortEnv)
 	}
 
-	return &ServerConfig{ServicePort: port}, nil
+	readTimeout, err := getSecondsFromEnv(ServerReadTimeoutEnv, defaultReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	writeTimeout, err := getSecondsFromEnv(ServerWriteTimeoutEnv, defaultWriteTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	heartbeatInterval, err := getSecondsFromEnv(ServerHeartbeatIntervalEnv, defaultHeartbeatInterval)
+	if err != nil {
+		return nil, err
+	}
+	if heartbeatInterval <= 0 {
+		return nil, fmt.Errorf("environment variable %s must be a positive integer", ServerHeartbeatIntervalEnv)
+	}
+
+	flowControl, err := getFlowControlConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	resumeGrace, err := getSecondsFromEnv(ServerResumeGraceEnv, defaultResumeGrace)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsDir, ok := os.LookupEnv(ServerResultsDirEnv)
+	if !ok {
+		resultsDir = defaultResultsDir
+	}
+
+	return &ServerConfig{
+		ServicePort:       port,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		HeartbeatInterval: heartbeatInterval,
+		FlowControl:       *flowControl,
+		ResumeGrace:       resumeGrace,
+		ResultsDir:        resultsDir,
+	}, nil
+}
+
+func getFlowControlConfigFromEnv() (*FlowControlConfig, error) {
+	window, err := getIntFromEnv(ServerCreditWindowEnv, defaultCreditWindow)
+	if err != nil {
+		return nil, err
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("environment variable %s must be a positive integer", ServerCreditWindowEnv)
+	}
+
+	highWatermark, err := getIntFromEnv(ServerQueueHighWatermarkEnv, defaultHighWatermark)
+	if err != nil {
+		return nil, err
+	}
+
+	lowWatermark, err := getIntFromEnv(ServerQueueLowWatermarkEnv, defaultLowWatermark)
+	if err != nil {
+		return nil, err
+	}
+	if lowWatermark > highWatermark {
+		return nil, fmt.Errorf("environment variable %s must not be greater than %s",
+			ServerQueueLowWatermarkEnv, ServerQueueHighWatermarkEnv)
+	}
+
+	maxLatency, err := getIntFromEnv(ServerMaxPublishLatencyEnv, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FlowControlConfig{
+		Window:            uint32(window),
+		HighWatermark:     highWatermark,
+		LowWatermark:      lowWatermark,
+		MaxPublishLatency: time.Duration(maxLatency) * time.Millisecond,
+	}, nil
+}
+
+func getIntFromEnv(name string, defaultValue int) (int, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return defaultValue, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("environment variable %s is not a valid non negative number", name)
+	}
+	return number, nil
+}
+
+// getSecondsFromEnv reads an optional amount of seconds, zero disables
+// the timeout
+func getSecondsFromEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	if _, ok := os.LookupEnv(name); !ok {
+		return defaultValue, nil
+	}
+
+	seconds, err := getIntFromEnv(name, 0)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
 }
 
 type Server struct {
+	config       *ServerConfig
 	socket       *network.SocketTcp
 	deleteSocket func()
 	client       *Client
 	deleteClient func()
 
-	inputManager    *client.IOManager
-	outputManager   *client.IOManager
-	clientIdCounter uint32
-	done            chan struct{}
+	inputManager     *client.IOManager
+	outputManager    *client.IOManager
+	store            *results.Store
+	clientIdCounter  uint32
+	requestIdCounter uint32
+	sessions         map[uint32]*Session
+	sessionsMutex    sync.Mutex
+	// Sessions whose grace period ran out, guarded by sessionsMutex.
+	// They are cancelled by the main loop since it's the one writing to
+	// the pipeline, expiredSignal wakes it up.
+	expired       []*Session
+	expiredSignal chan struct{}
+	done          chan struct{}
 }
 
-func NewServer(serverConfig *ServerConfig, inputManager *client.IOManager, outputManager *client.IOManager) (*Server, func()) {
-	server := &Server{inputManager: inputManager, outputManager: outputManager, done: make(chan struct{})}
+func NewServer(serverConfig *ServerConfig, store *results.Store, inputManager *client.IOManager, outputManager *client.IOManager) (*Server, func()) {
+	server := &Server{
+		config:        serverConfig,
+		inputManager:  inputManager,
+		outputManager: outputManager,
+		store:         store,
+		sessions:      make(map[uint32]*Session),
+		expiredSignal: make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	clientId, err := store.NextClientId()
+	if err != nil {
+		slog.Warn("couldn't read stored client ids", "error", err)
+	}
+	server.clientIdCounter = clientId
 	cleanup := func() {
 		deleteServer(server)
 	}
@@ -57,7 +222,7 @@ func NewServer(serverConfig *ServerConfig, inputManager *client.IOManager, outpu
 
 func deleteServer(s *Server) {
 	s.deleteSocket()
-	s.deleteClient()
+	s.closeClient()
 	s.inputManager.Close()
 	s.outputManager.Close()
 }
@@ -67,6 +232,37 @@ func (s *Server) GetClientId() uint32 {
 	return s.clientIdCounter
 }
 
+func (s *Server) GetRequestId() uint32 {
+	defer func() { s.requestIdCounter++ }()
+	return s.requestIdCounter
+}
+
+// resolveSession creates a session for new clients and looks up the
+// previous one for clients that reconnect to resume their upload
+func (s *Server) resolveSession(handshake *message.Message[*payload.Empty]) (*Session, error) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+
+	if handshake.Header.Optype != message.Resume {
+		session := NewSession(s.GetClientId(), s.GetRequestId())
+		s.sessions[session.clientId] = session
+		return session, nil
+	}
+
+	session, ok := s.sessions[handshake.Header.ClientId]
+	if !ok || session.requestId != handshake.Header.RequestId {
+		return nil, fmt.Errorf("unknown session for client %d request %d",
+			handshake.Header.ClientId, handshake.Header.RequestId)
+	}
+	if session.expiry != nil && !session.expiry.Stop() {
+		return nil, fmt.Errorf("session of client %d request %d expired",
+			handshake.Header.ClientId, handshake.Header.RequestId)
+	}
+	session.expiry = nil
+	slog.Info("resuming session", "session", session, "checkpoint", session.Checkpoint())
+	return session, nil
+}
+
 func (s *Server) GetDone() <-chan struct{} {
 	return s.done
 }
@@ -82,23 +278,110 @@ func (s *Server) Run(ctx context.Context) error {
 		return fmt.Errorf("error when listenning %s", err)
 	}
 
+	uploads := make(chan *connection)
+	acceptErr := make(chan error, 1)
+	go func() { acceptErr <- s.Accept(ctx, uploads) }()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 
-		default:
-			if err := s.Accept(); err != nil {
-				return fmt.Errorf("error when accepting connection %s", err)
+		case err := <-acceptErr:
+			return fmt.Errorf("error when accepting connection %s", err)
+
+		case <-s.expiredSignal:
+			for _, session := range s.takeExpired() {
+				slog.Info("session expired", "session", session)
+				s.cancelSession(session)
 			}
 
-			if err := s.StartClient(ctx); err != nil {
-				return fmt.Errorf("error when executing command %s", err)
+		case conn := <-uploads:
+			if !s.startSession(conn) {
+				continue
 			}
+
+			s.finishSession(s.client.session, s.StartClient(ctx))
+			s.closeClient()
 		}
 	}
 }
 
+// finishSession decides what happens with the request once its client is
+// gone. A misbehaving client only aborts its own session, the server
+// keeps accepting.
+func (s *Server) finishSession(session *Session, err error) {
+	switch {
+	case err == nil:
+		s.deleteSession(session)
+	case errors.Is(err, communication.ErrCancelled), errors.Is(err, results.ErrRequestCancelled):
+		slog.Info("client cancelled the request", "session", session)
+		s.cancelSession(session)
+	case session.IsUploadFinished():
+		// Results can't be resumed, the request is lost
+		slog.Error("aborting client session", "session", session, "error", err)
+		s.cancelSession(session)
+	default:
+		slog.Error("client disconnected, waiting for it to resume", "session", session, "grace", s.config.ResumeGrace, "error", err)
+		s.abandonSession(session)
+	}
+}
+
+func (s *Server) deleteSession(session *Session) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	delete(s.sessions, session.clientId)
+}
+
+// abandonSession keeps the session around so the client can resume it,
+// the request is cancelled once the grace period expires. The timer
+// doesn't wait for the main loop, which may be serving an upload: the
+// session is dropped right away and queued for the main loop to cancel.
+func (s *Server) abandonSession(session *Session) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	session.expiry = time.AfterFunc(s.config.ResumeGrace, func() {
+		s.sessionsMutex.Lock()
+		delete(s.sessions, session.clientId)
+		s.expired = append(s.expired, session)
+		s.sessionsMutex.Unlock()
+
+		select {
+		case s.expiredSignal <- struct{}{}:
+		default:
+			// The main loop was already signalled, it takes every
+			// queued session at once
+		}
+	})
+}
+
+// takeExpired returns the sessions whose grace period ran out since the
+// last call
+func (s *Server) takeExpired() []*Session {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	expired := s.expired
+	s.expired = nil
+	return expired
+}
+
+// cancelSession drops the session and tells every controller to drop the
+// state of its request
+func (s *Server) cancelSession(session *Session) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	delete(s.sessions, session.clientId)
+
+	cancelMsg := protocol.NewCancelMessage(protocol.MessageOptions{
+		MessageID: session.GetMessageId(),
+		ClientID:  session.clientId,
+		RequestID: session.requestId,
+	})
+	if err := s.outputManager.Write(cancelMsg.Marshal(), ""); err != nil {
+		slog.Error("couldn't cancel request", "session", session, "error", err)
+	}
+}
+
 func (s *Server) setSocket(serverConfig *ServerConfig) {
 	serverAddress := fmt.Sprintf("0.0.0.0:%v", serverConfig.ServicePort)
 	socket, deleteSocket := network.NewSocketTcp(serverAddress)
@@ -110,35 +393,111 @@ func (s *Server) Listen() error {
 	return s.socket.Listen()
 }
 
-func (s *Server) Accept() error {
-	clientSocket, deleteClientSocket, err := s.socket.Accept()
+// connection is an accepted client that already sent its handshake
+type connection struct {
+	socket       *network.SocketTcp
+	deleteSocket func()
+	protocol     *communication.Protocol
+	handshake    *message.Message[*payload.Empty]
+}
+
+// Accept takes connections until the socket is closed. Uploads are handed
+// to the main loop, which serves them one at a time, while status and
+// fetch requests are answered in their own goroutine so they don't wait
+// for the running upload.
+func (s *Server) Accept(ctx context.Context, uploads chan<- *connection) error {
+	for {
+		clientSocket, deleteClientSocket, err := s.socket.Accept()
+		if err != nil {
+			return err
+		}
+		clientSocket.SetTimeouts(s.config.ReadTimeout, s.config.WriteTimeout)
+
+		conn := &connection{
+			socket:       clientSocket,
+			deleteSocket: deleteClientSocket,
+			protocol:     communication.NewProtocol(clientSocket),
+		}
+		go s.handshake(ctx, conn, uploads)
+	}
+}
+
+func (s *Server) handshake(ctx context.Context, conn *connection, uploads chan<- *connection) {
+	handshake, err := conn.protocol.RecvSync()
 	if err != nil {
-		return err
+		slog.Error("error synchronizing with client", "error", err)
+		conn.deleteSocket()
+		return
 	}
+	conn.handshake = handshake
 
+	if isRetrieval(handshake) {
+		// Status and fetch are answered right away, they don't
+		// start a session
+		if err := s.serveRetrieval(conn.protocol, handshake); err != nil {
+			slog.Error("error answering client", "client", handshake.Header.ClientId, "request", handshake.Header.RequestId, "error", err)
+		}
+		conn.deleteSocket()
+		return
+	}
+
+	select {
+	case uploads <- conn:
+	case <-ctx.Done():
+		conn.deleteSocket()
+	}
+}
+
+// startSession resolves the session of an upload and answers its
+// handshake, it returns false if the connection was dropped
+func (s *Server) startSession(conn *connection) bool {
 	client, deleteClient, err := NewClient(
-		clientSocket,
-		s.GetClientId(),
-		deleteClientSocket,
+		conn.socket,
+		conn.protocol,
+		conn.handshake,
+		s.resolveSession,
+		conn.deleteSocket,
 	)
 	if err != nil {
-		return err
+		// The handshake failed, drop the connection but keep
+		// listening for other clients
+		slog.Error("error synchronizing with client", "error", err)
+		conn.deleteSocket()
+		return false
 	}
 	s.client = client
 	s.deleteClient = deleteClient
-	return nil
+	return true
+}
+
+func (s *Server) closeClient() {
+	if s.deleteClient == nil {
+		return
+	}
+	s.deleteClient()
+	s.client = nil
+	s.deleteClient = nil
 }
 
 func (s *Server) GetClientConn() net.Conn {
 	return s.client.socket.GetConnection()
 }
+
 func (s *Server) StartClient(ctx context.Context) error {
-	if err := s.client.Execute(s.outputManager); err != nil {
-		return fmt.Errorf("error receiving data from client %s", err)
+	stopHeartbeat := s.client.protocol.StartHeartbeat(s.config.HeartbeatInterval)
+	defer stopHeartbeat()
+
+	flow := NewFlowController(&s.config.FlowControl, s.outputManager)
+	if err := s.client.Execute(s.outputManager, flow); err != nil {
+		if network.IsTimeout(err) {
+			return fmt.Errorf("client stopped responding: %w", err)
+		}
+		return fmt.Errorf("error receiving data from client: %w", err)
 	}
 
-	service := results.NewResultsService(s.client.protocol, s.inputManager)
-	go service.Run(ctx)
+	service := results.NewResultsService(s.client.protocol, s.inputManager, s.store)
+	serviceErr := make(chan error, 1)
+	go func() { serviceErr <- service.Run(ctx) }()
 	<-service.Done()
-	return nil
+	return <-serviceErr
 }
@@ -0,0 +1,88 @@
+package src
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/message"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/payload"
+)
+
+type sequenceStatus int
+
+const (
+	sequenceExpected sequenceStatus = iota
+	sequenceDuplicated
+	sequenceGap
+)
+
+// Session keeps the upload progress of a client request so it survives
+// the connection and can be resumed after a disconnect
+type Session struct {
+	clientId     uint32
+	requestId    uint32
+	msgIdCounter uint32
+
+	acknowledged payload.Checkpoint
+	isEndGames   bool
+	isEndReviews bool
+	// The csv header of every stream, sent in its start message and
+	// attached to every batch so projection can find the columns
+	headers map[message.DataType][]byte
+
+	// Cancels the request unless the client resumes it in time
+	expiry *time.Timer
+}
+
+func NewSession(clientId uint32, requestId uint32) *Session {
+	return &Session{
+		clientId:  clientId,
+		requestId: requestId,
+		headers:   make(map[message.DataType][]byte),
+	}
+}
+
+func (s *Session) GetMessageId() uint32 {
+	defer func() { s.msgIdCounter++ }()
+	return s.msgIdCounter
+}
+
+func (s *Session) Checkpoint() payload.Checkpoint {
+	return s.acknowledged
+}
+
+func (s *Session) IsUploadFinished() bool {
+	return s.isEndGames && s.isEndReviews
+}
+
+func (s *Session) acknowledgedCount(dataType message.DataType) *uint32 {
+	if dataType == message.Games {
+		return &s.acknowledged.Games
+	}
+	return &s.acknowledged.Reviews
+}
+
+func (s *Session) expectedSequence(dataType message.DataType) uint32 {
+	return *s.acknowledgedCount(dataType)
+}
+
+// checkSequence compares a received sequence number against the next one
+// the session expects for that stream
+func (s *Session) checkSequence(dataType message.DataType, sequence uint32) sequenceStatus {
+	next := s.expectedSequence(dataType)
+	if sequence < next {
+		return sequenceDuplicated
+	}
+	if sequence > next {
+		return sequenceGap
+	}
+	return sequenceExpected
+}
+
+func (s *Session) acknowledge(dataType message.DataType, sequence uint32) {
+	*s.acknowledgedCount(dataType) = sequence + 1
+}
+
+func (s *Session) String() string {
+	return fmt.Sprintf("client %d request %d", s.clientId, s.requestId)
+}
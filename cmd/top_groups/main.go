@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/controllers"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/logging"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
+)
+
+func main() {
+	err := logging.InitLoggerWithEnv()
+	if err != nil {
+		slog.Error("error creating logger", "error", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signal := utils.MakeSignalHandler()
+
+	const nKeyName = "N_VALUE"
+	n, err := utils.GetFromEnvUint(nKeyName)
+	if err != nil {
+		slog.Error("error parsing N_VALUE env var", "error", err)
+		return
+	}
+
+	topGroups, err := controllers.NewTopGroups(*n)
+	if err != nil {
+		slog.Error("error creating top groups", "error", err)
+		return
+	}
+	defer topGroups.Destroy()
+
+	slog.Info("top groups started")
+	go func() {
+		err = topGroups.Run(ctx)
+		if err != nil {
+			slog.Error("error running top groups", "error", err.Error())
+			return
+		}
+	}()
+
+	utils.BlockUntilSignal(signal, topGroups.Done(), cancel)
+}
@@ -3,8 +3,11 @@ module github.com/jab227/tp1-sistemas-distribuidos-2c
 go 1.23
 
 require (
-	github.com/pemistahl/lingua-go v1.4.0 // indirect
-	github.com/rabbitmq/amqp091-go v1.10.0 // indirect
+	github.com/pemistahl/lingua-go v1.4.0
+	github.com/rabbitmq/amqp091-go v1.10.0
+)
+
+require (
 	github.com/shopspring/decimal v1.3.1 // indirect
 	golang.org/x/exp v0.0.0-20221106115401-f9659909a136 // indirect
 	google.golang.org/protobuf v1.31.0 // indirect
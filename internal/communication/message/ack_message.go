@@ -0,0 +1,32 @@
+package message
+
+import (
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/payload"
+)
+
+type AckMessageConfig struct {
+	ClientId  uint32
+	RequestId uint32
+	DataType  DataType
+	Sequence  uint32
+}
+
+func NewDefaultAckMessage() *Message[*payload.Ack] {
+	header := &Header{}
+	payload := payload.NewAck()
+	return newMessage(header, payload)
+}
+
+func NewAckMessage(ackMsgConf *AckMessageConfig) *Message[*payload.Ack] {
+	payload := &payload.Ack{
+		Type:     uint8(ackMsgConf.DataType),
+		Sequence: ackMsgConf.Sequence,
+	}
+	header := &Header{
+		Optype:      Ack,
+		ClientId:    ackMsgConf.ClientId,
+		RequestId:   ackMsgConf.RequestId,
+		PayloadSize: uint32(payload.Sizeof()),
+	}
+	return newMessage(header, payload)
+}
@@ -0,0 +1,21 @@
+package message
+
+import (
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/payload"
+)
+
+type CancelMessageConfig struct {
+	ClientId  uint32
+	RequestId uint32
+}
+
+func NewCancelMessage(cancelMsgConf *CancelMessageConfig) *Message[*payload.Empty] {
+	payload := &payload.Empty{}
+	header := &Header{
+		Optype:      Cancel,
+		ClientId:    cancelMsgConf.ClientId,
+		RequestId:   cancelMsgConf.RequestId,
+		PayloadSize: uint32(payload.Sizeof()),
+	}
+	return newMessage(header, payload)
+}
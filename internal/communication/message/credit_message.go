@@ -0,0 +1,25 @@
+package message
+
+import (
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/payload"
+)
+
+type CreditMessageConfig struct {
+	ClientId  uint32
+	RequestId uint32
+	Amount    uint32
+}
+
+// A credit message allows the client to send Amount more stream messages
+func NewCreditMessage(creditMsgConf *CreditMessageConfig) *Message[*payload.Credit] {
+	payload := &payload.Credit{
+		Amount: creditMsgConf.Amount,
+	}
+	header := &Header{
+		Optype:      Credit,
+		ClientId:    creditMsgConf.ClientId,
+		RequestId:   creditMsgConf.RequestId,
+		PayloadSize: uint32(payload.Sizeof()),
+	}
+	return newMessage(header, payload)
+}
@@ -16,6 +16,7 @@ type DataMessageConfig struct {
 	Start    bool
 	End      bool
 	DataType DataType
+	Sequence uint32
 	Data     []byte
 }
 
@@ -28,9 +29,10 @@ func NewDefaultDataMessage() *Message[*payload.Data] {
 func NewDataMessage(dataMsgConf *DataMessageConfig) *Message[*payload.Data] {
 	payload := &payload.Data{
 		Header: &utils.StreamHeader{
-			Type:  uint8(dataMsgConf.DataType),
-			Start: utils.GetStartFlag(dataMsgConf.Start),
-			End:   utils.GetEndFlag(dataMsgConf.End),
+			Type:     uint8(dataMsgConf.DataType),
+			Start:    utils.GetStartFlag(dataMsgConf.Start),
+			End:      utils.GetEndFlag(dataMsgConf.End),
+			Sequence: dataMsgConf.Sequence,
 		},
 		Payload: &utils.StreamPayload{
 			Data: dataMsgConf.Data,
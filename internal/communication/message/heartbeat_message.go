@@ -0,0 +1,16 @@
+package message
+
+import (
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/payload"
+)
+
+func NewHeartbeatMessage(clientId uint32) *Message[*payload.Empty] {
+	payload := &payload.Empty{}
+	header := &Header{
+		Optype:      Heartbeat,
+		ClientId:    clientId,
+		RequestId:   0,
+		PayloadSize: uint32(payload.Sizeof()),
+	}
+	return newMessage(header, payload)
+}
@@ -15,6 +15,14 @@ const (
 	Result
 	Sync
 	SyncAck
+	Heartbeat
+	Resume
+	Ack
+	Credit
+	Cancel
+	Status
+	Fetch
+	StatusReport
 )
 
 type Header struct {
@@ -13,6 +13,12 @@ const (
 	Query3
 	Query4
 	Query5
+	Query6
+	Query7
+	Query8
+	// Rejections has the csv lines that were dropped, it's sent once
+	// every query finished
+	Rejections
 )
 
 type ResultMessageConfig struct {
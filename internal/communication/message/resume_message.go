@@ -0,0 +1,23 @@
+package message
+
+import (
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/payload"
+)
+
+type ResumeMessageConfig struct {
+	ClientId  uint32
+	RequestId uint32
+}
+
+// A resume message replaces the sync message when a client reconnects
+// and wants to continue a previous upload
+func NewResumeMessage(resumeMsgConf *ResumeMessageConfig) *Message[*payload.Empty] {
+	payload := &payload.Empty{}
+	header := &Header{
+		Optype:      Resume,
+		ClientId:    resumeMsgConf.ClientId,
+		RequestId:   resumeMsgConf.RequestId,
+		PayloadSize: uint32(payload.Sizeof()),
+	}
+	return newMessage(header, payload)
+}
@@ -0,0 +1,50 @@
+package message
+
+import (
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/payload"
+)
+
+type RetrieveMessageConfig struct {
+	Optype    Optype
+	ClientId  uint32
+	RequestId uint32
+}
+
+// A status or fetch message replaces the sync message when a client
+// connects only to ask about a previous request
+func NewRetrieveMessage(retrieveMsgConf *RetrieveMessageConfig) *Message[*payload.Empty] {
+	payload := &payload.Empty{}
+	header := &Header{
+		Optype:      retrieveMsgConf.Optype,
+		ClientId:    retrieveMsgConf.ClientId,
+		RequestId:   retrieveMsgConf.RequestId,
+		PayloadSize: uint32(payload.Sizeof()),
+	}
+	return newMessage(header, payload)
+}
+
+type StatusReportMessageConfig struct {
+	ClientId  uint32
+	RequestId uint32
+	Status    payload.Status
+}
+
+func NewDefaultStatusReportMessage() *Message[*payload.Status] {
+	header := &Header{}
+	payload := payload.NewStatus()
+	return newMessage(header, payload)
+}
+
+func NewStatusReportMessage(statusMsgConf *StatusReportMessageConfig) *Message[*payload.Status] {
+	payload := &payload.Status{
+		State:    statusMsgConf.Status.State,
+		Finished: statusMsgConf.Status.Finished,
+	}
+	header := &Header{
+		Optype:      StatusReport,
+		ClientId:    statusMsgConf.ClientId,
+		RequestId:   statusMsgConf.RequestId,
+		PayloadSize: uint32(payload.Sizeof()),
+	}
+	return newMessage(header, payload)
+}
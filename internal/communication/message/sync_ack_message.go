@@ -7,16 +7,21 @@ import (
 type SyncAckMessageConfig struct {
 	ClientId  uint32
 	RequestId uint32
+	// Acknowledged stream messages, non zero only when resuming
+	Checkpoint payload.Checkpoint
 }
 
-func NewDefaultSyncAckMessage() *Message[*payload.Empty] {
+func NewDefaultSyncAckMessage() *Message[*payload.Checkpoint] {
 	header := &Header{}
-	payload := payload.NewEmpty()
+	payload := payload.NewCheckpoint()
 	return newMessage(header, payload)
 }
 
-func NewSyncAckMessage(syncAckMsgConf *SyncAckMessageConfig) *Message[*payload.Empty] {
-	payload := &payload.Empty{}
+func NewSyncAckMessage(syncAckMsgConf *SyncAckMessageConfig) *Message[*payload.Checkpoint] {
+	payload := &payload.Checkpoint{
+		Reviews: syncAckMsgConf.Checkpoint.Reviews,
+		Games:   syncAckMsgConf.Checkpoint.Games,
+	}
 	header := &Header{
 		Optype:      SyncAck,
 		ClientId:    syncAckMsgConf.ClientId,
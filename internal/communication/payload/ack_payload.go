@@ -0,0 +1,38 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"unsafe"
+)
+
+type Ack struct {
+	Type     uint8
+	Sequence uint32
+}
+
+func NewAck() *Ack {
+	return &Ack{}
+}
+
+func (s *Ack) Sizeof() int {
+	typeSize := int(unsafe.Sizeof(s.Type))
+	sequenceSize := int(unsafe.Sizeof(s.Sequence))
+	return typeSize + sequenceSize
+}
+
+func (s *Ack) Marshall() []byte {
+	buff := make([]byte, 0, s.Sizeof())
+	buff = append(buff, s.Type)
+	buff = binary.LittleEndian.AppendUint32(buff, s.Sequence)
+	return buff
+}
+
+func (s *Ack) Unmarshall(data []byte) {
+	typeSize := int(unsafe.Sizeof(s.Type))
+	sequenceSize := int(unsafe.Sizeof(s.Sequence))
+
+	buff := bytes.NewBuffer(data)
+	s.Type = uint8(buff.Next(typeSize)[0])
+	s.Sequence = binary.LittleEndian.Uint32(buff.Next(sequenceSize))
+}
@@ -0,0 +1,40 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"unsafe"
+)
+
+// Checkpoint holds how many messages of each stream the server has
+// already acknowledged
+type Checkpoint struct {
+	Reviews uint32
+	Games   uint32
+}
+
+func NewCheckpoint() *Checkpoint {
+	return &Checkpoint{}
+}
+
+func (s *Checkpoint) Sizeof() int {
+	reviewsSize := int(unsafe.Sizeof(s.Reviews))
+	gamesSize := int(unsafe.Sizeof(s.Games))
+	return reviewsSize + gamesSize
+}
+
+func (s *Checkpoint) Marshall() []byte {
+	buff := make([]byte, 0, s.Sizeof())
+	buff = binary.LittleEndian.AppendUint32(buff, s.Reviews)
+	buff = binary.LittleEndian.AppendUint32(buff, s.Games)
+	return buff
+}
+
+func (s *Checkpoint) Unmarshall(data []byte) {
+	reviewsSize := int(unsafe.Sizeof(s.Reviews))
+	gamesSize := int(unsafe.Sizeof(s.Games))
+
+	buff := bytes.NewBuffer(data)
+	s.Reviews = binary.LittleEndian.Uint32(buff.Next(reviewsSize))
+	s.Games = binary.LittleEndian.Uint32(buff.Next(gamesSize))
+}
@@ -0,0 +1,27 @@
+package payload
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+type Credit struct {
+	Amount uint32
+}
+
+func NewCredit() *Credit {
+	return &Credit{}
+}
+
+func (s *Credit) Sizeof() int {
+	return int(unsafe.Sizeof(s.Amount))
+}
+
+func (s *Credit) Marshall() []byte {
+	buff := make([]byte, 0, s.Sizeof())
+	return binary.LittleEndian.AppendUint32(buff, s.Amount)
+}
+
+func (s *Credit) Unmarshall(data []byte) {
+	s.Amount = binary.LittleEndian.Uint32(data[:s.Sizeof()])
+}
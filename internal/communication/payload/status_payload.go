@@ -0,0 +1,54 @@
+package payload
+
+import (
+	"bytes"
+	"math/bits"
+	"unsafe"
+)
+
+type RequestState uint8
+
+const (
+	RequestUnknown RequestState = iota
+	RequestRunning
+	RequestFinished
+	RequestAborted
+)
+
+// Status reports the progress of a request, Finished has the bit of
+// every query whose results are available set
+type Status struct {
+	State    RequestState
+	Finished uint8
+}
+
+func NewStatus() *Status {
+	return &Status{}
+}
+
+func (s *Status) IsFinished(query uint8) bool {
+	return s.Finished&(1<<query) != 0
+}
+
+func (s *Status) FinishedCount() int {
+	return bits.OnesCount8(s.Finished)
+}
+
+func (s *Status) Sizeof() int {
+	stateSize := int(unsafe.Sizeof(s.State))
+	finishedSize := int(unsafe.Sizeof(s.Finished))
+	return stateSize + finishedSize
+}
+
+func (s *Status) Marshall() []byte {
+	buff := make([]byte, 0, s.Sizeof())
+	buff = append(buff, uint8(s.State))
+	buff = append(buff, s.Finished)
+	return buff
+}
+
+func (s *Status) Unmarshall(data []byte) {
+	buff := bytes.NewBuffer(data)
+	s.State = RequestState(buff.Next(1)[0])
+	s.Finished = buff.Next(1)[0]
+}
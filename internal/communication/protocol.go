@@ -1,6 +1,11 @@
 package communication
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/message"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/payload"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/utils"
@@ -10,11 +15,26 @@ import (
 type Protocol struct {
 	socket         *network.SocketTcp
 	syncAckMsgConf *message.SyncAckMessageConfig
+	sendMutex      sync.Mutex
+
+	ackMutex     sync.Mutex
+	acknowledged payload.Checkpoint
+
+	creditCond *sync.Cond
+	credits    uint32
+	recvErr    error
 }
 
+var ErrConnectionLost = errors.New("connection lost while waiting for credits")
+
+// ErrCancelled is returned by the receiving side when the peer cancelled
+// the request instead of sending the expected message
+var ErrCancelled = errors.New("request cancelled by peer")
+
 func NewProtocol(socket *network.SocketTcp) *Protocol {
 	return &Protocol{
-		socket: socket,
+		socket:     socket,
+		creditCond: sync.NewCond(&sync.Mutex{}),
 	}
 }
 
@@ -22,28 +42,115 @@ func (p *Protocol) Sync() error {
 	if err := p.sendSyncMessage(); err != nil {
 		return err
 	}
+	_, err := p.recvSyncAck()
+	return err
+}
+
+// Resume reconnects to a previous session, the returned checkpoint holds
+// how many messages of each stream the server already has
+func (p *Protocol) Resume(clientId uint32, requestId uint32) (*payload.Checkpoint, error) {
+	resumeMessage := message.NewResumeMessage(&message.ResumeMessageConfig{
+		ClientId:  clientId,
+		RequestId: requestId,
+	})
+	if err := sendMessage(p, resumeMessage); err != nil {
+		return nil, err
+	}
 
+	checkpoint, err := p.recvSyncAck()
+	if err != nil {
+		return nil, err
+	}
+	if p.syncAckMsgConf.ClientId != clientId || p.syncAckMsgConf.RequestId != requestId {
+		return nil, fmt.Errorf("server couldn't resume session of client %d request %d", clientId, requestId)
+	}
+	return checkpoint, nil
+}
+
+func (p *Protocol) recvSyncAck() (*payload.Checkpoint, error) {
 	syncAckMessage, err := p.recvSyncAckMessage()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	p.syncAckMsgConf = &message.SyncAckMessageConfig{
-		ClientId:  syncAckMessage.Header.ClientId,
-		RequestId: syncAckMessage.Header.RequestId,
+		ClientId:   syncAckMessage.Header.ClientId,
+		RequestId:  syncAckMessage.Header.RequestId,
+		Checkpoint: *syncAckMessage.Payload,
 	}
-	return nil
+	p.ackMutex.Lock()
+	p.acknowledged = *syncAckMessage.Payload
+	p.ackMutex.Unlock()
+	return syncAckMessage.Payload, nil
 }
 
-func (p *Protocol) SyncAck(clientId uint32) error {
-	_, err := p.recvSyncMessage()
+// RecvSync waits for the client handshake, which is either a sync
+// message, a resume message carrying the previous session ids, or a
+// status or fetch message asking about a previous request
+func (p *Protocol) RecvSync() (*message.Message[*payload.Empty], error) {
+	syncMessage, err := p.recvSyncMessage()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	switch syncMessage.Header.Optype {
+	case message.Sync, message.Resume, message.Status, message.Fetch:
+		return syncMessage, nil
+	default:
+		return nil, fmt.Errorf("expected sync, resume, status or fetch message, got optype %d", syncMessage.Header.Optype)
+	}
+}
+
+// Attach binds the connection to a request without going through the
+// sync handshake, it's used to answer status and fetch messages
+func (p *Protocol) Attach(clientId uint32, requestId uint32) {
+	p.syncAckMsgConf = &message.SyncAckMessageConfig{
+		ClientId:  clientId,
+		RequestId: requestId,
+	}
+}
+
+// Status asks the server how far a previous request got
+func (p *Protocol) Status(clientId uint32, requestId uint32) (*payload.Status, error) {
+	return p.retrieve(message.Status, clientId, requestId)
+}
+
+// Fetch asks the server for the finished results of a previous request,
+// the status is followed by one result message per finished query
+func (p *Protocol) Fetch(clientId uint32, requestId uint32) (*payload.Status, error) {
+	return p.retrieve(message.Fetch, clientId, requestId)
+}
+
+func (p *Protocol) retrieve(optype message.Optype, clientId uint32, requestId uint32) (*payload.Status, error) {
+	retrieveMessage := message.NewRetrieveMessage(&message.RetrieveMessageConfig{
+		Optype:    optype,
+		ClientId:  clientId,
+		RequestId: requestId,
+	})
+	if err := sendMessage(p, retrieveMessage); err != nil {
+		return nil, err
 	}
+	p.Attach(clientId, requestId)
 
-	syncAckMsgConf := &message.SyncAckMessageConfig{
-		ClientId: clientId,
+	statusMessage := message.NewDefaultStatusReportMessage()
+	if err := recvMessage(p, statusMessage); err != nil {
+		return nil, err
 	}
+	if statusMessage.Header.Optype != message.StatusReport {
+		return nil, fmt.Errorf("expected status report message, got optype %d", statusMessage.Header.Optype)
+	}
+	return statusMessage.Payload, nil
+}
+
+func (p *Protocol) SendStatusReport(status payload.Status) error {
+	statusMessage := message.NewStatusReportMessage(&message.StatusReportMessageConfig{
+		ClientId:  p.ClientId(),
+		RequestId: p.RequestId(),
+		Status:    status,
+	})
+	return sendMessage(p, statusMessage)
+}
+
+func (p *Protocol) SendSyncAck(syncAckMsgConf *message.SyncAckMessageConfig) error {
 	if err := p.sendSyncAckMessage(syncAckMsgConf); err != nil {
 		return err
 	}
@@ -52,9 +159,18 @@ func (p *Protocol) SyncAck(clientId uint32) error {
 	return nil
 }
 
+func (p *Protocol) ClientId() uint32 {
+	return p.syncAckMsgConf.ClientId
+}
+
+func (p *Protocol) RequestId() uint32 {
+	return p.syncAckMsgConf.RequestId
+}
+
 func (p *Protocol) SendDataMessage(dataMsgConf *message.DataMessageConfig) error {
 	dataMessage := message.NewDataMessage(dataMsgConf)
 	dataMessage.Header.ClientId = p.syncAckMsgConf.ClientId
+	dataMessage.Header.RequestId = p.syncAckMsgConf.RequestId
 	err := sendMessage(p, dataMessage)
 	return err
 }
@@ -70,6 +186,7 @@ func (p *Protocol) RecvDataMessage() (*message.Message[*payload.Data], error) {
 func (p *Protocol) SendResultMessage(resultMsgConf *message.ResultMessageConfig) error {
 	resultMessage := message.NewResultMessage(resultMsgConf)
 	resultMessage.Header.ClientId = p.syncAckMsgConf.ClientId
+	resultMessage.Header.RequestId = p.syncAckMsgConf.RequestId
 	err := sendMessage(p, resultMessage)
 	return err
 }
@@ -82,6 +199,128 @@ func (p *Protocol) RecvResultMessage() (*message.Message[*payload.Result], error
 	return resultMessage, nil
 }
 
+// SendAck tells the client the server is done with the stream message
+// numbered sequence
+func (p *Protocol) SendAck(dataType message.DataType, sequence uint32) error {
+	ackMessage := message.NewAckMessage(&message.AckMessageConfig{
+		ClientId:  p.syncAckMsgConf.ClientId,
+		RequestId: p.syncAckMsgConf.RequestId,
+		DataType:  dataType,
+		Sequence:  sequence,
+	})
+	return sendMessage(p, ackMessage)
+}
+
+// Acknowledged returns how many messages of the stream were
+// acknowledged by the server so far
+func (p *Protocol) Acknowledged(dataType message.DataType) uint32 {
+	p.ackMutex.Lock()
+	defer p.ackMutex.Unlock()
+	if dataType == message.Games {
+		return p.acknowledged.Games
+	}
+	return p.acknowledged.Reviews
+}
+
+func (p *Protocol) recordAck(ack *payload.Ack) {
+	p.ackMutex.Lock()
+	defer p.ackMutex.Unlock()
+	count := ack.Sequence + 1
+	if message.DataType(ack.Type) == message.Games {
+		p.acknowledged.Games = max(p.acknowledged.Games, count)
+	} else {
+		p.acknowledged.Reviews = max(p.acknowledged.Reviews, count)
+	}
+}
+
+// GrantCredit allows the client to send amount more stream messages
+func (p *Protocol) GrantCredit(amount uint32) error {
+	creditMessage := message.NewCreditMessage(&message.CreditMessageConfig{
+		ClientId:  p.syncAckMsgConf.ClientId,
+		RequestId: p.syncAckMsgConf.RequestId,
+		Amount:    amount,
+	})
+	return sendMessage(p, creditMessage)
+}
+
+// AcquireCredit blocks until the server grants credit for one more stream
+// message. Credits arrive as control messages, so some other goroutine
+// must be receiving from the connection meanwhile.
+func (p *Protocol) AcquireCredit() error {
+	p.creditCond.L.Lock()
+	defer p.creditCond.L.Unlock()
+	for p.credits == 0 && p.recvErr == nil {
+		p.creditCond.Wait()
+	}
+	if p.credits == 0 {
+		return fmt.Errorf("%w: %w", ErrConnectionLost, p.recvErr)
+	}
+	p.credits--
+	return nil
+}
+
+func (p *Protocol) addCredits(amount uint32) {
+	p.creditCond.L.Lock()
+	defer p.creditCond.L.Unlock()
+	p.credits += amount
+	p.creditCond.Broadcast()
+}
+
+// failReceive wakes up everyone waiting for credits that will never come
+func (p *Protocol) failReceive(err error) {
+	p.creditCond.L.Lock()
+	defer p.creditCond.L.Unlock()
+	p.recvErr = err
+	p.creditCond.Broadcast()
+}
+
+// SendCancel asks the server to abort the current request and drop
+// everything it processed for it
+func (p *Protocol) SendCancel() error {
+	cancelMessage := message.NewCancelMessage(&message.CancelMessageConfig{
+		ClientId:  p.ClientId(),
+		RequestId: p.RequestId(),
+	})
+	return sendMessage(p, cancelMessage)
+}
+
+func (p *Protocol) SendHeartbeat() error {
+	var clientId uint32
+	if p.syncAckMsgConf != nil {
+		clientId = p.syncAckMsgConf.ClientId
+	}
+	heartbeatMessage := message.NewHeartbeatMessage(clientId)
+	return sendMessage(p, heartbeatMessage)
+}
+
+// StartHeartbeat sends a heartbeat every interval until the returned
+// function is called or a send fails. Heartbeats are skipped
+// transparently by the receiving side, they only keep its read
+// deadline from expiring while the connection is otherwise idle.
+func (p *Protocol) StartHeartbeat(interval time.Duration) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.SendHeartbeat(); err != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
 func (p *Protocol) sendSyncMessage() error {
 	syncMessage := message.NewSyncMessage()
 	err := sendMessage(p, syncMessage)
@@ -102,7 +341,7 @@ func (p *Protocol) sendSyncAckMessage(syncAckMsgConf *message.SyncAckMessageConf
 	return err
 }
 
-func (p *Protocol) recvSyncAckMessage() (*message.Message[*payload.Empty], error) {
+func (p *Protocol) recvSyncAckMessage() (*message.Message[*payload.Checkpoint], error) {
 	syncAckMessage := message.NewDefaultSyncAckMessage()
 	if err := recvMessage(p, syncAckMessage); err != nil {
 		return nil, err
@@ -110,15 +349,67 @@ func (p *Protocol) recvSyncAckMessage() (*message.Message[*payload.Empty], error
 	return syncAckMessage, nil
 }
 
+const (
+	heartbeatOptype = message.Heartbeat
+	ackOptype       = message.Ack
+	creditOptype    = message.Credit
+	cancelOptype    = message.Cancel
+)
+
+func isControlOptype(optype message.Optype) bool {
+	return optype == heartbeatOptype || optype == ackOptype || optype == creditOptype
+}
+
 func sendMessage[T utils.Marshallable](context *Protocol, message *message.Message[T]) error {
 	data := message.Marshall()
+	context.sendMutex.Lock()
+	defer context.sendMutex.Unlock()
 	return context.socket.Send(data)
 }
 
+// recvMessage reads the next message, heartbeats, acks and credits are
+// control messages handled here so callers only ever see the message they
+// asked for
 func recvMessage[T utils.Marshallable](context *Protocol, message *message.Message[T]) error {
-	if err := recvHeader(context, message); err != nil {
+	if err := recvNonControlMessage(context, message); err != nil {
+		context.failReceive(err)
 		return err
 	}
+	return nil
+}
+
+func recvNonControlMessage[T utils.Marshallable](context *Protocol, message *message.Message[T]) error {
+	for {
+		if err := recvHeader(context, message); err != nil {
+			return err
+		}
+		optype := message.Header.Optype
+		if optype == cancelOptype {
+			cancelData := make([]byte, message.Header.PayloadSize)
+			if err := context.socket.Receive(cancelData); err != nil {
+				return err
+			}
+			return ErrCancelled
+		}
+		if !isControlOptype(optype) {
+			break
+		}
+
+		controlData := make([]byte, message.Header.PayloadSize)
+		if err := context.socket.Receive(controlData); err != nil {
+			return err
+		}
+		switch optype {
+		case ackOptype:
+			ack := payload.NewAck()
+			ack.Unmarshall(controlData)
+			context.recordAck(ack)
+		case creditOptype:
+			credit := payload.NewCredit()
+			credit.Unmarshall(controlData)
+			context.addCredits(credit.Amount)
+		}
+	}
 	return recvPayload(context, message)
 }
 
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bytes"
+	"encoding/binary"
 	"unsafe"
 )
 
@@ -19,17 +20,21 @@ const (
 	EndSet    EndFlag = 1
 )
 
+// Sequence numbers each message of a stream starting from zero, the
+// start and end messages included
 type StreamHeader struct {
-	Type  uint8
-	Start StartFlag
-	End   EndFlag
+	Type     uint8
+	Start    StartFlag
+	End      EndFlag
+	Sequence uint32
 }
 
 func (h *StreamHeader) Sizeof() int {
 	typeSize := int(unsafe.Sizeof(h.Type))
 	startSize := int(unsafe.Sizeof(h.Start))
 	endSize := int(unsafe.Sizeof(h.End))
-	return typeSize + startSize + endSize
+	sequenceSize := int(unsafe.Sizeof(h.Sequence))
+	return typeSize + startSize + endSize + sequenceSize
 }
 
 func (h *StreamHeader) Marshall() []byte {
@@ -38,6 +43,7 @@ func (h *StreamHeader) Marshall() []byte {
 	buff = append(buff, uint8(h.Type))
 	buff = append(buff, uint8(h.Start))
 	buff = append(buff, uint8(h.End))
+	buff = binary.LittleEndian.AppendUint32(buff, h.Sequence)
 	return buff
 }
 
@@ -45,11 +51,13 @@ func (h *StreamHeader) Unmarshall(data []byte) {
 	typeSize := int(unsafe.Sizeof(h.Type))
 	startSize := int(unsafe.Sizeof(h.Start))
 	endSize := int(unsafe.Sizeof(h.End))
+	sequenceSize := int(unsafe.Sizeof(h.Sequence))
 
 	buff := bytes.NewBuffer(data)
 	h.Type = uint8(buff.Next(typeSize)[0])
 	h.Start = StartFlag(buff.Next(startSize)[0])
 	h.End = EndFlag(buff.Next(endSize)[0])
+	h.Sequence = binary.LittleEndian.Uint32(buff.Next(sequenceSize))
 }
 
 func GetStartFlag(start bool) StartFlag {
@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
+	models "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/model"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/sentiment"
+)
+
+type gameDisagreement struct {
+	name    string
+	sum     float64
+	reviews uint64
+}
+
+// mean is from 0, every text agrees with its label, to 1, every text
+// says the opposite
+func (g *gameDisagreement) mean() float64 {
+	return g.sum / float64(g.reviews)
+}
+
+type disagreementState map[string]*gameDisagreement
+
+func (d disagreementState) insert(review models.Review) {
+	g, ok := d[review.AppID]
+	if !ok {
+		g = &gameDisagreement{name: review.Name}
+		d[review.AppID] = g
+	}
+	// The label is 1 or -1 and the sentiment goes from -1 to 1
+	g.sum += math.Abs(float64(review.Score)-float64(review.Sentiment)) / 2
+	g.reviews++
+}
+
+// Disagreement finds the n games whose reviews text disagrees the most
+// with their recommendation label, only the games with at least
+// minReviews scored reviews are taken into account
+type Disagreement struct {
+	io         client.IOManager
+	done       chan struct{}
+	states     *requestStates[disagreementState]
+	ends       *endGatherer
+	n          uint64
+	minReviews uint64
+}
+
+func NewDisagreement(n uint64, minReviews uint64) (*Disagreement, error) {
+	var io client.IOManager
+	if err := io.Connect(client.DirectSubscriber, client.OutputWorker); err != nil {
+		return nil, fmt.Errorf("couldn't create disagreement: %w", err)
+	}
+	return &Disagreement{
+		io:   io,
+		done: make(chan struct{}),
+		states: newRequestStates(func() disagreementState {
+			return disagreementState(make(map[string]*gameDisagreement))
+		}),
+		ends:       newEndGatherer(),
+		n:          n,
+		minReviews: minReviews,
+	}, nil
+}
+
+func (d *Disagreement) Destroy() {
+	d.io.Close()
+}
+
+func (d *Disagreement) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *Disagreement) Run(ctx context.Context) error {
+	defer func() {
+		d.done <- struct{}{}
+	}()
+	consumerCh, err := d.io.Consume()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case delivery := <-consumerCh:
+			d.io.BeginBatch()
+			msgBytes := delivery.Body
+			var msg protocol.Message
+			if err := msg.Unmarshal(msgBytes); err != nil {
+				reason := fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				d.io.Reject(delivery, reason)
+				continue
+			}
+			key := msg.GetClientKey()
+			if d.states.IsCancelled(key) && !msg.ExpectKind(protocol.Cancel) {
+				delivery.Ack()
+				continue
+			}
+
+			if msg.ExpectKind(protocol.Data) {
+				if !msg.HasReviewData() {
+					d.io.Reject(delivery, fmt.Errorf("wrong type: expected review data"))
+					continue
+				}
+				reviews, err := models.ReadReviews(msg.Elements())
+				if err != nil {
+					d.io.Reject(delivery, err)
+					continue
+				}
+				for _, review := range reviews {
+					// The texts in other languages weren't scored
+					if review.Language != "" && review.Language != sentiment.Language.String() {
+						continue
+					}
+					d.states.Get(key).insert(review)
+				}
+			} else if msg.ExpectKind(protocol.End) && !d.ends.Gather(msg) {
+				slog.Debug("waiting for the ends of the other partitions", "node", "disagreement")
+			} else if msg.ExpectKind(protocol.End) {
+				slog.Debug("received end", "node", "disagreement")
+				if err := d.writeResults(msg, msgBytes, d.states.Get(key)); err != nil {
+					return err
+				}
+				d.states.Delete(key)
+			} else if msg.ExpectKind(protocol.Cancel) {
+				slog.Info("cancelling request", "node", "disagreement", "client", msg.GetClientID(), "request", msg.GetRequestID())
+				d.states.Cancel(key)
+				d.ends.Forget(key)
+				if err := d.io.Broadcast(msgBytes); err != nil {
+					return fmt.Errorf("couldn't forward cancel: %w", err)
+				}
+			} else {
+				d.io.Reject(delivery, fmt.Errorf("unexpected message type: %s", msg.GetMessageType()))
+				continue
+			}
+			if err := d.io.Flush(); err != nil {
+				return fmt.Errorf("couldn't confirm outputs: %w", err)
+			}
+			delivery.Ack()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// writeResults sends the games from the most disagreeing one, like
+// "Signalis: 0.62"
+func (d *Disagreement) writeResults(msg protocol.Message, msgBytes []byte, state disagreementState) error {
+	options := protocol.MessageOptions{
+		MessageID: msg.GetMessageID(),
+		ClientID:  msg.GetClientID(),
+		RequestID: msg.GetRequestID(),
+	}
+	var games []*gameDisagreement
+	for _, g := range state {
+		if g.reviews >= d.minReviews {
+			games = append(games, g)
+		}
+	}
+	slices.SortFunc(games, func(a, b *gameDisagreement) int {
+		return cmp.Or(cmp.Compare(b.mean(), a.mean()), cmp.Compare(a.name, b.name))
+	})
+	games = games[:min(uint64(len(games)), d.n)]
+
+	for _, g := range games {
+		builder := protocol.NewPayloadBuffer(1)
+		builder.BeginPayloadElement()
+		builder.WriteBytes([]byte(fmt.Sprintf("%s: %.2f", g.name, g.mean())))
+		builder.EndPayloadElement()
+		res := protocol.NewResultsMessage(protocol.Query7, builder.Bytes(), options)
+		if err := d.io.Write(res.Marshal(), ""); err != nil {
+			return fmt.Errorf("couldn't write query 7 output: %w", err)
+		}
+	}
+	res := protocol.NewPartitionedEndMessage(protocol.Reviews, msg.GetReceivers(), d.io.Partitions(msgBytes), options)
+	res.SetQueryResult(protocol.Query7)
+	if err := d.io.Write(res.Marshal(), ""); err != nil {
+		return fmt.Errorf("couldn't write query 7 end: %w", err)
+	}
+	slog.Debug("query 7 results", "games", len(games))
+	return nil
+}
@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+)
+
+// endGatherer counts the ENDs of every request. A partitioned stage
+// sends one END from each partition, the data of the request is
+// complete once all of them arrived.
+type endGatherer struct {
+	received map[endKey]int
+}
+
+type endKey struct {
+	protocol.ClientKey
+	games bool
+}
+
+func newEndGatherer() *endGatherer {
+	return &endGatherer{received: make(map[endKey]int)}
+}
+
+// Gather records the END and reports whether it was the last one
+func (g *endGatherer) Gather(msg protocol.Message) bool {
+	key := endKey{msg.GetClientKey(), msg.HasGameData()}
+	g.received[key]++
+	if g.received[key] < msg.GetSenders() {
+		return false
+	}
+	delete(g.received, key)
+	return true
+}
+
+// Forget drops the ENDs gathered for a cancelled request
+func (g *endGatherer) Forget(key protocol.ClientKey) {
+	delete(g.received, endKey{key, true})
+	delete(g.received, endKey{key, false})
+}
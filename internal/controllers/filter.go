@@ -8,8 +8,9 @@ import (
 	filter2 "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/filter"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/end"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/env"
+	models "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/model"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
-	"github.com/pemistahl/lingua-go"
 )
 
 type Filter struct {
@@ -18,8 +19,11 @@ type Filter struct {
 	gameFilter    filter2.FunFilterGames
 	reviewFilter  filter2.FuncFilterReviews
 	hasGameFilter bool
+	// forwardRejected is set when the records that don't pass the filter
+	// are written to the rejected output instead of being dropped
+	forwardRejected bool
 
-	detector *lingua.LanguageDetector
+	detector *filter2.LanguageDetector
 
 	done chan struct{}
 }
@@ -43,14 +47,13 @@ func NewFilter(filter string) (Filter, error) {
 	}
 
 	// If it needs a detector, create one
-	var detector *lingua.LanguageDetector
+	var detector *filter2.LanguageDetector
 	if filter2.NeedsDecoder(filter) {
-		languages := []lingua.Language{
-			lingua.English,
-			lingua.Spanish,
+		config, err := filter2.GetLanguageConfig()
+		if err != nil {
+			return Filter{}, fmt.Errorf("couldn't read language detection config: %w", err)
 		}
-		detectorObj := lingua.NewLanguageDetectorBuilder().FromLanguages(languages...).Build()
-		detector = &detectorObj
+		detector = filter2.NewLanguageDetector(config)
 	}
 
 	var io client.IOManager
@@ -59,8 +62,17 @@ func NewFilter(filter string) (Filter, error) {
 	if !ok {
 		return Filter{}, fmt.Errorf("unknown filter IO config: %s", filter)
 	}
+	rejectedOutput, err := client.GetRejectedOutputType()
+	if err != nil {
+		return Filter{}, fmt.Errorf("couldn't read rejected output type: %w", err)
+	}
 	slog.Debug("selected filter")
-	if err := io.Connect(filterIOConfig.Input, filterIOConfig.Output); err != nil {
+	inputs := map[string]client.InputType{"": filterIOConfig.Input}
+	outputs := map[string]client.OutputType{
+		"":                    filterIOConfig.Output,
+		client.RejectedOutput: rejectedOutput,
+	}
+	if err := io.ConnectNamed(inputs, outputs); err != nil {
 		return Filter{}, fmt.Errorf("couldn't create filter io: %w", err)
 	}
 
@@ -71,6 +83,8 @@ func NewFilter(filter string) (Filter, error) {
 		hasGameFilter: hasGameFilter,
 		detector:      detector,
 
+		forwardRejected: rejectedOutput != client.NoneOutput,
+
 		done: make(chan struct{}),
 	}, nil
 }
@@ -80,69 +94,117 @@ func (f *Filter) Done() <-chan struct{} {
 }
 
 func (f *Filter) Run(ctx context.Context) error {
-	consumerCh := f.io.Input.GetConsumer()
 	defer func() { f.done <- struct{}{} }()
 	options, err := end.GetServiceOptionsFromEnv()
 	if err != nil {
 		return err
 	}
 	service, err := end.NewService(options)
-	tx, rx := service.Run(ctx)
+	if err != nil {
+		return err
+	}
+	defer service.Destroy()
+	workers, err := env.GetWorkerPoolSize()
+	if err != nil {
+		return err
+	}
+	rx, err := service.Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The deliveries are processed by a pool of workers, a redelivery
+	// after a crash writes the same keys and downstream drops what it
+	// already got
+	errs := make(chan error, 1)
+	go func() {
+		errs <- f.io.ConsumeParallel(ctx, workers, func(delivery client.Delivery, out *client.Forwarder) error {
+			return f.handleDelivery(delivery, out, service)
+		})
+	}()
 	for {
 		select {
-		case delivery := <-consumerCh:
-			msgBytes := delivery.Body
-			var msg protocol.Message
-			if err := msg.Unmarshal(msgBytes); err != nil {
-				return fmt.Errorf("couldn't unmarshal protocol message: %w", err)
-			}
-
-			// Detect type
-			if msg.ExpectKind(protocol.Data) {
-				// Handle filter
-				if f.hasGameFilter {
-					if err := f.handleGameFunc(msg); err != nil {
-						return fmt.Errorf("couldn't handle game function: %w", err)
-					}
-				} else {
-					if err := f.handleReviewFunc(msg); err != nil {
-						return fmt.Errorf("couldn't handle review function: %w", err)
-					}
-				}
-				delivery.Ack(false)
-			} else if msg.ExpectKind(protocol.End) {
-				var msgType protocol.DataType
-				if msg.HasGameData() {
-					msgType = protocol.Games
-				} else if msg.HasReviewData() {
-					msgType = protocol.Reviews
-				}
-
-				newMsg := protocol.NewEndMessage(
-					msgType,
-					protocol.MessageOptions{
-						ClientID:  msg.GetClientID(),
-						RequestID: msg.GetRequestID(),
-						MessageID: msg.GetMessageID(),
-					})
-
-				tx <- newMsg
-				delivery.Ack(false)
-			}
 		case <-rx:
 			slog.Info("END received")
+			if f.detector != nil {
+				hits, misses := f.detector.CacheStats()
+				slog.Info("language detection cache", "hits", hits, "misses", misses, "hit_rate", f.detector.HitRate())
+			}
+		case err := <-errs:
+			return err
 		case <-ctx.Done():
 			return nil
 		}
 	}
 }
 
-func (f *Filter) handleGameFunc(receivedMsg protocol.Message) error {
-	gamesPassed, err := f.gameFilter(receivedMsg)
+func (f *Filter) handleDelivery(delivery client.Delivery, out *client.Forwarder, service *end.Service) error {
+	msgBytes := delivery.Body
+	var msg protocol.Message
+	if err := msg.Unmarshal(msgBytes); err != nil {
+		out.Reject(fmt.Errorf("couldn't unmarshal protocol message: %w", err))
+		return nil
+	}
+
+	// Detect type
+	if msg.ExpectKind(protocol.Data) {
+		// Handle filter, the filters only fail on messages they
+		// can't read
+		if f.hasGameFilter {
+			if err := f.handleGameFunc(out, msg); err != nil {
+				out.Reject(fmt.Errorf("couldn't handle game function: %w", err))
+			}
+		} else {
+			if err := f.handleReviewFunc(out, msg); err != nil {
+				out.Reject(fmt.Errorf("couldn't handle review function: %w", err))
+			}
+		}
+	} else if msg.ExpectKind(protocol.End) {
+		var msgType protocol.DataType
+		if msg.HasGameData() {
+			msgType = protocol.Games
+		} else if msg.HasReviewData() {
+			msgType = protocol.Reviews
+		}
+
+		newMsg := protocol.NewEndMessage(
+			msgType,
+			protocol.MessageOptions{
+				ClientID:  msg.GetClientID(),
+				RequestID: msg.GetRequestID(),
+				MessageID: msg.GetMessageID(),
+			})
+
+		out.OnCommit(func() error { return service.Send(newMsg) })
+	} else if msg.ExpectKind(protocol.Cancel) {
+		slog.Info("cancelling request", "client", msg.GetClientID(), "request", msg.GetRequestID())
+		// The coordinator must forget the ENDs of the request
+		// and every downstream node its state
+		out.OnCommit(func() error { return service.Send(msg) })
+		out.Broadcast(msgBytes)
+		if f.forwardRejected {
+			out.BroadcastTo(client.RejectedOutput, msgBytes)
+		}
+	} else {
+		out.Reject(fmt.Errorf("unexpected message type: %s", msg.GetMessageType()))
+	}
+	return nil
+}
+
+func (f *Filter) handleGameFunc(out *client.Forwarder, receivedMsg protocol.Message) error {
+	gamesPassed, gamesRejected, err := f.gameFilter(receivedMsg)
 	if err != nil {
 		return fmt.Errorf("couldn't filter game: %w", err)
 	}
-	for _, game := range gamesPassed {
+	f.writeGames(out, "", receivedMsg, gamesPassed)
+	if f.forwardRejected {
+		f.writeGames(out, client.RejectedOutput, receivedMsg, gamesRejected)
+	}
+	return nil
+}
+
+func (f *Filter) writeGames(out *client.Forwarder, output string, receivedMsg protocol.Message, games []models.Game) {
+	for _, game := range games {
 		payloadBuffer := protocol.NewPayloadBuffer(1)
 		payloadBuffer.BeginPayloadElement()
 		game.BuildPayload(payloadBuffer)
@@ -158,19 +220,24 @@ func (f *Filter) handleGameFunc(receivedMsg protocol.Message) error {
 			},
 		)
 
-		if err := f.io.Write(responseMsg.Marshal(), game.AppID); err != nil {
-			return fmt.Errorf("couldn't write game response: %w", err)
-		}
+		out.WriteTo(output, responseMsg.Marshal(), game.AppID)
 	}
-	return nil
 }
 
-func (f *Filter) handleReviewFunc(receivedMsg protocol.Message) error {
-	reviewsPassed, err := f.reviewFilter(receivedMsg, f.detector)
+func (f *Filter) handleReviewFunc(out *client.Forwarder, receivedMsg protocol.Message) error {
+	reviewsPassed, reviewsRejected, err := f.reviewFilter(receivedMsg, f.detector)
 	if err != nil {
 		return fmt.Errorf("couldn't filter reviews: %w", err)
 	}
-	for _, review := range reviewsPassed {
+	f.writeReviews(out, "", receivedMsg, reviewsPassed)
+	if f.forwardRejected {
+		f.writeReviews(out, client.RejectedOutput, receivedMsg, reviewsRejected)
+	}
+	return nil
+}
+
+func (f *Filter) writeReviews(out *client.Forwarder, output string, receivedMsg protocol.Message, reviews []models.Review) {
+	for _, review := range reviews {
 		payloadBuffer := protocol.NewPayloadBuffer(1)
 		payloadBuffer.BeginPayloadElement()
 		review.BuildPayload(payloadBuffer)
@@ -186,11 +253,8 @@ func (f *Filter) handleReviewFunc(receivedMsg protocol.Message) error {
 			},
 		)
 
-		if err := f.io.Write(responseMsg.Marshal(), review.AppID); err != nil {
-			return fmt.Errorf("couldn't write review response: %w", err)
-		}
+		out.WriteTo(output, responseMsg.Marshal(), review.AppID)
 	}
-	return nil
 }
 
 func (f *Filter) Close() {
@@ -0,0 +1,236 @@
+package controllers
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
+	models "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/model"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+)
+
+// groupStats are the playtime statistics of the games of a group
+type groupStats struct {
+	name   string
+	median float32
+	p90    float32
+	games  uint32
+}
+
+// compareGroups sorts the groups from the one with the highest median
+// playtime, the p90 and then the name break the ties
+func compareGroups(a, b groupStats) int {
+	return cmp.Or(cmp.Compare(b.median, a.median), cmp.Compare(b.p90, a.p90), cmp.Compare(a.name, b.name))
+}
+
+func (g groupStats) write(builder *protocol.PayloadBuffer) {
+	builder.BeginPayloadElement()
+	builder.WriteBytes([]byte(g.name))
+	builder.WriteFloat32(g.median)
+	builder.WriteFloat32(g.p90)
+	builder.WriteUint32(g.games)
+	builder.EndPayloadElement()
+}
+
+func readGroupStats(element *protocol.Element) (groupStats, error) {
+	name, err := element.ReadBytes()
+	if err != nil {
+		return groupStats{}, fmt.Errorf("couldn't read group name: %w", err)
+	}
+	stats := groupStats{name: string(name)}
+	if stats.median, err = element.ReadFloat32(); err != nil {
+		return groupStats{}, fmt.Errorf("couldn't read median of %s: %w", name, err)
+	}
+	if stats.p90, err = element.ReadFloat32(); err != nil {
+		return groupStats{}, fmt.Errorf("couldn't read p90 of %s: %w", name, err)
+	}
+	if stats.games, err = element.ReadUint32(); err != nil {
+		return groupStats{}, fmt.Errorf("couldn't read games of %s: %w", name, err)
+	}
+	return stats, nil
+}
+
+// readGroupsStats reads the stats of every element, see models.ReadGames
+func readGroupsStats(elements *protocol.PayloadElements) ([]groupStats, error) {
+	var groups []groupStats
+	for i, element := range elements.Iter() {
+		stats, err := readGroupStats(&element)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		groups = append(groups, stats)
+	}
+	return groups, nil
+}
+
+// playtimePercentile interpolates the p-th percentile of sorted, which
+// can't be empty
+func playtimePercentile(sorted []float32, p float64) float32 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	weight := float32(rank - float64(lower))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*weight
+}
+
+// groupByState has the playtimes of the games of every group
+type groupByState map[string][]float32
+
+// topGroups returns the n groups with at least minGames games with the
+// highest median playtime
+func (s groupByState) topGroups(n uint64, minGames uint64) []groupStats {
+	var groups []groupStats
+	for name, playtimes := range s {
+		if uint64(len(playtimes)) < minGames {
+			continue
+		}
+		slices.Sort(playtimes)
+		groups = append(groups, groupStats{
+			name:   name,
+			median: playtimePercentile(playtimes, 50),
+			p90:    playtimePercentile(playtimes, 90),
+			games:  uint32(len(playtimes)),
+		})
+	}
+	slices.SortFunc(groups, compareGroups)
+	return groups[:min(uint64(len(groups)), n)]
+}
+
+// GroupBy computes the median and p90 playtime of the groups of its
+// partition and sends the n best ones to be merged with the rest
+type GroupBy struct {
+	io       client.IOManager
+	done     chan struct{}
+	states   *requestStates[groupByState]
+	ends     *endGatherer
+	key      GroupKey
+	n        uint64
+	minGames uint64
+}
+
+func NewGroupBy(key GroupKey, n uint64, minGames uint64) (*GroupBy, error) {
+	var io client.IOManager
+	if err := io.Connect(client.DirectSubscriber, client.OutputWorker); err != nil {
+		return nil, fmt.Errorf("couldn't create group by: %w", err)
+	}
+	return &GroupBy{
+		io:   io,
+		done: make(chan struct{}),
+		states: newRequestStates(func() groupByState {
+			return groupByState(make(map[string][]float32))
+		}),
+		ends:     newEndGatherer(),
+		key:      key,
+		n:        n,
+		minGames: minGames,
+	}, nil
+}
+
+func (g *GroupBy) Destroy() {
+	g.io.Close()
+}
+
+func (g *GroupBy) Done() <-chan struct{} {
+	return g.done
+}
+
+func (g *GroupBy) Run(ctx context.Context) error {
+	defer func() {
+		g.done <- struct{}{}
+	}()
+	consumerCh, err := g.io.Consume()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case delivery := <-consumerCh:
+			g.io.BeginBatch()
+			msgBytes := delivery.Body
+			var msg protocol.Message
+			if err := msg.Unmarshal(msgBytes); err != nil {
+				reason := fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				g.io.Reject(delivery, reason)
+				continue
+			}
+			key := msg.GetClientKey()
+			if g.states.IsCancelled(key) && !msg.ExpectKind(protocol.Cancel) {
+				delivery.Ack()
+				continue
+			}
+
+			if msg.ExpectKind(protocol.Data) {
+				if !msg.HasGameData() {
+					g.io.Reject(delivery, fmt.Errorf("wrong type: expected game data"))
+					continue
+				}
+				games, err := models.ReadGames(msg.Elements())
+				if err != nil {
+					g.io.Reject(delivery, err)
+					continue
+				}
+				state := g.states.Get(key)
+				for _, game := range games {
+					group := g.key.value(game)
+					state[group] = append(state[group], game.AvgPlayTime)
+				}
+			} else if msg.ExpectKind(protocol.End) && !g.ends.Gather(msg) {
+				slog.Debug("waiting for the ends of the other partitions", "node", "group_by")
+			} else if msg.ExpectKind(protocol.End) {
+				slog.Debug("received end", "node", "group_by")
+				if err := g.writeResults(msg, msgBytes, g.states.Get(key)); err != nil {
+					return err
+				}
+				g.states.Delete(key)
+			} else if msg.ExpectKind(protocol.Cancel) {
+				slog.Info("cancelling request", "node", "group_by", "client", msg.GetClientID(), "request", msg.GetRequestID())
+				g.states.Cancel(key)
+				g.ends.Forget(key)
+				if err := g.io.Broadcast(msgBytes); err != nil {
+					return fmt.Errorf("couldn't forward cancel: %w", err)
+				}
+			} else {
+				g.io.Reject(delivery, fmt.Errorf("unexpected message type: %s", msg.GetMessageType()))
+				continue
+			}
+			if err := g.io.Flush(); err != nil {
+				return fmt.Errorf("couldn't confirm outputs: %w", err)
+			}
+			delivery.Ack()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// writeResults sends the best groups of the partition followed by its
+// END, the top groups waits for the END of every partition
+func (g *GroupBy) writeResults(msg protocol.Message, msgBytes []byte, state groupByState) error {
+	options := protocol.MessageOptions{
+		MessageID: msg.GetMessageID(),
+		ClientID:  msg.GetClientID(),
+		RequestID: msg.GetRequestID(),
+	}
+	groups := state.topGroups(g.n, g.minGames)
+	if len(groups) > 0 {
+		builder := protocol.NewPayloadBuffer(len(groups))
+		for _, group := range groups {
+			group.write(builder)
+		}
+		res := protocol.NewDataMessage(protocol.Games, builder.Bytes(), options)
+		if err := g.io.Write(res.Marshal(), ""); err != nil {
+			return fmt.Errorf("couldn't write group by output: %w", err)
+		}
+	}
+	res := protocol.NewPartitionedEndMessage(protocol.Games, msg.GetReceivers(), g.io.Partitions(msgBytes), options)
+	if err := g.io.Write(res.Marshal(), ""); err != nil {
+		return fmt.Errorf("couldn't write group by end: %w", err)
+	}
+	slog.Debug("group by results", "groups", len(state), "top", len(groups))
+	return nil
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"slices"
+	"testing"
+
+	models "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/model"
+)
+
+func TestPlaytimePercentile(t *testing.T) {
+	tests := []struct {
+		sorted []float32
+		p      float64
+		want   float32
+	}{
+		{[]float32{7}, 50, 7},
+		{[]float32{7}, 90, 7},
+		{[]float32{1, 2, 3}, 50, 2},
+		// Between two values it interpolates
+		{[]float32{1, 2, 3, 4}, 50, 2.5},
+		{[]float32{0, 10}, 90, 9},
+		{[]float32{1, 2, 3, 4}, 100, 4},
+		{[]float32{1, 2, 3, 4}, 0, 1},
+	}
+	for _, tt := range tests {
+		if got := playtimePercentile(tt.sorted, tt.p); got != tt.want {
+			t.Errorf("p%.0f of %v: expected %v, got %v", tt.p, tt.sorted, tt.want, got)
+		}
+	}
+}
+
+func TestTopGroups(t *testing.T) {
+	state := groupByState{
+		"valve":    {10, 30, 20},
+		"bethesda": {5, 15, 25},
+		// Same median as valve, the p90 breaks the tie
+		"sega": {20, 20, 20},
+		// Same median and p90 as sega, the name breaks the tie
+		"capcom": {20, 20, 20},
+		// Highest median but too few games
+		"indie": {100},
+	}
+
+	groups := state.topGroups(10, 2)
+	var names []string
+	for _, group := range groups {
+		names = append(names, group.name)
+	}
+	if want := []string{"valve", "capcom", "sega", "bethesda"}; !slices.Equal(names, want) {
+		t.Fatalf("expected groups %v, got %v", want, names)
+	}
+	if valve := groups[0]; valve.median != 20 || valve.p90 != 28 || valve.games != 3 {
+		t.Errorf("unexpected stats of valve: %+v", valve)
+	}
+
+	if top := state.topGroups(2, 2); len(top) != 2 || top[0].name != "valve" || top[1].name != "capcom" {
+		t.Errorf("expected the two best groups, got %+v", top)
+	}
+	if top := state.topGroups(10, 1); len(top) != 5 || top[0].name != "indie" {
+		t.Errorf("expected every group, got %+v", top)
+	}
+	if top := state.topGroups(10, 4); len(top) != 0 {
+		t.Errorf("expected no group with 4 games, got %+v", top)
+	}
+}
+
+func TestGroupKeyGroups(t *testing.T) {
+	game := models.Game{Developers: " Valve, Hidden Path ,,Valve", Publishers: "Valve"}
+	if got := DeveloperKey.groups(game); !slices.Equal(got, []string{"Valve", "Hidden Path"}) {
+		t.Errorf("unexpected developers: %q", got)
+	}
+	if got := PublisherKey.groups(game); !slices.Equal(got, []string{"Valve"}) {
+		t.Errorf("unexpected publishers: %q", got)
+	}
+	if got := DeveloperKey.groups(models.Game{}); len(got) != 0 {
+		t.Errorf("expected a game without developers to have no groups, got %q", got)
+	}
+}
+
+func TestGroupKeyPartition(t *testing.T) {
+	games := []models.Game{
+		{AvgPlayTime: 1, Developers: "b,a"},
+		{AvgPlayTime: 2, Developers: "c"},
+		{AvgPlayTime: 3, Developers: "a"},
+	}
+	tags := map[string]string{"a": "1", "b": "2", "c": "1"}
+	partitions := DeveloperKey.partition(games, func(group string) string {
+		return tags[group]
+	})
+
+	if len(partitions) != 2 {
+		t.Fatalf("expected a message per partition, got %+v", partitions)
+	}
+	// The first partition is the one of the first group of the first game
+	if partitions[0].key != "b" || len(partitions[0].games) != 1 {
+		t.Errorf("unexpected first partition: %+v", partitions[0])
+	}
+	var groups []string
+	for _, game := range partitions[1].games {
+		groups = append(groups, game.Developers)
+	}
+	if partitions[1].key != "a" || !slices.Equal(groups, []string{"a", "c", "a"}) {
+		t.Errorf("unexpected second partition: %+v", partitions[1])
+	}
+}
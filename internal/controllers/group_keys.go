@@ -0,0 +1,232 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/end"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/env"
+	models "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/model"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
+)
+
+// GroupKey is the field of the games they're grouped by
+type GroupKey int
+
+const (
+	DeveloperKey GroupKey = iota
+	PublisherKey
+)
+
+const GroupByEnv = "GROUP_BY"
+
+// GetGroupKey returns the key set in GROUP_BY, developers or publishers
+func GetGroupKey() (GroupKey, error) {
+	value, err := utils.GetFromEnv(GroupByEnv)
+	if err != nil {
+		return DeveloperKey, err
+	}
+	switch *value {
+	case "developers":
+		return DeveloperKey, nil
+	case "publishers":
+		return PublisherKey, nil
+	default:
+		return DeveloperKey, fmt.Errorf("environment variable %s must be developers or publishers: %s", GroupByEnv, *value)
+	}
+}
+
+// groupKeysGameFields are the fields of the games read by the group keys
+const groupKeysGameFields = models.AvgPlayTimeField | models.DevelopersField | models.PublishersField
+
+func (k GroupKey) field() models.GameFields {
+	if k == PublisherKey {
+		return models.PublishersField
+	}
+	return models.DevelopersField
+}
+
+func (k GroupKey) value(game models.Game) string {
+	if k == PublisherKey {
+		return game.Publishers
+	}
+	return game.Developers
+}
+
+// groups returns the groups of the comma separated list of the game, a
+// game made by the same studio twice is counted once
+func (k GroupKey) groups(game models.Game) []string {
+	var groups []string
+	for _, group := range strings.Split(k.value(game), ",") {
+		group = strings.TrimSpace(group)
+		if group != "" && !slices.Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// withGroup returns the playtime of game with group as its only group
+func (k GroupKey) withGroup(game models.Game, group string) models.Game {
+	grouped := models.Game{AvgPlayTime: game.AvgPlayTime, Fields: models.AvgPlayTimeField | k.field()}
+	if k == PublisherKey {
+		grouped.Publishers = group
+	} else {
+		grouped.Developers = group
+	}
+	return grouped
+}
+
+// groupedPartition has the games going to a partition of the group by,
+// key is any of their groups and routes the message to it
+type groupedPartition struct {
+	key   string
+	games []models.Game
+}
+
+// partition splits games by group and spreads the groups over the
+// partitions tagOf maps them to. They're returned in the order their
+// first game arrived, so processing a message again writes the same
+// outputs in the same order.
+func (k GroupKey) partition(games []models.Game, tagOf func(group string) string) []groupedPartition {
+	var partitions []groupedPartition
+	indexes := make(map[string]int)
+	for _, game := range games {
+		for _, group := range k.groups(game) {
+			tag := tagOf(group)
+			i, ok := indexes[tag]
+			if !ok {
+				i = len(partitions)
+				indexes[tag] = i
+				partitions = append(partitions, groupedPartition{key: group})
+			}
+			partitions[i].games = append(partitions[i].games, k.withGroup(game, group))
+		}
+	}
+	return partitions
+}
+
+// GroupKeys writes a game once for every group it belongs to, routed by
+// the group so every group ends up in a single partition of the group by.
+// The games of a message are sent in one message per partition.
+type GroupKeys struct {
+	io   client.IOManager
+	done chan struct{}
+	key  GroupKey
+}
+
+func NewGroupKeys(key GroupKey) (*GroupKeys, error) {
+	var io client.IOManager
+	if err := io.Connect(client.DirectSubscriber, client.Router); err != nil {
+		return nil, fmt.Errorf("couldn't create group keys: %w", err)
+	}
+	return &GroupKeys{
+		io:   io,
+		done: make(chan struct{}),
+		key:  key,
+	}, nil
+}
+
+func (g *GroupKeys) Close() {
+	g.io.Close()
+}
+
+func (g *GroupKeys) Done() <-chan struct{} {
+	return g.done
+}
+
+func (g *GroupKeys) Run(ctx context.Context) error {
+	defer func() { g.done <- struct{}{} }()
+	options, err := end.GetServiceOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+	service, err := end.NewService(options)
+	if err != nil {
+		return err
+	}
+	defer service.Destroy()
+	workers, err := env.GetWorkerPoolSize()
+	if err != nil {
+		return err
+	}
+	rx, err := service.Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- g.io.ConsumeParallel(ctx, workers, func(delivery client.Delivery, out *client.Forwarder) error {
+			g.handleDelivery(delivery, out, service)
+			return nil
+		})
+	}()
+	for {
+		select {
+		case <-rx:
+			slog.Info("END received")
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (g *GroupKeys) handleDelivery(delivery client.Delivery, out *client.Forwarder, service *end.Service) {
+	msgBytes := delivery.Body
+	var msg protocol.Message
+	if err := msg.Unmarshal(msgBytes); err != nil {
+		out.Reject(fmt.Errorf("couldn't unmarshal protocol message: %w", err))
+		return
+	}
+
+	if msg.ExpectKind(protocol.Data) {
+		if !msg.HasGameData() {
+			out.Reject(fmt.Errorf("wrong type: expected game data"))
+			return
+		}
+		options := protocol.MessageOptions{
+			MessageID: msg.GetMessageID(),
+			ClientID:  msg.GetClientID(),
+			RequestID: msg.GetRequestID(),
+		}
+		games, err := models.ReadGames(msg.Elements())
+		if err != nil {
+			out.Reject(err)
+			return
+		}
+		// Only the client of the message is needed to route it
+		route := protocol.NewDataMessage(protocol.Games, nil, options).Marshal()
+		partitions := g.key.partition(games, func(group string) string {
+			return g.io.TagOf(route, group)
+		})
+		for _, p := range partitions {
+			builder := protocol.NewPayloadBuffer(len(p.games))
+			for _, game := range p.games {
+				game.BuildPayload(builder)
+			}
+			res := protocol.NewDataMessage(protocol.Games, builder.Bytes(), options)
+			out.Write(res.Marshal(), p.key)
+		}
+	} else if msg.ExpectKind(protocol.End) {
+		endMsg := protocol.NewEndMessage(protocol.Games, protocol.MessageOptions{
+			MessageID: msg.GetMessageID(),
+			ClientID:  msg.GetClientID(),
+			RequestID: msg.GetRequestID(),
+		})
+		out.OnCommit(func() error { return service.Send(endMsg) })
+	} else if msg.ExpectKind(protocol.Cancel) {
+		slog.Info("cancelling request", "node", "group_keys", "client", msg.GetClientID(), "request", msg.GetRequestID())
+		out.OnCommit(func() error { return service.Send(msg) })
+		out.Broadcast(msgBytes)
+	} else {
+		out.Reject(fmt.Errorf("unexpected message type: %s", msg.GetMessageType()))
+	}
+}
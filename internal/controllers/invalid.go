@@ -0,0 +1,7 @@
+package controllers
+
+import "errors"
+
+// errInvalidMessage marks messages a node can't process. They are
+// rejected to be retried and dead lettered instead of stopping the node.
+var errInvalidMessage = errors.New("invalid message")
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/memory"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+)
+
+func TestControllerDeadLettersTruncatedMessages(t *testing.T) {
+	t.Setenv("MIDDLEWARE_BROKER", "memory")
+	t.Setenv("INPUT_MAX_RETRIES", "2")
+	t.Setenv("INPUT_WORKER_QUEUE", "truncated-groups")
+	t.Setenv("INPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("INPUT_WORKER_QUEUE_COUNT", "1")
+	t.Setenv("OUTPUT_WORKER_QUEUE", "truncated-results")
+	t.Setenv("OUTPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("OUTPUT_WORKER_QUEUE_COUNT", "1")
+
+	topGroups, err := NewTopGroups(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer topGroups.Destroy()
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- topGroups.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-topGroups.Done()
+		if err := <-errs; err != context.Canceled {
+			t.Errorf("expected the controller to run until cancelled, got %v", err)
+		}
+	}()
+
+	opts := protocol.MessageOptions{ClientID: 1, RequestID: 1}
+	builder := protocol.NewPayloadBuffer(1)
+	groupStats{name: "valve", median: 20, p90: 28, games: 3}.write(builder)
+	data := protocol.NewDataMessage(protocol.Games, builder.Bytes(), opts).Marshal()
+
+	// An element whose stats stop after the median
+	short := protocol.NewPayloadBuffer(1)
+	short.BeginPayloadElement()
+	short.WriteBytes([]byte("valve"))
+	short.WriteFloat32(20)
+	short.EndPayloadElement()
+
+	broker := memory.Default()
+	input := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: "truncated-groups"})
+	input.Write(data[:len(data)-4], "")
+	input.Write(protocol.NewDataMessage(protocol.Games, short.Bytes(), opts).Marshal(), "")
+	input.Write(data, "")
+	end := protocol.NewEndMessage(protocol.Games, opts)
+	input.Write(end.Marshal(), "")
+
+	deadline := time.After(time.Second)
+	for broker.Depth(rabbitmq.DeadLetterQueue("truncated-groups")) < 2 || broker.Depth("truncated-results") < 2 {
+		select {
+		case err := <-errs:
+			t.Fatalf("the controller stopped: %v", err)
+		case <-deadline:
+			t.Fatalf(
+				"expected both truncated messages to be parked and the results written, got %d parked and %d results",
+				broker.Depth(rabbitmq.DeadLetterQueue("truncated-groups")),
+				broker.Depth("truncated-results"),
+			)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 
@@ -17,21 +18,40 @@ type joinerState struct {
 	ends    int
 }
 
+// joinerGameFields are the fields of the games read by the joiner, the
+// games are forwarded whole
+const joinerGameFields = models.AppIDField
+
+// Inputs of the joiner, configured by the variables prefixed with GAMES_
+// and REVIEWS_
+const (
+	JoinerGamesInput   = "games"
+	JoinerReviewsInput = "reviews"
+)
+
 type Joiner struct {
-	io   client.IOManager
-	done chan struct{}
-	s    joinerState
+	io     client.IOManager
+	done   chan struct{}
+	states *requestStates[*joinerState]
+	ends   *endGatherer
 }
 
 func NewJoiner() (*Joiner, error) {
 	var io client.IOManager
-	if err := io.Connect(client.DirectSubscriber, client.Router); err != nil {
-		return nil, fmt.Errorf("couldn't create os counter: %w", err)
+	inputs := map[string]client.InputType{
+		JoinerGamesInput:   client.DirectSubscriber,
+		JoinerReviewsInput: client.DirectSubscriber,
+	}
+	if err := io.ConnectNamed(inputs, map[string]client.OutputType{"": client.Router}); err != nil {
+		return nil, fmt.Errorf("couldn't create joiner: %w", err)
 	}
 	return &Joiner{
 		io:   io,
 		done: make(chan struct{}),
-		s:    joinerState{ends: 2},
+		states: newRequestStates(func() *joinerState {
+			return &joinerState{ends: 2}
+		}),
+		ends: newEndGatherer(),
 	}, nil
 }
 
@@ -44,33 +64,56 @@ func (j *Joiner) Done() <-chan struct{} {
 }
 
 func (j *Joiner) Run(ctx context.Context) error {
-	consumerCh := j.io.Input.GetConsumer()
 	defer func() {
 		j.done <- struct{}{}
 	}()
+	consumerCh, err := j.io.Consume()
+	if err != nil {
+		return err
+	}
 
 	for {
 		select {
 		case delivery := <-consumerCh:
+			j.io.BeginBatch()
 			msgBytes := delivery.Body
 			var msg protocol.Message
 			if err := msg.Unmarshal(msgBytes); err != nil {
-				return fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				reason := fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				j.io.Reject(delivery, reason)
+				continue
+			}
+			key := msg.GetClientKey()
+			if j.states.IsCancelled(key) && !msg.ExpectKind(protocol.Cancel) {
+				delivery.Ack()
+				continue
 			}
 			if msg.ExpectKind(protocol.Data) {
 				elements := msg.Elements()
-				if err := j.handleDataMessage(msg, elements); err != nil {
+				err := j.handleDataMessage(j.states.Get(key), delivery.Input, msg, elements)
+				if errors.Is(err, errInvalidMessage) {
+					j.io.Reject(delivery, err)
+					continue
+				}
+				if err != nil {
 					return err
 				}
 			} else if msg.ExpectKind(protocol.End) {
 				// reset state
 				slog.Debug("received end", "node", "joiner")
-				j.s.ends--
-				if j.s.ends != 0 {
+				s := j.states.Get(key)
+				if j.ends.Gather(msg) {
+					s.ends--
+				}
+				if s.ends != 0 {
+					if err := j.io.Flush(); err != nil {
+						return fmt.Errorf("couldn't confirm outputs: %w", err)
+					}
+					delivery.Ack()
 					continue
 				}
 
-				tuples := join.Join(j.s.games, j.s.reviews)
+				tuples := join.Join(s.games, s.reviews)
 				// NOTE(juan): This would be more
 				// efficient with batching but for now
 				// it's okay
@@ -87,40 +130,55 @@ func (j *Joiner) Run(ctx context.Context) error {
 						return fmt.Errorf("couldn't write query 1 output: %w", err)
 					}
 				}
-				// TODO: Send end and handle sync
-				res := protocol.NewEndMessage(protocol.Games, protocol.MessageOptions{
+				// Every joiner sends its END, the next stage
+				// gathers one from each of the partitions
+				res := protocol.NewPartitionedEndMessage(protocol.Games, msg.GetReceivers(), j.io.Partitions(msgBytes), protocol.MessageOptions{
 					MessageID: msg.GetMessageID(),
 					ClientID:  msg.GetClientID(),
 					RequestID: msg.GetRequestID(),
 				})
-				// TODO(fede) - Handle end sync - Replace hardcoded 1
-				if err := j.io.Write(res.Marshal(), "1"); err != nil {
+				if err := j.io.WritePartitions(res.Marshal(), "1"); err != nil {
 					return fmt.Errorf("couldn't write query 1 output: %w", err)
 				}
-				j.s = joinerState{}
+				j.states.Delete(key)
+			} else if msg.ExpectKind(protocol.Cancel) {
+				slog.Info("cancelling request", "node", "joiner", "client", msg.GetClientID(), "request", msg.GetRequestID())
+				j.states.Cancel(key)
+				j.ends.Forget(key)
+				if err := j.io.Broadcast(msgBytes); err != nil {
+					return fmt.Errorf("couldn't forward cancel: %w", err)
+				}
 			} else {
-				return fmt.Errorf("unexpected message type: %s", msg.GetMessageType())
+				j.io.Reject(delivery, fmt.Errorf("unexpected message type: %s", msg.GetMessageType()))
+				continue
+			}
+			if err := j.io.Flush(); err != nil {
+				return fmt.Errorf("couldn't confirm outputs: %w", err)
 			}
-			delivery.Ack(false)
+			delivery.Ack()
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 	}
 }
 
-func (j *Joiner) handleDataMessage(msg protocol.Message, elements *protocol.PayloadElements) error {
-	if msg.HasGameData() {
-		for _, element := range elements.Iter() {
-			game := models.ReadGame(&element)
-			j.s.games = append(j.s.games, game)
+// handleDataMessage keeps the games or the reviews of msg, the data must
+// be the kind of the input it came from
+func (j *Joiner) handleDataMessage(s *joinerState, input string, msg protocol.Message, elements *protocol.PayloadElements) error {
+	if input == JoinerGamesInput && msg.HasGameData() {
+		games, err := models.ReadGames(elements)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidMessage, err)
 		}
-	} else if msg.HasReviewData() {
-		for _, element := range elements.Iter() {
-			review := models.ReadReview(&element)
-			j.s.reviews = append(j.s.reviews, review)
+		s.games = append(s.games, games...)
+	} else if input == JoinerReviewsInput && msg.HasReviewData() {
+		reviews, err := models.ReadReviews(elements)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidMessage, err)
 		}
+		s.reviews = append(s.reviews, reviews...)
 	} else {
-		return fmt.Errorf("unexpected data type")
+		return fmt.Errorf("%w: unexpected data type on input %q", errInvalidMessage, input)
 	}
 	return nil
 }
@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/model"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+)
+
+type languageCount struct {
+	name string
+	// joined is set once the game arrived, the reviews of the games that
+	// never do aren't reported
+	joined bool
+	counts map[string]uint
+}
+
+type languageCounterState struct {
+	games map[string]*languageCount
+	ends  int
+}
+
+func (s *languageCounterState) get(appID string) *languageCount {
+	count, ok := s.games[appID]
+	if !ok {
+		count = &languageCount{counts: make(map[string]uint)}
+		s.games[appID] = count
+	}
+	return count
+}
+
+// languageCounterGameFields are the fields of the games read by the language counter
+const languageCounterGameFields = models.AppIDField | models.NameField
+
+// LanguageCounter joins the games with their classified reviews and
+// counts the reviews of every game by language. Only the counts are
+// kept, not the reviews.
+type LanguageCounter struct {
+	io     client.IOManager
+	done   chan struct{}
+	states *requestStates[*languageCounterState]
+	ends   *endGatherer
+}
+
+func NewLanguageCounter() (*LanguageCounter, error) {
+	var io client.IOManager
+	if err := io.Connect(client.DirectSubscriber, client.OutputWorker); err != nil {
+		return nil, fmt.Errorf("couldn't create language counter: %w", err)
+	}
+	return &LanguageCounter{
+		io:   io,
+		done: make(chan struct{}),
+		states: newRequestStates(func() *languageCounterState {
+			return &languageCounterState{games: make(map[string]*languageCount), ends: 2}
+		}),
+		ends: newEndGatherer(),
+	}, nil
+}
+
+func (l *LanguageCounter) Destroy() {
+	l.io.Close()
+}
+
+func (l *LanguageCounter) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *LanguageCounter) Run(ctx context.Context) error {
+	defer func() {
+		l.done <- struct{}{}
+	}()
+	consumerCh, err := l.io.Consume()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case delivery := <-consumerCh:
+			l.io.BeginBatch()
+			msgBytes := delivery.Body
+			var msg protocol.Message
+			if err := msg.Unmarshal(msgBytes); err != nil {
+				reason := fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				l.io.Reject(delivery, reason)
+				continue
+			}
+			key := msg.GetClientKey()
+			if l.states.IsCancelled(key) && !msg.ExpectKind(protocol.Cancel) {
+				delivery.Ack()
+				continue
+			}
+			if msg.ExpectKind(protocol.Data) {
+				err := l.handleDataMessage(l.states.Get(key), msg)
+				if errors.Is(err, errInvalidMessage) {
+					l.io.Reject(delivery, err)
+					continue
+				}
+				if err != nil {
+					return err
+				}
+			} else if msg.ExpectKind(protocol.End) {
+				slog.Debug("received end", "node", "language_counter")
+				s := l.states.Get(key)
+				if l.ends.Gather(msg) {
+					s.ends--
+				}
+				if s.ends != 0 {
+					if err := l.io.Flush(); err != nil {
+						return fmt.Errorf("couldn't confirm outputs: %w", err)
+					}
+					delivery.Ack()
+					continue
+				}
+				if err := l.writeResults(msg, msgBytes, s); err != nil {
+					return err
+				}
+				l.states.Delete(key)
+			} else if msg.ExpectKind(protocol.Cancel) {
+				slog.Info("cancelling request", "node", "language_counter", "client", msg.GetClientID(), "request", msg.GetRequestID())
+				l.states.Cancel(key)
+				l.ends.Forget(key)
+				if err := l.io.Broadcast(msgBytes); err != nil {
+					return fmt.Errorf("couldn't forward cancel: %w", err)
+				}
+			} else {
+				l.io.Reject(delivery, fmt.Errorf("unexpected message type: %s", msg.GetMessageType()))
+				continue
+			}
+			if err := l.io.Flush(); err != nil {
+				return fmt.Errorf("couldn't confirm outputs: %w", err)
+			}
+			delivery.Ack()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *LanguageCounter) handleDataMessage(s *languageCounterState, msg protocol.Message) error {
+	if msg.HasGameData() {
+		games, err := models.ReadGames(msg.Elements())
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidMessage, err)
+		}
+		for _, game := range games {
+			count := s.get(game.AppID)
+			count.name = game.Name
+			count.joined = true
+		}
+	} else if msg.HasReviewData() {
+		reviews, err := models.ReadReviews(msg.Elements())
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidMessage, err)
+		}
+		for _, review := range reviews {
+			s.get(review.AppID).counts[review.Language]++
+		}
+	} else {
+		return fmt.Errorf("%w: unexpected data type", errInvalidMessage)
+	}
+	return nil
+}
+
+// writeResults sends a line for every game with reviews, like
+// "Signalis: English=10, Spanish=2"
+func (l *LanguageCounter) writeResults(msg protocol.Message, msgBytes []byte, s *languageCounterState) error {
+	options := protocol.MessageOptions{
+		MessageID: msg.GetMessageID(),
+		ClientID:  msg.GetClientID(),
+		RequestID: msg.GetRequestID(),
+	}
+	// NOTE: This should be batched instead of being sent one by one
+	for _, count := range s.games {
+		if !count.joined || len(count.counts) == 0 {
+			continue
+		}
+		languages := make([]string, 0, len(count.counts))
+		for _, language := range slices.Sorted(maps.Keys(count.counts)) {
+			languages = append(languages, fmt.Sprintf("%s=%d", language, count.counts[language]))
+		}
+		builder := protocol.NewPayloadBuffer(1)
+		builder.BeginPayloadElement()
+		builder.WriteBytes([]byte(count.name + ": " + strings.Join(languages, ", ")))
+		builder.EndPayloadElement()
+		res := protocol.NewResultsMessage(protocol.Query6, builder.Bytes(), options)
+		if err := l.io.Write(res.Marshal(), ""); err != nil {
+			return fmt.Errorf("couldn't write query 6 output: %w", err)
+		}
+	}
+	res := protocol.NewPartitionedEndMessage(protocol.Games, msg.GetReceivers(), l.io.Partitions(msgBytes), options)
+	res.SetQueryResult(protocol.Query6)
+	if err := l.io.Write(res.Marshal(), ""); err != nil {
+		return fmt.Errorf("couldn't write query 6 end: %w", err)
+	}
+	return nil
+}
@@ -14,6 +14,9 @@ type osState struct {
 	windows, mac, linux uint
 }
 
+// osCounterGameFields are the fields of the games read by the os counter
+const osCounterGameFields = models.SupportedOSField
+
 type OSCounter struct {
 	io   client.IOManager
 	done chan struct{}
@@ -35,27 +38,43 @@ func (o OSCounter) Done() <-chan struct{} {
 }
 
 func (o *OSCounter) Run(ctx context.Context) error {
-	consumerCh := o.io.Input.GetConsumer()
 	defer func() {
 		o.done <- struct{}{}
 	}()
-	var s osState
+	consumerCh, err := o.io.Consume()
+	if err != nil {
+		return err
+	}
+	states := newRequestStates(func() *osState { return &osState{} })
 	for {
 		select {
 		case delivery := <-consumerCh:
+			o.io.BeginBatch()
 			msgBytes := delivery.Body
 			var msg protocol.Message
 			if err := msg.Unmarshal(msgBytes); err != nil {
-				return fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				reason := fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				o.io.Reject(delivery, reason)
+				continue
+			}
+			key := msg.GetClientKey()
+			if states.IsCancelled(key) && !msg.ExpectKind(protocol.Cancel) {
+				delivery.Ack()
+				continue
 			}
 			if msg.ExpectKind(protocol.Data) {
 				if !msg.HasGameData() {
-					return fmt.Errorf("couldn't wrong type: expected game data")
+					o.io.Reject(delivery, fmt.Errorf("couldn't wrong type: expected game data"))
+					continue
 				}
 
-				elements := msg.Elements()
-				for _, element := range elements.Iter() {
-					game := models.ReadGame(&element)
+				games, err := models.ReadGames(msg.Elements())
+				if err != nil {
+					o.io.Reject(delivery, err)
+					continue
+				}
+				s := states.Get(key)
+				for _, game := range games {
 					if game.SupportedOS.IsWindowsSupported() {
 						s.windows += 1
 					}
@@ -69,6 +88,7 @@ func (o *OSCounter) Run(ctx context.Context) error {
 			} else if msg.ExpectKind(protocol.End) {
 				// reset state
 				slog.Info("received end", "node", "os_counter")
+				s := states.Get(key)
 				builder := protocol.NewPayloadBuffer(1)
 				builder.BeginPayloadElement()
 				builder.WriteUint32(uint32(s.windows))
@@ -83,12 +103,22 @@ func (o *OSCounter) Run(ctx context.Context) error {
 				if err := o.io.Write(res.Marshal(), ""); err != nil {
 					return fmt.Errorf("couldn't write query 1 output: %w", err)
 				}
-				slog.Debug("query 1 results", "result", res, "state", s)
-				s = osState{}
+				slog.Debug("query 1 results", "result", res, "state", *s)
+				states.Delete(key)
+			} else if msg.ExpectKind(protocol.Cancel) {
+				slog.Info("cancelling request", "node", "os_counter", "client", msg.GetClientID(), "request", msg.GetRequestID())
+				states.Cancel(key)
+				if err := o.io.Broadcast(msgBytes); err != nil {
+					return fmt.Errorf("couldn't forward cancel: %w", err)
+				}
 			} else {
-				return fmt.Errorf("unexpected message type: %s", msg.GetMessageType())
+				o.io.Reject(delivery, fmt.Errorf("unexpected message type: %s", msg.GetMessageType()))
+				continue
+			}
+			if err := o.io.Flush(); err != nil {
+				return fmt.Errorf("couldn't confirm outputs: %w", err)
 			}
-			delivery.Ack(false)
+			delivery.Ack()
 		case <-ctx.Done():
 			return ctx.Err()
 		}
@@ -34,10 +34,14 @@ func percentilIndex(length, percentil int) int {
 	return int(math.Round(float64(length) * float64(percentil) / 100.0))
 }
 
+// percentileGameFields are the fields of the games read by the percentile
+const percentileGameFields = models.AppIDField | models.NameField
+
 type Percentile struct {
-	io   client.IOManager
-	done chan struct{}
-	s    percentileState
+	io     client.IOManager
+	done   chan struct{}
+	states *requestStates[percentileState]
+	ends   *endGatherer
 }
 
 func NewPercentile() (*Percentile, error) {
@@ -48,7 +52,10 @@ func NewPercentile() (*Percentile, error) {
 	return &Percentile{
 		io:   io,
 		done: make(chan struct{}),
-		s:    percentileState(make(map[string]innerPercentile)),
+		states: newRequestStates(func() percentileState {
+			return percentileState(make(map[string]innerPercentile))
+		}),
+		ends: newEndGatherer(),
 	}, nil
 }
 
@@ -61,36 +68,54 @@ func (r *Percentile) Done() <-chan struct{} {
 }
 
 func (r *Percentile) Run(ctx context.Context) error {
-	consumerCh := r.io.Input.GetConsumer()
 	defer func() {
 		r.done <- struct{}{}
 	}()
+	consumerCh, err := r.io.Consume()
+	if err != nil {
+		return err
+	}
 
 	for {
 		select {
 		case delivery := <-consumerCh:
+			r.io.BeginBatch()
 			msgBytes := delivery.Body
 			var msg protocol.Message
 			if err := msg.Unmarshal(msgBytes); err != nil {
-				return fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				reason := fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				r.io.Reject(delivery, reason)
+				continue
+			}
+			key := msg.GetClientKey()
+			if r.states.IsCancelled(key) && !msg.ExpectKind(protocol.Cancel) {
+				delivery.Ack()
+				continue
 			}
 
 			if msg.ExpectKind(protocol.Data) {
 				if !msg.HasGameData() {
-					return fmt.Errorf("couldn't wrong type: expected game data")
+					r.io.Reject(delivery, fmt.Errorf("couldn't wrong type: expected game data"))
+					continue
+				}
+				games, err := models.ReadGames(msg.Elements())
+				if err != nil {
+					r.io.Reject(delivery, err)
+					continue
 				}
-				elements := msg.Elements()
-				for _, element := range elements.Iter() {
-					game := models.ReadGame(&element)
-					r.s.insertOrUpdate(game)
+				for _, game := range games {
+					r.states.Get(key).insertOrUpdate(game)
 				}
+			} else if msg.ExpectKind(protocol.End) && !r.ends.Gather(msg) {
+				slog.Debug("waiting for the ends of the other partitions", "node", "percentile")
 			} else if msg.ExpectKind(protocol.End) {
 				// reset state
 				slog.Debug("received end", "node", "review_counter")
 
 				// Compute percentile
-				results := make([]innerPercentile, 0, len(r.s))
-				for _, v := range r.s {
+				s := r.states.Get(key)
+				results := make([]innerPercentile, 0, len(s))
+				for _, v := range s {
 					results = append(results, v)
 				}
 				slices.SortFunc(results, func(a, b innerPercentile) int {
@@ -98,7 +123,7 @@ func (r *Percentile) Run(ctx context.Context) error {
 				})
 				idx := percentilIndex(len(results), 90)
 				// NOTE: This should be batched instead of being sent one by one
-				slog.Debug("query 5 results", "result", results[idx:], "state", r.s)
+				slog.Debug("query 5 results", "result", results[idx:], "state", s)
 				for _, result := range results[idx:] {
 					builder := protocol.NewPayloadBuffer(1)
 					builder.BeginPayloadElement()
@@ -112,10 +137,9 @@ func (r *Percentile) Run(ctx context.Context) error {
 					if err := r.io.Write(res.Marshal(), ""); err != nil {
 						return fmt.Errorf("couldn't write query 5 output: %w", err)
 					}
-
-					r.s = percentileState(make(map[string]innerPercentile))
 				}
-				res := protocol.NewEndMessage(protocol.Games, protocol.MessageOptions{
+				r.states.Delete(key)
+				res := protocol.NewPartitionedEndMessage(protocol.Games, msg.GetReceivers(), r.io.Partitions(msgBytes), protocol.MessageOptions{
 					MessageID: msg.GetMessageID(),
 					ClientID:  msg.GetClientID(),
 					RequestID: msg.GetRequestID(),
@@ -125,10 +149,21 @@ func (r *Percentile) Run(ctx context.Context) error {
 				if err := r.io.Write(res.Marshal(), ""); err != nil {
 					return fmt.Errorf("couldn't write query 5 end: %w", err)
 				}
+			} else if msg.ExpectKind(protocol.Cancel) {
+				slog.Info("cancelling request", "node", "percentile", "client", msg.GetClientID(), "request", msg.GetRequestID())
+				r.states.Cancel(key)
+				r.ends.Forget(key)
+				if err := r.io.Broadcast(msgBytes); err != nil {
+					return fmt.Errorf("couldn't forward cancel: %w", err)
+				}
 			} else {
-				return fmt.Errorf("unexpected message type: %s", msg.GetMessageType())
+				r.io.Reject(delivery, fmt.Errorf("unexpected message type: %s", msg.GetMessageType()))
+				continue
+			}
+			if err := r.io.Flush(); err != nil {
+				return fmt.Errorf("couldn't confirm outputs: %w", err)
 			}
-			delivery.Ack(false)
+			delivery.Ack()
 		case <-ctx.Done():
 			return ctx.Err()
 		}
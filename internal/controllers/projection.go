@@ -3,32 +3,80 @@ package controllers
 import (
 	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"strings"
 
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/filter"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/end"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/env"
 	models "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/model"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
-	"github.com/rabbitmq/amqp091-go"
 )
 
+// projectedGameFields are the fields of the games read by the stages after
+// projection, the rest are dropped
+var projectedGameFields = func() models.GameFields {
+	fields := osCounterGameFields |
+		topGamesGameFields |
+		joinerGameFields |
+		reviewCounterGameFields |
+		topReviewsGameFields |
+		percentileGameFields |
+		languageCounterGameFields |
+		groupKeysGameFields
+	for _, filterFields := range filter.FilterGameFields {
+		fields |= filterFields
+	}
+	return fields
+}()
+
+// schemaCacheSize is how many csv headers projection keeps parsed, one
+// per file of the clients being served is enough
+const schemaCacheSize = 64
+
 type Projection struct {
 	iomanager client.IOManager
 	done      chan struct{}
+	policy    CSVErrorPolicy
+	// Every batch carries the header of its file, it's only parsed the
+	// first time
+	gameSchemas   *models.SchemaCache
+	reviewSchemas *models.SchemaCache
 }
 
 func NewProjection() (*Projection, error) {
+	policy, err := GetCSVErrorPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	// The rejected lines are only reported when they don't stop the node
+	outputs := map[string]client.OutputType{"": client.DirectPublisher}
+	if policy != FailOnError {
+		outputs[ReportOutput] = client.OutputWorker
+	}
+	if policy == QuarantineOnError {
+		outputs[QuarantineOutput] = client.OutputWorker
+	}
 	ioManager := client.IOManager{}
-	err := ioManager.Connect(client.InputWorker, client.DirectPublisher)
+	err = ioManager.ConnectNamed(map[string]client.InputType{"": client.InputWorker}, outputs)
 	if err != nil {
 		return nil, err
 	}
 
 	done := make(chan struct{}, 1)
 
-	return &Projection{ioManager, done}, nil
+	return &Projection{
+		iomanager:     ioManager,
+		done:          done,
+		policy:        policy,
+		gameSchemas:   models.NewSchemaCache(schemaCacheSize, models.NewGameSchema),
+		reviewSchemas: models.NewSchemaCache(schemaCacheSize, models.NewReviewSchema),
+	}, nil
 }
 
 func (p *Projection) GetDone() <-chan struct{} {
@@ -40,7 +88,6 @@ func (p *Projection) DoneSignal() {
 }
 
 func (p *Projection) Run(ctx context.Context) error {
-	consumerChan := p.iomanager.Input.GetConsumer()
 	defer p.DoneSignal()
 	options, err := end.GetServiceOptionsFromEnv()
 	if err != nil {
@@ -50,20 +97,36 @@ func (p *Projection) Run(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	tx, rx := service.Run(ctx)
+	defer service.Destroy()
+	workers, err := env.GetWorkerPoolSize()
+	if err != nil {
+		return err
+	}
+	rx, err := service.Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Parsing the CSV lines is the heavy part, a pool of workers does it
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.iomanager.ConsumeParallel(ctx, workers, func(msg client.Delivery, out *client.Forwarder) error {
+			err := p.handleMessage(msg, out, service)
+			if errors.Is(err, errInvalidMessage) {
+				out.Reject(err)
+				return nil
+			}
+			return err
+		})
+	}()
 	ends := 2
 	for {
 		select {
-		case msg := <-consumerChan:
-			err := p.handleMessage(msg, tx)
-			if err != nil {
-				return err
-			}
-
-			msg.Ack(false)
 		case <-rx:
 			ends--
 			slog.Info("END received", "ends", ends)
+		case err := <-errs:
+			return err
 		case <-ctx.Done():
 			return ctx.Err()
 		}
@@ -71,72 +134,135 @@ func (p *Projection) Run(ctx context.Context) error {
 }
 
 // TODO(fede) - Replace name for something else
-func (p *Projection) handleMessage(msg amqp091.Delivery, tx chan<- protocol.Message) error {
+func (p *Projection) handleMessage(msg client.Delivery, out *client.Forwarder, service *end.Service) error {
 	bytes := msg.Body
 	internalMsg := protocol.Message{}
 	err := internalMsg.Unmarshal(bytes)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", errInvalidMessage, err)
 	}
 	if internalMsg.ExpectKind(protocol.Data) {
 		var res *protocol.Message
+		var rejected *rejectedRows
 		var tag string
 		if internalMsg.HasGameData() {
-			res, err = p.handleGamesMessages(internalMsg)
+			res, rejected, err = p.handleGamesMessages(internalMsg)
 			if err != nil {
 				return err
 			}
 			tag = "game"
 		} else if internalMsg.HasReviewData() {
-			res, err = p.handleReviewsMessages(internalMsg)
+			res, rejected, err = p.handleReviewsMessages(internalMsg)
 			if err != nil {
 				return err
 			}
 			tag = "review"
 		} else {
-			return fmt.Errorf("unexpected message that isn't games or reviews")
+			return fmt.Errorf("%w: unexpected message that isn't games or reviews", errInvalidMessage)
 		}
-		if err := p.iomanager.Write(res.Marshal(), tag); err != nil {
-			return err
+		out.Write(res.Marshal(), tag)
+		if !rejected.empty() {
+			slog.Debug("rejected csv lines", "client", internalMsg.GetClientID(), "lines", len(rejected.rows))
+			opts := protocol.MessageOptions{
+				MessageID: internalMsg.GetMessageID(),
+				ClientID:  internalMsg.GetClientID(),
+				RequestID: internalMsg.GetRequestID(),
+			}
+			report := rejected.report(opts)
+			out.WriteTo(ReportOutput, report.Marshal(), "")
+			if p.policy == QuarantineOnError {
+				quarantine := rejected.quarantine(opts)
+				out.WriteTo(QuarantineOutput, quarantine.Marshal(), "")
+			}
 		}
 	} else if internalMsg.ExpectKind(protocol.End) {
 		slog.Debug("received end", "game", internalMsg.HasGameData(), "reviews", internalMsg.HasReviewData())
-		tx <- internalMsg
+		out.OnCommit(func() error { return service.Send(internalMsg) })
+	} else if internalMsg.ExpectKind(protocol.Cancel) {
+		slog.Info("cancelling request", "client", internalMsg.GetClientID(), "request", internalMsg.GetRequestID())
+		out.OnCommit(func() error { return service.Send(internalMsg) })
+		for _, tag := range []string{"game", "review"} {
+			out.Write(bytes, tag)
+		}
 	} else {
-		return fmt.Errorf("expected Data or End MessageType got %d", internalMsg.GetMessageType())
+		return fmt.Errorf("%w: expected Data, End or Cancel MessageType got %d", errInvalidMessage, internalMsg.GetMessageType())
 	}
 	return nil
 }
 
-// TODO(fede) - Replace hardcoded separators
-func (p *Projection) handleGamesMessages(msg protocol.Message) (*protocol.Message, error) {
-	elements := msg.Elements()
-	var listOfGames []models.Game
-
-	for _, element := range elements.Iter() {
-		csvData := string(element.ReadBytes())
+// parseCSVLines parses the lines of every element after the header. The
+// lines that fail stop the parsing under FailOnError, otherwise they're
+// added to rejected.
+func parseCSVLines[T any](elements *protocol.PayloadElements, policy CSVErrorPolicy, rejected *rejectedRows, parse func([]string) (*T, error)) ([]T, error) {
+	var parsed []T
+	for element, ok := elements.NextElement(); ok; element, ok = elements.NextElement() {
+		data, err := element.ReadBytes()
+		if err != nil {
+			return nil, fmt.Errorf("%w: couldn't read csv lines: %w", errInvalidMessage, err)
+		}
+		csvData := string(data)
 		reader := strings.NewReader(csvData)
 		csvReader := csv.NewReader(reader)
 		csvReader.LazyQuotes = true
 		csvReader.FieldsPerRecord = -1
 
-		listOfCsvGames, err := csvReader.ReadAll()
-		if err != nil {
-			return nil, fmt.Errorf("could not parse lines of csv %s: %w", csvData, err)
-		}
-
-		for _, line := range listOfCsvGames {
-			game, err := models.GameFromCSVLine(line)
-			if err != nil {
-				return nil, fmt.Errorf("could not parse game from csv line %s: %w", line, err)
+		for {
+			offset := csvReader.InputOffset()
+			line, err := csvReader.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			var value *T
+			if err == nil {
+				value, err = parse(line)
+			}
+			if err == nil {
+				parsed = append(parsed, *value)
+				continue
 			}
 
-			listOfGames = append(listOfGames, *game)
+			rawLine := strings.TrimRight(csvData[offset:csvReader.InputOffset()], "\r\n")
+			if policy != FailOnError {
+				rejected.add(err, rawLine)
+				continue
+			}
+			if errors.Is(err, models.ErrSchemaMismatch) {
+				return nil, fmt.Errorf("%w: %w", errInvalidMessage, err)
+			}
+			return nil, fmt.Errorf("could not parse csv line %s: %w", rawLine, err)
 		}
 	}
+	return parsed, nil
+}
+
+func (p *Projection) handleGamesMessages(msg protocol.Message) (*protocol.Message, *rejectedRows, error) {
+	elements := msg.Elements()
+
+	// The first element is the header of the file the lines come from
+	header, ok := elements.NextElement()
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: missing csv header", errInvalidMessage)
+	}
+	headerLine, err := header.ReadBytes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: couldn't read csv header: %w", errInvalidMessage, err)
+	}
+	schema, err := p.gameSchemas.Get(headerLine)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errInvalidMessage, err)
+	}
+
+	rejected := &rejectedRows{dataType: protocol.Games}
+	listOfGames, err := parseCSVLines(elements, p.policy, rejected, func(line []string) (*models.Game, error) {
+		return models.GameFromCSVLine(schema, line)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 
 	payloadBuffer := protocol.NewPayloadBuffer(len(listOfGames))
 	for _, game := range listOfGames {
+		game.Project(projectedGameFields)
 		game.BuildPayload(payloadBuffer)
 	}
 
@@ -146,33 +272,32 @@ func (p *Projection) handleGamesMessages(msg protocol.Message) (*protocol.Messag
 		RequestID: msg.GetRequestID(),
 	})
 
-	return &responseMsg, nil
+	return &responseMsg, rejected, nil
 }
 
-func (p *Projection) handleReviewsMessages(msg protocol.Message) (*protocol.Message, error) {
+func (p *Projection) handleReviewsMessages(msg protocol.Message) (*protocol.Message, *rejectedRows, error) {
 	elements := msg.Elements()
-	var listOfReviews []models.Review
 
-	for _, element := range elements.Iter() {
-		csvData := string(element.ReadBytes())
-		reader := strings.NewReader(csvData)
-		csvReader := csv.NewReader(reader)
-		csvReader.LazyQuotes = true
-		csvReader.FieldsPerRecord = -1
-
-		listOfCsvReviews, err := csvReader.ReadAll()
-		if err != nil {
-			return nil, fmt.Errorf("could not parse lines of csv %s: %w", csvData, err)
-		}
-
-		for _, line := range listOfCsvReviews {
-			review, err := models.ReviewFromCSVLine(line)
-			if err != nil {
-				return nil, fmt.Errorf("could not parse review from csv line %s: %w", line, err)
-			}
+	// The first element is the header of the file the lines come from
+	header, ok := elements.NextElement()
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: missing csv header", errInvalidMessage)
+	}
+	headerLine, err := header.ReadBytes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: couldn't read csv header: %w", errInvalidMessage, err)
+	}
+	schema, err := p.reviewSchemas.Get(headerLine)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errInvalidMessage, err)
+	}
 
-			listOfReviews = append(listOfReviews, *review)
-		}
+	rejected := &rejectedRows{dataType: protocol.Reviews}
+	listOfReviews, err := parseCSVLines(elements, p.policy, rejected, func(line []string) (*models.Review, error) {
+		return models.ReviewFromCSVLine(schema, line)
+	})
+	if err != nil {
+		return nil, nil, err
 	}
 
 	payloadBuffer := protocol.NewPayloadBuffer(len(listOfReviews))
@@ -186,7 +311,7 @@ func (p *Projection) handleReviewsMessages(msg protocol.Message) (*protocol.Mess
 		RequestID: msg.GetRequestID(),
 	})
 
-	return &responseMsg, nil
+	return &responseMsg, rejected, nil
 }
 
 func (p *Projection) Close() {
@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	models "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/model"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+)
+
+// batchOf is a batch of the reviews file, every chunk is an element
+func batchOf(chunks ...string) *protocol.PayloadElements {
+	builder := protocol.NewPayloadBuffer(len(chunks))
+	for _, chunk := range chunks {
+		builder.BeginPayloadElement()
+		builder.WriteBytes([]byte(chunk))
+		builder.EndPayloadElement()
+	}
+	msg := protocol.NewDataMessage(protocol.Reviews, builder.Bytes(), protocol.MessageOptions{})
+	return msg.Elements()
+}
+
+func parseReviews(t *testing.T, policy CSVErrorPolicy, elements *protocol.PayloadElements) ([]models.Review, *rejectedRows, error) {
+	t.Helper()
+	schema, err := models.NewReviewSchema("app_id,app_name,review_text,review_score")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := &rejectedRows{dataType: protocol.Reviews}
+	reviews, err := parseCSVLines(elements, policy, rejected, func(line []string) (*models.Review, error) {
+		return models.ReviewFromCSVLine(schema, line)
+	})
+	return reviews, rejected, err
+}
+
+func TestParseCSVLinesRejectsTheLinesThatFail(t *testing.T) {
+	for _, policy := range []CSVErrorPolicy{SkipOnError, QuarantineOnError} {
+		elements := batchOf(
+			"1,Portal,great,1\n2,Portal 2\n3,Half-Life,boring,7\n",
+			// The quote is never closed, the rest of the element is a
+			// single field
+			"4,Half-Life 2,\"fun,1\n5,Dota 2,ok,-1\n",
+			"6,Team Fortress,fun,1\n",
+		)
+		reviews, rejected, err := parseReviews(t, policy, elements)
+		if err != nil {
+			t.Fatalf("policy %d: %v", policy, err)
+		}
+
+		var ids []string
+		for _, review := range reviews {
+			ids = append(ids, review.AppID)
+		}
+		if !slices.Equal(ids, []string{"1", "6"}) {
+			t.Errorf("policy %d: expected reviews 1 and 6 to be parsed, got %v", policy, ids)
+		}
+
+		want := []rejectedRow{
+			{reason: "reviews: wrong number of fields", line: "2,Portal 2"},
+			{reason: "reviews: invalid review_score", line: "3,Half-Life,boring,7"},
+			{reason: "reviews: wrong number of fields", line: "4,Half-Life 2,\"fun,1\n5,Dota 2,ok,-1"},
+		}
+		if !slices.Equal(rejected.rows, want) {
+			t.Errorf("policy %d: expected rejected lines %q, got %q", policy, want, rejected.rows)
+		}
+	}
+}
+
+func TestParseCSVLinesFailsOnTheFirstLineThatFails(t *testing.T) {
+	_, rejected, err := parseReviews(t, FailOnError, batchOf("1,Portal,great,1\n2,Portal 2\n"))
+	if !errors.Is(err, errInvalidMessage) || !errors.Is(err, models.ErrSchemaMismatch) {
+		t.Errorf("expected a wrong field count to invalidate the message, got %v", err)
+	}
+	if !rejected.empty() {
+		t.Errorf("expected no line to be rejected, got %q", rejected.rows)
+	}
+
+	_, _, err = parseReviews(t, FailOnError, batchOf("4,Half-Life 2,\"fun,1\n5,Dota 2,ok,-1\n"))
+	if !errors.Is(err, errInvalidMessage) {
+		t.Errorf("expected a malformed line to invalidate the message, got %v", err)
+	}
+
+	// An invalid value stops the node, the batch is redelivered
+	_, _, err = parseReviews(t, FailOnError, batchOf("3,Half-Life,boring,7\n"))
+	var fieldErr *models.FieldError
+	if errors.Is(err, errInvalidMessage) || !errors.As(err, &fieldErr) {
+		t.Errorf("expected the invalid field to be reported, got %v", err)
+	}
+}
+
+func TestRejectedRowsQuarantineKeepsTheWholeLine(t *testing.T) {
+	long := make([]byte, maxSampleLength*2)
+	for i := range long {
+		long[i] = 'a'
+	}
+	rejected := &rejectedRows{dataType: protocol.Reviews}
+	rejected.add(models.ErrSchemaMismatch, string(long))
+
+	lineOf := func(msg protocol.Message) string {
+		elements := msg.Elements()
+		element, ok := elements.NextElement()
+		if !ok {
+			t.Fatal("expected a rejected line")
+		}
+		element.ReadBytes()
+		line, err := element.ReadBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(line)
+	}
+	if got := lineOf(rejected.report(protocol.MessageOptions{})); len(got) != maxSampleLength {
+		t.Errorf("expected the report to keep %d characters, got %d", maxSampleLength, len(got))
+	}
+	if got := lineOf(rejected.quarantine(protocol.MessageOptions{})); got != string(long) {
+		t.Errorf("expected the quarantine to keep the whole line, got %d characters", len(got))
+	}
+}
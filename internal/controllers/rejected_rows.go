@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+
+	models "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/model"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
+)
+
+// CSVErrorPolicy is what the projection does with a csv line it can't
+// parse
+type CSVErrorPolicy int
+
+const (
+	// FailOnError stops the node, the line is redelivered until it's
+	// dead-lettered with the rest of its batch
+	FailOnError CSVErrorPolicy = iota
+	// SkipOnError drops the line and reports it to the client
+	SkipOnError
+	// QuarantineOnError drops the line, reports it to the client and
+	// keeps it whole in the quarantine output
+	QuarantineOnError
+)
+
+const CSVErrorPolicyEnv = "CSV_ERROR_POLICY"
+
+// Outputs of the projection for the lines it rejects, configured by the
+// variables prefixed with REPORT_ and QUARANTINE_
+const (
+	ReportOutput     = "report"
+	QuarantineOutput = "quarantine"
+)
+
+// maxSampleLength is how much of a rejected line is reported, the whole
+// line is only kept in quarantine
+const maxSampleLength = 256
+
+// GetCSVErrorPolicy returns the policy set in CSV_ERROR_POLICY, one of
+// fail, skip or quarantine. It defaults to fail.
+func GetCSVErrorPolicy() (CSVErrorPolicy, error) {
+	value, err := utils.GetFromEnv(CSVErrorPolicyEnv)
+	if err != nil {
+		return FailOnError, nil
+	}
+	switch *value {
+	case "fail":
+		return FailOnError, nil
+	case "skip":
+		return SkipOnError, nil
+	case "quarantine":
+		return QuarantineOnError, nil
+	default:
+		return FailOnError, fmt.Errorf("environment variable %s must be fail, skip or quarantine: %s", CSVErrorPolicyEnv, *value)
+	}
+}
+
+type rejectedRow struct {
+	reason string
+	line   string
+}
+
+// rejectedRows are the lines of a batch the projection couldn't parse
+type rejectedRows struct {
+	dataType protocol.DataType
+	rows     []rejectedRow
+}
+
+// rejectionReason groups the errors of the lines, the client gets a count
+// for every reason
+func rejectionReason(err error) string {
+	var fieldErr *models.FieldError
+	var parseErr *csv.ParseError
+	switch {
+	case errors.As(err, &fieldErr):
+		return "invalid " + fieldErr.Column
+	case errors.Is(err, models.ErrSchemaMismatch):
+		return "wrong number of fields"
+	case errors.As(err, &parseErr):
+		return "malformed csv"
+	default:
+		return err.Error()
+	}
+}
+
+func (r *rejectedRows) add(err error, line string) {
+	file := "games"
+	if r.dataType == protocol.Reviews {
+		file = "reviews"
+	}
+	r.rows = append(r.rows, rejectedRow{
+		reason: file + ": " + rejectionReason(err),
+		line:   line,
+	})
+}
+
+func (r *rejectedRows) empty() bool {
+	return len(r.rows) == 0
+}
+
+// report is the message sent to the results, with the reason and the
+// start of every line
+func (r *rejectedRows) report(opts protocol.MessageOptions) protocol.Message {
+	builder := protocol.NewPayloadBuffer(len(r.rows))
+	for _, row := range r.rows {
+		builder.BeginPayloadElement()
+		builder.WriteBytes([]byte(row.reason))
+		builder.WriteBytes([]byte(row.line[:min(len(row.line), maxSampleLength)]))
+		builder.EndPayloadElement()
+	}
+	return protocol.NewResultsMessage(protocol.Rejections, builder.Bytes(), opts)
+}
+
+// quarantine is the message sent to the quarantine output, with the
+// reason and the whole line
+func (r *rejectedRows) quarantine(opts protocol.MessageOptions) protocol.Message {
+	builder := protocol.NewPayloadBuffer(len(r.rows))
+	for _, row := range r.rows {
+		builder.BeginPayloadElement()
+		builder.WriteBytes([]byte(row.reason))
+		builder.WriteBytes([]byte(row.line))
+		builder.EndPayloadElement()
+	}
+	return protocol.NewDataMessage(r.dataType, builder.Bytes(), opts)
+}
@@ -26,10 +26,14 @@ func (r reviewCounterState) insertOrUpdate(game models.Game) {
 	r[game.AppID] = v
 }
 
+// reviewCounterGameFields are the fields of the games read by the review counter
+const reviewCounterGameFields = models.AppIDField | models.NameField
+
 type ReviewCounter struct {
-	io   client.IOManager
-	done chan struct{}
-	s    reviewCounterState
+	io     client.IOManager
+	done   chan struct{}
+	states *requestStates[reviewCounterState]
+	ends   *endGatherer
 }
 
 func NewReviewCounter() (*ReviewCounter, error) {
@@ -40,7 +44,10 @@ func NewReviewCounter() (*ReviewCounter, error) {
 	return &ReviewCounter{
 		io:   io,
 		done: make(chan struct{}),
-		s:    reviewCounterState(make(map[string]inner)),
+		states: newRequestStates(func() reviewCounterState {
+			return reviewCounterState(make(map[string]inner))
+		}),
+		ends: newEndGatherer(),
 	}, nil
 }
 
@@ -53,34 +60,51 @@ func (r *ReviewCounter) Done() <-chan struct{} {
 }
 
 func (r *ReviewCounter) Run(ctx context.Context) error {
-	consumerCh := r.io.Input.GetConsumer()
 	defer func() {
 		r.done <- struct{}{}
 	}()
+	consumerCh, err := r.io.Consume()
+	if err != nil {
+		return err
+	}
 
 	for {
 		select {
 		case delivery := <-consumerCh:
+			r.io.BeginBatch()
 			msgBytes := delivery.Body
 			var msg protocol.Message
 			if err := msg.Unmarshal(msgBytes); err != nil {
-				return fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				reason := fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				r.io.Reject(delivery, reason)
+				continue
+			}
+			key := msg.GetClientKey()
+			if r.states.IsCancelled(key) && !msg.ExpectKind(protocol.Cancel) {
+				delivery.Ack()
+				continue
 			}
 
 			if msg.ExpectKind(protocol.Data) {
 				if !msg.HasGameData() {
-					return fmt.Errorf("couldn't wrong type: expected game data")
+					r.io.Reject(delivery, fmt.Errorf("couldn't wrong type: expected game data"))
+					continue
 				}
-				elements := msg.Elements()
-				for _, element := range elements.Iter() {
-					game := models.ReadGame(&element)
-					r.s.insertOrUpdate(game)
+				games, err := models.ReadGames(msg.Elements())
+				if err != nil {
+					r.io.Reject(delivery, err)
+					continue
 				}
+				for _, game := range games {
+					r.states.Get(key).insertOrUpdate(game)
+				}
+			} else if msg.ExpectKind(protocol.End) && !r.ends.Gather(msg) {
+				slog.Debug("waiting for the ends of the other partitions", "node", "review_counter")
 			} else if msg.ExpectKind(protocol.End) {
 				// reset state
 				slog.Debug("received end", "node", "review_counter")
 				// NOTE: This should be batched instead of being sent one by one
-				for _, result := range r.s {
+				for _, result := range r.states.Get(key) {
 					if result.counter < 5000 {
 						continue
 					}
@@ -97,9 +121,9 @@ func (r *ReviewCounter) Run(ctx context.Context) error {
 						return fmt.Errorf("couldn't write query 4 output: %w", err)
 					}
 					slog.Debug("query 4 results", "result", result.name)
-					r.s = reviewCounterState(make(map[string]inner))
 				}
-				res := protocol.NewEndMessage(protocol.Games, protocol.MessageOptions{
+				r.states.Delete(key)
+				res := protocol.NewPartitionedEndMessage(protocol.Games, msg.GetReceivers(), r.io.Partitions(msgBytes), protocol.MessageOptions{
 					MessageID: msg.GetMessageID(),
 					ClientID:  msg.GetClientID(),
 					RequestID: msg.GetRequestID(),
@@ -109,10 +133,21 @@ func (r *ReviewCounter) Run(ctx context.Context) error {
 				if err := r.io.Write(res.Marshal(), ""); err != nil {
 					return fmt.Errorf("couldn't write query 4 end: %w", err)
 				}
+			} else if msg.ExpectKind(protocol.Cancel) {
+				slog.Info("cancelling request", "node", "review_counter", "client", msg.GetClientID(), "request", msg.GetRequestID())
+				r.states.Cancel(key)
+				r.ends.Forget(key)
+				if err := r.io.Broadcast(msgBytes); err != nil {
+					return fmt.Errorf("couldn't forward cancel: %w", err)
+				}
 			} else {
-				return fmt.Errorf("unexpected message type: %s", msg.GetMessageType())
+				r.io.Reject(delivery, fmt.Errorf("unexpected message type: %s", msg.GetMessageType()))
+				continue
+			}
+			if err := r.io.Flush(); err != nil {
+				return fmt.Errorf("couldn't confirm outputs: %w", err)
 			}
-			delivery.Ack(false)
+			delivery.Ack()
 		case <-ctx.Done():
 			return ctx.Err()
 		}
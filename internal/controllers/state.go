@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+)
+
+// cancelledRetention is how long a cancelled request is remembered. Every
+// stage forwards the cancel behind the messages it already sent, so the
+// ones still in flight arrive long before it runs out. Neither the END
+// nor a later request of the client can be waited for instead, the
+// stages drop the END of a cancelled request and every connection gets a
+// new client id.
+const cancelledRetention = 10 * time.Minute
+
+// requestStates keeps the state of every client request a controller is
+// working on. Cancelled requests are remembered so messages still in
+// flight for them don't bring their state back.
+type requestStates[T any] struct {
+	states    map[protocol.ClientKey]T
+	cancelled map[protocol.ClientKey]time.Time
+	newState  func() T
+}
+
+func newRequestStates[T any](newState func() T) *requestStates[T] {
+	return &requestStates[T]{
+		states:    make(map[protocol.ClientKey]T),
+		cancelled: make(map[protocol.ClientKey]time.Time),
+		newState:  newState,
+	}
+}
+
+// Get returns the state of the request, creating it on first use
+func (r *requestStates[T]) Get(key protocol.ClientKey) T {
+	state, ok := r.states[key]
+	if !ok {
+		state = r.newState()
+		r.states[key] = state
+	}
+	return state
+}
+
+func (r *requestStates[T]) Set(key protocol.ClientKey, state T) {
+	r.states[key] = state
+}
+
+// Delete drops the state of a finished request
+func (r *requestStates[T]) Delete(key protocol.ClientKey) {
+	delete(r.states, key)
+}
+
+// Cancel drops the state of the request and ignores it until the
+// retention period runs out
+func (r *requestStates[T]) Cancel(key protocol.ClientKey) {
+	now := time.Now()
+	r.expireCancelled(now)
+	delete(r.states, key)
+	r.cancelled[key] = now
+}
+
+func (r *requestStates[T]) IsCancelled(key protocol.ClientKey) bool {
+	cancelledAt, ok := r.cancelled[key]
+	if ok && time.Since(cancelledAt) > cancelledRetention {
+		delete(r.cancelled, key)
+		return false
+	}
+	return ok
+}
+
+// expireCancelled forgets the requests cancelled before the retention
+// period
+func (r *requestStates[T]) expireCancelled(now time.Time) {
+	for key, cancelledAt := range r.cancelled {
+		if now.Sub(cancelledAt) > cancelledRetention {
+			delete(r.cancelled, key)
+		}
+	}
+}
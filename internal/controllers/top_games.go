@@ -15,10 +15,13 @@ type topGamesState struct {
 	heapGames *heap.HeapGames
 }
 
+// topGamesGameFields are the fields of the games read by the top games
+const topGamesGameFields = models.NameField | models.AvgPlayTimeField
+
 type TopGames struct {
 	iomanager client.IOManager
 	done      chan struct{}
-	state     *topGamesState
+	states    *requestStates[*topGamesState]
 	n         uint64
 }
 
@@ -32,8 +35,10 @@ func NewTopGames(n uint64) (*TopGames, error) {
 	return &TopGames{
 		iomanager: ioManager,
 		done:      make(chan struct{}, 1),
-		state:     &topGamesState{heapGames: heap.NewHeapGames()},
-		n:         n,
+		states: newRequestStates(func() *topGamesState {
+			return &topGamesState{heapGames: heap.NewHeapGames()}
+		}),
+		n: n,
 	}, nil
 }
 
@@ -42,46 +47,71 @@ func (tg *TopGames) Done() <-chan struct{} {
 }
 
 func (tg *TopGames) Run(ctx context.Context) error {
-	consumerChan := tg.iomanager.Input.GetConsumer()
 	defer func() {
 		tg.done <- struct{}{}
 	}()
+	consumerChan, err := tg.iomanager.Consume()
+	if err != nil {
+		return err
+	}
 
 	for {
 		select {
 		case msg := <-consumerChan:
+			tg.iomanager.BeginBatch()
 			bytes := msg.Body
 			internalMsg := protocol.Message{}
 			if err := internalMsg.Unmarshal(bytes); err != nil {
-				return fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				reason := fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				tg.iomanager.Reject(msg, reason)
+				continue
+			}
+			key := internalMsg.GetClientKey()
+			if tg.states.IsCancelled(key) && !internalMsg.ExpectKind(protocol.Cancel) {
+				msg.Ack()
+				continue
 			}
 
 			if internalMsg.ExpectKind(protocol.Data) {
 				if !internalMsg.HasGameData() {
-					return fmt.Errorf("wrong type: expected game data")
+					tg.iomanager.Reject(msg, fmt.Errorf("wrong type: expected game data"))
+					continue
+				}
+				games, err := models.ReadGames(internalMsg.Elements())
+				if err != nil {
+					tg.iomanager.Reject(msg, err)
+					continue
 				}
-				tg.processGamesData(internalMsg)
+				tg.processGamesData(tg.states.Get(key), games)
 			} else if internalMsg.ExpectKind(protocol.End) {
-				if err := tg.writeResult(internalMsg); err != nil {
+				if err := tg.writeResult(tg.states.Get(key), internalMsg); err != nil {
 					return err
 				}
+				tg.states.Delete(key)
+			} else if internalMsg.ExpectKind(protocol.Cancel) {
+				slog.Info("cancelling request", "node", "top_games", "client", internalMsg.GetClientID(), "request", internalMsg.GetRequestID())
+				tg.states.Cancel(key)
+				if err := tg.iomanager.Broadcast(bytes); err != nil {
+					return fmt.Errorf("couldn't forward cancel: %w", err)
+				}
 			} else {
-				return fmt.Errorf("unexpected message type: %s", internalMsg.GetMessageType())
+				tg.iomanager.Reject(msg, fmt.Errorf("unexpected message type: %s", internalMsg.GetMessageType()))
+				continue
 			}
 
-			msg.Ack(false)
+			if err := tg.iomanager.Flush(); err != nil {
+				return fmt.Errorf("couldn't confirm outputs: %w", err)
+			}
+			msg.Ack()
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 	}
 }
 
-func (tg *TopGames) processGamesData(internalMsg protocol.Message) {
-	heapGames := tg.state.heapGames
-	elements := internalMsg.Elements()
-
-	for _, element := range elements.Iter() {
-		game := models.ReadGame(&element)
+func (tg *TopGames) processGamesData(state *topGamesState, games []models.Game) {
+	heapGames := state.heapGames
+	for _, game := range games {
 		if heapGames.Len() < int(tg.n) {
 			heapGames.PushValue(game)
 			continue
@@ -96,8 +126,8 @@ func (tg *TopGames) processGamesData(internalMsg protocol.Message) {
 	}
 }
 
-func (tg *TopGames) writeResult(internalMsg protocol.Message) error {
-	listOfGames := tg.state.heapGames.TopNGames(tg.n)
+func (tg *TopGames) writeResult(state *topGamesState, internalMsg protocol.Message) error {
+	listOfGames := state.heapGames.TopNGames(tg.n)
 	slog.Debug("top10", "games", listOfGames)
 	for _, game := range listOfGames {
 		buffer := protocol.NewPayloadBuffer(1)
@@ -125,8 +155,5 @@ func (tg *TopGames) writeResult(internalMsg protocol.Message) error {
 		return fmt.Errorf("couldn't write query 2 end: %w", err)
 	}
 	slog.Debug("query 2 results", "state", listOfGames)
-
-	// reset state
-	tg.state.heapGames = heap.NewHeapGames()
 	return nil
 }
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+)
+
+// TopGroups merges the best groups of every group by partition into the
+// n with the highest median playtime
+type TopGroups struct {
+	io     client.IOManager
+	done   chan struct{}
+	states *requestStates[*[]groupStats]
+	ends   *endGatherer
+	n      uint64
+}
+
+func NewTopGroups(n uint64) (*TopGroups, error) {
+	var io client.IOManager
+	if err := io.Connect(client.InputWorker, client.OutputWorker); err != nil {
+		return nil, fmt.Errorf("couldn't create top groups: %w", err)
+	}
+	return &TopGroups{
+		io:   io,
+		done: make(chan struct{}),
+		states: newRequestStates(func() *[]groupStats {
+			return &[]groupStats{}
+		}),
+		ends: newEndGatherer(),
+		n:    n,
+	}, nil
+}
+
+func (t *TopGroups) Destroy() {
+	t.io.Close()
+}
+
+func (t *TopGroups) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *TopGroups) Run(ctx context.Context) error {
+	defer func() {
+		t.done <- struct{}{}
+	}()
+	consumerCh, err := t.io.Consume()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case delivery := <-consumerCh:
+			t.io.BeginBatch()
+			msgBytes := delivery.Body
+			var msg protocol.Message
+			if err := msg.Unmarshal(msgBytes); err != nil {
+				reason := fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				t.io.Reject(delivery, reason)
+				continue
+			}
+			key := msg.GetClientKey()
+			if t.states.IsCancelled(key) && !msg.ExpectKind(protocol.Cancel) {
+				delivery.Ack()
+				continue
+			}
+
+			if msg.ExpectKind(protocol.Data) {
+				read, err := readGroupsStats(msg.Elements())
+				if err != nil {
+					t.io.Reject(delivery, err)
+					continue
+				}
+				groups := t.states.Get(key)
+				*groups = append(*groups, read...)
+			} else if msg.ExpectKind(protocol.End) && !t.ends.Gather(msg) {
+				slog.Debug("waiting for the ends of the other partitions", "node", "top_groups")
+			} else if msg.ExpectKind(protocol.End) {
+				slog.Debug("received end", "node", "top_groups")
+				if err := t.writeResults(msg, *t.states.Get(key)); err != nil {
+					return err
+				}
+				t.states.Delete(key)
+			} else if msg.ExpectKind(protocol.Cancel) {
+				slog.Info("cancelling request", "node", "top_groups", "client", msg.GetClientID(), "request", msg.GetRequestID())
+				t.states.Cancel(key)
+				t.ends.Forget(key)
+				if err := t.io.Broadcast(msgBytes); err != nil {
+					return fmt.Errorf("couldn't forward cancel: %w", err)
+				}
+			} else {
+				t.io.Reject(delivery, fmt.Errorf("unexpected message type: %s", msg.GetMessageType()))
+				continue
+			}
+			if err := t.io.Flush(); err != nil {
+				return fmt.Errorf("couldn't confirm outputs: %w", err)
+			}
+			delivery.Ack()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// writeResults sends the groups from the one with the highest median,
+// like "rose-engine: median=12.50, p90=40.00 (3 games)"
+func (t *TopGroups) writeResults(msg protocol.Message, groups []groupStats) error {
+	options := protocol.MessageOptions{
+		MessageID: msg.GetMessageID(),
+		ClientID:  msg.GetClientID(),
+		RequestID: msg.GetRequestID(),
+	}
+	slices.SortFunc(groups, compareGroups)
+	groups = groups[:min(uint64(len(groups)), t.n)]
+
+	for _, group := range groups {
+		builder := protocol.NewPayloadBuffer(1)
+		builder.BeginPayloadElement()
+		builder.WriteBytes([]byte(fmt.Sprintf("%s: median=%.2f, p90=%.2f (%d games)", group.name, group.median, group.p90, group.games)))
+		builder.EndPayloadElement()
+		res := protocol.NewResultsMessage(protocol.Query8, builder.Bytes(), options)
+		if err := t.io.Write(res.Marshal(), ""); err != nil {
+			return fmt.Errorf("couldn't write query 8 output: %w", err)
+		}
+	}
+	res := protocol.NewEndMessage(protocol.Games, options)
+	res.SetQueryResult(protocol.Query8)
+	if err := t.io.Write(res.Marshal(), ""); err != nil {
+		return fmt.Errorf("couldn't write query 8 end: %w", err)
+	}
+	slog.Debug("query 8 results", "groups", len(groups))
+	return nil
+}
@@ -16,10 +16,14 @@ type topReviewsState struct {
 	appByReviewScore map[string]int
 }
 
+// topReviewsGameFields are the fields of the games read by the top reviews
+const topReviewsGameFields = models.AppIDField | models.NameField
+
 type TopReviews struct {
 	iomanager client.IOManager
 	done      chan struct{}
-	state     *topReviewsState
+	states    *requestStates[*topReviewsState]
+	ends      *endGatherer
 	n         int
 }
 
@@ -33,8 +37,11 @@ func NewTopReviews(n int) (*TopReviews, error) {
 	return &TopReviews{
 		iomanager: ioManager,
 		done:      make(chan struct{}, 1),
-		state:     &topReviewsState{make(map[string]int)},
-		n:         n,
+		states: newRequestStates(func() *topReviewsState {
+			return &topReviewsState{make(map[string]int)}
+		}),
+		ends: newEndGatherer(),
+		n:    n,
 	}, nil
 }
 
@@ -43,53 +50,82 @@ func (tr *TopReviews) Done() <-chan struct{} {
 }
 
 func (tr *TopReviews) Run(ctx context.Context) error {
-	consumerCh := tr.iomanager.Input.GetConsumer()
 	defer func() {
 		tr.done <- struct{}{}
 	}()
+	consumerCh, err := tr.iomanager.Consume()
+	if err != nil {
+		return err
+	}
 
 	for {
 		select {
 		case delivery := <-consumerCh:
+			tr.iomanager.BeginBatch()
 			bytes := delivery.Body
 			msg := protocol.Message{}
 			if err := msg.Unmarshal(bytes); err != nil {
-				return fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				reason := fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				tr.iomanager.Reject(delivery, reason)
+				continue
+			}
+			key := msg.GetClientKey()
+			if tr.states.IsCancelled(key) && !msg.ExpectKind(protocol.Cancel) {
+				delivery.Ack()
+				continue
 			}
 
 			if msg.ExpectKind(protocol.Data) {
 				if !msg.HasGameData() {
-					return fmt.Errorf("wrong type: expected game data")
+					tr.iomanager.Reject(delivery, fmt.Errorf("wrong type: expected game data"))
+					continue
 				}
-				tr.processReviewsData(msg)
+				games, err := models.ReadGames(msg.Elements())
+				if err != nil {
+					tr.iomanager.Reject(delivery, err)
+					continue
+				}
+				tr.processReviewsData(tr.states.Get(key), games)
+			} else if msg.ExpectKind(protocol.End) && !tr.ends.Gather(msg) {
+				slog.Debug("waiting for the ends of the other partitions", "node", "top_reviews")
 			} else if msg.ExpectKind(protocol.End) {
 				slog.Debug("received end", "game", msg.HasGameData())
-				if err := tr.writeResult(msg); err != nil {
+				if err := tr.writeResult(tr.states.Get(key), msg); err != nil {
 					return err
 				}
+				tr.states.Delete(key)
+			} else if msg.ExpectKind(protocol.Cancel) {
+				slog.Info("cancelling request", "node", "top_reviews", "client", msg.GetClientID(), "request", msg.GetRequestID())
+				tr.states.Cancel(key)
+				tr.ends.Forget(key)
+				if err := tr.iomanager.Broadcast(bytes); err != nil {
+					return fmt.Errorf("couldn't forward cancel: %w", err)
+				}
 			} else {
-				return fmt.Errorf("unexpected message type: %s", msg.GetMessageType())
+				tr.iomanager.Reject(delivery, fmt.Errorf("unexpected message type: %s", msg.GetMessageType()))
+				continue
 			}
-			delivery.Ack(false)
+			if err := tr.iomanager.Flush(); err != nil {
+				return fmt.Errorf("couldn't confirm outputs: %w", err)
+			}
+			delivery.Ack()
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 	}
 }
 
-func (tr *TopReviews) processReviewsData(internalMsg protocol.Message) {
-	elements := internalMsg.Elements()
-	for _, element := range elements.Iter() {
-		game := models.ReadGame(&element)
+func (tr *TopReviews) processReviewsData(state *topReviewsState, games []models.Game) {
+	for _, game := range games {
 		slog.Debug("received game", "game", game)
 		key := fmt.Sprintf("%s||%s", game.AppID, game.Name)
-		tr.state.appByReviewScore[key] += 1
+		state.appByReviewScore[key] += 1
 	}
 }
 
-func (tr *TopReviews) writeResult(internalMsg protocol.Message) error {
-	values := make([]heap.Value, 0, len(tr.state.appByReviewScore))
-	for k, v := range tr.state.appByReviewScore {
+func (tr *TopReviews) writeResult(state *topReviewsState, internalMsg protocol.Message) error {
+	values := make([]heap.Value, 0, len(state.appByReviewScore))
+	for k, v := range state.appByReviewScore {
 		name := strings.Split(k, "||")[1]
 		count := v
 		values = append(values, heap.Value{name, count})
@@ -115,7 +151,8 @@ func (tr *TopReviews) writeResult(internalMsg protocol.Message) error {
 			return fmt.Errorf("couldn't write query 3 output: %w", err)
 		}
 	}
-	res := protocol.NewEndMessage(protocol.Games, protocol.MessageOptions{
+	// The results queue gathers the ENDs of every partition
+	res := protocol.NewPartitionedEndMessage(protocol.Games, internalMsg.GetReceivers(), 1, protocol.MessageOptions{
 		MessageID: internalMsg.GetMessageID(),
 		ClientID:  internalMsg.GetClientID(),
 		RequestID: internalMsg.GetRequestID(),
@@ -125,10 +162,7 @@ func (tr *TopReviews) writeResult(internalMsg protocol.Message) error {
 	if err := tr.iomanager.Write(res.Marshal(), ""); err != nil {
 		return fmt.Errorf("couldn't write query 5 end: %w", err)
 	}
-	slog.Debug("query 3 results", "result", res, "state", *tr.state)
-
-	// reset state
-	tr.state.appByReviewScore = make(map[string]int)
+	slog.Debug("query 3 results", "result", res, "state", *state)
 	return nil
 }
 
@@ -6,53 +6,66 @@ import (
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
 	"log/slog"
+	"maps"
+	"slices"
 )
 
 type EndCoordinator struct {
-	output client.OutputType
-	io     client.IOManager
+	// outputs are the names of the outputs every END is propagated to
+	outputs []string
+	io      client.IOManager
 
 	expectedGamesEnd   int
 	expectedReviewsEnd int
 
-	GamesEndCounter   int
-	ReviewsEndCounter int
+	// The ENDs received so far of every request
+	GamesEndCounter   map[protocol.ClientKey]int
+	ReviewsEndCounter map[protocol.ClientKey]int
 
 	done chan struct{}
 }
 
-func NewEndCoordinator(output client.OutputType, expectedGames int, expectedReviews int) (*EndCoordinator, error) {
+// NewEndCoordinator propagates the ENDs to every output, the stages whose
+// nodes write to several of them need all of them to get the END
+func NewEndCoordinator(outputs map[string]client.OutputType, expectedGames int, expectedReviews int) (*EndCoordinator, error) {
 	io := client.IOManager{}
-	if err := io.Connect(client.InputWorker, output); err != nil {
+	if err := io.ConnectNamed(map[string]client.InputType{"": client.InputWorker}, outputs); err != nil {
 		return nil, fmt.Errorf("error initializing IOManager %s", err)
 	}
 
 	return &EndCoordinator{
-		output:             output,
+		outputs:            slices.Sorted(maps.Keys(io.Outputs)),
 		io:                 io,
 		expectedGamesEnd:   expectedGames,
 		expectedReviewsEnd: expectedReviews,
-		GamesEndCounter:    0,
-		ReviewsEndCounter:  0,
+		GamesEndCounter:    make(map[protocol.ClientKey]int),
+		ReviewsEndCounter:  make(map[protocol.ClientKey]int),
 		done:               make(chan struct{}),
 	}, nil
 }
 
 func (c *EndCoordinator) Run(ctx context.Context) error {
-	consumer := c.io.Input.GetConsumer()
 	defer func() {
 		c.done <- struct{}{}
 	}()
+	consumer, err := c.io.Consume()
+	if err != nil {
+		return err
+	}
 
 	for {
 		select {
 		case delivery := <-consumer:
+			c.io.BeginBatch()
 			bytes := delivery.Body
 			msg := protocol.Message{}
 			if err := msg.Unmarshal(bytes); err != nil {
-				return fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				reason := fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				c.io.Reject(delivery, reason)
+				continue
 			}
 
+			key := msg.GetClientKey()
 			if msg.ExpectKind(protocol.End) {
 				if msg.HasGameData() {
 					// Check if it expects games
@@ -61,23 +74,21 @@ func (c *EndCoordinator) Run(ctx context.Context) error {
 					}
 
 					// Sum counter
-					c.GamesEndCounter += 1
-					slog.Info("Received Game END", "counter", c.GamesEndCounter)
-					if c.GamesEndCounter >= c.expectedGamesEnd {
-						endMsg := protocol.NewEndMessage(protocol.Games, protocol.MessageOptions{
-							MessageID: msg.GetMessageID(),
-							ClientID:  msg.GetClientID(),
-							RequestID: msg.GetRequestID(),
-						})
-
-						slog.Info("Propagating END", "counter", c.GamesEndCounter)
-						if err := c.io.Write(endMsg.Marshal(), "game"); err != nil {
-							return fmt.Errorf("couldn't write end message: %w", err)
+					c.GamesEndCounter[key] += 1
+					slog.Info("Received Game END", "counter", c.GamesEndCounter[key])
+					if c.GamesEndCounter[key] >= c.expectedGamesEnd {
+						slog.Info("Propagating END", "counter", c.GamesEndCounter[key])
+						if err := c.propagateEnd(msg, protocol.Games, "game"); err != nil {
+							return err
 						}
+						delete(c.GamesEndCounter, key)
 					}
 
 					// ACK of the MSg
-					delivery.Ack(false)
+					if err := c.io.Flush(); err != nil {
+						return fmt.Errorf("couldn't confirm outputs: %w", err)
+					}
+					delivery.Ack()
 				} else if msg.HasReviewData() {
 					//. Check if its expects reviews
 					if c.expectedReviewsEnd <= 0 {
@@ -85,30 +96,36 @@ func (c *EndCoordinator) Run(ctx context.Context) error {
 					}
 
 					// Sum counter
-					c.ReviewsEndCounter += 1
-					slog.Info("Received Review END", "counter", c.ReviewsEndCounter)
-					if c.ReviewsEndCounter >= c.expectedReviewsEnd {
-						endMsg := protocol.NewEndMessage(protocol.Reviews, protocol.MessageOptions{
-							MessageID: msg.GetMessageID(),
-							ClientID:  msg.GetClientID(),
-							RequestID: msg.GetRequestID(),
-						})
-
-						slog.Info("Propagating END", "counter", c.ReviewsEndCounter)
-						if err := c.io.Write(endMsg.Marshal(), "review"); err != nil {
-							return fmt.Errorf("couldn't write end message: %w", err)
+					c.ReviewsEndCounter[key] += 1
+					slog.Info("Received Review END", "counter", c.ReviewsEndCounter[key])
+					if c.ReviewsEndCounter[key] >= c.expectedReviewsEnd {
+						slog.Info("Propagating END", "counter", c.ReviewsEndCounter[key])
+						if err := c.propagateEnd(msg, protocol.Reviews, "review"); err != nil {
+							return err
 						}
+						delete(c.ReviewsEndCounter, key)
 					}
 
 					// ACK of the MSg
-					delivery.Ack(false)
+					if err := c.io.Flush(); err != nil {
+						return fmt.Errorf("couldn't confirm outputs: %w", err)
+					}
+					delivery.Ack()
 				} else {
-					return fmt.Errorf("unexpected end type, should be game or review, got: %v", msg)
+					c.io.Reject(delivery, fmt.Errorf("unexpected end type, should be game or review, got: %v", msg))
+					continue
 				}
 
+			} else if msg.ExpectKind(protocol.Cancel) {
+				// Forget the ENDs already counted for the request
+				slog.Info("Received CANCEL", "client", msg.GetClientID(), "request", msg.GetRequestID())
+				delete(c.GamesEndCounter, key)
+				delete(c.ReviewsEndCounter, key)
+				delivery.Ack()
 			} else {
 				// Should never happen
-				return fmt.Errorf("unexpected message type different to END: %s", msg.GetMessageType())
+				c.io.Reject(delivery, fmt.Errorf("unexpected message type different to END: %s", msg.GetMessageType()))
+				continue
 			}
 
 		case <-ctx.Done():
@@ -117,6 +134,24 @@ func (c *EndCoordinator) Run(ctx context.Context) error {
 	}
 }
 
+// propagateEnd writes the END of the request of msg to every partition of
+// every output
+func (c *EndCoordinator) propagateEnd(msg protocol.Message, dataType protocol.DataType, tag string) error {
+	bytes := msg.Marshal()
+	for _, name := range c.outputs {
+		output := c.io.Output(name)
+		endMsg := protocol.NewPartitionedEndMessage(dataType, 1, output.Partitions(bytes), protocol.MessageOptions{
+			MessageID: msg.GetMessageID(),
+			ClientID:  msg.GetClientID(),
+			RequestID: msg.GetRequestID(),
+		})
+		if err := output.WritePartitions(endMsg.Marshal(), tag); err != nil {
+			return fmt.Errorf("couldn't write end message to output %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
 func (c *EndCoordinator) GetDone() <-chan struct{} {
 	return c.done
 }
@@ -1,7 +1,6 @@
 package coordinator
 
 import (
-	"fmt"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
 )
@@ -34,17 +33,5 @@ func GetOutputType() (client.OutputType, error) {
 		return client.NoneOutput, err
 	}
 
-	var outputType client.OutputType
-	switch *value {
-	case "worker":
-		outputType = client.OutputWorker
-	case "fanout":
-		outputType = client.FanoutPublisher
-	case "direct":
-		outputType = client.Router
-	default:
-		return client.NoneOutput, fmt.Errorf("invalid output type: %s", *value)
-	}
-
-	return outputType, nil
+	return client.ParseOutputType(*value)
 }
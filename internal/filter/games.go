@@ -5,10 +5,11 @@ import (
 	"fmt"
 	models "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/model"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
-	"strings"
 )
 
-type FunFilterGames func(msg protocol.Message) ([]models.Game, error)
+// FunFilterGames splits the games of msg between the ones that pass the
+// filter and the ones that don't
+type FunFilterGames func(msg protocol.Message) (passed []models.Game, rejected []models.Game, err error)
 
 const (
 	IndieFilter  string = "indieFilter"
@@ -22,61 +23,82 @@ var FilterGamesMap map[string]FunFilterGames = map[string]FunFilterGames{
 	DecadeFilter: FilterByDecade,
 }
 
-func FilterByGenreIndie(msg protocol.Message) ([]models.Game, error) {
+// FilterGameFields are the fields of the games read by every filter, the
+// id is always read to route them
+var FilterGameFields map[string]models.GameFields = map[string]models.GameFields{
+	IndieFilter:  models.AppIDField | models.GenresField,
+	ActionFilter: models.AppIDField | models.GenresField,
+	DecadeFilter: models.AppIDField | models.ReleaseYearField,
+}
+
+func FilterByGenreIndie(msg protocol.Message) ([]models.Game, []models.Game, error) {
 	var listOfPassed []models.Game
+	var listOfRejected []models.Game
 
 	if !msg.HasGameData() {
-		return []models.Game{}, fmt.Errorf("expected game data")
+		return []models.Game{}, []models.Game{}, fmt.Errorf("expected game data")
 	}
 
-	elements := msg.Elements()
-	for _, element := range elements.Iter() {
-		game := models.ReadGame(&element)
-		listOfPassed = AppendIfContainsGenre(game, listOfPassed, "indie")
+	games, err := models.ReadGames(msg.Elements())
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, game := range games {
+		if ContainsGenre(game, models.GenreIndie) {
+			listOfPassed = append(listOfPassed, game)
+		} else {
+			listOfRejected = append(listOfRejected, game)
+		}
 	}
 
-	return listOfPassed, nil
+	return listOfPassed, listOfRejected, nil
 }
 
-func FilterByGenreAction(msg protocol.Message) ([]models.Game, error) {
+func FilterByGenreAction(msg protocol.Message) ([]models.Game, []models.Game, error) {
 	var listOfPassed []models.Game
+	var listOfRejected []models.Game
 
 	if !msg.HasGameData() {
-		return []models.Game{}, fmt.Errorf("expected game data")
+		return []models.Game{}, []models.Game{}, fmt.Errorf("expected game data")
 	}
 
-	elements := msg.Elements()
-	for _, element := range elements.Iter() {
-		game := models.ReadGame(&element)
-		listOfPassed = AppendIfContainsGenre(game, listOfPassed, "action")
+	games, err := models.ReadGames(msg.Elements())
+	if err != nil {
+		return nil, nil, err
 	}
-	return listOfPassed, nil
-}
-
-func AppendIfContainsGenre(game models.Game, listOfPassed []models.Game, genre string) []models.Game {
-	genres := strings.Split(game.Genres, ",")
-	for _, g := range genres {
-		if strings.EqualFold(g, genre) {
+	for _, game := range games {
+		if ContainsGenre(game, models.GenreAction) {
 			listOfPassed = append(listOfPassed, game)
+		} else {
+			listOfRejected = append(listOfRejected, game)
 		}
 	}
-	return listOfPassed
+	return listOfPassed, listOfRejected, nil
 }
 
-func FilterByDecade(msg protocol.Message) ([]models.Game, error) {
+func ContainsGenre(game models.Game, genre models.Genre) bool {
+	return game.Genres.Has(genre)
+}
+
+func FilterByDecade(msg protocol.Message) ([]models.Game, []models.Game, error) {
 	var listOfPassed []models.Game
+	var listOfRejected []models.Game
 
 	if !msg.HasGameData() {
-		return []models.Game{}, errors.New("expected game data")
+		return []models.Game{}, []models.Game{}, errors.New("expected game data")
 	}
 
-	elements := msg.Elements()
-	for _, element := range elements.Iter() {
-		game := models.ReadGame(&element)
+	games, err := models.ReadGames(msg.Elements())
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, game := range games {
 		if game.ReleaseYear <= 2020 && game.ReleaseYear >= 2010 {
 			listOfPassed = append(listOfPassed, game)
+		} else {
+			listOfRejected = append(listOfRejected, game)
 		}
 	}
 
-	return listOfPassed, nil
+	return listOfPassed, listOfRejected, nil
 }
@@ -1,6 +1,8 @@
 package filter
 
-import "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
+import (
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
+)
 
 var FilterInputsOutputs map[string]struct {
 	Input  client.InputType
@@ -9,10 +11,12 @@ var FilterInputsOutputs map[string]struct {
 	Input  client.InputType
 	Output client.OutputType
 }{
-	IndieFilter:    {Input: client.DirectSubscriber, Output: client.Router},
-	ActionFilter:   {Input: client.DirectSubscriber, Output: client.Router},
-	DecadeFilter:   {Input: client.DirectSubscriber, Output: client.OutputWorker},
-	PositiveFilter: {Input: client.DirectSubscriber, Output: client.Router},
-	NegativeFilter: {Input: client.DirectSubscriber, Output: client.Router},
-	EnglishFilter:  {Input: client.DirectSubscriber, Output: client.Router},
+	IndieFilter:        {Input: client.DirectSubscriber, Output: client.Router},
+	ActionFilter:       {Input: client.DirectSubscriber, Output: client.Router},
+	DecadeFilter:       {Input: client.DirectSubscriber, Output: client.OutputWorker},
+	PositiveFilter:     {Input: client.DirectSubscriber, Output: client.Router},
+	NegativeFilter:     {Input: client.DirectSubscriber, Output: client.Router},
+	EnglishFilter:      {Input: client.DirectSubscriber, Output: client.Router},
+	LanguageClassifier: {Input: client.DirectSubscriber, Output: client.Router},
+	SentimentAnalyzer:  {Input: client.DirectSubscriber, Output: client.Router},
 }
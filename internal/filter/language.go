@@ -0,0 +1,249 @@
+package filter
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
+	"github.com/pemistahl/lingua-go"
+)
+
+const (
+	LanguageCandidatesEnv      = "LANGUAGE_CANDIDATES"
+	LanguageMinConfidenceEnv   = "LANGUAGE_MIN_CONFIDENCE"
+	LanguageShortTextLengthEnv = "LANGUAGE_SHORT_TEXT_LENGTH"
+	LanguageShortTextPolicyEnv = "LANGUAGE_SHORT_TEXT_POLICY"
+	LanguageCacheSizeEnv       = "LANGUAGE_CACHE_SIZE"
+)
+
+const DefaultLanguageCacheSize = 10000
+
+// ShortTextPolicy decides the language of the texts too short to be
+// detected reliably
+type ShortTextPolicy string
+
+const (
+	// ShortTextDetect detects them like any other text
+	ShortTextDetect ShortTextPolicy = "detect"
+	// ShortTextAccept takes them as written in the wanted language, it
+	// only applies to filtering by language. Detect can't tell theirs.
+	ShortTextAccept ShortTextPolicy = "accept"
+	// ShortTextReject takes them as written in another language
+	ShortTextReject ShortTextPolicy = "reject"
+)
+
+type LanguageConfig struct {
+	// Candidates are the languages a text can be detected as
+	Candidates []lingua.Language
+	// MinConfidence is the confidence under which a text isn't taken as
+	// written in the detected language, zero disables it
+	MinConfidence float64
+	// The texts with less than ShortTextLength characters follow
+	// ShortTextPolicy
+	ShortTextLength int
+	ShortTextPolicy ShortTextPolicy
+	// CacheSize is how many detections are kept, zero disables the cache
+	CacheSize int
+}
+
+// GetLanguageConfig reads the configuration of the language detection,
+// every variable is optional. By default English and Spanish are the
+// candidates and every text is detected.
+func GetLanguageConfig() (LanguageConfig, error) {
+	config := LanguageConfig{
+		Candidates:      []lingua.Language{lingua.English, lingua.Spanish},
+		ShortTextPolicy: ShortTextDetect,
+		CacheSize:       DefaultLanguageCacheSize,
+	}
+
+	if value, ok := os.LookupEnv(LanguageCandidatesEnv); ok {
+		candidates, err := parseLanguages(value)
+		if err != nil {
+			return LanguageConfig{}, fmt.Errorf("environment variable %s: %w", LanguageCandidatesEnv, err)
+		}
+		config.Candidates = candidates
+	}
+
+	if value, ok := os.LookupEnv(LanguageMinConfidenceEnv); ok {
+		confidence, err := strconv.ParseFloat(value, 64)
+		if err != nil || confidence < 0 || confidence > 1 {
+			return LanguageConfig{}, fmt.Errorf(
+				"environment variable %s must be a number between 0 and 1: %s",
+				LanguageMinConfidenceEnv,
+				value,
+			)
+		}
+		config.MinConfidence = confidence
+	}
+
+	if _, ok := os.LookupEnv(LanguageShortTextLengthEnv); ok {
+		length, err := utils.GetFromEnvInt(LanguageShortTextLengthEnv)
+		if err != nil {
+			return LanguageConfig{}, err
+		}
+		config.ShortTextLength = int(*length)
+	}
+
+	if value, ok := os.LookupEnv(LanguageShortTextPolicyEnv); ok {
+		policy := ShortTextPolicy(value)
+		switch policy {
+		case ShortTextDetect, ShortTextAccept, ShortTextReject:
+			config.ShortTextPolicy = policy
+		default:
+			return LanguageConfig{}, fmt.Errorf(
+				"environment variable %s must be %s, %s or %s: %s",
+				LanguageShortTextPolicyEnv,
+				ShortTextDetect,
+				ShortTextAccept,
+				ShortTextReject,
+				value,
+			)
+		}
+	}
+
+	if _, ok := os.LookupEnv(LanguageCacheSizeEnv); ok {
+		size, err := utils.GetFromEnvInt(LanguageCacheSizeEnv)
+		if err != nil {
+			return LanguageConfig{}, err
+		}
+		config.CacheSize = int(*size)
+	}
+
+	return config, nil
+}
+
+// parseLanguages reads a comma separated list of language names, like
+// english,spanish
+func parseLanguages(value string) ([]lingua.Language, error) {
+	var languages []lingua.Language
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		language, ok := languageNamed(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown language: %s", name)
+		}
+		languages = append(languages, language)
+	}
+	if len(languages) < 2 {
+		return nil, fmt.Errorf("at least two languages are needed: %s", value)
+	}
+	return languages, nil
+}
+
+func languageNamed(name string) (lingua.Language, bool) {
+	for _, language := range lingua.AllLanguages() {
+		if strings.EqualFold(language.String(), name) {
+			return language, true
+		}
+	}
+	return lingua.Unknown, false
+}
+
+// detection is what the cache keeps of a text
+type detection struct {
+	language   lingua.Language
+	confidence float64
+}
+
+// LanguageDetector tells the language of the reviews. It's safe for
+// concurrent use.
+type LanguageDetector struct {
+	detector lingua.LanguageDetector
+	config   LanguageConfig
+
+	// cache is keyed by the hash of the text, many reviews are repeated
+	cache  *utils.LRU[uint64, detection]
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func NewLanguageDetector(config LanguageConfig) *LanguageDetector {
+	d := &LanguageDetector{
+		detector: lingua.NewLanguageDetectorBuilder().FromLanguages(config.Candidates...).Build(),
+		config:   config,
+	}
+	if config.CacheSize > 0 {
+		d.cache = utils.NewLRU[uint64, detection](config.CacheSize)
+	}
+	return d
+}
+
+// Is reports whether text is written in language
+func (d *LanguageDetector) Is(text string, language lingua.Language) bool {
+	if d.isShort(text) {
+		return d.config.ShortTextPolicy == ShortTextAccept
+	}
+
+	detected := d.detect(text)
+	return detected.language == language && detected.confidence >= d.config.MinConfidence
+}
+
+// Detect returns the language text is written in, lingua.Unknown when it
+// can't be told with enough confidence or text is too short to be
+// detected reliably
+func (d *LanguageDetector) Detect(text string) lingua.Language {
+	if d.isShort(text) {
+		return lingua.Unknown
+	}
+
+	detected := d.detect(text)
+	if detected.confidence < d.config.MinConfidence {
+		return lingua.Unknown
+	}
+	return detected.language
+}
+
+func (d *LanguageDetector) isShort(text string) bool {
+	return d.config.ShortTextPolicy != ShortTextDetect && utf8.RuneCountInString(strings.TrimSpace(text)) < d.config.ShortTextLength
+}
+
+func (d *LanguageDetector) detect(text string) detection {
+	if d.cache == nil {
+		return d.compute(text)
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(text))
+	key := hash.Sum64()
+	if detected, ok := d.cache.Get(key); ok {
+		d.hits.Add(1)
+		return detected
+	}
+	d.misses.Add(1)
+	detected := d.compute(text)
+	d.cache.Put(key, detected)
+	return detected
+}
+
+func (d *LanguageDetector) compute(text string) detection {
+	language, ok := d.detector.DetectLanguageOf(text)
+	if !ok {
+		return detection{language: lingua.Unknown}
+	}
+	detected := detection{language: language, confidence: 1}
+	// Computing the confidence costs as much as detecting the language
+	if d.config.MinConfidence > 0 {
+		detected.confidence = d.detector.ComputeLanguageConfidence(text, language)
+	}
+	return detected
+}
+
+// CacheStats returns how many detections were found in the cache and how
+// many had to be computed
+func (d *LanguageDetector) CacheStats() (hits uint64, misses uint64) {
+	return d.hits.Load(), d.misses.Load()
+}
+
+// HitRate is the fraction of the detections found in the cache
+func (d *LanguageDetector) HitRate() float64 {
+	hits, misses := d.CacheStats()
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
@@ -0,0 +1,112 @@
+package filter_test
+
+import (
+	"testing"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/filter"
+	models "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/model"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+	"github.com/pemistahl/lingua-go"
+)
+
+func TestGetLanguageConfig(t *testing.T) {
+	t.Setenv(filter.LanguageCandidatesEnv, "english, German,french")
+	t.Setenv(filter.LanguageMinConfidenceEnv, "0.6")
+	t.Setenv(filter.LanguageShortTextPolicyEnv, "reject")
+
+	config, err := filter.GetLanguageConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []lingua.Language{lingua.English, lingua.German, lingua.French}
+	if len(config.Candidates) != len(expected) {
+		t.Fatalf("expected candidates %v, got %v", expected, config.Candidates)
+	}
+	for i, language := range expected {
+		if config.Candidates[i] != language {
+			t.Errorf("expected candidates %v, got %v", expected, config.Candidates)
+		}
+	}
+	if config.MinConfidence != 0.6 || config.ShortTextPolicy != filter.ShortTextReject {
+		t.Errorf("unexpected config: %+v", config)
+	}
+
+	t.Setenv(filter.LanguageCandidatesEnv, "english,klingon")
+	if _, err := filter.GetLanguageConfig(); err == nil {
+		t.Error("expected an unknown language to fail")
+	}
+}
+
+func TestShortTextPolicy(t *testing.T) {
+	config := filter.LanguageConfig{
+		Candidates:      []lingua.Language{lingua.English, lingua.Spanish},
+		ShortTextLength: 10,
+	}
+
+	config.ShortTextPolicy = filter.ShortTextAccept
+	detector := filter.NewLanguageDetector(config)
+	if !detector.Is(" gg ", lingua.English) {
+		t.Error("expected the short text to be accepted")
+	}
+	// Accepting a short text doesn't tell its language
+	if language := detector.Detect(" gg "); language != lingua.Unknown {
+		t.Errorf("expected the short text to be of an unknown language, got %s", language)
+	}
+
+	config.ShortTextPolicy = filter.ShortTextReject
+	if filter.NewLanguageDetector(config).Is("gg", lingua.English) {
+		t.Error("expected the short text to be rejected")
+	}
+}
+
+func TestEnglishFilterTrustsTheLanguageTag(t *testing.T) {
+	reviews := []models.Review{
+		{AppID: "1", Text: "Este juego es muy divertido y lo recomiendo", Language: lingua.English.String()},
+		{AppID: "2", Text: "This game is really fun and I recommend it", Language: lingua.Spanish.String()},
+		{AppID: "3", Text: "This game is really fun and I recommend it"},
+	}
+	builder := protocol.NewPayloadBuffer(len(reviews))
+	for _, review := range reviews {
+		review.BuildPayload(builder)
+	}
+	msg := protocol.NewDataMessage(protocol.Reviews, builder.Bytes(), protocol.MessageOptions{})
+
+	detector := filter.NewLanguageDetector(filter.LanguageConfig{
+		Candidates: []lingua.Language{lingua.English, lingua.Spanish},
+	})
+	passed, rejected, err := filter.FilterByEnglish(msg, detector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The untagged review is detected
+	if len(passed) != 2 || passed[0].AppID != "1" || passed[1].AppID != "3" {
+		t.Errorf("expected reviews 1 and 3 to pass, got %+v", passed)
+	}
+	if len(rejected) != 1 || rejected[0].AppID != "2" {
+		t.Errorf("expected review 2 to be rejected, got %+v", rejected)
+	}
+}
+
+func TestAnalyzeSentimentRejectsTheReviewsItCantScore(t *testing.T) {
+	reviews := []models.Review{
+		{AppID: "1", Text: "A great game, I loved it", Language: lingua.English.String()},
+		{AppID: "2", Text: "Un juego genial, me encanto", Language: lingua.Spanish.String()},
+		{AppID: "3", Text: "It has a map and some levels", Language: lingua.English.String()},
+	}
+	builder := protocol.NewPayloadBuffer(len(reviews))
+	for _, review := range reviews {
+		review.BuildPayload(builder)
+	}
+	msg := protocol.NewDataMessage(protocol.Reviews, builder.Bytes(), protocol.MessageOptions{})
+
+	passed, rejected, err := filter.AnalyzeSentiment(msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passed) != 1 || passed[0].AppID != "1" || passed[0].Sentiment <= 0 {
+		t.Errorf("expected review 1 to be scored, got %+v", passed)
+	}
+	if len(rejected) != 2 || rejected[0].AppID != "2" || rejected[1].AppID != "3" {
+		t.Errorf("expected reviews 2 and 3 to be rejected, got %+v", rejected)
+	}
+}
@@ -6,79 +6,162 @@ import (
 
 	models "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/model"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/sentiment"
 	"github.com/pemistahl/lingua-go"
 )
 
-type FuncFilterReviews func(msg protocol.Message, detector *lingua.LanguageDetector) ([]models.Review, error)
+// FuncFilterReviews splits the reviews of msg between the ones that pass
+// the filter and the ones that don't
+type FuncFilterReviews func(msg protocol.Message, detector *LanguageDetector) (passed []models.Review, rejected []models.Review, err error)
 
 const (
-	PositiveFilter string = "positiveFilter"
-	NegativeFilter string = "negativeFilter"
-	EnglishFilter  string = "englishFilter"
+	PositiveFilter     string = "positiveFilter"
+	NegativeFilter     string = "negativeFilter"
+	EnglishFilter      string = "englishFilter"
+	LanguageClassifier string = "languageClassifier"
+	SentimentAnalyzer  string = "sentimentAnalyzer"
 )
 
 var FilterReviewsMap map[string]FuncFilterReviews = map[string]FuncFilterReviews{
-	PositiveFilter: FilterByPositiveScore,
-	NegativeFilter: FilterByNegativeScore,
-	EnglishFilter:  FilterByEnglish,
+	PositiveFilter:     FilterByPositiveScore,
+	NegativeFilter:     FilterByNegativeScore,
+	EnglishFilter:      FilterByEnglish,
+	LanguageClassifier: ClassifyByLanguage,
+	SentimentAnalyzer:  AnalyzeSentiment,
 }
 
 func NeedsDecoder(name string) bool {
-	return name == EnglishFilter
+	return name == EnglishFilter || name == LanguageClassifier
 }
 
-func FilterByPositiveScore(msg protocol.Message, detector *lingua.LanguageDetector) ([]models.Review, error) {
+func FilterByPositiveScore(msg protocol.Message, detector *LanguageDetector) ([]models.Review, []models.Review, error) {
 	var listOfPassed []models.Review
+	var listOfRejected []models.Review
 
 	if !msg.HasReviewData() {
-		return []models.Review{}, errors.New("expected review data")
+		return []models.Review{}, []models.Review{}, errors.New("expected review data")
 	}
 
-	elements := msg.Elements()
-	for _, element := range elements.Iter() {
-		review := models.ReadReview(&element)
+	reviews, err := models.ReadReviews(msg.Elements())
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, review := range reviews {
 		if review.Score == models.Positive {
 			listOfPassed = append(listOfPassed, review)
+		} else {
+			listOfRejected = append(listOfRejected, review)
 		}
 	}
 
-	return listOfPassed, nil
+	return listOfPassed, listOfRejected, nil
 }
 
-func FilterByNegativeScore(msg protocol.Message, detector *lingua.LanguageDetector) ([]models.Review, error) {
+func FilterByNegativeScore(msg protocol.Message, detector *LanguageDetector) ([]models.Review, []models.Review, error) {
 	var listOfPassed []models.Review
+	var listOfRejected []models.Review
 
 	if !msg.HasReviewData() {
 		slog.Debug("Shouldn't happen")
-		return []models.Review{}, errors.New("expected review data")
+		return []models.Review{}, []models.Review{}, errors.New("expected review data")
+	}
+	reviews, err := models.ReadReviews(msg.Elements())
+	if err != nil {
+		return nil, nil, err
 	}
-	elements := msg.Elements()
-	for _, element := range elements.Iter() {
-		review := models.ReadReview(&element)
+	for _, review := range reviews {
 		slog.Debug("read review", "review", review)
 		if review.Score == models.Negative {
 			listOfPassed = append(listOfPassed, review)
+		} else {
+			listOfRejected = append(listOfRejected, review)
 		}
 	}
 
-	return listOfPassed, nil
+	return listOfPassed, listOfRejected, nil
 }
 
-func FilterByEnglish(msg protocol.Message, detector *lingua.LanguageDetector) ([]models.Review, error) {
+func FilterByEnglish(msg protocol.Message, detector *LanguageDetector) ([]models.Review, []models.Review, error) {
 	var listOfPassed []models.Review
+	var listOfRejected []models.Review
 
 	if !msg.HasReviewData() {
-		return []models.Review{}, errors.New("expected review data")
+		return []models.Review{}, []models.Review{}, errors.New("expected review data")
 	}
 
-	elements := msg.Elements()
-	for _, element := range elements.Iter() {
-		review := models.ReadReview(&element)
-		language, exist := (*detector).DetectLanguageOf(review.Text)
-		if exist && language == lingua.English {
+	reviews, err := models.ReadReviews(msg.Elements())
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, review := range reviews {
+		if IsInLanguage(review, lingua.English, detector) {
 			listOfPassed = append(listOfPassed, review)
+		} else {
+			listOfRejected = append(listOfRejected, review)
+		}
+	}
+
+	return listOfPassed, listOfRejected, nil
+}
+
+// IsInLanguage reports whether review is written in language, the
+// reviews tagged by the classifier aren't detected again
+func IsInLanguage(review models.Review, language lingua.Language, detector *LanguageDetector) bool {
+	if review.Language != "" {
+		return review.Language == language.String()
+	}
+	return detector.Is(review.Text, language)
+}
+
+// ClassifyByLanguage tags every review with the language it's written in,
+// none of them is rejected
+func ClassifyByLanguage(msg protocol.Message, detector *LanguageDetector) ([]models.Review, []models.Review, error) {
+	var listOfPassed []models.Review
+
+	if !msg.HasReviewData() {
+		return []models.Review{}, []models.Review{}, errors.New("expected review data")
+	}
+
+	reviews, err := models.ReadReviews(msg.Elements())
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, review := range reviews {
+		review.Language = detector.Detect(review.Text).String()
+		listOfPassed = append(listOfPassed, review)
+	}
+
+	return listOfPassed, nil, nil
+}
+
+// AnalyzeSentiment scores the sentiment of the text of every review. The
+// ones that can't be scored, because they aren't in the language of the
+// lexicon or none of their words is in it, are rejected.
+func AnalyzeSentiment(msg protocol.Message, detector *LanguageDetector) ([]models.Review, []models.Review, error) {
+	var listOfPassed []models.Review
+	var listOfRejected []models.Review
+
+	if !msg.HasReviewData() {
+		return []models.Review{}, []models.Review{}, errors.New("expected review data")
+	}
+
+	reviews, err := models.ReadReviews(msg.Elements())
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, review := range reviews {
+		if review.Language != sentiment.Language.String() {
+			listOfRejected = append(listOfRejected, review)
+			continue
+		}
+		score, hits := sentiment.Score(review.Text)
+		if hits == 0 {
+			listOfRejected = append(listOfRejected, review)
+			continue
 		}
+		review.Sentiment = score
+		listOfPassed = append(listOfPassed, review)
 	}
 
-	return listOfPassed, nil
+	return listOfPassed, listOfRejected, nil
 }
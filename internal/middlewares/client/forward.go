@@ -0,0 +1,405 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+)
+
+// MessageKeyHeader carries the key of the messages written through
+// ProcessAndForward, the inputs drop the ones whose key they already
+// acknowledged
+const MessageKeyHeader = "x-message-key"
+
+// DefaultDedupWindow is how many acknowledged keys an IOManager remembers.
+// Duplicates come from an upstream node that crashed between writing its
+// outputs and acknowledging its input, they arrive shortly after the
+// originals.
+//
+// The keys are kept in memory, so deduplication is per process: a node
+// that restarts, or another replica reading the same queue, doesn't know
+// the keys this one acknowledged.
+const DefaultDedupWindow = 1 << 16
+
+// MessageKey identifies the message of delivery. It's the key it was
+// written with or, for the messages written without one, a hash of the
+// body, which for the messages of the server includes its message ID.
+func MessageKey(delivery middlewares.Delivery) uint64 {
+	if key, ok := headerKey(delivery.Headers); ok {
+		return key
+	}
+	hash := fnv.New64a()
+	hash.Write(delivery.Body)
+	return hash.Sum64()
+}
+
+func headerKey(headers middlewares.Headers) (uint64, bool) {
+	key, ok := headers[MessageKeyHeader].(int64)
+	return uint64(key), ok
+}
+
+// DeriveKey returns the key of the output written in position index while
+// processing the message with key input
+func DeriveKey(input uint64, index uint32) uint64 {
+	var buf [12]byte
+	binary.BigEndian.PutUint64(buf[:8], input)
+	binary.BigEndian.PutUint32(buf[8:], index)
+	hash := fnv.New64a()
+	hash.Write(buf[:])
+	return hash.Sum64()
+}
+
+// Deduplicator remembers the last acknowledged keys
+type Deduplicator struct {
+	mutex sync.Mutex
+	seen  map[uint64]struct{}
+	// order is a ring with the keys in seen, the oldest one is forgotten
+	// when it's full
+	order []uint64
+	next  int
+}
+
+func NewDeduplicator(window int) *Deduplicator {
+	return &Deduplicator{
+		seen:  make(map[uint64]struct{}, window),
+		order: make([]uint64, 0, window),
+	}
+}
+
+func (d *Deduplicator) Seen(key uint64) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	_, ok := d.seen[key]
+	return ok
+}
+
+func (d *Deduplicator) Remember(key uint64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.remember(key)
+}
+
+// Acknowledge runs ack and remembers key, it returns whether key was
+// already acknowledged. The check, the ack and the record happen under
+// the same lock, so of two copies of a message in flight at once only
+// the first one acknowledged counts as the original.
+func (d *Deduplicator) Acknowledge(key uint64, ack func() error) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	_, duplicated := d.seen[key]
+	if err := ack(); err != nil {
+		return duplicated, err
+	}
+	d.remember(key)
+	return duplicated, nil
+}
+
+func (d *Deduplicator) remember(key uint64) {
+	if _, ok := d.seen[key]; ok {
+		return
+	}
+	if len(d.order) < cap(d.order) {
+		d.order = append(d.order, key)
+	} else {
+		delete(d.seen, d.order[d.next])
+		d.order[d.next] = key
+		d.next = (d.next + 1) % len(d.order)
+	}
+	d.seen[key] = struct{}{}
+}
+
+// dedupAcknowledger remembers the key of the delivery once it's
+// acknowledged, a message given back is still expected
+type dedupAcknowledger struct {
+	middlewares.Acknowledger
+	dedup *Deduplicator
+	key   uint64
+}
+
+func (a dedupAcknowledger) Ack() error {
+	_, err := a.dedup.Acknowledge(a.key, a.Acknowledger.Ack)
+	return err
+}
+
+// Forwarder collects the outputs of a delivery, they are written once
+// it's processed. Each one carries a key derived from the key of the
+// delivery and the order it was written in, so processing the delivery
+// again writes the same keys.
+type Forwarder struct {
+	key      uint64
+	written  uint32
+	writes   []forward
+	onCommit []func() error
+	rejected error
+}
+
+type forward struct {
+	output  string
+	msg     []byte
+	tag     string
+	headers middlewares.Headers
+}
+
+// Write writes msg to the unnamed output
+func (f *Forwarder) Write(msg []byte, tag string) {
+	f.WriteTo("", msg, tag)
+}
+
+// WriteTo writes msg to the output called name
+func (f *Forwarder) WriteTo(name string, msg []byte, tag string) {
+	headers := middlewares.Headers{MessageKeyHeader: int64(DeriveKey(f.key, f.written))}
+	f.written++
+	f.writes = append(f.writes, forward{output: name, msg: msg, tag: tag, headers: headers})
+}
+
+// Broadcast writes msg to every destination of the unnamed output
+func (f *Forwarder) Broadcast(msg []byte) {
+	f.BroadcastTo("", msg)
+}
+
+// BroadcastTo writes msg to every destination of the output called name.
+// The copies carry no key, the control messages are broadcast and they
+// are idempotent.
+func (f *Forwarder) BroadcastTo(name string, msg []byte) {
+	f.writes = append(f.writes, forward{output: name, msg: msg})
+}
+
+// OnCommit runs fn once the outputs are confirmed, right before the
+// delivery is acknowledged. What the node does besides writing its
+// outputs, like passing an END on, goes here so it keeps the order of
+// the messages of the client.
+func (f *Forwarder) OnCommit(fn func() error) {
+	f.onCommit = append(f.onCommit, fn)
+}
+
+// Reject discards the outputs, the delivery is rejected instead of
+// acknowledged
+func (f *Forwarder) Reject(reason error) {
+	f.rejected = reason
+}
+
+// ProcessAndForward runs process, which collects the outputs of delivery
+// in the Forwarder, writes them and acknowledges delivery once the
+// broker confirmed all of them.
+//
+// If the node stops in between, the delivery comes back and process
+// writes the same outputs again with the same keys, so the nodes reading
+// them drop the copies they already acknowledged. That only holds if
+// process writes the same outputs in the same order every time, and only
+// while the reader that acknowledged the originals keeps running: the
+// keys aren't persisted, so a reader that restarts, or another replica
+// reading the same queue, takes the copies as new messages. On error
+// nothing is written and the delivery isn't settled.
+func (m *IOManager) ProcessAndForward(delivery Delivery, process func(*Forwarder) error) error {
+	forwarder := &Forwarder{key: MessageKey(delivery.Delivery)}
+	if err := process(forwarder); err != nil {
+		return err
+	}
+	return m.commit(delivery, forwarder)
+}
+
+// commit writes the outputs of delivery and settles it. The batches of the
+// outputs are shared, so a single delivery is committed at a time.
+//
+// Consume drops the copies of the messages acknowledged before they
+// arrive, but two copies can be processed at once. Their keys are checked
+// again here, under the same lock as the ack, and only the first one
+// committed writes its outputs.
+func (m *IOManager) commit(delivery Delivery, f *Forwarder) error {
+	m.commitMutex.Lock()
+	defer m.commitMutex.Unlock()
+
+	if key, ok := headerKey(delivery.Headers); ok && m.dedup.Seen(key) {
+		slog.Debug("dropping duplicated message", "input", delivery.Input, "key", key)
+		return delivery.Ack()
+	}
+	if f.rejected != nil {
+		m.Reject(delivery, f.rejected)
+		return nil
+	}
+
+	m.BeginBatch()
+	for _, w := range f.writes {
+		output := m.Output(w.output)
+		var err error
+		if w.headers == nil {
+			err = output.Broadcast(w.msg)
+		} else if writer, ok := output.handler.(rabbitmq.HeaderWriter); ok {
+			err = writer.WriteWithHeaders(w.msg, w.tag, w.headers)
+		} else {
+			err = output.Write(w.msg, w.tag)
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't write to output %q: %w", w.output, err)
+		}
+	}
+	if err := m.Flush(); err != nil {
+		return fmt.Errorf("couldn't confirm outputs: %w", err)
+	}
+	for _, fn := range f.onCommit {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return delivery.Ack()
+}
+
+// ConsumeParallel processes the deliveries of every input with workers
+// goroutines running handle. The outputs are committed as in
+// ProcessAndForward, in the order the messages of each client arrived:
+// a delivery that finishes before an earlier one of its client waits in
+// a reorder buffer until that one is committed. It returns when ctx is
+// done, the inputs are closed or handle fails.
+func (m *IOManager) ConsumeParallel(ctx context.Context, workers int, handle func(Delivery, *Forwarder) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	work := make(chan workItem)
+	done := make(chan workItem)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range work {
+				item.forwarder = &Forwarder{key: MessageKey(item.delivery.Delivery)}
+				item.err = handle(item.delivery, item.forwarder)
+				select {
+				case done <- item:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	defer func() {
+		// The workers waiting to hand their delivery back give up
+		cancel()
+		close(work)
+		wg.Wait()
+	}()
+
+	buffer := newReorderBuffer()
+	deliveries, err := m.Consume()
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return nil
+			}
+			// The finished deliveries are committed while waiting
+			// for a free worker, the workers may be waiting on them
+			item := buffer.add(delivery)
+			for sent := false; !sent; {
+				select {
+				case work <- item:
+					sent = true
+				case finished := <-done:
+					if err := m.commitInOrder(buffer, finished); err != nil {
+						return err
+					}
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		case finished := <-done:
+			if err := m.commitInOrder(buffer, finished); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// commitInOrder commits finished and every delivery of its client that
+// was waiting for it
+func (m *IOManager) commitInOrder(buffer *reorderBuffer, finished workItem) error {
+	if finished.err != nil {
+		return finished.err
+	}
+	for _, item := range buffer.finish(finished) {
+		if err := m.commit(item.delivery, item.forwarder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// workItem is a delivery handed to the workers of ConsumeParallel,
+// sequence is its position among the deliveries of its client
+type workItem struct {
+	delivery  Delivery
+	client    protocol.ClientKey
+	sequence  uint64
+	forwarder *Forwarder
+	err       error
+}
+
+// reorderBuffer keeps the deliveries a worker finished before an earlier
+// one of the same client. The ones that aren't protocol messages share
+// the zero client, they are rejected anyway.
+type reorderBuffer struct {
+	clients map[protocol.ClientKey]*clientOrder
+}
+
+type clientOrder struct {
+	// received is the sequence of the next delivery of the client, next
+	// the sequence of the next one to commit
+	received uint64
+	next     uint64
+	finished map[uint64]workItem
+}
+
+func newReorderBuffer() *reorderBuffer {
+	return &reorderBuffer{clients: make(map[protocol.ClientKey]*clientOrder)}
+}
+
+// add gives delivery the next sequence of its client
+func (b *reorderBuffer) add(delivery Delivery) workItem {
+	key, _ := protocol.PeekClientKey(delivery.Body)
+	order, ok := b.clients[key]
+	if !ok {
+		order = &clientOrder{finished: make(map[uint64]workItem)}
+		b.clients[key] = order
+	}
+	item := workItem{delivery: delivery, client: key, sequence: order.received}
+	order.received++
+	return item
+}
+
+// finish stores item and returns the deliveries of its client that can be
+// committed now, in order. A client is forgotten once it has nothing in
+// flight.
+func (b *reorderBuffer) finish(item workItem) []workItem {
+	order := b.clients[item.client]
+	order.finished[item.sequence] = item
+
+	var ready []workItem
+	for {
+		next, ok := order.finished[order.next]
+		if !ok {
+			break
+		}
+		delete(order.finished, order.next)
+		ready = append(ready, next)
+		order.next++
+	}
+	if order.next == order.received {
+		delete(b.clients, item.client)
+	}
+	return ready
+}
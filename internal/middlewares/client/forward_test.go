@@ -0,0 +1,342 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/memory"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+)
+
+func TestProcessAndForwardDropsTheOutputsOfARedelivery(t *testing.T) {
+	t.Setenv("INPUT_WORKER_QUEUE", "input")
+	t.Setenv("INPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("INPUT_WORKER_QUEUE_COUNT", "1")
+	t.Setenv("OUTPUT_WORKER_QUEUE", "forwarded")
+	t.Setenv("OUTPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("OUTPUT_WORKER_QUEUE_COUNT", "1")
+	t.Setenv("FORWARDED_INPUT_WORKER_QUEUE", "forwarded")
+	t.Setenv("FORWARDED_INPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("FORWARDED_INPUT_WORKER_QUEUE_COUNT", "1")
+
+	broker := memory.NewBroker()
+	upstream := client.IOManager{Memory: broker}
+	if err := upstream.Connect(client.InputWorker, client.OutputWorker); err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	downstream := client.IOManager{Memory: broker}
+	if err := downstream.ConnectNamed(map[string]client.InputType{"forwarded": client.InputWorker}, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer downstream.Close()
+
+	input := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: "input"})
+	inputs := consume(t, &upstream)
+	forwarded := consume(t, &downstream)
+	process := func(out *client.Forwarder) error {
+		out.Write([]byte("first"), "")
+		out.Write([]byte("second"), "")
+		return nil
+	}
+
+	input.Write([]byte("batch"), "")
+	if err := upstream.ProcessAndForward(receive(t, inputs), process); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		receive(t, forwarded).Ack()
+	}
+
+	// The copy the broker delivers again when the node crashed before
+	// acknowledging the batch
+	input.Write([]byte("batch"), "")
+	if err := upstream.ProcessAndForward(receive(t, inputs), process); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case duplicate := <-forwarded:
+		t.Fatalf("the duplicated %q wasn't dropped", duplicate.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if depth := broker.Depth("input"); depth != 0 {
+		t.Errorf("the batch wasn't acknowledged, %d messages left", depth)
+	}
+}
+
+func TestProcessAndForwardDropsTheOutputsOfAnUpstreamThatRestarted(t *testing.T) {
+	t.Setenv("INPUT_WORKER_QUEUE", "input")
+	t.Setenv("INPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("INPUT_WORKER_QUEUE_COUNT", "1")
+	t.Setenv("OUTPUT_WORKER_QUEUE", "forwarded")
+	t.Setenv("OUTPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("OUTPUT_WORKER_QUEUE_COUNT", "1")
+	t.Setenv("FORWARDED_INPUT_WORKER_QUEUE", "forwarded")
+	t.Setenv("FORWARDED_INPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("FORWARDED_INPUT_WORKER_QUEUE_COUNT", "1")
+
+	broker := memory.NewBroker()
+	downstream := client.IOManager{Memory: broker}
+	if err := downstream.ConnectNamed(map[string]client.InputType{"forwarded": client.InputWorker}, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer downstream.Close()
+	forwarded := consume(t, &downstream)
+	writeOutputs := func(out *client.Forwarder) error {
+		out.Write([]byte("first"), "")
+		out.Write([]byte("second"), "")
+		return nil
+	}
+
+	// The outputs are confirmed but the node stops before acknowledging
+	// the batch
+	crashed := client.IOManager{Memory: broker}
+	if err := crashed.Connect(client.InputWorker, client.OutputWorker); err != nil {
+		t.Fatal(err)
+	}
+	input := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: "input"})
+	input.Write([]byte("batch"), "")
+	err := crashed.ProcessAndForward(receive(t, consume(t, &crashed)), func(out *client.Forwarder) error {
+		out.OnCommit(func() error { return errors.New("crashed") })
+		return writeOutputs(out)
+	})
+	if err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+	for range 2 {
+		receive(t, forwarded).Ack()
+	}
+	crashed.Close()
+
+	// The node that replaces it gets the batch again
+	restarted := client.IOManager{Memory: broker}
+	if err := restarted.Connect(client.InputWorker, client.OutputWorker); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	if err := restarted.ProcessAndForward(receive(t, consume(t, &restarted)), writeOutputs); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case duplicate := <-forwarded:
+		t.Fatalf("the duplicated %q wasn't dropped", duplicate.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if depth := broker.Depth("input"); depth != 0 {
+		t.Errorf("the batch wasn't acknowledged, %d messages left", depth)
+	}
+}
+
+func TestProcessAndForwardCommitsOneOfTwoCopiesInFlight(t *testing.T) {
+	t.Setenv("INPUT_WORKER_QUEUE", "input")
+	t.Setenv("INPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("INPUT_WORKER_QUEUE_COUNT", "2")
+	t.Setenv("OUTPUT_WORKER_QUEUE", "output")
+	t.Setenv("OUTPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("OUTPUT_WORKER_QUEUE_COUNT", "1")
+
+	broker := memory.NewBroker()
+	io := client.IOManager{Memory: broker}
+	if err := io.Connect(client.InputWorker, client.OutputWorker); err != nil {
+		t.Fatal(err)
+	}
+	defer io.Close()
+
+	// Both copies are taken from the queue before either is
+	// acknowledged, so Consume can't tell them apart
+	input := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: "input"})
+	headers := middlewares.Headers{client.MessageKeyHeader: int64(42)}
+	input.WriteWithHeaders([]byte("batch"), "", headers)
+	input.WriteWithHeaders([]byte("batch"), "", headers)
+	inputs := consume(t, &io)
+	first := receive(t, inputs)
+	second := receive(t, inputs)
+
+	process := func(out *client.Forwarder) error {
+		out.Write([]byte("output"), "")
+		return nil
+	}
+	if err := io.ProcessAndForward(first, process); err != nil {
+		t.Fatal(err)
+	}
+	if err := io.ProcessAndForward(second, process); err != nil {
+		t.Fatal(err)
+	}
+
+	if depth := broker.Depth("output"); depth != 1 {
+		t.Errorf("expected a single output, got %d", depth)
+	}
+	if depth := broker.Depth("input"); depth != 0 {
+		t.Errorf("both copies must be acknowledged, %d messages left", depth)
+	}
+}
+
+func TestConsumeParallelKeepsTheOrderOfEachClient(t *testing.T) {
+	t.Setenv("INPUT_WORKER_QUEUE", "input")
+	t.Setenv("INPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("INPUT_WORKER_QUEUE_COUNT", "8")
+	t.Setenv("OUTPUT_WORKER_QUEUE", "output")
+	t.Setenv("OUTPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("OUTPUT_WORKER_QUEUE_COUNT", "1")
+
+	broker := memory.NewBroker()
+	io := client.IOManager{Memory: broker}
+	if err := io.Connect(client.InputWorker, client.OutputWorker); err != nil {
+		t.Fatal(err)
+	}
+	defer io.Close()
+
+	const clients = 5
+	const messages = 50
+	input := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: "input"})
+	for i := range messages {
+		for clientID := range clients {
+			msg := protocol.NewDataMessage(protocol.Games, nil, protocol.MessageOptions{
+				ClientID:  uint32(clientID),
+				RequestID: 1,
+				MessageID: uint32(i),
+			})
+			input.Write(msg.Marshal(), "")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- io.ConsumeParallel(ctx, 4, func(delivery client.Delivery, out *client.Forwarder) error {
+			// Later messages are faster, they would overtake the earlier
+			// ones of their client without ordering
+			var msg protocol.Message
+			if err := msg.Unmarshal(delivery.Body); err != nil {
+				return err
+			}
+			time.Sleep(time.Duration(messages-msg.GetMessageID()) * 10 * time.Microsecond)
+			out.Write(delivery.Body, "")
+			return nil
+		})
+	}()
+
+	output := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: "output"})
+	deliveries := consumeInput(t, output)
+	next := make([]uint32, clients)
+	for range clients * messages {
+		var delivery client.Delivery
+		select {
+		case delivery.Delivery = <-deliveries:
+		case err := <-errs:
+			t.Fatal(err)
+		case <-time.After(time.Second):
+			t.Fatal("the outputs didn't arrive")
+		}
+		delivery.Ack()
+
+		var msg protocol.Message
+		if err := msg.Unmarshal(delivery.Body); err != nil {
+			t.Fatal(err)
+		}
+		clientID := msg.GetClientID()
+		if msg.GetMessageID() != next[clientID] {
+			t.Fatalf("client %d: expected message %d, got %d", clientID, next[clientID], msg.GetMessageID())
+		}
+		next[clientID]++
+	}
+
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the pool to stop with the context, got %v", err)
+	}
+}
+
+func TestConsumeParallelProcessesTheMessagesOfAClientConcurrently(t *testing.T) {
+	t.Setenv("INPUT_WORKER_QUEUE", "input")
+	t.Setenv("INPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("INPUT_WORKER_QUEUE_COUNT", "8")
+	t.Setenv("OUTPUT_WORKER_QUEUE", "output")
+	t.Setenv("OUTPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("OUTPUT_WORKER_QUEUE_COUNT", "1")
+
+	broker := memory.NewBroker()
+	io := client.IOManager{Memory: broker}
+	if err := io.Connect(client.InputWorker, client.OutputWorker); err != nil {
+		t.Fatal(err)
+	}
+	defer io.Close()
+
+	const workers = 4
+	input := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: "input"})
+	for i := range workers {
+		msg := protocol.NewDataMessage(protocol.Games, nil, protocol.MessageOptions{
+			ClientID:  1,
+			RequestID: 1,
+			MessageID: uint32(i),
+		})
+		input.Write(msg.Marshal(), "")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan struct{}, workers)
+	release := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- io.ConsumeParallel(ctx, workers, func(delivery client.Delivery, out *client.Forwarder) error {
+			started <- struct{}{}
+			<-release
+			out.Write(delivery.Body, "")
+			return nil
+		})
+	}()
+
+	// Every message of the client is being processed at once
+	for range workers {
+		select {
+		case <-started:
+		case err := <-errs:
+			t.Fatal(err)
+		case <-time.After(time.Second):
+			t.Fatal("the messages of the client weren't processed concurrently")
+		}
+	}
+	close(release)
+
+	deliveries := consumeInput(t, memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: "output"}))
+	for i := range workers {
+		var delivery client.Delivery
+		select {
+		case delivery.Delivery = <-deliveries:
+		case <-time.After(time.Second):
+			t.Fatal("the outputs didn't arrive")
+		}
+		delivery.Ack()
+
+		var msg protocol.Message
+		if err := msg.Unmarshal(delivery.Body); err != nil {
+			t.Fatal(err)
+		}
+		if msg.GetMessageID() != uint32(i) {
+			t.Fatalf("expected message %d, got %d", i, msg.GetMessageID())
+		}
+	}
+}
+
+func TestDeduplicatorForgetsTheOldestKeys(t *testing.T) {
+	dedup := client.NewDeduplicator(2)
+	dedup.Remember(1)
+	dedup.Remember(2)
+	dedup.Remember(3)
+
+	if dedup.Seen(1) {
+		t.Error("expected the oldest key to be forgotten")
+	}
+	if !dedup.Seen(2) || !dedup.Seen(3) {
+		t.Error("expected the newest keys to be remembered")
+	}
+}
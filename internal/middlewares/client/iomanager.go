@@ -1,10 +1,16 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
+	"sync"
 
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/env"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/memory"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
 )
 
@@ -15,6 +21,7 @@ const (
 	InputWorker
 	FanoutSubscriber
 	DirectSubscriber
+	TopicSubscriber
 )
 
 type OutputType int
@@ -25,138 +32,510 @@ const (
 	FanoutPublisher
 	DirectPublisher
 	Router
+	TopicPublisher
 )
 
+// ParseOutputType reads the output types nodes take from their
+// environment, direct stands for a router over a direct exchange
+func ParseOutputType(value string) (OutputType, error) {
+	switch value {
+	case "worker":
+		return OutputWorker, nil
+	case "fanout":
+		return FanoutPublisher, nil
+	case "direct":
+		return Router, nil
+	case "topic":
+		return TopicPublisher, nil
+	default:
+		return NoneOutput, fmt.Errorf("invalid output type: %s", value)
+	}
+}
+
+// Delivery is a message received from one of the inputs, whatever the
+// broker
+type Delivery struct {
+	middlewares.Delivery
+	// Input is the name of the input the message came from
+	Input string
+}
+
+// IOManager holds the inputs and outputs of a node. Each one has a name
+// and is configured by the environment variables of its kind prefixed
+// with it, see env.Named. Connect sets up the unnamed ones, which is
+// what most nodes need.
 type IOManager struct {
-	Conn rabbitmq.Connection
+	Conn *rabbitmq.Connection
+	// Memory is the in-process broker the handlers use instead of
+	// RabbitMQ. It's set by Connect when MIDDLEWARE_BROKER is memory,
+	// tests can set it beforehand to isolate their nodes.
+	Memory *memory.Broker
 
-	InputType InputType
-	Input     rabbitmq.InputHandler
+	Inputs  map[string]rabbitmq.InputHandler
+	Outputs map[string]rabbitmq.OutputHandler
 
-	OutputType OutputType
-	Output     rabbitmq.OutputHandler
+	// dedup holds the keys of the acknowledged messages, see
+	// ProcessAndForward
+	dedup *Deduplicator
+	// commitMutex serializes the commits of ProcessAndForward, it's
+	// shared by the copies of the IOManager the controllers keep
+	commitMutex *sync.Mutex
+	// closed stops the consumers, it's closed once however many copies
+	// of the IOManager are closed
+	closed    chan struct{}
+	closeOnce *sync.Once
 }
 
-func (m *IOManager) connectInput(conn *rabbitmq.Connection, input InputType) error {
+func (m *IOManager) newInput(name string, input InputType) (rabbitmq.InputHandler, error) {
 	switch input {
-	case NoneInput:
-		return nil
 	case InputWorker:
-		config, err := env.GetInputWorkerQueueConfig()
+		config, err := env.GetInputWorkerQueueConfig(name)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		m.Input = rabbitmq.NewWorkerQueue(*config)
+		if m.Memory != nil {
+			return memory.NewWorkerQueue(m.Memory, *config), nil
+		}
+		return rabbitmq.NewWorkerQueue(*config), nil
 	case FanoutSubscriber:
-		config, err := env.GetFanoutSubscriberConfig()
+		config, err := env.GetFanoutSubscriberConfig(name)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		m.Input = rabbitmq.NewFanoutSubscriber(*config)
+		if m.Memory != nil {
+			return memory.NewFanoutSubscriber(m.Memory, *config), nil
+		}
+		return rabbitmq.NewFanoutSubscriber(*config), nil
 	case DirectSubscriber:
-		config, err := env.GetDirectSubscriberConfig()
+		config, err := env.GetDirectSubscriberConfig(name)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		m.Input = rabbitmq.NewDirectSubscriber(*config)
-	}
-
-	err := m.Input.Connect(conn)
-	if err != nil {
-		return err
+		if m.Memory != nil {
+			return memory.NewDirectSubscriber(m.Memory, *config), nil
+		}
+		return rabbitmq.NewDirectSubscriber(*config), nil
+	case TopicSubscriber:
+		config, err := env.GetTopicSubscriberConfig(name)
+		if err != nil {
+			return nil, err
+		}
+		if m.Memory != nil {
+			return memory.NewTopicSubscriber(m.Memory, *config), nil
+		}
+		return rabbitmq.NewTopicSubscriber(*config), nil
+	default:
+		return nil, fmt.Errorf("unknown input type: %d", input)
 	}
-	return nil
 }
 
-func (m *IOManager) connectOutput(conn *rabbitmq.Connection, output OutputType) error {
+func (m *IOManager) newOutput(name string, output OutputType) (rabbitmq.OutputHandler, error) {
 	switch output {
-	case NoneOutput:
-		return nil
 	case OutputWorker:
-		config, err := env.GetOutputWorkerQueueConfig()
+		config, err := env.GetOutputWorkerQueueConfig(name)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if m.Memory != nil {
+			return memory.NewWorkerQueue(m.Memory, *config), nil
 		}
-		m.Output = rabbitmq.NewWorkerQueue(*config)
+		return rabbitmq.NewWorkerQueue(*config), nil
 	case FanoutPublisher:
-		config, err := env.GetFanoutPublisherConfig()
+		config, err := env.GetFanoutPublisherConfig(name)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if m.Memory != nil {
+			return memory.NewFanoutPublisher(m.Memory, *config), nil
 		}
-		m.Output = rabbitmq.NewFanoutPublisher(*config)
+		return rabbitmq.NewFanoutPublisher(*config), nil
 	case DirectPublisher:
-		config, err := env.GetDirectPublisherConfig()
+		config, err := env.GetDirectPublisherConfig(name)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if m.Memory != nil {
+			return memory.NewDirectPublisher(m.Memory, *config), nil
 		}
-		m.Output = rabbitmq.NewDirectPublisher(*config)
+		return rabbitmq.NewDirectPublisher(*config), nil
+	case TopicPublisher:
+		config, err := env.GetTopicPublisherConfig(name)
+		if err != nil {
+			return nil, err
+		}
+		if m.Memory != nil {
+			return memory.NewTopicPublisher(m.Memory, *config), nil
+		}
+		return rabbitmq.NewTopicPublisher(*config), nil
 	case Router:
-		config, err := env.GetDirectPublisherConfig()
-		tags, err := env.GetRouterTags()
+		return m.newRouter(name)
+	default:
+		return nil, fmt.Errorf("unknown output type: %d", output)
+	}
+}
+
+func (m *IOManager) newRouter(name string) (rabbitmq.OutputHandler, error) {
+	config, err := env.GetDirectPublisherConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := env.GetRouterTags(name)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get tags from env: %w", err)
+	}
+	isProjection, err := env.GetIsProjection(name)
+	if err != nil {
+		isProjection = false
+	}
+
+	var publisher rabbitmq.OutputHandler
+	if m.Memory != nil {
+		publisher = memory.NewDirectPublisher(m.Memory, *config)
+	} else {
+		publisher = rabbitmq.NewDirectPublisher(*config)
+	}
+	if isProjection {
+		slog.Debug("selected game review selector", "output", name)
+		return rabbitmq.NewRouterOn(publisher, []string{"game", "review"}, rabbitmq.GameReviewRouter{}), nil
+	}
+
+	slog.Debug("selected consistent hash selector", "output", name)
+	controlConfig, err := env.GetRouterControlConfig()
+	if err != nil {
+		return nil, err
+	}
+	var control rabbitmq.ControlLog
+	if m.Memory != nil {
+		control = memory.NewControlStream(m.Memory, *controlConfig)
+	} else {
+		control = rabbitmq.NewControlStream(*controlConfig)
+	}
+	return rabbitmq.NewPartitionedRouter(publisher, config.Exchange, tags, control), nil
+}
+
+// Connect sets up the unnamed input and output, either can be None
+func (m *IOManager) Connect(input InputType, output OutputType) error {
+	inputs := map[string]InputType{"": input}
+	outputs := map[string]OutputType{"": output}
+	return m.ConnectNamed(inputs, outputs)
+}
+
+// ConnectNamed sets up an input for every entry of inputs and an output
+// for every entry of outputs, the ones of type None are skipped
+func (m *IOManager) ConnectNamed(inputs map[string]InputType, outputs map[string]OutputType) error {
+	if err := m.connectBroker(); err != nil {
+		return err
+	}
+	m.Inputs = make(map[string]rabbitmq.InputHandler)
+	m.Outputs = make(map[string]rabbitmq.OutputHandler)
+	m.dedup = NewDeduplicator(DefaultDedupWindow)
+	m.commitMutex = &sync.Mutex{}
+	m.closed = make(chan struct{})
+	m.closeOnce = &sync.Once{}
 
+	for _, name := range slices.Sorted(maps.Keys(inputs)) {
+		if inputs[name] == NoneInput {
+			continue
+		}
+		input, err := m.newInput(name, inputs[name])
 		if err != nil {
-			return fmt.Errorf("couldn't get tags from env: %w", err)
+			return err
+		}
+		if err := input.Connect(m.Conn); err != nil {
+			return fmt.Errorf("failed to connect input %q: %w", name, err)
 		}
-		isProjection, err := env.GetIsProjection()
+		m.Inputs[name] = input
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(outputs)) {
+		if outputs[name] == NoneOutput {
+			continue
+		}
+		output, err := m.newOutput(name, outputs[name])
 		if err != nil {
-			isProjection = false
+			return err
 		}
-		var selector rabbitmq.RouteSelector
-		if isProjection {
-			slog.Debug("selected game review selector")
-			selector = rabbitmq.GameReviewRouter{}
-			tags = []string{"game", "review"}
-		} else {
-			slog.Debug("selected id selector")
-			selector = rabbitmq.NewIDRouter(len(tags))
+		if err := output.Connect(m.Conn); err != nil {
+			return fmt.Errorf("failed to connect output %q: %w", name, err)
 		}
-		router := rabbitmq.NewRouter(*config, tags, selector)
-		m.Output = &router
+		m.Outputs[name] = output
 	}
 
-	err := m.Output.Connect(conn)
+	return nil
+}
+
+// connectBroker connects to RabbitMQ unless the in-memory broker is used
+func (m *IOManager) connectBroker() error {
+	if m.Memory != nil {
+		return nil
+	}
+
+	broker, err := env.GetBroker()
 	if err != nil {
 		return err
 	}
-	return nil
-}
+	if broker == env.MemoryBroker {
+		m.Memory = memory.Default()
+		return nil
+	}
 
-func (m *IOManager) Connect(input InputType, output OutputType) error {
 	conn, err := env.GetConnection()
 	if err != nil {
 		return err
 	}
-	m.Conn = *conn
+	m.Conn = conn
+	return nil
+}
 
-	if err = m.connectInput(conn, input); err != nil {
-		return err
+// Consume returns the messages of every input in a single channel,
+// they must be settled with Ack, Requeue or Reject. The messages with a
+// key that was already acknowledged are dropped, a copy that arrives
+// while the original is being processed is only caught when it's
+// committed, see commit. It fails if the broker refuses to consume any
+// of the inputs.
+func (m *IOManager) Consume() (<-chan Delivery, error) {
+	if len(m.Inputs) == 0 {
+		panic("no input was configured")
 	}
-	m.InputType = input
 
-	if err = m.connectOutput(conn, output); err != nil {
-		return err
+	consumers := make(map[string]<-chan middlewares.Delivery, len(m.Inputs))
+	for name, input := range m.Inputs {
+		consumer, err := input.GetConsumer()
+		if err != nil {
+			return nil, fmt.Errorf("failed to consume input %q: %w", name, err)
+		}
+		consumers[name] = consumer
 	}
-	m.OutputType = output
 
-	return nil
+	deliveries := make(chan Delivery)
+	closed := m.closed
+	dedup := m.dedup
+	var wg sync.WaitGroup
+	for name, consumer := range consumers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for delivery := range consumer {
+				if key, ok := headerKey(delivery.Headers); ok {
+					if dedup.Seen(key) {
+						slog.Debug("dropping duplicated message", "input", name, "key", key)
+						if err := delivery.Ack(); err != nil {
+							slog.Error("couldn't acknowledge duplicated message", "input", name, "error", err)
+						}
+						continue
+					}
+					delivery.Acknowledger = dedupAcknowledger{Acknowledger: delivery.Acknowledger, dedup: dedup, key: key}
+				}
+				select {
+				case deliveries <- Delivery{Delivery: delivery, Input: name}:
+				case <-closed:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(deliveries)
+	}()
+	return deliveries, nil
 }
 
+// Reject gives a message the node couldn't process back to the input it
+// came from. It's retried as many times as the input allows and then
+// parked in its dead letter queue. If neither can be done the message is
+// requeued, a single message never stops the node.
+func (m *IOManager) Reject(delivery Delivery, reason error) {
+	// The retry is a copy with the same key, it must not be taken for a
+	// duplicate once the original is acknowledged
+	rejected := delivery.Delivery
+	if acknowledger, ok := rejected.Acknowledger.(dedupAcknowledger); ok {
+		rejected.Acknowledger = acknowledger.Acknowledger
+	}
+
+	retrier, ok := m.Inputs[delivery.Input].(rabbitmq.Retrier)
+	if !ok {
+		slog.Warn("dead lettering message", "input", delivery.Input, "reason", reason)
+		if err := rejected.Nack(); err != nil {
+			slog.Error("couldn't dead letter message", "input", delivery.Input, "error", err)
+		}
+		return
+	}
+
+	maxRetries := retrier.MaxRetries()
+	if maxRetries <= 0 {
+		maxRetries = rabbitmq.DefaultMaxRetries
+	}
+	var err error
+	if retries := rabbitmq.RetryCount(rejected.Headers); retries < maxRetries {
+		slog.Warn("retrying message", "input", delivery.Input, "retries", retries+1, "reason", reason)
+		err = retrier.Retry(rejected, rabbitmq.RetryHeaders(rejected, retries+1, reason))
+	} else {
+		slog.Warn("parking message in the dead letter queue", "input", delivery.Input, "retries", retries, "reason", reason)
+		err = retrier.Park(rejected, rabbitmq.RetryHeaders(rejected, retries, reason))
+	}
+	if err != nil {
+		slog.Error("couldn't reject message, requeueing it", "input", delivery.Input, "error", err)
+		if err := rejected.Requeue(); err != nil {
+			slog.Error("couldn't requeue message", "input", delivery.Input, "error", err)
+		}
+	}
+}
+
+// Output is an output of the IOManager addressed by name
+type Output struct {
+	name    string
+	handler rabbitmq.OutputHandler
+}
+
+// Output returns the output called name, it panics if it wasn't
+// configured
+func (m *IOManager) Output(name string) Output {
+	handler, ok := m.Outputs[name]
+	if !ok {
+		panic(fmt.Sprintf("output %q was not configured", name))
+	}
+	return Output{name: name, handler: handler}
+}
+
+func (o Output) Write(msg []byte, tag string) error {
+	return o.handler.Write(msg, tag)
+}
+
+// Broadcast writes msg to every destination of the output. Routers pick a
+// single destination on Write, control messages must reach all of them
+func (o Output) Broadcast(msg []byte) error {
+	if broadcaster, ok := o.handler.(rabbitmq.Broadcaster); ok {
+		return broadcaster.Broadcast(msg)
+	}
+	return o.handler.Write(msg, "")
+}
+
+// Partitions returns over how many partitions the output spreads the
+// request of msg, a stage gathering them waits for as many ENDs
+func (o Output) Partitions(msg []byte) int {
+	if partitioner, ok := o.handler.(rabbitmq.Partitioner); ok {
+		return partitioner.Partitions(msg)
+	}
+	return 1
+}
+
+// WritePartitions writes msg to every partition of its request, ENDs
+// must reach all of them. Outputs that don't partition write it to tag.
+func (o Output) WritePartitions(msg []byte, tag string) error {
+	if partitioner, ok := o.handler.(rabbitmq.Partitioner); ok {
+		return partitioner.WritePartitions(msg, tag)
+	}
+	return o.handler.Write(msg, tag)
+}
+
+// TagOf returns the partition msg goes to when it's written with key,
+// messages written with keys of the same partition can be batched
+// together. Outputs that don't partition send it to key.
+func (o Output) TagOf(msg []byte, key string) string {
+	if partitioner, ok := o.handler.(rabbitmq.Partitioner); ok {
+		return partitioner.TagOf(msg, key)
+	}
+	return key
+}
+
+var ErrDepthNotSupported = errors.New("output doesn't support depth inspection")
+
+// Depth returns how many messages are waiting in the output queue
+func (o Output) Depth() (int, error) {
+	inspector, ok := o.handler.(rabbitmq.DepthInspector)
+	if !ok {
+		return 0, ErrDepthNotSupported
+	}
+	return inspector.Depth()
+}
+
+// Write writes msg to the unnamed output
 func (m *IOManager) Write(msg []byte, tag string) error {
-	if m.OutputType == NoneOutput {
-		panic("no output was configured")
+	return m.Output("").Write(msg, tag)
+}
+
+// WriteTo writes msg to the output called name
+func (m *IOManager) WriteTo(name string, msg []byte, tag string) error {
+	return m.Output(name).Write(msg, tag)
+}
+
+// Broadcast writes msg to every destination of the unnamed output
+func (m *IOManager) Broadcast(msg []byte) error {
+	return m.Output("").Broadcast(msg)
+}
+
+// Partitions returns over how many partitions the unnamed output spreads
+// the request of msg
+func (m *IOManager) Partitions(msg []byte) int {
+	return m.Output("").Partitions(msg)
+}
+
+// WritePartitions writes msg to every partition of its request on the
+// unnamed output
+func (m *IOManager) WritePartitions(msg []byte, tag string) error {
+	return m.Output("").WritePartitions(msg, tag)
+}
+
+// TagOf returns the partition msg goes to when it's written with key to
+// the unnamed output
+func (m *IOManager) TagOf(msg []byte, key string) string {
+	return m.Output("").TagOf(msg, key)
+}
+
+// OutputDepth returns how many messages are waiting in the unnamed output
+// queue
+func (m *IOManager) OutputDepth() (int, error) {
+	return m.Output("").Depth()
+}
+
+// BeginBatch defers the broker confirmations of the following writes to
+// every output until Flush, outputs that don't batch confirm every write
+func (m *IOManager) BeginBatch() {
+	for _, output := range m.Outputs {
+		if batcher, ok := output.(rabbitmq.Batcher); ok {
+			batcher.BeginBatch()
+		}
 	}
+}
 
-	return m.Output.Write(msg, tag)
+// Flush returns once the broker confirmed every write since BeginBatch.
+// Inputs must be acknowledged only after the outputs derived from them
+// are flushed.
+func (m *IOManager) Flush() error {
+	for name, output := range m.Outputs {
+		if batcher, ok := output.(rabbitmq.Batcher); ok {
+			if err := batcher.Flush(); err != nil {
+				return fmt.Errorf("failed to flush output %q: %w", name, err)
+			}
+		}
+	}
+	return nil
 }
 
+// Close stops consuming and closes the inputs, the outputs and the
+// connection. The copies of the IOManager share them, closing any of
+// them again does nothing.
 func (m *IOManager) Close() {
-	if m.InputType != NoneInput {
-		m.Input.Close()
+	once := m.closeOnce
+	if once == nil {
+		once = &sync.Once{}
 	}
+	once.Do(func() {
+		if m.closed != nil {
+			close(m.closed)
+		}
 
-	if m.OutputType != NoneOutput {
-		m.Output.Close()
-	}
+		for _, input := range m.Inputs {
+			input.Close()
+		}
+
+		for _, output := range m.Outputs {
+			output.Close()
+		}
 
-	m.Conn.Close()
+		if m.Conn != nil {
+			m.Conn.Close()
+		}
+	})
 }
@@ -0,0 +1,168 @@
+package client_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/client"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/memory"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
+)
+
+func receive(t *testing.T, deliveries <-chan client.Delivery) client.Delivery {
+	t.Helper()
+	select {
+	case delivery := <-deliveries:
+		return delivery
+	case <-time.After(time.Second):
+		t.Fatal("no message was delivered")
+	}
+	return client.Delivery{}
+}
+
+func consume(t *testing.T, io *client.IOManager) <-chan client.Delivery {
+	t.Helper()
+	deliveries, err := io.Consume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func consumeInput(t *testing.T, input rabbitmq.InputHandler) <-chan middlewares.Delivery {
+	t.Helper()
+	deliveries, err := input.GetConsumer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func TestIOManagerNamedInputsAndOutputs(t *testing.T) {
+	t.Setenv("GAMES_INPUT_WORKER_QUEUE", "games")
+	t.Setenv("GAMES_INPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("GAMES_INPUT_WORKER_QUEUE_COUNT", "1")
+	t.Setenv("REVIEWS_INPUT_WORKER_QUEUE", "reviews")
+	t.Setenv("REVIEWS_INPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("REVIEWS_INPUT_WORKER_QUEUE_COUNT", "1")
+	t.Setenv("OUTPUT_WORKER_QUEUE", "passed")
+	t.Setenv("OUTPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("OUTPUT_WORKER_QUEUE_COUNT", "1")
+	t.Setenv("REJECTED_OUTPUT_WORKER_QUEUE", "rejected")
+	t.Setenv("REJECTED_OUTPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("REJECTED_OUTPUT_WORKER_QUEUE_COUNT", "1")
+
+	broker := memory.NewBroker()
+	io := client.IOManager{Memory: broker}
+	err := io.ConnectNamed(
+		map[string]client.InputType{"games": client.InputWorker, "reviews": client.InputWorker},
+		map[string]client.OutputType{"": client.OutputWorker, "rejected": client.OutputWorker},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer io.Close()
+
+	reviews := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: "reviews"})
+	reviews.Write([]byte("review"), "")
+	deliveries := consume(t, &io)
+	delivery := receive(t, deliveries)
+	if delivery.Input != "reviews" || string(delivery.Body) != "review" {
+		t.Fatalf("expected the review from reviews, got %q from %q", delivery.Body, delivery.Input)
+	}
+
+	// The rejected message is retried on the input it came from
+	io.Reject(delivery, errors.New("failed"))
+	delivery = receive(t, deliveries)
+	if delivery.Input != "reviews" || rabbitmq.RetryCount(delivery.Headers) != 1 {
+		t.Fatalf("expected a retry from reviews, got one from %q", delivery.Input)
+	}
+	delivery.Ack()
+
+	games := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: "games"})
+	games.Write([]byte("game"), "")
+	if delivery := receive(t, deliveries); delivery.Input != "games" {
+		t.Fatalf("expected a game from games, got one from %q", delivery.Input)
+	}
+
+	io.Write([]byte("passed"), "")
+	io.WriteTo("rejected", []byte("rejected"), "")
+	if broker.Depth("passed") != 1 || broker.Depth("rejected") != 1 {
+		t.Errorf("expected a message on each output, got %d and %d", broker.Depth("passed"), broker.Depth("rejected"))
+	}
+}
+
+func TestRejectRetriesAMessageAndThenParksIt(t *testing.T) {
+	t.Setenv("INPUT_WORKER_QUEUE", "input")
+	t.Setenv("INPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("INPUT_WORKER_QUEUE_COUNT", "1")
+	t.Setenv("INPUT_MAX_RETRIES", "2")
+
+	broker := memory.NewBroker()
+	io := client.IOManager{Memory: broker}
+	if err := io.Connect(client.InputWorker, client.NoneOutput); err != nil {
+		t.Fatal(err)
+	}
+	defer io.Close()
+
+	input := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: "input"})
+	input.Write([]byte("poison"), "")
+	deliveries := consume(t, &io)
+
+	// The first delivery and its two retries
+	for retries := range 3 {
+		delivery := receive(t, deliveries)
+		if count := rabbitmq.RetryCount(delivery.Headers); count != retries {
+			t.Fatalf("expected %d retries, got %d", retries, count)
+		}
+		io.Reject(delivery, errors.New("can't decode"))
+	}
+
+	select {
+	case delivery := <-deliveries:
+		t.Fatalf("expected the message to be parked, got %q", delivery.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if depth := broker.Depth("input"); depth != 0 {
+		t.Errorf("expected the input to be empty, got %d messages", depth)
+	}
+
+	parked := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: rabbitmq.DeadLetterQueue("input")})
+	delivery := <-consumeInput(t, parked)
+	if count := rabbitmq.RetryCount(delivery.Headers); count != 2 {
+		t.Errorf("expected the parked message to be retried twice, got %d", count)
+	}
+	if reason := delivery.Headers[rabbitmq.RetryReasonHeader]; reason != "can't decode" {
+		t.Errorf("expected the reason of the last failure, got %v", reason)
+	}
+}
+
+func TestIOManagerCopiesCanBeClosed(t *testing.T) {
+	t.Setenv("INPUT_WORKER_QUEUE", "input")
+	t.Setenv("INPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("INPUT_WORKER_QUEUE_COUNT", "1")
+	t.Setenv("OUTPUT_WORKER_QUEUE", "output")
+	t.Setenv("OUTPUT_WORKER_QUEUE_TIMEOUT", "1")
+	t.Setenv("OUTPUT_WORKER_QUEUE_COUNT", "1")
+
+	io := client.IOManager{Memory: memory.NewBroker()}
+	if err := io.Connect(client.InputWorker, client.OutputWorker); err != nil {
+		t.Fatal(err)
+	}
+	deliveries := consume(t, &io)
+
+	// The controllers keep copies, any of them may be closed
+	copied := io
+	copied.Close()
+	io.Close()
+	select {
+	case _, ok := <-deliveries:
+		if ok {
+			t.Error("expected no message after closing")
+		}
+	case <-time.After(time.Second):
+		t.Error("the deliveries weren't closed")
+	}
+}
@@ -0,0 +1,23 @@
+package client
+
+import (
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/env"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
+)
+
+// RejectedOutput is the output the records that don't pass a filter go
+// to, it's configured by the variables prefixed with REJECTED_. The
+// coordinator writes the ENDs there too.
+const RejectedOutput = "rejected"
+
+const OutputTypeEnv = "OUTPUT_TYPE"
+
+// GetRejectedOutputType returns the type of the rejected output set in
+// REJECTED_OUTPUT_TYPE, NoneOutput if the rejected records are dropped
+func GetRejectedOutputType() (OutputType, error) {
+	value, err := utils.GetFromEnv(env.Named(RejectedOutput, OutputTypeEnv))
+	if err != nil {
+		return NoneOutput, nil
+	}
+	return ParseOutputType(*value)
+}
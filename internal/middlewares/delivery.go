@@ -0,0 +1,40 @@
+// Package middlewares holds what every transport of the middleware
+// shares, so the nodes don't depend on the broker they run on.
+package middlewares
+
+// Headers of a message, the values are the ones AMQP can carry
+type Headers map[string]any
+
+// Acknowledger settles a delivery on the transport it came from
+type Acknowledger interface {
+	// Ack marks the message as processed
+	Ack() error
+	// Nack rejects the message for good, the input moves it to its
+	// dead letter queue. rabbitmq.Retrier parks it with the reason of
+	// the failure instead.
+	Nack() error
+	// Requeue gives the message back to be delivered again
+	Requeue() error
+}
+
+// Delivery is a message received from an input. It must be settled
+// exactly once with Ack, Nack or Requeue.
+type Delivery struct {
+	Body        []byte
+	Headers     Headers
+	Redelivered bool
+
+	Acknowledger Acknowledger
+}
+
+func (d Delivery) Ack() error {
+	return d.Acknowledger.Ack()
+}
+
+func (d Delivery) Nack() error {
+	return d.Acknowledger.Nack()
+}
+
+func (d Delivery) Requeue() error {
+	return d.Acknowledger.Requeue()
+}
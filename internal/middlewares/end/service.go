@@ -4,17 +4,27 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"sync"
 
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/env"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/memory"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
 )
 
 type Service struct {
-	fanoutPub          *rabbitmq.FanoutPublisher
-	fanoutSub          *rabbitmq.FanoutSubscriber
-	coordinator        *rabbitmq.WorkerQueue
+	// mutex serializes the writes of Send and Run
+	mutex       sync.Mutex
+	conn        *rabbitmq.Connection
+	fanoutPub   rabbitmq.OutputHandler
+	fanoutSub   subscriber
+	coordinator rabbitmq.OutputHandler
+}
+
+type subscriber interface {
+	rabbitmq.InputHandler
+	rabbitmq.Retrier
 }
 
 type ServiceOptions struct {
@@ -48,7 +58,7 @@ func GetServiceOptionsFromEnv() (*ServiceOptions, error) {
 		return nil, fmt.Errorf(
 			"environment variable %s must be a positive integer: %d",
 			"END_SERVICE_TIMEOUT",
-			timeout,
+			*timeout,
 		)
 	}
 
@@ -61,40 +71,59 @@ func GetServiceOptionsFromEnv() (*ServiceOptions, error) {
 }
 
 func NewService(opts *ServiceOptions) (*Service, error) {
-	conn, err := env.GetConnection()
+	broker, err := env.GetBroker()
 	if err != nil {
 		return nil, err
 	}
 
-	coordinator := rabbitmq.NewWorkerQueue(rabbitmq.WorkerQueueConfig{
+	coordinatorConfig := rabbitmq.WorkerQueueConfig{
 		Name:          opts.CoordinatorQueue,
 		Timeout:       opts.Timeout,
 		PrefetchCount: 1,
-	})
+	}
+	fanoutPubConfig := rabbitmq.FanoutPublisherConfig{
+		Exchange: opts.Exchange,
+		Timeout:  opts.Timeout,
+	}
+	fanoutSubConfig := rabbitmq.FanoutSubscriberConfig{
+		Exchange: opts.Exchange,
+		Queue:    opts.SubscriberQueue,
+	}
+
+	var conn *rabbitmq.Connection
+	var coordinator, fanoutPub rabbitmq.OutputHandler
+	var fanoutSub subscriber
+	if broker == env.MemoryBroker {
+		coordinator = memory.NewWorkerQueue(memory.Default(), coordinatorConfig)
+		fanoutPub = memory.NewFanoutPublisher(memory.Default(), fanoutPubConfig)
+		fanoutSub = memory.NewFanoutSubscriber(memory.Default(), fanoutSubConfig)
+	} else {
+		conn, err = env.GetConnection()
+		if err != nil {
+			return nil, err
+		}
+		coordinator = rabbitmq.NewWorkerQueue(coordinatorConfig)
+		fanoutPub = rabbitmq.NewFanoutPublisher(fanoutPubConfig)
+		fanoutSub = rabbitmq.NewFanoutSubscriber(fanoutSubConfig)
+	}
+
 	if err := coordinator.Connect(conn); err != nil {
 		return nil, fmt.Errorf("end service: couldn't create coordinator queue: %w", err)
 	}
 
-	fanoutPub := rabbitmq.NewFanoutPublisher(rabbitmq.FanoutPublisherConfig{
-		Exchange: opts.Exchange,
-		Timeout:  opts.Timeout,
-	})
 	if err := fanoutPub.Connect(conn); err != nil {
 		return nil, fmt.Errorf("end service: couldn't create fanout publisher queue: %w", err)
 	}
 
-	fanoutSub := rabbitmq.NewFanoutSubscriber(rabbitmq.FanoutSubscriberConfig{
-		Exchange: opts.Exchange,
-		Queue:    opts.SubscriberQueue,
-	})
 	if err := fanoutSub.Connect(conn); err != nil {
 		return nil, fmt.Errorf("end service: couldn't create fanout subscriber queue: %w", err)
 	}
 
 	return &Service{
-		fanoutPub:          fanoutPub,
-		fanoutSub:          fanoutSub,
-		coordinator:        coordinator,
+		conn:        conn,
+		fanoutPub:   fanoutPub,
+		fanoutSub:   fanoutSub,
+		coordinator: coordinator,
 	}, nil
 }
 
@@ -102,43 +131,85 @@ func (s *Service) Destroy() {
 	s.fanoutPub.Close()
 	s.fanoutSub.Close()
 	s.coordinator.Close()
+	if s.conn != nil {
+		s.conn.Close()
+	}
 }
 
-func (s *Service) Run(ctx context.Context) (chan<- protocol.Message, <-chan struct{}) {
-	tx := make(chan protocol.Message, 1)
+// Send passes an END on to the other replicas of the node, or a CANCEL
+// to the coordinator. It returns once the broker confirmed it, so the
+// message it was derived from can be acknowledged.
+func (s *Service) Send(msg protocol.Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if msg.ExpectKind(protocol.Cancel) {
+		// Only the coordinator keeps END counts, my brothers have
+		// nothing to drop
+		if err := s.coordinator.Write(msg.Marshal(), ""); err != nil {
+			return fmt.Errorf("end service: couldn't send cancel to the coordinator: %w", err)
+		}
+		return nil
+	}
+	utils.Assert(msg.ExpectKind(protocol.End), "must be an END message")
+	utils.Assert(msg.HasGameData() || msg.HasReviewData(), "unreachable")
+
+	if err := s.fanoutPub.Write(msg.Marshal(), ""); err != nil {
+		return fmt.Errorf("end service: couldn't send end: %w", err)
+	}
+	return nil
+}
+
+// Run tells the coordinator about the ENDs the replicas of the node send,
+// rx gets a value for each of them
+func (s *Service) Run(ctx context.Context) (<-chan struct{}, error) {
+	consumerCh, err := s.fanoutSub.GetConsumer()
+	if err != nil {
+		return nil, fmt.Errorf("end service: couldn't consume ends: %w", err)
+	}
 	rx := make(chan struct{}, 1)
 	go func() {
-		consumerCh := s.fanoutSub.GetConsumer()
 		for {
 			select {
-			// FROM THE QUEUE
-			case msg := <-tx:
-				utils.Assert(msg.ExpectKind(protocol.End), "must be an END message")
-				utils.Assert(msg.HasGameData() || msg.HasReviewData(), "unreachable")
-
-				marshaledMsg := msg.Marshal()
-				s.fanoutPub.Write(marshaledMsg, "")
 			// FROM MY BROTHERS
 			// NEED SOME OATS BROTHER
 			case delivery := <-consumerCh:
 				msgBytes := delivery.Body
 				var msg protocol.Message
-				if err := msg.Unmarshal(msgBytes); err != nil {
+				err := msg.Unmarshal(msgBytes)
+				if err == nil && !msg.ExpectKind(protocol.End) {
+					err = fmt.Errorf("expected an END, got a %s", msg.GetMessageType())
+				}
+				if err != nil {
 					slog.Error("couldn't unmarshal message", "error", err)
+					// A malformed END never gets better, it's
+					// parked right away
+					if err := s.fanoutSub.Park(delivery, rabbitmq.RetryHeaders(delivery, 0, err)); err != nil {
+						slog.Error("couldn't reject message", "error", err)
+					}
 					continue
 				}
-				utils.Assert(msg.ExpectKind(protocol.End), "must be an END message")
 				// Notify I received END
-				s.coordinator.Write(msg.Marshal(), "")
+				s.mutex.Lock()
+				err = s.coordinator.Write(msg.Marshal(), "")
+				s.mutex.Unlock()
+				if err != nil {
+					// The END comes back and the coordinator is
+					// told again
+					slog.Error("couldn't send end to the coordinator", "error", err)
+					if err := delivery.Requeue(); err != nil {
+						slog.Error("couldn't requeue end", "error", err)
+					}
+					continue
+				}
 				// Notify that I received an END
 				rx <- struct{}{}
 				// Acknowledge
-				delivery.Ack(false)
+				delivery.Ack()
 			case <-ctx.Done():
 				slog.Error("context error", "error", ctx.Err())
 				return
 			}
 		}
 	}()
-	return tx, rx
+	return rx, nil
 }
@@ -1,6 +1,9 @@
 package env
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
 )
@@ -39,3 +42,36 @@ func GetConnection() (*rabbitmq.Connection, error) {
 
 	return &connection, nil
 }
+
+const MiddlewareBroker = "MIDDLEWARE_BROKER"
+
+// Brokers the middleware can run on
+const (
+	RabbitMQBroker = "rabbitmq"
+	MemoryBroker   = "memory"
+)
+
+// GetBroker returns which broker the nodes talk to, it defaults to
+// RabbitMQ. The in-memory one only reaches nodes of the same process.
+func GetBroker() (string, error) {
+	if _, ok := os.LookupEnv(MiddlewareBroker); !ok {
+		return RabbitMQBroker, nil
+	}
+
+	broker, err := utils.GetFromEnv(MiddlewareBroker)
+	if err != nil {
+		return "", err
+	}
+	switch *broker {
+	case RabbitMQBroker, MemoryBroker:
+		return *broker, nil
+	default:
+		return "", fmt.Errorf(
+			"environment variable %s must be %s or %s: %s",
+			MiddlewareBroker,
+			RabbitMQBroker,
+			MemoryBroker,
+			*broker,
+		)
+	}
+}
@@ -10,21 +10,21 @@ import (
 const FanoutPublisherExchange = "FANOUT_PUBLISHER_EXCHANGE"
 const FanoutPublisherTimeout = "FANOUT_PUBLISHER_TIMEOUT"
 
-func GetFanoutPublisherConfig() (*rabbitmq.FanoutPublisherConfig, error) {
-	exchange, err := utils.GetFromEnv(FanoutPublisherExchange)
+func GetFanoutPublisherConfig(name string) (*rabbitmq.FanoutPublisherConfig, error) {
+	exchange, err := utils.GetFromEnv(Named(name, FanoutPublisherExchange))
 	if err != nil {
 		return nil, err
 	}
 
-	timeout, err := utils.GetFromEnvUint(FanoutPublisherTimeout)
+	timeout, err := utils.GetFromEnvUint(Named(name, FanoutPublisherTimeout))
 	if err != nil {
 		return nil, err
 	}
 	if *timeout <= 0 {
 		return nil, fmt.Errorf(
 			"environment variable %s must be a positive integer: %d",
-			FanoutPublisherTimeout,
-			timeout,
+			Named(name, FanoutPublisherTimeout),
+			*timeout,
 		)
 	}
 
@@ -37,19 +37,25 @@ func GetFanoutPublisherConfig() (*rabbitmq.FanoutPublisherConfig, error) {
 const FanoutSubscriberExchange = "FANOUT_SUBSCRIBER_EXCHANGE"
 const FanoutSubscriberQueueName = "FANOUT_SUBSCRIBER_QUEUE_NAME"
 
-func GetFanoutSubscriberConfig() (*rabbitmq.FanoutSubscriberConfig, error) {
-	exchange, err := utils.GetFromEnv(FanoutSubscriberExchange)
+func GetFanoutSubscriberConfig(name string) (*rabbitmq.FanoutSubscriberConfig, error) {
+	exchange, err := utils.GetFromEnv(Named(name, FanoutSubscriberExchange))
 	if err != nil {
 		return nil, err
 	}
 
-	name, err := utils.GetFromEnv(FanoutSubscriberQueueName)
+	queue, err := utils.GetFromEnv(Named(name, FanoutSubscriberQueueName))
+	if err != nil {
+		return nil, err
+	}
+
+	maxRetries, err := getMaxRetries()
 	if err != nil {
 		return nil, err
 	}
 
 	return &rabbitmq.FanoutSubscriberConfig{
-		Exchange: *exchange,
-		Queue:    *name,
+		Exchange:   *exchange,
+		Queue:      *queue,
+		MaxRetries: maxRetries,
 	}, nil
 }
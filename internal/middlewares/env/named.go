@@ -0,0 +1,14 @@
+package env
+
+import "strings"
+
+// Named returns the variable configuring the input or output called
+// name of an IOManager. The variables of the unnamed ones have no
+// prefix, the ones of an output called rejected look like
+// REJECTED_DIRECT_PUBLISHER_EXCHANGE.
+func Named(name string, variable string) string {
+	if name == "" {
+		return variable
+	}
+	return strings.ToUpper(name) + "_" + variable
+}
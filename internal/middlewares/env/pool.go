@@ -0,0 +1,32 @@
+package env
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
+)
+
+const WorkerPoolSize = "WORKER_POOL_SIZE"
+
+// GetWorkerPoolSize returns how many deliveries a node processes at the
+// same time, one when WORKER_POOL_SIZE isn't set. The prefetch count of
+// the inputs must be at least as large or the workers starve.
+func GetWorkerPoolSize() (int, error) {
+	if _, ok := os.LookupEnv(WorkerPoolSize); !ok {
+		return 1, nil
+	}
+
+	size, err := utils.GetFromEnvInt(WorkerPoolSize)
+	if err != nil {
+		return 0, err
+	}
+	if *size <= 0 {
+		return 0, fmt.Errorf(
+			"environment variable %s must be a positive integer: %d",
+			WorkerPoolSize,
+			*size,
+		)
+	}
+	return int(*size), nil
+}
@@ -12,21 +12,21 @@ import (
 const DirectPublisherExchange = "DIRECT_PUBLISHER_EXCHANGE"
 const DirectPublisherTimeout = "DIRECT_PUBLISHER_TIMEOUT"
 
-func GetDirectPublisherConfig() (*rabbitmq.DirectPublisherConfig, error) {
-	exchange, err := utils.GetFromEnv(DirectPublisherExchange)
+func GetDirectPublisherConfig(name string) (*rabbitmq.DirectPublisherConfig, error) {
+	exchange, err := utils.GetFromEnv(Named(name, DirectPublisherExchange))
 	if err != nil {
 		return nil, err
 	}
 
-	timeout, err := utils.GetFromEnvUint(DirectPublisherTimeout)
+	timeout, err := utils.GetFromEnvUint(Named(name, DirectPublisherTimeout))
 	if err != nil {
 		return nil, err
 	}
 	if *timeout <= 0 {
 		return nil, fmt.Errorf(
 			"environment variable %s must be a positive integer: %d",
-			DirectPublisherTimeout,
-			timeout,
+			Named(name, DirectPublisherTimeout),
+			*timeout,
 		)
 	}
 
@@ -41,24 +41,24 @@ const DirectSubscriberQueue = "DIRECT_SUBSCRIBER_QUEUE"
 const DirectSubscriberKeys = "DIRECT_SUBSCRIBER_KEYS"
 const DirectSubscriberPrefetchCount = "DIRECT_SUBSCRIBER_PREFETCH_COUNT"
 
-func GetDirectSubscriberConfig() (*rabbitmq.DirectSubscriberConfig, error) {
-	exchange, err := utils.GetFromEnv(DirectSubscriberExchange)
+func GetDirectSubscriberConfig(name string) (*rabbitmq.DirectSubscriberConfig, error) {
+	exchange, err := utils.GetFromEnv(Named(name, DirectSubscriberExchange))
 	if err != nil {
 		return nil, err
 	}
 
-	queue, err := utils.GetFromEnv(DirectSubscriberQueue)
+	queue, err := utils.GetFromEnv(Named(name, DirectSubscriberQueue))
 	if err != nil {
 		return nil, err
 	}
 
-	keys, err := utils.GetFromEnv(DirectSubscriberKeys)
+	keys, err := utils.GetFromEnv(Named(name, DirectSubscriberKeys))
 	if err != nil {
 		return nil, err
 	}
 
 	finalPrefetchCount := -1
-	prefetchCount, err := utils.GetFromEnvInt(DirectSubscriberPrefetchCount)
+	prefetchCount, err := utils.GetFromEnvInt(Named(name, DirectSubscriberPrefetchCount))
 	if err != nil {
 		slog.Info("No prefetch count specified")
 	} else {
@@ -67,10 +67,16 @@ func GetDirectSubscriberConfig() (*rabbitmq.DirectSubscriberConfig, error) {
 
 	exchangeList := strings.Split(*exchange, ",")
 	keysList := strings.Split(*keys, ",")
+	maxRetries, err := getMaxRetries()
+	if err != nil {
+		return nil, err
+	}
+
 	return &rabbitmq.DirectSubscriberConfig{
 		Exchange:      exchangeList,
 		Queue:         *queue,
 		Keys:          keysList,
 		PrefetchCount: finalPrefetchCount,
+		MaxRetries:    maxRetries,
 	}, nil
 }
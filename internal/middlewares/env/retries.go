@@ -0,0 +1,32 @@
+package env
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
+)
+
+const InputMaxRetries = "INPUT_MAX_RETRIES"
+
+// getMaxRetries reads how many times an input message is retried before
+// it's dead lettered, it defaults to rabbitmq.DefaultMaxRetries
+func getMaxRetries() (int, error) {
+	if _, ok := os.LookupEnv(InputMaxRetries); !ok {
+		return rabbitmq.DefaultMaxRetries, nil
+	}
+
+	maxRetries, err := utils.GetFromEnvInt(InputMaxRetries)
+	if err != nil {
+		return 0, err
+	}
+	if *maxRetries <= 0 {
+		return 0, fmt.Errorf(
+			"environment variable %s must be a positive integer: %d",
+			InputMaxRetries,
+			*maxRetries,
+		)
+	}
+	return int(*maxRetries), nil
+}
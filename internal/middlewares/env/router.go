@@ -1,16 +1,33 @@
 package env
 
 import (
+	"fmt"
+	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
 )
 
 const OutputRouterTags = "OUTPUT_ROUTER_TAGS"
+const IsProjection = "IS_PROJECTION"
+const RouterControlExchange = "ROUTER_CONTROL_EXCHANGE"
 
-func GetRouterTags() ([]string, error) {
-	tags, err := utils.GetFromEnv(OutputRouterTags)
+const DefaultRouterControlExchange = "router-control"
+
+// routerControlTimeout is how many seconds publishing a router update
+// waits for the broker to confirm it
+const routerControlTimeout = 5
+
+// routerControlMarkers numbers the routers of a process, every router
+// needs its own marker
+var routerControlMarkers atomic.Uint32
+
+func GetRouterTags(name string) ([]string, error) {
+	tags, err := utils.GetFromEnv(Named(name, OutputRouterTags))
 	if err != nil {
 		return nil, err
 	}
@@ -19,10 +36,38 @@ func GetRouterTags() ([]string, error) {
 	return tagsList, nil
 }
 
-func GetIsProjection() (bool, error) {
-	isProjectionStr, err := utils.GetFromEnv("IS_PROJECTION")
+func GetIsProjection(name string) (bool, error) {
+	isProjectionStr, err := utils.GetFromEnv(Named(name, IsProjection))
 	if err != nil {
 		return false, err
 	}
 	return strconv.ParseBool(*isProjectionStr)
 }
+
+// GetRouterControlConfig returns the log where rescaling updates are
+// published. It's kept in a stream, so routers that start after an
+// update still read it.
+func GetRouterControlConfig() (*rabbitmq.ControlStreamConfig, error) {
+	exchange := DefaultRouterControlExchange
+	if _, ok := os.LookupEnv(RouterControlExchange); ok {
+		value, err := utils.GetFromEnv(RouterControlExchange)
+		if err != nil {
+			return nil, err
+		}
+		exchange = *value
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't name router control marker: %w", err)
+	}
+	// The pid and hostname repeat when a container restarts, the start
+	// time tells apart the markers of both runs
+	marker := fmt.Sprintf("%s.%s.%d.%d.%d", exchange, hostname, os.Getpid(), routerControlMarkers.Add(1), time.Now().UnixNano())
+	return &rabbitmq.ControlStreamConfig{
+		Exchange: exchange,
+		Stream:   exchange + ".history",
+		Marker:   marker,
+		Timeout:  routerControlTimeout,
+	}, nil
+}
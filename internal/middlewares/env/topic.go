@@ -0,0 +1,80 @@
+package env
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
+)
+
+const TopicPublisherExchange = "TOPIC_PUBLISHER_EXCHANGE"
+const TopicPublisherTimeout = "TOPIC_PUBLISHER_TIMEOUT"
+
+func GetTopicPublisherConfig(name string) (*rabbitmq.TopicPublisherConfig, error) {
+	exchange, err := utils.GetFromEnv(Named(name, TopicPublisherExchange))
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, err := utils.GetFromEnvUint(Named(name, TopicPublisherTimeout))
+	if err != nil {
+		return nil, err
+	}
+	if *timeout <= 0 {
+		return nil, fmt.Errorf(
+			"environment variable %s must be a positive integer: %d",
+			Named(name, TopicPublisherTimeout),
+			*timeout,
+		)
+	}
+
+	return &rabbitmq.TopicPublisherConfig{
+		Exchange: *exchange,
+		Timeout:  uint8(*timeout),
+	}, nil
+}
+
+const TopicSubscriberExchange = "TOPIC_SUBSCRIBER_EXCHANGES"
+const TopicSubscriberQueue = "TOPIC_SUBSCRIBER_QUEUE"
+const TopicSubscriberPatterns = "TOPIC_SUBSCRIBER_PATTERNS"
+const TopicSubscriberPrefetchCount = "TOPIC_SUBSCRIBER_PREFETCH_COUNT"
+
+func GetTopicSubscriberConfig(name string) (*rabbitmq.TopicSubscriberConfig, error) {
+	exchange, err := utils.GetFromEnv(Named(name, TopicSubscriberExchange))
+	if err != nil {
+		return nil, err
+	}
+
+	queue, err := utils.GetFromEnv(Named(name, TopicSubscriberQueue))
+	if err != nil {
+		return nil, err
+	}
+
+	patterns, err := utils.GetFromEnv(Named(name, TopicSubscriberPatterns))
+	if err != nil {
+		return nil, err
+	}
+
+	finalPrefetchCount := -1
+	prefetchCount, err := utils.GetFromEnvInt(Named(name, TopicSubscriberPrefetchCount))
+	if err != nil {
+		slog.Info("No prefetch count specified")
+	} else {
+		finalPrefetchCount = int(*prefetchCount)
+	}
+
+	maxRetries, err := getMaxRetries()
+	if err != nil {
+		return nil, err
+	}
+
+	return &rabbitmq.TopicSubscriberConfig{
+		Exchange:      strings.Split(*exchange, ","),
+		Queue:         *queue,
+		Patterns:      strings.Split(*patterns, ","),
+		PrefetchCount: finalPrefetchCount,
+		MaxRetries:    maxRetries,
+	}, nil
+}
@@ -11,13 +11,13 @@ const InputWorkerQueueName = "INPUT_WORKER_QUEUE"
 const InputWorkerQueueTimeout = "INPUT_WORKER_QUEUE_TIMEOUT"
 const InputWorkerQueueCount = "INPUT_WORKER_QUEUE_COUNT"
 
-func GetInputWorkerQueueConfig() (*rabbitmq.WorkerQueueConfig, error) {
-	name, err := utils.GetFromEnv(InputWorkerQueueName)
+func GetInputWorkerQueueConfig(name string) (*rabbitmq.WorkerQueueConfig, error) {
+	queue, err := utils.GetFromEnv(Named(name, InputWorkerQueueName))
 	if err != nil {
 		return nil, err
 	}
 
-	timeout, err := utils.GetFromEnvUint(InputWorkerQueueTimeout)
+	timeout, err := utils.GetFromEnvUint(Named(name, InputWorkerQueueTimeout))
 	if err != nil {
 		return nil, err
 	}
@@ -25,27 +25,33 @@ func GetInputWorkerQueueConfig() (*rabbitmq.WorkerQueueConfig, error) {
 	if *timeout <= 0 {
 		return nil, fmt.Errorf(
 			"environment variable %s must be a positive integer: %d",
-			InputWorkerQueueTimeout,
-			timeout,
+			Named(name, InputWorkerQueueTimeout),
+			*timeout,
 		)
 	}
 
-	count, err := utils.GetFromEnvInt(InputWorkerQueueCount)
+	count, err := utils.GetFromEnvInt(Named(name, InputWorkerQueueCount))
 	if err != nil {
 		return nil, err
 	}
 	if *count <= 0 {
 		return nil, fmt.Errorf(
 			"environment variable %s must be a positive integer: %d",
-			InputWorkerQueueCount,
-			count,
+			Named(name, InputWorkerQueueCount),
+			*count,
 		)
 	}
 
+	maxRetries, err := getMaxRetries()
+	if err != nil {
+		return nil, err
+	}
+
 	return &rabbitmq.WorkerQueueConfig{
-		Name:          *name,
+		Name:          *queue,
 		Timeout:       uint8(*timeout),
 		PrefetchCount: int(*count),
+		MaxRetries:    maxRetries,
 	}, nil
 }
 
@@ -53,38 +59,38 @@ const OutputWorkerQueueName = "OUTPUT_WORKER_QUEUE"
 const OutputWorkerQueueTimeout = "OUTPUT_WORKER_QUEUE_TIMEOUT"
 const OutputWorkerQueueCount = "OUTPUT_WORKER_QUEUE_COUNT"
 
-func GetOutputWorkerQueueConfig() (*rabbitmq.WorkerQueueConfig, error) {
-	name, err := utils.GetFromEnv(OutputWorkerQueueName)
+func GetOutputWorkerQueueConfig(name string) (*rabbitmq.WorkerQueueConfig, error) {
+	queue, err := utils.GetFromEnv(Named(name, OutputWorkerQueueName))
 	if err != nil {
 		return nil, err
 	}
 
-	timeout, err := utils.GetFromEnvUint(OutputWorkerQueueTimeout)
+	timeout, err := utils.GetFromEnvUint(Named(name, OutputWorkerQueueTimeout))
 	if err != nil {
 		return nil, err
 	}
 	if *timeout <= 0 {
 		return nil, fmt.Errorf(
 			"environment variable %s must be a positive integer: %d",
-			OutputWorkerQueueTimeout,
-			timeout,
+			Named(name, OutputWorkerQueueTimeout),
+			*timeout,
 		)
 	}
 
-	count, err := utils.GetFromEnvInt(OutputWorkerQueueCount)
+	count, err := utils.GetFromEnvInt(Named(name, OutputWorkerQueueCount))
 	if err != nil {
 		return nil, err
 	}
 	if *count <= 0 {
 		return nil, fmt.Errorf(
 			"environment variable %s must be a positive integer: %d",
-			OutputWorkerQueueCount,
-			count,
+			Named(name, OutputWorkerQueueCount),
+			*count,
 		)
 	}
 
 	return &rabbitmq.WorkerQueueConfig{
-		Name:          *name,
+		Name:          *queue,
 		Timeout:       uint8(*timeout),
 		PrefetchCount: int(*count),
 	}, nil
@@ -0,0 +1,513 @@
+// Package memory is an in-process broker with the semantics of the
+// RabbitMQ topology the nodes use: worker queues, streams, fanout and
+// direct exchanges, acknowledgements and redelivery. It lets the nodes run
+// without a live broker, mostly for tests.
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
+)
+
+var ErrUnknownExchange = errors.New("exchange wasn't declared")
+var ErrExchangeKind = errors.New("exchange was declared with another kind")
+var ErrUnknownDelivery = errors.New("delivery isn't waiting for an acknowledgement")
+
+const (
+	fanout = "fanout"
+	direct = "direct"
+	topic  = "topic"
+)
+
+type Broker struct {
+	mutex     sync.Mutex
+	queues    map[string]*queue
+	streams   map[string]*stream
+	exchanges map[string]*exchange
+}
+
+// target is where an exchange routes messages, a queue or a stream
+type target interface {
+	push(msg message)
+}
+
+type exchange struct {
+	kind     string
+	bindings []binding
+}
+
+type binding struct {
+	queue string
+	key   string
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		queues:    make(map[string]*queue),
+		streams:   make(map[string]*stream),
+		exchanges: make(map[string]*exchange),
+	}
+}
+
+var defaultBroker = sync.OnceValue(NewBroker)
+
+// Default is the broker shared by every handler of the process that
+// wasn't given one
+func Default() *Broker {
+	return defaultBroker()
+}
+
+// declareQueue returns the queue called name, it's created the first
+// time it's declared
+func (b *Broker) declareQueue(name string) *queue {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		q = newQueue(name)
+		b.queues[name] = q
+	}
+	return q
+}
+
+// declareInput returns the queue called name like declareQueue, the
+// messages rejected from it are moved to its dead letter queue as RabbitMQ
+// does with the dead letter exchange of the queues the inputs declare
+func (b *Broker) declareInput(name string) *queue {
+	dlq := b.declareQueue(rabbitmq.DeadLetterQueue(name))
+	q := b.declareQueue(name)
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.deadLetter = dlq
+	return q
+}
+
+// declareStream returns the stream called name, it's created the first
+// time it's declared
+func (b *Broker) declareStream(name string) *stream {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	s, ok := b.streams[name]
+	if !ok {
+		s = newStream()
+		b.streams[name] = s
+	}
+	return s
+}
+
+// targetOf must be called with the mutex held
+func (b *Broker) targetOf(name string) (target, bool) {
+	if q, ok := b.queues[name]; ok {
+		return q, true
+	}
+	if s, ok := b.streams[name]; ok {
+		return s, true
+	}
+	return nil, false
+}
+
+func (b *Broker) declareExchange(name string, kind string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	e, ok := b.exchanges[name]
+	if !ok {
+		b.exchanges[name] = &exchange{kind: kind}
+		return nil
+	}
+	if e.kind != kind {
+		return fmt.Errorf("%w: %s is %s", ErrExchangeKind, name, e.kind)
+	}
+	return nil
+}
+
+func (b *Broker) bind(queue string, key string, exchange string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownExchange, exchange)
+	}
+	bind := binding{queue: queue, key: key}
+	if !slices.Contains(e.bindings, bind) {
+		e.bindings = append(e.bindings, bind)
+	}
+	return nil
+}
+
+// publish routes msg to the queues bound to exchange with key, the
+// default exchange "" routes it to the queue called key. Like in
+// RabbitMQ a message that matches no queue is dropped.
+func (b *Broker) publish(exchange string, key string, msg message) error {
+	b.mutex.Lock()
+	var targets []target
+	if exchange == "" {
+		if t, ok := b.targetOf(key); ok {
+			targets = append(targets, t)
+		}
+	} else {
+		e, ok := b.exchanges[exchange]
+		if !ok {
+			b.mutex.Unlock()
+			return fmt.Errorf("%w: %s", ErrUnknownExchange, exchange)
+		}
+		for _, bind := range e.bindings {
+			if !matches(e.kind, bind.key, key) {
+				continue
+			}
+			if t, ok := b.targetOf(bind.queue); ok {
+				targets = append(targets, t)
+			}
+		}
+	}
+	b.mutex.Unlock()
+
+	msg.exchange = exchange
+	msg.key = key
+	for _, t := range targets {
+		t.push(msg)
+	}
+	return nil
+}
+
+// matches reports whether a binding of an exchange of kind routes key
+func matches(kind string, binding string, key string) bool {
+	switch kind {
+	case fanout:
+		return true
+	case topic:
+		return topicMatches(strings.Split(binding, "."), strings.Split(key, "."))
+	default:
+		return binding == key
+	}
+}
+
+// topicMatches follows the AMQP topic rules: * stands for exactly one
+// word and # for zero or more
+func topicMatches(pattern []string, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for skip := 0; skip <= len(words); skip++ {
+			if topicMatches(pattern[1:], words[skip:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+	}
+}
+
+// Depth returns how many messages of the queue weren't delivered yet
+func (b *Broker) Depth(queue string) int {
+	b.mutex.Lock()
+	q, ok := b.queues[queue]
+	b.mutex.Unlock()
+	if !ok {
+		return 0
+	}
+	return q.depth()
+}
+
+type message struct {
+	body        []byte
+	headers     middlewares.Headers
+	exchange    string
+	key         string
+	redelivered bool
+}
+
+type unacked struct {
+	msg      message
+	consumer *consumer
+}
+
+// queue keeps its messages until a consumer acknowledges them, the ones
+// that are rejected with requeue or whose consumer goes away are
+// delivered again
+type queue struct {
+	name string
+
+	mutex   sync.Mutex
+	ready   []message
+	unacked map[uint64]unacked
+	nextTag uint64
+	// notify is closed and replaced every time a message is ready
+	notify chan struct{}
+	// deadLetter gets the messages rejected without requeue, they're
+	// dropped if it's nil
+	deadLetter *queue
+}
+
+func newQueue(name string) *queue {
+	return &queue{
+		name:    name,
+		unacked: make(map[uint64]unacked),
+		notify:  make(chan struct{}),
+	}
+}
+
+func (q *queue) push(msg message) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.ready = append(q.ready, msg)
+	q.wakeUp()
+}
+
+// wakeUp must be called with the mutex held
+func (q *queue) wakeUp() {
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// requeue must be called with the mutex held, the message goes back to
+// the front of the queue as it was the oldest
+func (q *queue) requeue(tag uint64) {
+	u, ok := q.unacked[tag]
+	if !ok {
+		return
+	}
+	delete(q.unacked, tag)
+	u.msg.redelivered = true
+	q.ready = slices.Insert(q.ready, 0, u.msg)
+	q.wakeUp()
+}
+
+func (q *queue) depth() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.ready)
+}
+
+func (q *queue) settle(tag uint64, requeue bool) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.unacked[tag]; !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownDelivery, tag)
+	}
+	if requeue {
+		q.requeue(tag)
+	} else {
+		delete(q.unacked, tag)
+	}
+	return nil
+}
+
+// reject removes the message and moves it to the dead letter queue
+func (q *queue) reject(tag uint64) error {
+	q.mutex.Lock()
+	u, ok := q.unacked[tag]
+	if !ok {
+		q.mutex.Unlock()
+		return fmt.Errorf("%w: %d", ErrUnknownDelivery, tag)
+	}
+	delete(q.unacked, tag)
+	deadLetter := q.deadLetter
+	q.mutex.Unlock()
+
+	if deadLetter != nil {
+		u.msg.redelivered = false
+		deadLetter.push(u.msg)
+	}
+	return nil
+}
+
+type acknowledger struct {
+	q   *queue
+	tag uint64
+}
+
+func (a acknowledger) Ack() error {
+	return a.q.settle(a.tag, false)
+}
+
+// Nack moves the message to the dead letter queue of the input, the
+// queues without one drop it
+func (a acknowledger) Nack() error {
+	return a.q.reject(a.tag)
+}
+
+func (a acknowledger) Requeue() error {
+	return a.q.settle(a.tag, true)
+}
+
+type consumer struct {
+	q      *queue
+	out    chan middlewares.Delivery
+	closed chan struct{}
+	// cancelled is set under the queue mutex, so no message is taken
+	// from the queue after close returns
+	cancelled bool
+	closeOnce sync.Once
+}
+
+// consume starts delivering the messages of the queue, several consumers
+// of the same queue share its messages
+func (q *queue) consume() *consumer {
+	c := &consumer{
+		q:      q,
+		out:    make(chan middlewares.Delivery),
+		closed: make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *consumer) run() {
+	defer close(c.out)
+	for {
+		delivery, tag, notify, ok := c.next()
+		if !ok {
+			return
+		}
+		if notify != nil {
+			select {
+			case <-notify:
+			case <-c.closed:
+				return
+			}
+			continue
+		}
+
+		select {
+		case c.out <- delivery:
+		case <-c.closed:
+			c.q.mutex.Lock()
+			c.q.requeue(tag)
+			c.q.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// next takes the oldest message of the queue, if there is none it
+// returns a channel that is closed once there is one
+func (c *consumer) next() (middlewares.Delivery, uint64, <-chan struct{}, bool) {
+	q := c.q
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if c.cancelled {
+		return middlewares.Delivery{}, 0, nil, false
+	}
+	if len(q.ready) == 0 {
+		return middlewares.Delivery{}, 0, q.notify, true
+	}
+
+	msg := q.ready[0]
+	q.ready = q.ready[1:]
+	q.nextTag++
+	q.unacked[q.nextTag] = unacked{msg: msg, consumer: c}
+	return middlewares.Delivery{
+		Body:         msg.body,
+		Headers:      msg.headers,
+		Redelivered:  msg.redelivered,
+		Acknowledger: acknowledger{q: q, tag: q.nextTag},
+	}, q.nextTag, nil, true
+}
+
+// close stops the consumer, the messages it didn't acknowledge are
+// delivered again to the other consumers
+func (c *consumer) close() {
+	c.closeOnce.Do(func() {
+		q := c.q
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		c.cancelled = true
+		close(c.closed)
+
+		var tags []uint64
+		for tag, u := range q.unacked {
+			if u.consumer == c {
+				tags = append(tags, tag)
+			}
+		}
+		slices.Sort(tags)
+		slices.Reverse(tags)
+		for _, tag := range tags {
+			q.requeue(tag)
+		}
+	})
+}
+
+// stream keeps every message it's given, each consumer reads all of them
+// from the first one. Acknowledging a message doesn't remove it.
+type stream struct {
+	mutex sync.Mutex
+	log   []message
+	// notify is closed and replaced every time a message is appended
+	notify chan struct{}
+}
+
+func newStream() *stream {
+	return &stream{notify: make(chan struct{})}
+}
+
+func (s *stream) push(msg message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.log = append(s.log, msg)
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// at returns the message at offset, if there is none yet it returns a
+// channel that is closed once there is one
+func (s *stream) at(offset int) (message, <-chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if offset < len(s.log) {
+		return s.log[offset], nil
+	}
+	return message{}, s.notify
+}
+
+// streamAcknowledger settles nothing, the messages of a stream stay in it
+type streamAcknowledger struct{}
+
+func (streamAcknowledger) Ack() error     { return nil }
+func (streamAcknowledger) Nack() error    { return nil }
+func (streamAcknowledger) Requeue() error { return nil }
+
+// read delivers the messages of the stream from the first one until done
+// is closed
+func (s *stream) read(done <-chan struct{}) <-chan middlewares.Delivery {
+	out := make(chan middlewares.Delivery)
+	go func() {
+		defer close(out)
+		for offset := 0; ; {
+			msg, notify := s.at(offset)
+			if notify != nil {
+				select {
+				case <-notify:
+				case <-done:
+					return
+				}
+				continue
+			}
+
+			delivery := middlewares.Delivery{
+				Body:         msg.body,
+				Headers:      msg.headers,
+				Acknowledger: streamAcknowledger{},
+			}
+			select {
+			case out <- delivery:
+				offset++
+			case <-done:
+				return
+			}
+		}
+	}()
+	return out
+}
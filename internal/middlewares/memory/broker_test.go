@@ -0,0 +1,257 @@
+package memory_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/memory"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
+)
+
+func receive(t *testing.T, consumer <-chan middlewares.Delivery) middlewares.Delivery {
+	t.Helper()
+	select {
+	case delivery := <-consumer:
+		return delivery
+	case <-time.After(time.Second):
+		t.Fatal("no message was delivered")
+		return middlewares.Delivery{}
+	}
+}
+
+func consume(t *testing.T, input rabbitmq.InputHandler) <-chan middlewares.Delivery {
+	t.Helper()
+	consumer, err := input.GetConsumer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return consumer
+}
+
+func expectNothing(t *testing.T, consumer <-chan middlewares.Delivery) {
+	t.Helper()
+	select {
+	case delivery := <-consumer:
+		t.Fatalf("unexpected message %q", delivery.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWorkerQueue(t *testing.T) {
+	broker := memory.NewBroker()
+	config := rabbitmq.WorkerQueueConfig{Name: "work"}
+
+	producer := memory.NewWorkerQueue(broker, config)
+	worker := memory.NewWorkerQueue(broker, config)
+	for _, h := range []*memory.WorkerQueue{producer, worker} {
+		if err := h.Connect(nil); err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+	}
+
+	for _, body := range []string{"a", "b"} {
+		if err := producer.Write([]byte(body), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if depth, _ := producer.Depth(); depth != 2 {
+		t.Errorf("expected depth 2, got %d", depth)
+	}
+
+	consumer := consume(t, worker)
+	first := receive(t, consumer)
+	if string(first.Body) != "a" {
+		t.Fatalf("expected a, got %q", first.Body)
+	}
+	if err := first.Requeue(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The consumer may have taken b before a went back to the queue
+	received := map[string]middlewares.Delivery{}
+	for range 2 {
+		delivery := receive(t, consumer)
+		received[string(delivery.Body)] = delivery
+		if err := delivery.Ack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !received["a"].Redelivered || received["b"].Redelivered {
+		t.Errorf("expected only a to be redelivered, got %v", received)
+	}
+	if err := received["a"].Ack(); !errors.Is(err, memory.ErrUnknownDelivery) {
+		t.Errorf("expected a second ack to fail, got %v", err)
+	}
+	expectNothing(t, consumer)
+}
+
+func TestUnackedMessagesGoBackWhenTheConsumerCloses(t *testing.T) {
+	broker := memory.NewBroker()
+	config := rabbitmq.WorkerQueueConfig{Name: "work"}
+
+	crashing := memory.NewWorkerQueue(broker, config)
+	crashing.Connect(nil)
+	crashing.Write([]byte("a"), "")
+	receive(t, consume(t, crashing))
+	crashing.Close()
+
+	worker := memory.NewWorkerQueue(broker, config)
+	worker.Connect(nil)
+	defer worker.Close()
+	delivery := receive(t, consume(t, worker))
+	if string(delivery.Body) != "a" || !delivery.Redelivered {
+		t.Fatalf("expected a redelivered, got %q", delivery.Body)
+	}
+}
+
+func TestFanout(t *testing.T) {
+	broker := memory.NewBroker()
+	publisher := memory.NewFanoutPublisher(broker, rabbitmq.FanoutPublisherConfig{Exchange: "end"})
+	publisher.Connect(nil)
+
+	var consumers []<-chan middlewares.Delivery
+	for _, queue := range []string{"end-1", "end-2"} {
+		subscriber := memory.NewFanoutSubscriber(broker, rabbitmq.FanoutSubscriberConfig{Exchange: "end", Queue: queue})
+		if err := subscriber.Connect(nil); err != nil {
+			t.Fatal(err)
+		}
+		defer subscriber.Close()
+		consumers = append(consumers, consume(t, subscriber))
+	}
+
+	publisher.Write([]byte("end"), "")
+	for _, consumer := range consumers {
+		if delivery := receive(t, consumer); string(delivery.Body) != "end" {
+			t.Errorf("expected end, got %q", delivery.Body)
+		}
+	}
+}
+
+func TestDirect(t *testing.T) {
+	broker := memory.NewBroker()
+	subscriber := memory.NewDirectSubscriber(broker, rabbitmq.DirectSubscriberConfig{
+		Exchange: []string{"games"},
+		Queue:    "joiner-1",
+		Keys:     []string{"1"},
+	})
+	if err := subscriber.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	consumer := consume(t, subscriber)
+
+	router := memory.NewRouter(broker, rabbitmq.DirectPublisherConfig{Exchange: "games"}, []string{"0", "1"}, rabbitmq.GameReviewRouter{})
+	if err := router.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	router.Write([]byte("game"), "game")
+	router.Write([]byte("review"), "review")
+	if delivery := receive(t, consumer); string(delivery.Body) != "review" {
+		t.Errorf("expected review, got %q", delivery.Body)
+	}
+	expectNothing(t, consumer)
+}
+
+func TestRetryAndPark(t *testing.T) {
+	broker := memory.NewBroker()
+	worker := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: "work"})
+	worker.Connect(nil)
+	defer worker.Close()
+	consumer := consume(t, worker)
+
+	worker.Write([]byte("poison"), "")
+	delivery := receive(t, consumer)
+	headers := rabbitmq.RetryHeaders(delivery, 1, errors.New("can't decode"))
+	if err := worker.Retry(delivery, headers); err != nil {
+		t.Fatal(err)
+	}
+
+	delivery = receive(t, consumer)
+	if count := rabbitmq.RetryCount(delivery.Headers); count != 1 {
+		t.Fatalf("expected the retry to carry its count, got %d", count)
+	}
+	if err := worker.Park(delivery, delivery.Headers); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, consumer)
+
+	if depth := broker.Depth(rabbitmq.DeadLetterQueue("work")); depth != 1 {
+		t.Errorf("expected a parked message, got %d", depth)
+	}
+}
+
+func TestNackMovesTheMessageToTheDeadLetterQueue(t *testing.T) {
+	broker := memory.NewBroker()
+	subscriber := memory.NewFanoutSubscriber(broker, rabbitmq.FanoutSubscriberConfig{Exchange: "ends", Queue: "ends-1"})
+	publisher := memory.NewFanoutPublisher(broker, rabbitmq.FanoutPublisherConfig{Exchange: "ends"})
+	if err := subscriber.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	consumer := consume(t, subscriber)
+
+	publisher.Write([]byte("poison"), "")
+	if err := receive(t, consumer).Nack(); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, consumer)
+
+	// The dead letters outlive the subscriber
+	subscriber.Close()
+	parked := memory.NewWorkerQueue(broker, rabbitmq.WorkerQueueConfig{Name: rabbitmq.DeadLetterQueue("ends-1")})
+	if delivery := receive(t, consume(t, parked)); string(delivery.Body) != "poison" {
+		t.Errorf("expected the rejected message to be parked, got %q", delivery.Body)
+	}
+}
+
+func TestTopic(t *testing.T) {
+	broker := memory.NewBroker()
+	publisher := memory.NewTopicPublisher(broker, rabbitmq.TopicPublisherConfig{Exchange: "data"})
+	if err := publisher.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	subscribe := func(queue string, patterns ...string) <-chan middlewares.Delivery {
+		subscriber := memory.NewTopicSubscriber(broker, rabbitmq.TopicSubscriberConfig{
+			Exchange: []string{"data"},
+			Queue:    queue,
+			Patterns: patterns,
+		})
+		if err := subscriber.Connect(nil); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { subscriber.Close() })
+		return consume(t, subscriber)
+	}
+	indie := subscribe("indie", "games.indie")
+	games := subscribe("games", "games.*")
+	english := subscribe("english", "#.en")
+	everything := subscribe("everything", "#")
+
+	for _, topic := range []string{"games.indie", "games.action", "reviews.en", "reviews.positive.en"} {
+		publisher.Write([]byte(topic), topic)
+	}
+
+	expect := func(consumer <-chan middlewares.Delivery, topics ...string) {
+		t.Helper()
+		for _, topic := range topics {
+			delivery := receive(t, consumer)
+			if string(delivery.Body) != topic {
+				t.Errorf("expected %s, got %s", topic, delivery.Body)
+			}
+			delivery.Ack()
+		}
+		expectNothing(t, consumer)
+	}
+	expect(indie, "games.indie")
+	expect(games, "games.indie", "games.action")
+	expect(english, "reviews.en", "reviews.positive.en")
+	expect(everything, "games.indie", "games.action", "reviews.en", "reviews.positive.en")
+}
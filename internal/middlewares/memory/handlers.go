@@ -0,0 +1,310 @@
+package memory
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
+)
+
+// The handlers share their configuration with the RabbitMQ ones and
+// satisfy the same interfaces. Connect ignores the connection, they
+// talk to the broker they were created with.
+
+// subscription is the consuming side every input handler shares
+type subscription struct {
+	broker     *Broker
+	queue      string
+	maxRetries int
+
+	mutex     sync.Mutex
+	consumers []*consumer
+}
+
+func (s *subscription) GetConsumer() (<-chan middlewares.Delivery, error) {
+	c := s.broker.declareInput(s.queue).consume()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.consumers = append(s.consumers, c)
+	return c.out, nil
+}
+
+// Retry sends a message that couldn't be processed to the back of the
+// queue
+func (s *subscription) Retry(delivery middlewares.Delivery, headers middlewares.Headers) error {
+	return s.republish(s.queue, delivery, headers)
+}
+
+// Park moves a message that keeps failing to the dead letter queue
+func (s *subscription) Park(delivery middlewares.Delivery, headers middlewares.Headers) error {
+	target := rabbitmq.DeadLetterQueue(s.queue)
+	s.broker.declareQueue(target)
+	return s.republish(target, delivery, headers)
+}
+
+func (s *subscription) MaxRetries() int {
+	return s.maxRetries
+}
+
+func (s *subscription) republish(queue string, delivery middlewares.Delivery, headers middlewares.Headers) error {
+	msg := message{body: delivery.Body, headers: headers}
+	if err := s.broker.publish("", queue, msg); err != nil {
+		return fmt.Errorf("failed to send message to %s: %w", queue, err)
+	}
+	return delivery.Ack()
+}
+
+func (s *subscription) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.consumers {
+		c.close()
+	}
+	s.consumers = nil
+	return nil
+}
+
+type WorkerQueue struct {
+	subscription
+	Config rabbitmq.WorkerQueueConfig
+}
+
+func NewWorkerQueue(broker *Broker, config rabbitmq.WorkerQueueConfig) *WorkerQueue {
+	return &WorkerQueue{
+		subscription: subscription{broker: broker, queue: config.Name, maxRetries: config.MaxRetries},
+		Config:       config,
+	}
+}
+
+func (wq *WorkerQueue) Connect(conn *rabbitmq.Connection) error {
+	wq.broker.declareInput(wq.Config.Name)
+	return nil
+}
+
+func (wq *WorkerQueue) Write(p []byte, tag string) error {
+	return wq.WriteWithHeaders(p, tag, nil)
+}
+
+func (wq *WorkerQueue) WriteWithHeaders(p []byte, tag string, headers middlewares.Headers) error {
+	return wq.broker.publish("", wq.Config.Name, message{body: p, headers: headers})
+}
+
+func (wq *WorkerQueue) Depth() (int, error) {
+	return wq.broker.Depth(wq.Config.Name), nil
+}
+
+type FanoutPublisher struct {
+	broker *Broker
+	Config rabbitmq.FanoutPublisherConfig
+}
+
+func NewFanoutPublisher(broker *Broker, config rabbitmq.FanoutPublisherConfig) *FanoutPublisher {
+	return &FanoutPublisher{broker: broker, Config: config}
+}
+
+func (p *FanoutPublisher) Connect(conn *rabbitmq.Connection) error {
+	return p.broker.declareExchange(p.Config.Exchange, fanout)
+}
+
+func (p *FanoutPublisher) Write(msg []byte, tag string) error {
+	return p.WriteWithHeaders(msg, tag, nil)
+}
+
+func (p *FanoutPublisher) WriteWithHeaders(msg []byte, tag string, headers middlewares.Headers) error {
+	return p.broker.publish(p.Config.Exchange, "", message{body: msg, headers: headers})
+}
+
+func (p *FanoutPublisher) Close() error {
+	return nil
+}
+
+type FanoutSubscriber struct {
+	subscription
+	Config rabbitmq.FanoutSubscriberConfig
+}
+
+func NewFanoutSubscriber(broker *Broker, config rabbitmq.FanoutSubscriberConfig) *FanoutSubscriber {
+	return &FanoutSubscriber{
+		subscription: subscription{broker: broker, queue: config.Queue, maxRetries: config.MaxRetries},
+		Config:       config,
+	}
+}
+
+func (s *FanoutSubscriber) Connect(conn *rabbitmq.Connection) error {
+	if err := s.broker.declareExchange(s.Config.Exchange, fanout); err != nil {
+		return fmt.Errorf("failed to declare exchange: %w", err)
+	}
+	s.broker.declareInput(s.Config.Queue)
+	if err := s.broker.bind(s.Config.Queue, "", s.Config.Exchange); err != nil {
+		return fmt.Errorf("failed to bind queue: %w", err)
+	}
+	return nil
+}
+
+// ControlStream is the rabbitmq.ControlLog kept in a stream of the broker
+type ControlStream struct {
+	broker *Broker
+	Config rabbitmq.ControlStreamConfig
+
+	mutex sync.Mutex
+	done  chan struct{}
+}
+
+func NewControlStream(broker *Broker, config rabbitmq.ControlStreamConfig) *ControlStream {
+	return &ControlStream{broker: broker, Config: config, done: make(chan struct{})}
+}
+
+func (s *ControlStream) Connect(conn *rabbitmq.Connection) error {
+	if err := s.broker.declareExchange(s.Config.Exchange, fanout); err != nil {
+		return fmt.Errorf("failed to declare exchange: %w", err)
+	}
+	s.broker.declareStream(s.Config.Stream)
+	if err := s.broker.bind(s.Config.Stream, "", s.Config.Exchange); err != nil {
+		return fmt.Errorf("failed to bind stream: %w", err)
+	}
+	return nil
+}
+
+func (s *ControlStream) GetConsumer() (<-chan middlewares.Delivery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.broker.declareStream(s.Config.Stream).read(s.done), nil
+}
+
+func (s *ControlStream) Publish(update rabbitmq.RouterUpdate) error {
+	msg, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	return s.broker.publish(s.Config.Exchange, "", message{body: msg})
+}
+
+func (s *ControlStream) Mark() (string, error) {
+	return s.Config.Marker, s.Publish(rabbitmq.RouterUpdate{Marker: s.Config.Marker})
+}
+
+func (s *ControlStream) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	return nil
+}
+
+type DirectPublisher struct {
+	broker *Broker
+	Config rabbitmq.DirectPublisherConfig
+}
+
+func NewDirectPublisher(broker *Broker, config rabbitmq.DirectPublisherConfig) *DirectPublisher {
+	return &DirectPublisher{broker: broker, Config: config}
+}
+
+func (p *DirectPublisher) Connect(conn *rabbitmq.Connection) error {
+	return p.broker.declareExchange(p.Config.Exchange, direct)
+}
+
+func (p *DirectPublisher) Write(msg []byte, key string) error {
+	return p.WriteWithHeaders(msg, key, nil)
+}
+
+func (p *DirectPublisher) WriteWithHeaders(msg []byte, key string, headers middlewares.Headers) error {
+	return p.broker.publish(p.Config.Exchange, key, message{body: msg, headers: headers})
+}
+
+func (p *DirectPublisher) Close() error {
+	return nil
+}
+
+type DirectSubscriber struct {
+	subscription
+	Config rabbitmq.DirectSubscriberConfig
+}
+
+func NewDirectSubscriber(broker *Broker, config rabbitmq.DirectSubscriberConfig) *DirectSubscriber {
+	return &DirectSubscriber{
+		subscription: subscription{broker: broker, queue: config.Queue, maxRetries: config.MaxRetries},
+		Config:       config,
+	}
+}
+
+func (s *DirectSubscriber) Connect(conn *rabbitmq.Connection) error {
+	for _, exchange := range s.Config.Exchange {
+		if err := s.broker.declareExchange(exchange, direct); err != nil {
+			return fmt.Errorf("failed to declare exchange %s: %w", exchange, err)
+		}
+	}
+	s.broker.declareInput(s.Config.Queue)
+	for _, key := range s.Config.Keys {
+		for _, exchange := range s.Config.Exchange {
+			if err := s.broker.bind(s.Config.Queue, key, exchange); err != nil {
+				return fmt.Errorf("failed to bind queue %s to exchange %s: %w", s.Config.Queue, exchange, err)
+			}
+		}
+	}
+	return nil
+}
+
+type TopicPublisher struct {
+	broker *Broker
+	Config rabbitmq.TopicPublisherConfig
+}
+
+func NewTopicPublisher(broker *Broker, config rabbitmq.TopicPublisherConfig) *TopicPublisher {
+	return &TopicPublisher{broker: broker, Config: config}
+}
+
+func (p *TopicPublisher) Connect(conn *rabbitmq.Connection) error {
+	return p.broker.declareExchange(p.Config.Exchange, topic)
+}
+
+func (p *TopicPublisher) Write(msg []byte, topic string) error {
+	return p.WriteWithHeaders(msg, topic, nil)
+}
+
+func (p *TopicPublisher) WriteWithHeaders(msg []byte, topic string, headers middlewares.Headers) error {
+	return p.broker.publish(p.Config.Exchange, topic, message{body: msg, headers: headers})
+}
+
+func (p *TopicPublisher) Close() error {
+	return nil
+}
+
+type TopicSubscriber struct {
+	subscription
+	Config rabbitmq.TopicSubscriberConfig
+}
+
+func NewTopicSubscriber(broker *Broker, config rabbitmq.TopicSubscriberConfig) *TopicSubscriber {
+	return &TopicSubscriber{
+		subscription: subscription{broker: broker, queue: config.Queue, maxRetries: config.MaxRetries},
+		Config:       config,
+	}
+}
+
+func (s *TopicSubscriber) Connect(conn *rabbitmq.Connection) error {
+	for _, exchange := range s.Config.Exchange {
+		if err := s.broker.declareExchange(exchange, topic); err != nil {
+			return fmt.Errorf("failed to declare exchange %s: %w", exchange, err)
+		}
+	}
+	s.broker.declareInput(s.Config.Queue)
+	for _, pattern := range s.Config.Patterns {
+		for _, exchange := range s.Config.Exchange {
+			if err := s.broker.bind(s.Config.Queue, pattern, exchange); err != nil {
+				return fmt.Errorf("failed to bind queue %s to exchange %s: %w", s.Config.Queue, exchange, err)
+			}
+		}
+	}
+	return nil
+}
+
+// NewRouter routes like rabbitmq.Router over a direct exchange of broker
+func NewRouter(broker *Broker, config rabbitmq.DirectPublisherConfig, tags []string, s rabbitmq.RouteSelector) *rabbitmq.Router {
+	return rabbitmq.NewRouterOn(NewDirectPublisher(broker, config), tags, s)
+}
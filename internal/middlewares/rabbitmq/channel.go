@@ -0,0 +1,266 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+var ErrChannelClosed = errors.New("channel was closed")
+var ErrPublishNacked = errors.New("broker rejected the published message")
+
+// setupFunc declares the topology a handler needs on a fresh channel, it
+// returns the queue the handler consumes from if it has one
+type setupFunc func(ch *amqp091.Channel) (string, error)
+
+// managedChannel is an amqp channel that outlives the connection. After
+// a reconnection it's opened again and its topology declared again, so
+// handlers can keep publishing and consuming.
+type managedChannel struct {
+	conn  *Connection
+	setup setupFunc
+
+	mutex     sync.RWMutex
+	ch        *amqp091.Channel
+	queue     string
+	recovered chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// While batching, publishes don't wait for their confirmation
+	// until the batch is flushed
+	publishMutex sync.Mutex
+	batching     bool
+	pending      []pendingPublish
+}
+
+// pendingPublish is a message the broker didn't confirm yet, it's kept
+// to publish it again if the channel dies before the confirmation
+type pendingPublish struct {
+	confirmation *amqp091.DeferredConfirmation
+	ch           *amqp091.Channel
+	exchange     string
+	key          string
+	msg          amqp091.Publishing
+}
+
+func newManagedChannel(conn *Connection, setup setupFunc) *managedChannel {
+	return &managedChannel{
+		conn:      conn,
+		setup:     setup,
+		recovered: make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (m *managedChannel) get() (*amqp091.Channel, string) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.ch, m.queue
+}
+
+// recover opens the channel on conn and wakes up everyone waiting for it
+func (m *managedChannel) recover(conn *amqp091.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	queue, err := m.setup(ch)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.ch = ch
+	m.queue = queue
+	close(m.recovered)
+	m.recovered = make(chan struct{})
+	go m.watch(ch.NotifyClose(make(chan *amqp091.Error, 1)), ch)
+	return nil
+}
+
+// watch waits for the broker to close ch. A channel error closes the
+// channel but not the connection, so the channel is reopened on its own.
+// A graceful close doesn't report an error and ends the watch.
+func (m *managedChannel) watch(closes <-chan *amqp091.Error, ch *amqp091.Channel) {
+	amqpErr, ok := <-closes
+	if !ok || amqpErr == nil {
+		return
+	}
+	slog.Warn("channel closed by RabbitMQ, reopening it", "error", amqpErr)
+	m.conn.recoverChannel(m, ch)
+}
+
+// waitRecovery blocks until stale is replaced by a recovered channel
+func (m *managedChannel) waitRecovery(stale *amqp091.Channel) error {
+	for {
+		m.mutex.RLock()
+		current, recovered := m.ch, m.recovered
+		m.mutex.RUnlock()
+		if current != stale {
+			return nil
+		}
+
+		select {
+		case <-recovered:
+		case <-m.closed:
+			return ErrChannelClosed
+		case <-m.conn.closing:
+			return ErrChannelClosed
+		}
+	}
+}
+
+// publish returns once the broker confirms the message, or right away
+// while batching, then the confirmation is awaited by flush
+func (m *managedChannel) publish(timeout time.Duration, exchange string, key string, msg amqp091.Publishing) error {
+	p, err := m.send(timeout, exchange, key, msg)
+	if err != nil {
+		return err
+	}
+
+	m.publishMutex.Lock()
+	if m.batching {
+		m.pending = append(m.pending, p)
+		m.publishMutex.Unlock()
+		return nil
+	}
+	m.publishMutex.Unlock()
+	return m.confirm(timeout, p)
+}
+
+// send retries on the recovered channel when the broker went away while
+// publishing, every attempt has its own timeout
+func (m *managedChannel) send(timeout time.Duration, exchange string, key string, msg amqp091.Publishing) (pendingPublish, error) {
+	for {
+		ch, _ := m.get()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, msg)
+		cancel()
+		if err == nil || !ch.IsClosed() {
+			return pendingPublish{confirmation, ch, exchange, key, msg}, err
+		}
+
+		slog.Debug("channel closed while publishing, waiting for recovery", "exchange", exchange, "key", key)
+		if err := m.waitRecovery(ch); err != nil {
+			return pendingPublish{}, err
+		}
+	}
+}
+
+// confirm waits for the broker to confirm p. Messages whose channel died
+// before the confirmation are published again on the recovered channel,
+// so a message may be delivered twice but never lost.
+func (m *managedChannel) confirm(timeout time.Duration, p pendingPublish) error {
+	for {
+		if p.confirmation == nil {
+			// The channel isn't in confirm mode
+			return nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		acked, err := p.confirmation.WaitContext(ctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("no confirmation from the broker: %w", err)
+		}
+		if acked {
+			return nil
+		}
+		if !p.ch.IsClosed() {
+			return ErrPublishNacked
+		}
+
+		if err := m.waitRecovery(p.ch); err != nil {
+			return err
+		}
+		if p, err = m.send(timeout, p.exchange, p.key, p.msg); err != nil {
+			return err
+		}
+	}
+}
+
+// beginBatch makes publishes return without waiting for confirmations
+// until flush is called
+func (m *managedChannel) beginBatch() {
+	m.publishMutex.Lock()
+	defer m.publishMutex.Unlock()
+	m.batching = true
+}
+
+// flush waits for the confirmation of every message published since
+// beginBatch and ends the batch
+func (m *managedChannel) flush(timeout time.Duration) error {
+	m.publishMutex.Lock()
+	pending := m.pending
+	m.pending = nil
+	m.batching = false
+	m.publishMutex.Unlock()
+
+	for _, p := range pending {
+		if err := m.confirm(timeout, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consume returns deliveries from the handler queue. The returned
+// channel survives reconnections, consuming starts again on the
+// recovered channel. Deliveries received before the outage can't be
+// acknowledged anymore, the broker delivers them again.
+func (m *managedChannel) consume() (<-chan middlewares.Delivery, error) {
+	return m.consumeWith(nil)
+}
+
+// consumeWith consumes like consume with the consumer arguments args
+func (m *managedChannel) consumeWith(args amqp091.Table) (<-chan middlewares.Delivery, error) {
+	ch, queue := m.get()
+	deliveries, err := ch.Consume(queue, "", false, false, false, false, args)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan middlewares.Delivery)
+	go func() {
+		defer close(out)
+		for {
+			for delivery := range deliveries {
+				select {
+				case out <- newDelivery(delivery):
+				case <-m.closed:
+					return
+				}
+			}
+
+			// The channel died, consume again once it's back
+			for {
+				if err := m.waitRecovery(ch); err != nil {
+					return
+				}
+				ch, queue = m.get()
+				deliveries, err = ch.Consume(queue, "", false, false, false, false, args)
+				if err == nil {
+					break
+				}
+				slog.Error("couldn't consume from recovered channel", "queue", queue, "error", err)
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (m *managedChannel) close() error {
+	m.closeOnce.Do(func() { close(m.closed) })
+	m.conn.forget(m)
+	ch, _ := m.get()
+	return ch.Close()
+}
@@ -2,27 +2,168 @@ package rabbitmq
 
 import (
 	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
 	"github.com/rabbitmq/amqp091-go"
 )
 
+const (
+	minReconnectBackoff = 500 * time.Millisecond
+	maxReconnectBackoff = 30 * time.Second
+)
+
+// Connection to the broker. When the broker goes away it reconnects with
+// an exponential backoff and recovers every channel opened through it.
 type Connection struct {
-	conn *amqp091.Connection
+	url string
+
+	mutex     sync.Mutex
+	conn      *amqp091.Connection
+	channels  []*managedChannel
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
 func (c *Connection) Connect(hostname string, port string, username string, password string) error {
-	conn, err := amqp091.Dial(fmt.Sprintf("amqp://%s:%s@%s:%s/", username, password, hostname, port))
+	c.url = fmt.Sprintf("amqp://%s:%s@%s:%s/", username, password, hostname, port)
+	conn, err := amqp091.Dial(c.url)
 	if err != nil {
 		return fmt.Errorf("failed to connect to RabbitMQ: %s", err)
 	}
 
 	c.conn = conn
+	c.closing = make(chan struct{})
+	go c.watch(conn)
 	return nil
 }
 
 func (c *Connection) GetConnection() *amqp091.Connection {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.conn
 }
 
+// openChannel opens a channel whose topology is declared by setup now
+// and again after every reconnection
+func (c *Connection) openChannel(setup setupFunc) (*managedChannel, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	m := newManagedChannel(c, setup)
+	if err := m.recover(c.conn); err != nil {
+		return nil, err
+	}
+	c.channels = append(c.channels, m)
+	return m, nil
+}
+
+func (c *Connection) forget(m *managedChannel) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.channels = slices.DeleteFunc(c.channels, func(other *managedChannel) bool {
+		return other == m
+	})
+}
+
+// watch waits for the connection to be lost, a graceful close doesn't
+// report an error and ends the watch
+func (c *Connection) watch(conn *amqp091.Connection) {
+	amqpErr, ok := <-conn.NotifyClose(make(chan *amqp091.Error, 1))
+	if !ok || amqpErr == nil {
+		return
+	}
+	slog.Warn("connection to RabbitMQ lost, reconnecting", "error", amqpErr)
+	c.reconnect()
+}
+
+func (c *Connection) reconnect() {
+	backoff := minReconnectBackoff
+	for {
+		select {
+		case <-c.closing:
+			return
+		case <-time.After(backoff):
+		}
+
+		if err := c.tryReconnect(); err != nil {
+			slog.Warn("couldn't reconnect to RabbitMQ", "error", err, "backoff", backoff)
+			backoff = min(backoff*2, maxReconnectBackoff)
+			continue
+		}
+		slog.Info("reconnected to RabbitMQ")
+		return
+	}
+}
+
+func (c *Connection) tryReconnect() error {
+	conn, err := amqp091.Dial(c.url)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, m := range c.channels {
+		if err := m.recover(conn); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	c.conn = conn
+	go c.watch(conn)
+	return nil
+}
+
+// recoverChannel opens m again on the current connection once the broker
+// closed stale, retrying with the same backoff as reconnecting
+func (c *Connection) recoverChannel(m *managedChannel, stale *amqp091.Channel) {
+	backoff := minReconnectBackoff
+	for {
+		err := c.tryRecoverChannel(m, stale)
+		if err == nil {
+			return
+		}
+		slog.Warn("couldn't reopen channel", "error", err, "backoff", backoff)
+
+		select {
+		case <-c.closing:
+			return
+		case <-m.closed:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxReconnectBackoff)
+	}
+}
+
+func (c *Connection) tryRecoverChannel(m *managedChannel, stale *amqp091.Channel) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Either it was recovered already, or the whole connection was lost
+	// and reconnecting recovers it
+	if current, _ := m.get(); current != stale || c.conn.IsClosed() {
+		return nil
+	}
+	select {
+	case <-m.closed:
+		return nil
+	default:
+	}
+	return m.recover(c.conn)
+}
+
+// Close closes the connection for good, it can be called more than once
 func (c *Connection) Close() error {
-	return c.conn.Close()
+	var err error
+	c.closeOnce.Do(func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		close(c.closing)
+		err = c.conn.Close()
+	})
+	return err
 }
@@ -0,0 +1,173 @@
+package rabbitmq
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
+)
+
+// The reconnection tests need a broker, they run when RABBITMQ_TEST_ADDR
+// has its address, like localhost:5672
+const testAddrEnv = "RABBITMQ_TEST_ADDR"
+
+// proxy forwards connections to the broker and can drop them all, which
+// the client sees as the broker going away
+type proxy struct {
+	listener net.Listener
+	target   string
+
+	mutex sync.Mutex
+	conns []net.Conn
+}
+
+func newProxy(t *testing.T, target string) *proxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxy{listener: listener, target: target}
+	go p.serve()
+	t.Cleanup(func() { listener.Close() })
+	return p
+}
+
+func (p *proxy) serve() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		broker, err := net.Dial("tcp", p.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		p.mutex.Lock()
+		p.conns = append(p.conns, client, broker)
+		p.mutex.Unlock()
+		go io.Copy(broker, client)
+		go io.Copy(client, broker)
+	}
+}
+
+func (p *proxy) dropConnections() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func connect(t *testing.T, addr string) *Connection {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conn Connection
+	if err := conn.Connect(host, port, "guest", "guest"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &conn
+}
+
+func brokerAddr(t *testing.T) string {
+	t.Helper()
+	addr, ok := os.LookupEnv(testAddrEnv)
+	if !ok {
+		t.Skipf("%s not set", testAddrEnv)
+	}
+	return addr
+}
+
+func newTestQueue(t *testing.T, conn *Connection, name string) *WorkerQueue {
+	t.Helper()
+	wq := NewWorkerQueue(WorkerQueueConfig{Name: name, Timeout: 5, PrefetchCount: 1})
+	if err := wq.Connect(conn); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ch, _ := wq.ch.get(); ch != nil {
+			ch.QueueDelete(name, false, false, false)
+			ch.QueueDelete(DeadLetterQueue(name), false, false, false)
+		}
+		wq.Close()
+	})
+	return wq
+}
+
+// roundTrip writes body and expects it back from deliveries
+func roundTrip(t *testing.T, wq *WorkerQueue, deliveries <-chan middlewares.Delivery, body string) {
+	t.Helper()
+	if err := wq.Write([]byte(body), ""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case delivery := <-deliveries:
+		if string(delivery.Body) != body {
+			t.Fatalf("expected %q, got %q", body, delivery.Body)
+		}
+		delivery.Ack()
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%q wasn't delivered", body)
+	}
+}
+
+func TestChannelIsReopenedAfterAChannelError(t *testing.T) {
+	conn := connect(t, brokerAddr(t))
+	wq := newTestQueue(t, conn, "test-channel-error")
+	deliveries, err := wq.GetConsumer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, wq, deliveries, "before")
+
+	// Inspecting a queue that doesn't exist closes the channel, the
+	// connection stays up
+	ch, _ := wq.ch.get()
+	if _, err := ch.QueueDeclarePassive("test-missing-queue", true, false, false, false, nil); err == nil {
+		t.Fatal("expected the passive declaration to fail")
+	}
+	if conn.GetConnection().IsClosed() {
+		t.Fatal("expected only the channel to be closed")
+	}
+
+	roundTrip(t, wq, deliveries, "after")
+}
+
+func TestConnectionIsRecoveredAfterTheBrokerGoesAway(t *testing.T) {
+	p := newProxy(t, brokerAddr(t))
+	conn := connect(t, p.listener.Addr().String())
+	wq := newTestQueue(t, conn, "test-reconnect")
+	deliveries, err := wq.GetConsumer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, wq, deliveries, "before")
+
+	stale := conn.GetConnection()
+	p.dropConnections()
+	roundTrip(t, wq, deliveries, "after")
+
+	if conn.GetConnection() == stale {
+		t.Error("expected a new connection")
+	}
+}
+
+func TestConnectionCanBeClosedTwice(t *testing.T) {
+	conn := connect(t, brokerAddr(t))
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("expected the second close to do nothing, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const controlPrefetch = 16
+
+// ControlLog delivers every RouterUpdate ever published, oldest first, so
+// a router that starts late still gets the updates it missed
+type ControlLog interface {
+	InputHandler
+	// Publish appends update to the log
+	Publish(update RouterUpdate) error
+	// Mark appends a marker only this log recognizes, it's delivered
+	// after every update published before it
+	Mark() (string, error)
+}
+
+// ControlStreamConfig configures the log of router updates. They're
+// published on Exchange, a fanout exchange, and kept in Stream, a stream
+// bound to it that is read from the start by every router.
+type ControlStreamConfig struct {
+	Exchange string
+	Stream   string
+	// Marker names the router reading the log, see ControlLog.Mark
+	Marker  string
+	Timeout uint8
+}
+
+// ControlStream is the ControlLog kept in a RabbitMQ stream
+type ControlStream struct {
+	ch     *managedChannel
+	Config ControlStreamConfig
+}
+
+func NewControlStream(config ControlStreamConfig) *ControlStream {
+	return &ControlStream{Config: config}
+}
+
+func (s *ControlStream) Connect(conn *Connection) error {
+	ch, err := conn.openChannel(s.setup)
+	if err != nil {
+		return fmt.Errorf("failed to create channel: %w", err)
+	}
+
+	s.ch = ch
+	return nil
+}
+
+func (s *ControlStream) setup(ch *amqp091.Channel) (string, error) {
+	if err := ch.ExchangeDeclare(s.Config.Exchange, "fanout", true, false, false, false, nil); err != nil {
+		return "", fmt.Errorf("failed to declare exchange: %w", err)
+	}
+
+	args := amqp091.Table{"x-queue-type": "stream"}
+	q, err := ch.QueueDeclare(s.Config.Stream, true, false, false, false, args)
+	if err != nil {
+		return "", fmt.Errorf("failed to declare stream: %w", err)
+	}
+	if err := ch.QueueBind(q.Name, "", s.Config.Exchange, false, nil); err != nil {
+		return "", fmt.Errorf("failed to bind stream: %w", err)
+	}
+
+	// Streams are only consumed with a prefetch count
+	if err := ch.Qos(controlPrefetch, 0, false); err != nil {
+		return "", fmt.Errorf("failed to set QoS: %w", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		return "", fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+	return q.Name, nil
+}
+
+// GetConsumer reads the stream from its first update. After a
+// reconnection it's read from the start again, applying an update twice
+// changes nothing.
+func (s *ControlStream) GetConsumer() (<-chan middlewares.Delivery, error) {
+	consumer, err := s.ch.consumeWith(amqp091.Table{"x-stream-offset": "first"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer: %w", err)
+	}
+	return consumer, nil
+}
+
+func (s *ControlStream) Publish(update RouterUpdate) error {
+	msg, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	err = s.ch.publish(time.Second*time.Duration(s.Config.Timeout), s.Config.Exchange, "", amqp091.Publishing{
+		DeliveryMode: amqp091.Persistent,
+		ContentType:  "application/json",
+		Body:         msg,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish router update: %w", err)
+	}
+	return nil
+}
+
+func (s *ControlStream) Mark() (string, error) {
+	return s.Config.Marker, s.Publish(RouterUpdate{Marker: s.Config.Marker})
+}
+
+func (s *ControlStream) Close() error {
+	return s.ch.close()
+}
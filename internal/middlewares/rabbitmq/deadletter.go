@@ -0,0 +1,109 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// Headers of the messages sent back to their queue to be retried
+const (
+	RetryCountHeader  = "x-retry-count"
+	RetryReasonHeader = "x-retry-reason"
+)
+
+// DefaultMaxRetries is how many times a message is retried before it's
+// parked
+const DefaultMaxRetries = 3
+
+const retryPublishTimeout = 5 * time.Second
+
+// DeadLetterExchange is where the broker moves the messages rejected from
+// queue, they end up parked in DeadLetterQueue(queue)
+func DeadLetterExchange(queue string) string {
+	return queue + ".dlx"
+}
+
+// DeadLetterQueue is where the messages that keep failing in queue are
+// parked
+func DeadLetterQueue(queue string) string {
+	return queue + ".dlq"
+}
+
+// declareQueue declares a queue together with its dead letter exchange
+// and queue. Every declaration of a queue must go through here, the
+// broker refuses to declare the same queue with different arguments.
+// The dead letters outlive the queue even if it's exclusive, so the ones
+// of the fanout subscribers can be listed with cmd/dlq too.
+func declareQueue(ch *amqp091.Channel, name string, exclusive bool) (amqp091.Queue, error) {
+	dlx := DeadLetterExchange(name)
+	if err := ch.ExchangeDeclare(dlx, "fanout", true, false, false, false, nil); err != nil {
+		return amqp091.Queue{}, fmt.Errorf("failed to declare dead letter exchange: %w", err)
+	}
+
+	dlq, err := ch.QueueDeclare(DeadLetterQueue(name), true, false, false, false, nil)
+	if err != nil {
+		return amqp091.Queue{}, fmt.Errorf("failed to declare dead letter queue: %w", err)
+	}
+	if err := ch.QueueBind(dlq.Name, "", dlx, false, nil); err != nil {
+		return amqp091.Queue{}, fmt.Errorf("failed to bind dead letter queue: %w", err)
+	}
+
+	args := amqp091.Table{"x-dead-letter-exchange": dlx}
+	return ch.QueueDeclare(name, true, false, exclusive, false, args)
+}
+
+// RetryCount returns how many times the message was already retried
+func RetryCount(headers map[string]any) int {
+	switch count := headers[RetryCountHeader].(type) {
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	case int:
+		return count
+	default:
+		return 0
+	}
+}
+
+// RetryHeaders returns the headers of delivery with the retry count and
+// the reason of the last failure set
+func RetryHeaders(delivery middlewares.Delivery, count int, reason error) middlewares.Headers {
+	headers := middlewares.Headers{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	headers[RetryCountHeader] = int32(count)
+	headers[RetryReasonHeader] = reason.Error()
+	return headers
+}
+
+// retry sends a copy of delivery to the back of its queue and
+// acknowledges the original once the broker confirmed it
+func (m *managedChannel) retry(delivery middlewares.Delivery, headers middlewares.Headers) error {
+	_, queue := m.get()
+	return m.republish(queue, delivery, headers)
+}
+
+// park moves delivery to the dead letter queue of its queue. It's sent
+// there directly instead of rejected, so the headers keep the reason.
+func (m *managedChannel) park(delivery middlewares.Delivery, headers middlewares.Headers) error {
+	_, queue := m.get()
+	return m.republish(DeadLetterQueue(queue), delivery, headers)
+}
+
+func (m *managedChannel) republish(queue string, delivery middlewares.Delivery, headers middlewares.Headers) error {
+	err := m.publish(retryPublishTimeout, "", queue, amqp091.Publishing{
+		Headers:      amqp091.Table(headers),
+		DeliveryMode: amqp091.Persistent,
+		ContentType:  "text/plain",
+		Body:         delivery.Body,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send message to %s: %w", queue, err)
+	}
+	return delivery.Ack()
+}
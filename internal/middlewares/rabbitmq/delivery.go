@@ -0,0 +1,33 @@
+package rabbitmq
+
+import (
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+type acknowledger struct {
+	delivery amqp091.Delivery
+}
+
+func (a acknowledger) Ack() error {
+	return a.delivery.Ack(false)
+}
+
+// Nack rejects the message without requeueing it, the broker moves it to
+// the dead letter exchange of the queue, see declareQueue
+func (a acknowledger) Nack() error {
+	return a.delivery.Nack(false, false)
+}
+
+func (a acknowledger) Requeue() error {
+	return a.delivery.Nack(false, true)
+}
+
+func newDelivery(delivery amqp091.Delivery) middlewares.Delivery {
+	return middlewares.Delivery{
+		Body:         delivery.Body,
+		Headers:      middlewares.Headers(delivery.Headers),
+		Redelivered:  delivery.Redelivered,
+		Acknowledger: acknowledger{delivery},
+	}
+}
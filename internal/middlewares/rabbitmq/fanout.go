@@ -1,8 +1,8 @@
 package rabbitmq
 
 import (
-	"context"
 	"fmt"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
 	"github.com/rabbitmq/amqp091-go"
 	"time"
 )
@@ -13,7 +13,7 @@ type FanoutPublisherConfig struct {
 }
 
 type FanoutPublisher struct {
-	ch     *amqp091.Channel
+	ch     *managedChannel
 	Config FanoutPublisherConfig
 }
 
@@ -22,12 +22,17 @@ func NewFanoutPublisher(config FanoutPublisherConfig) *FanoutPublisher {
 }
 
 func (p *FanoutPublisher) Connect(conn *Connection) error {
-	ch, err := conn.GetConnection().Channel()
+	ch, err := conn.openChannel(p.setup)
 	if err != nil {
 		return fmt.Errorf("failed to open channel: %w", err)
 	}
 
-	err = ch.ExchangeDeclare(
+	p.ch = ch
+	return nil
+}
+
+func (p *FanoutPublisher) setup(ch *amqp091.Channel) (string, error) {
+	err := ch.ExchangeDeclare(
 		p.Config.Exchange,
 		"fanout",
 		true,
@@ -37,26 +42,28 @@ func (p *FanoutPublisher) Connect(conn *Connection) error {
 		nil,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to declare exchange: %w", err)
+		return "", fmt.Errorf("failed to declare exchange: %w", err)
 	}
 
-	p.ch = ch
-	return nil
+	if err := ch.Confirm(false); err != nil {
+		return "", fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+	return "", nil
 }
 
 func (p *FanoutPublisher) Write(msg []byte, tag string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(p.Config.Timeout))
-	defer cancel()
+	return p.WriteWithHeaders(msg, tag, nil)
+}
 
-	err := p.ch.PublishWithContext(
-		ctx,
+func (p *FanoutPublisher) WriteWithHeaders(msg []byte, tag string, headers middlewares.Headers) error {
+	err := p.ch.publish(
+		time.Second*time.Duration(p.Config.Timeout),
 		p.Config.Exchange,
 		"",
-		false,
-		false,
 		amqp091.Publishing{
 			ContentType: "text/plain",
 			Body:        msg,
+			Headers:     amqp091.Table(headers),
 		},
 	)
 	if err != nil {
@@ -65,18 +72,27 @@ func (p *FanoutPublisher) Write(msg []byte, tag string) error {
 	return nil
 }
 
+func (p *FanoutPublisher) BeginBatch() {
+	p.ch.beginBatch()
+}
+
+// Flush waits until the broker confirms every write since BeginBatch
+func (p *FanoutPublisher) Flush() error {
+	return p.ch.flush(time.Second * time.Duration(p.Config.Timeout))
+}
+
 func (p *FanoutPublisher) Close() error {
-	return p.ch.Close()
+	return p.ch.close()
 }
 
 type FanoutSubscriberConfig struct {
-	Exchange string
-	Queue    string
+	Exchange   string
+	Queue      string
+	MaxRetries int
 }
 
 type FanoutSubscriber struct {
-	ch     *amqp091.Channel
-	q      *amqp091.Queue
+	ch     *managedChannel
 	Config FanoutSubscriberConfig
 }
 
@@ -85,12 +101,17 @@ func NewFanoutSubscriber(config FanoutSubscriberConfig) *FanoutSubscriber {
 }
 
 func (s *FanoutSubscriber) Connect(conn *Connection) error {
-	ch, err := conn.GetConnection().Channel()
+	ch, err := conn.openChannel(s.setup)
 	if err != nil {
 		return fmt.Errorf("failed to create channel: %w", err)
 	}
 
-	err = ch.ExchangeDeclare(
+	s.ch = ch
+	return nil
+}
+
+func (s *FanoutSubscriber) setup(ch *amqp091.Channel) (string, error) {
+	err := ch.ExchangeDeclare(
 		s.Config.Exchange,
 		"fanout",
 		true,
@@ -100,19 +121,12 @@ func (s *FanoutSubscriber) Connect(conn *Connection) error {
 		nil,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to declare exchange: %w", err)
+		return "", fmt.Errorf("failed to declare exchange: %w", err)
 	}
 
-	q, err := ch.QueueDeclare(
-		s.Config.Queue,
-		true,
-		false,
-		true,
-		false,
-		nil,
-	)
+	q, err := declareQueue(ch, s.Config.Queue, true)
 	if err != nil {
-		return fmt.Errorf("failed to declare queue: %w", err)
+		return "", fmt.Errorf("failed to declare queue: %w", err)
 	}
 
 	err = ch.QueueBind(
@@ -123,32 +137,34 @@ func (s *FanoutSubscriber) Connect(conn *Connection) error {
 		nil,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to bind queue: %w", err)
+		return "", fmt.Errorf("failed to bind queue: %w", err)
 	}
 
-	s.ch = ch
-	s.q = &q
-	return nil
+	return q.Name, nil
 }
 
-// TODO(fede) - Handle panic
-func (s *FanoutSubscriber) GetConsumer() <-chan amqp091.Delivery {
-	consumer, err := s.ch.Consume(
-		s.q.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
+func (s *FanoutSubscriber) GetConsumer() (<-chan middlewares.Delivery, error) {
+	consumer, err := s.ch.consume()
 	if err != nil {
-		panic("failed to create consumer")
+		return nil, fmt.Errorf("failed to create consumer: %w", err)
 	}
+	return consumer, nil
+}
+
+// Retry sends a message that couldn't be processed back to the queue
+func (s *FanoutSubscriber) Retry(delivery middlewares.Delivery, headers middlewares.Headers) error {
+	return s.ch.retry(delivery, headers)
+}
+
+// Park moves a message that keeps failing to the dead letter queue
+func (s *FanoutSubscriber) Park(delivery middlewares.Delivery, headers middlewares.Headers) error {
+	return s.ch.park(delivery, headers)
+}
 
-	return consumer
+func (s *FanoutSubscriber) MaxRetries() int {
+	return s.Config.MaxRetries
 }
 
 func (s *FanoutSubscriber) Close() error {
-	return s.ch.Close()
+	return s.ch.close()
 }
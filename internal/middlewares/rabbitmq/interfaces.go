@@ -1,15 +1,62 @@
 package rabbitmq
 
-import "github.com/rabbitmq/amqp091-go"
+import "github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
 
 type InputHandler interface {
 	Connect(conn *Connection) error
-	GetConsumer() <-chan amqp091.Delivery
+	GetConsumer() (<-chan middlewares.Delivery, error)
 	Close() error
 }
 
+// Retrier is implemented by inputs that can give a message that
+// couldn't be processed another chance before dead lettering it
+type Retrier interface {
+	// Retry sends a copy of delivery with headers to the back of the
+	// queue and acknowledges the original
+	Retry(delivery middlewares.Delivery, headers middlewares.Headers) error
+	// Park moves delivery with headers to the dead letter queue
+	Park(delivery middlewares.Delivery, headers middlewares.Headers) error
+	// MaxRetries is how many times a message is retried before it's
+	// parked
+	MaxRetries() int
+}
+
 type OutputHandler interface {
 	Connect(conn *Connection) error
 	Write(msg []byte, tag string) error
 	Close() error
 }
+
+// HeaderWriter is implemented by outputs whose messages can carry
+// headers along with the body
+type HeaderWriter interface {
+	WriteWithHeaders(msg []byte, tag string, headers middlewares.Headers) error
+}
+
+// DepthInspector is implemented by outputs that can tell how many
+// messages are waiting in the broker to be consumed
+type DepthInspector interface {
+	Depth() (int, error)
+}
+
+// Broadcaster is implemented by outputs that spread messages over
+// several destinations and can deliver one to all of them
+type Broadcaster interface {
+	Broadcast(msg []byte) error
+}
+
+// Batcher is implemented by outputs that can defer the broker
+// confirmations of several writes and wait for all of them at once
+type Batcher interface {
+	BeginBatch()
+	Flush() error
+}
+
+// Partitioner is implemented by outputs that spread the data of a
+// request over several partitions, every one of them must get its END
+type Partitioner interface {
+	Partitions(msg []byte) int
+	WritePartitions(msg []byte, tag string) error
+	// TagOf returns the partition msg goes to when it's written with key
+	TagOf(msg []byte, key string) string
+}
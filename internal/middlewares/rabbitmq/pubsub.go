@@ -1,8 +1,8 @@
 package rabbitmq
 
 import (
-	"context"
 	"fmt"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
 	"github.com/rabbitmq/amqp091-go"
 	"time"
 )
@@ -13,7 +13,7 @@ type DirectPublisherConfig struct {
 }
 
 type DirectPublisher struct {
-	ch     *amqp091.Channel
+	ch     *managedChannel
 	Config DirectPublisherConfig
 }
 
@@ -22,12 +22,17 @@ func NewDirectPublisher(config DirectPublisherConfig) *DirectPublisher {
 }
 
 func (p *DirectPublisher) Connect(conn *Connection) error {
-	ch, err := conn.GetConnection().Channel()
+	ch, err := conn.openChannel(p.setup)
 	if err != nil {
 		return fmt.Errorf("failed to open channel: %w", err)
 	}
 
-	err = ch.ExchangeDeclare(
+	p.ch = ch
+	return nil
+}
+
+func (p *DirectPublisher) setup(ch *amqp091.Channel) (string, error) {
+	err := ch.ExchangeDeclare(
 		p.Config.Exchange,
 		"direct",
 		true,
@@ -37,26 +42,28 @@ func (p *DirectPublisher) Connect(conn *Connection) error {
 		nil,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to declare exchange: %w", err)
+		return "", fmt.Errorf("failed to declare exchange: %w", err)
 	}
 
-	p.ch = ch
-	return nil
+	if err := ch.Confirm(false); err != nil {
+		return "", fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+	return "", nil
 }
 
 func (p *DirectPublisher) Write(msg []byte, key string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(p.Config.Timeout))
-	defer cancel()
+	return p.WriteWithHeaders(msg, key, nil)
+}
 
-	err := p.ch.PublishWithContext(
-		ctx,
+func (p *DirectPublisher) WriteWithHeaders(msg []byte, key string, headers middlewares.Headers) error {
+	err := p.ch.publish(
+		time.Second*time.Duration(p.Config.Timeout),
 		p.Config.Exchange,
 		key,
-		false,
-		false,
 		amqp091.Publishing{
 			ContentType: "text/plain",
 			Body:        msg,
+			Headers:     amqp091.Table(headers),
 		},
 	)
 	if err != nil {
@@ -65,8 +72,17 @@ func (p *DirectPublisher) Write(msg []byte, key string) error {
 	return nil
 }
 
+func (p *DirectPublisher) BeginBatch() {
+	p.ch.beginBatch()
+}
+
+// Flush waits until the broker confirms every write since BeginBatch
+func (p *DirectPublisher) Flush() error {
+	return p.ch.flush(time.Second * time.Duration(p.Config.Timeout))
+}
+
 func (p *DirectPublisher) Close() error {
-	return p.ch.Close()
+	return p.ch.close()
 }
 
 type DirectSubscriberConfig struct {
@@ -74,11 +90,11 @@ type DirectSubscriberConfig struct {
 	Queue         string
 	Keys          []string
 	PrefetchCount int
+	MaxRetries    int
 }
 
 type DirectSubscriber struct {
-	ch     *amqp091.Channel
-	q      *amqp091.Queue
+	ch     *managedChannel
 	Config DirectSubscriberConfig
 }
 
@@ -87,11 +103,17 @@ func NewDirectSubscriber(config DirectSubscriberConfig) *DirectSubscriber {
 }
 
 func (s *DirectSubscriber) Connect(conn *Connection) error {
-	ch, err := conn.GetConnection().Channel()
+	ch, err := conn.openChannel(s.setup)
 	if err != nil {
 		return fmt.Errorf("failed to open channel: %w", err)
 	}
 
+	s.ch = ch
+	return nil
+}
+
+func (s *DirectSubscriber) setup(ch *amqp091.Channel) (string, error) {
+	var err error
 	// TODO(fede) - Allow this to be configurable - Improve it
 	if s.Config.PrefetchCount > 0 {
 		err = ch.Qos(
@@ -100,7 +122,7 @@ func (s *DirectSubscriber) Connect(conn *Connection) error {
 			false,                  // global
 		)
 		if err != nil {
-			return fmt.Errorf("failed to set QoS: %w", err)
+			return "", fmt.Errorf("failed to set QoS: %w", err)
 		}
 
 	}
@@ -116,20 +138,13 @@ func (s *DirectSubscriber) Connect(conn *Connection) error {
 			nil,
 		)
 		if err != nil {
-			return fmt.Errorf("failed to declare exchange %s: %w", exchange, err)
+			return "", fmt.Errorf("failed to declare exchange %s: %w", exchange, err)
 		}
 	}
 
-	q, err := ch.QueueDeclare(
-		s.Config.Queue,
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
+	q, err := declareQueue(ch, s.Config.Queue, false)
 	if err != nil {
-		return fmt.Errorf("failed to declare queue: %w", err)
+		return "", fmt.Errorf("failed to declare queue: %w", err)
 	}
 
 	for _, key := range s.Config.Keys {
@@ -142,34 +157,36 @@ func (s *DirectSubscriber) Connect(conn *Connection) error {
 				nil,
 			)
 			if err != nil {
-				return fmt.Errorf("failed to bind queue %s to exchange %s: %w", q.Name, exchange, err)
+				return "", fmt.Errorf("failed to bind queue %s to exchange %s: %w", q.Name, exchange, err)
 			}
 		}
 	}
 
-	s.ch = ch
-	s.q = &q
-	return nil
+	return q.Name, nil
 }
 
-// TODO(fede) - Handle panic
-func (s *DirectSubscriber) GetConsumer() <-chan amqp091.Delivery {
-	consumer, err := s.ch.Consume(
-		s.q.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
+func (s *DirectSubscriber) GetConsumer() (<-chan middlewares.Delivery, error) {
+	consumer, err := s.ch.consume()
 	if err != nil {
-		panic("failed to create consumer")
+		return nil, fmt.Errorf("failed to create consumer: %w", err)
 	}
+	return consumer, nil
+}
+
+// Retry sends a message that couldn't be processed back to the queue
+func (s *DirectSubscriber) Retry(delivery middlewares.Delivery, headers middlewares.Headers) error {
+	return s.ch.retry(delivery, headers)
+}
+
+// Park moves a message that keeps failing to the dead letter queue
+func (s *DirectSubscriber) Park(delivery middlewares.Delivery, headers middlewares.Headers) error {
+	return s.ch.park(delivery, headers)
+}
 
-	return consumer
+func (s *DirectSubscriber) MaxRetries() int {
+	return s.Config.MaxRetries
 }
 
 func (s *DirectSubscriber) Close() error {
-	return s.ch.Close()
+	return s.ch.close()
 }
@@ -1,28 +1,90 @@
 package rabbitmq
 
 import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
 	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
-	"hash"
 	"hash/fnv"
+	"log/slog"
+	"slices"
+	"strconv"
 	"strings"
-	//	"log/slog"
+	"sync"
+	"time"
 )
 
-type IDRouter struct {
-	hasher  hash.Hash64
-	idCount int
+// DefaultVirtualNodes is how many points every tag has in the ring of a
+// ConsistentHashRouter
+const DefaultVirtualNodes = 128
+
+// ConsistentHashRouter maps every key to the same tag, no matter the
+// process or the keys routed before. Tags own several points of a hash
+// ring, so adding or removing one only moves the keys of its neighbours.
+type ConsistentHashRouter struct {
+	points []uint64
+	owners []int
+}
+
+func NewConsistentHashRouter(tags []string, virtualNodes int) ConsistentHashRouter {
+	utils.Assert(len(tags) > 0, "the router needs at least one tag")
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+
+	type point struct {
+		hash  uint64
+		owner int
+	}
+	ring := make([]point, 0, len(tags)*virtualNodes)
+	for i, tag := range tags {
+		for v := 0; v < virtualNodes; v++ {
+			ring = append(ring, point{hashKey(tag + "#" + strconv.Itoa(v)), i})
+		}
+	}
+	slices.SortFunc(ring, func(a, b point) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(a.owner, b.owner))
+	})
+
+	r := ConsistentHashRouter{
+		points: make([]uint64, len(ring)),
+		owners: make([]int, len(ring)),
+	}
+	for i, p := range ring {
+		r.points[i] = p.hash
+		r.owners[i] = p.owner
+	}
+	return r
 }
 
-func NewIDRouter(idCount int) IDRouter {
-	return IDRouter{
-		hasher:  fnv.New64a(),
-		idCount: idCount,
+// Select returns the tag owning the first point of the ring at or after
+// the hash of key
+func (r ConsistentHashRouter) Select(key string) int {
+	h := hashKey(key)
+	i, _ := slices.BinarySearch(r.points, h)
+	if i == len(r.points) {
+		i = 0
 	}
+	return r.owners[i]
 }
 
-func (r IDRouter) Select(key string) int {
-	r.hasher.Write([]byte(key))
-	return int(r.hasher.Sum64()) % r.idCount
+func hashKey(key string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	return mix(hasher.Sum64())
+}
+
+// mix spreads the bits of FNV, keys that differ only in their last
+// characters (like consecutive ids) land close on the ring otherwise
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
 }
 
 type GameReviewRouter struct {
@@ -44,30 +106,239 @@ type RouteSelector interface {
 }
 
 type Router struct {
-	tags []string
-	s    RouteSelector
-	p    *DirectPublisher
+	p OutputHandler
+	// partition builds the selector of a tag list. Routers without it
+	// have fixed tags that aren't partitions of the keys.
+	partition func(tags []string) RouteSelector
+	exchange  string
+	control   ControlLog
+
+	mutex sync.RWMutex
+	// routes sorted by the first client they apply to
+	routes []route
+}
+
+type route struct {
+	fromClient uint32
+	tags       []string
+	s          RouteSelector
 }
 
-func NewRouter(config DirectPublisherConfig, tags []string, s RouteSelector) Router {
-	return Router{
-		tags: tags,
-		s:    s,
-		p:    &DirectPublisher{Config: config},
+// RouterUpdate is published on the control log to change the tags the
+// routers writing to Exchange spread keys over. It applies to the clients
+// from FromClient on, requests of previous clients keep their
+// partitioning until they finish.
+type RouterUpdate struct {
+	Exchange   string   `json:"exchange,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	FromClient uint32   `json:"from_client,omitempty"`
+	// Marker is only set on the updates of ControlLog.Mark, which change
+	// nothing
+	Marker string `json:"marker,omitempty"`
+}
+
+// controlReplayTimeout bounds how long Connect waits to read the updates
+// published before the router started
+const controlReplayTimeout = 30 * time.Second
+
+func NewRouter(config DirectPublisherConfig, tags []string, s RouteSelector) *Router {
+	return NewRouterOn(&DirectPublisher{Config: config}, tags, s)
+}
+
+// NewRouterOn routes over p, which must write to the queue bound with
+// the tag it's given
+func NewRouterOn(p OutputHandler, tags []string, s RouteSelector) *Router {
+	return &Router{
+		p:      p,
+		routes: []route{{tags: tags, s: s}},
+	}
+}
+
+// NewPartitionedRouter spreads keys over tags with consistent hashing.
+// If control isn't nil the tags can be changed while running by
+// publishing a RouterUpdate for exchange on it, the updates published
+// before the router started are applied when it connects.
+func NewPartitionedRouter(p OutputHandler, exchange string, tags []string, control ControlLog) *Router {
+	partition := func(tags []string) RouteSelector {
+		return NewConsistentHashRouter(tags, DefaultVirtualNodes)
+	}
+	return &Router{
+		p:         p,
+		partition: partition,
+		exchange:  exchange,
+		control:   control,
+		routes:    []route{{tags: tags, s: partition(tags)}},
 	}
 }
 
 func (r *Router) Connect(conn *Connection) error {
-	return r.p.Connect(conn)
+	if err := r.p.Connect(conn); err != nil {
+		return err
+	}
+	if r.control == nil {
+		return nil
+	}
+	if err := r.control.Connect(conn); err != nil {
+		return fmt.Errorf("failed to subscribe to router control: %w", err)
+	}
+	updates, err := r.control.GetConsumer()
+	if err != nil {
+		return fmt.Errorf("failed to read router control: %w", err)
+	}
+	if err := r.replay(updates); err != nil {
+		return err
+	}
+	go r.watchControl(updates)
+	return nil
+}
+
+// replay applies the updates published before the router connected. The
+// log is read until the marker the router appends to it, so no message is
+// routed with tags an earlier update already replaced.
+func (r *Router) replay(updates <-chan middlewares.Delivery) error {
+	marker, err := r.control.Mark()
+	if err != nil {
+		return fmt.Errorf("failed to mark router control: %w", err)
+	}
+
+	timeout := time.After(controlReplayTimeout)
+	for {
+		select {
+		case delivery, ok := <-updates:
+			if !ok {
+				return fmt.Errorf("router control closed while replaying updates")
+			}
+			if r.handle(delivery) == marker {
+				return nil
+			}
+		case <-timeout:
+			return fmt.Errorf("timed out replaying router updates of %s", r.exchange)
+		}
+	}
+}
+
+func (r *Router) watchControl(updates <-chan middlewares.Delivery) {
+	for delivery := range updates {
+		r.handle(delivery)
+	}
+}
+
+// handle applies the update in delivery and returns its marker
+func (r *Router) handle(delivery middlewares.Delivery) string {
+	var update RouterUpdate
+	if err := json.Unmarshal(delivery.Body, &update); err != nil {
+		slog.Error("invalid router update", "error", err)
+		delivery.Nack()
+		return ""
+	}
+	if update.Marker == "" && update.Exchange == r.exchange {
+		r.apply(update)
+	}
+	delivery.Ack()
+	return update.Marker
+}
+
+func (r *Router) apply(update RouterUpdate) {
+	if len(update.Tags) == 0 {
+		slog.Error("ignoring router update without tags", "exchange", update.Exchange)
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	next := route{fromClient: update.FromClient, tags: update.Tags, s: r.partition(update.Tags)}
+	i, found := slices.BinarySearchFunc(r.routes, update.FromClient, func(r route, fromClient uint32) int {
+		return cmp.Compare(r.fromClient, fromClient)
+	})
+	if found {
+		r.routes[i] = next
+	} else {
+		r.routes = slices.Insert(r.routes, i, next)
+	}
+	slog.Info("router rescaled", "exchange", r.exchange, "tags", update.Tags, "from_client", update.FromClient)
+}
+
+// routeOf returns the partitioning of the request msg belongs to
+func (r *Router) routeOf(msg []byte) route {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	key, err := protocol.PeekClientKey(msg)
+	if err != nil {
+		return r.routes[len(r.routes)-1]
+	}
+	for i := len(r.routes) - 1; i > 0; i-- {
+		if r.routes[i].fromClient <= key.ClientID {
+			return r.routes[i]
+		}
+	}
+	return r.routes[0]
 }
 
 func (r *Router) Close() error {
+	if r.control != nil {
+		r.control.Close()
+	}
 	return r.p.Close()
 }
 
 func (r *Router) Write(p []byte, key string) error {
-	idx := r.s.Select(key)
-	//o	slog.Debug("Index chosen from router", "index", idx, "key", key, "tag", r.tags[idx])
-	utils.Assert(idx < len(r.tags), "the index should be less that len(r.tags)")
-	return r.p.Write(p, r.tags[idx])
+	return r.WriteWithHeaders(p, key, nil)
+}
+
+// WriteWithHeaders routes p like Write, the headers are dropped if the
+// underlying output can't carry them
+func (r *Router) WriteWithHeaders(p []byte, key string, headers middlewares.Headers) error {
+	tag := r.TagOf(p, key)
+	if writer, ok := r.p.(HeaderWriter); ok && headers != nil {
+		return writer.WriteWithHeaders(p, tag, headers)
+	}
+	return r.p.Write(p, tag)
+}
+
+// TagOf returns the tag Write sends p to when it's written with key
+func (r *Router) TagOf(p []byte, key string) string {
+	route := r.routeOf(p)
+	idx := route.s.Select(key)
+	utils.Assert(idx < len(route.tags), "the index should be less that len(r.tags)")
+	return route.tags[idx]
+}
+
+func (r *Router) BeginBatch() {
+	if batcher, ok := r.p.(Batcher); ok {
+		batcher.BeginBatch()
+	}
+}
+
+func (r *Router) Flush() error {
+	if batcher, ok := r.p.(Batcher); ok {
+		return batcher.Flush()
+	}
+	return nil
+}
+
+// Broadcast writes p to every tag the request of p is routed to
+func (r *Router) Broadcast(p []byte) error {
+	for _, tag := range r.routeOf(p).tags {
+		if err := r.p.Write(p, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Partitions returns over how many tags the request of p is spread
+func (r *Router) Partitions(p []byte) int {
+	if r.partition == nil {
+		return 1
+	}
+	return len(r.routeOf(p).tags)
+}
+
+// WritePartitions writes p to every partition of its request, fixed
+// routers write it to the tag of key
+func (r *Router) WritePartitions(p []byte, key string) error {
+	if r.partition == nil {
+		return r.Write(p, key)
+	}
+	return r.Broadcast(p)
 }
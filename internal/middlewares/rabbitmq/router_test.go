@@ -0,0 +1,189 @@
+package rabbitmq_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/memory"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares/rabbitmq"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+)
+
+var joinerTags = []string{"1", "2", "3"}
+
+func TestConsistentHashRouterIsStableAcrossProcesses(t *testing.T) {
+	// Computed once, every process routing with the same tags must agree
+	expected := map[string]int{
+		"10":      2,
+		"20":      0,
+		"570":     0,
+		"730":     0,
+		"1091500": 2,
+		"292030":  1,
+		"413150":  2,
+	}
+
+	router := rabbitmq.NewConsistentHashRouter(joinerTags, rabbitmq.DefaultVirtualNodes)
+	for key, tag := range expected {
+		if got := router.Select(key); got != tag {
+			t.Errorf("key %s: expected tag %d, got %d", key, tag, got)
+		}
+	}
+}
+
+func TestConsistentHashRouterDoesNotDependOnPreviousKeys(t *testing.T) {
+	router := rabbitmq.NewConsistentHashRouter(joinerTags, rabbitmq.DefaultVirtualNodes)
+	first := router.Select("292030")
+	for i := 0; i < 1000; i++ {
+		router.Select(strconv.Itoa(i))
+	}
+	if got := router.Select("292030"); got != first {
+		t.Errorf("expected tag %d, got %d", first, got)
+	}
+
+	other := rabbitmq.NewConsistentHashRouter(joinerTags, rabbitmq.DefaultVirtualNodes)
+	if got := other.Select("292030"); got != first {
+		t.Errorf("another router chose tag %d instead of %d", got, first)
+	}
+}
+
+func TestConsistentHashRouterSpreadsKeys(t *testing.T) {
+	router := rabbitmq.NewConsistentHashRouter(joinerTags, rabbitmq.DefaultVirtualNodes)
+	const keys = 30000
+	counts := make([]int, len(joinerTags))
+	for i := 0; i < keys; i++ {
+		tag := router.Select(strconv.Itoa(i))
+		if tag < 0 || tag >= len(joinerTags) {
+			t.Fatalf("tag %d out of range", tag)
+		}
+		counts[tag]++
+	}
+
+	for tag, count := range counts {
+		if count < keys/len(joinerTags)/2 {
+			t.Errorf("tag %d got only %d of %d keys", tag, count, keys)
+		}
+	}
+}
+
+func TestConsistentHashRouterMovesFewKeysWhenATagIsAdded(t *testing.T) {
+	before := rabbitmq.NewConsistentHashRouter(joinerTags, rabbitmq.DefaultVirtualNodes)
+	after := rabbitmq.NewConsistentHashRouter(append(joinerTags[:len(joinerTags):len(joinerTags)], "4"), rabbitmq.DefaultVirtualNodes)
+
+	const keys = 10000
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := strconv.Itoa(i)
+		from, to := before.Select(key), after.Select(key)
+		if from != to {
+			if to != len(joinerTags) {
+				t.Fatalf("key %s moved between old tags %d and %d", key, from, to)
+			}
+			moved++
+		}
+	}
+
+	// The new tag takes about a quarter of the keys
+	if moved > keys/2 {
+		t.Errorf("%d of %d keys moved", moved, keys)
+	}
+}
+
+func dataOf(clientID uint32) []byte {
+	msg := protocol.NewDataMessage(protocol.Games, nil, protocol.MessageOptions{ClientID: clientID, RequestID: 1})
+	return msg.Marshal()
+}
+
+func TestPartitionedRouterRescalesNewClientsOnly(t *testing.T) {
+	broker := memory.NewBroker()
+	depths := func() (int, int) {
+		return broker.Depth("joiner-1"), broker.Depth("joiner-2")
+	}
+	for _, tag := range []string{"1", "2"} {
+		subscriber := memory.NewDirectSubscriber(broker, rabbitmq.DirectSubscriberConfig{
+			Exchange: []string{"games"},
+			Queue:    "joiner-" + tag,
+			Keys:     []string{tag},
+		})
+		if err := subscriber.Connect(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	controlConfig := rabbitmq.ControlStreamConfig{Exchange: "router-control", Stream: "router-control.history", Marker: "test"}
+	control := memory.NewControlStream(broker, controlConfig)
+	publisher := memory.NewDirectPublisher(broker, rabbitmq.DirectPublisherConfig{Exchange: "games"})
+	router := rabbitmq.NewPartitionedRouter(publisher, "games", []string{"1"}, control)
+	if err := router.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	control.Publish(rabbitmq.RouterUpdate{Exchange: "games", Tags: []string{"1", "2"}, FromClient: 5})
+
+	deadline := time.Now().Add(time.Second)
+	for router.Partitions(dataOf(5)) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the router didn't apply the update")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := router.Partitions(dataOf(4)); got != 1 {
+		t.Fatalf("a running client got %d partitions", got)
+	}
+
+	for i := 0; i < 100; i++ {
+		router.Write(dataOf(4), strconv.Itoa(i))
+	}
+	if first, second := depths(); first != 100 || second != 0 {
+		t.Fatalf("a running client was repartitioned: %d and %d", first, second)
+	}
+
+	for i := 0; i < 100; i++ {
+		router.Write(dataOf(5), strconv.Itoa(i))
+	}
+	if first, second := depths(); first == 200 || second == 0 {
+		t.Fatalf("a new client wasn't repartitioned: %d and %d", first, second)
+	}
+
+	end := protocol.NewEndMessage(protocol.Games, protocol.MessageOptions{ClientID: 5, RequestID: 1})
+	before1, before2 := depths()
+	if err := router.WritePartitions(end.Marshal(), "game"); err != nil {
+		t.Fatal(err)
+	}
+	if after1, after2 := depths(); after1 != before1+1 || after2 != before2+1 {
+		t.Error("the end didn't reach every partition")
+	}
+}
+
+func TestPartitionedRouterReplaysTheUpdatesPublishedBeforeItStarted(t *testing.T) {
+	broker := memory.NewBroker()
+	controlConfig := rabbitmq.ControlStreamConfig{Exchange: "router-control", Stream: "router-control.history"}
+	updates := memory.NewControlStream(broker, controlConfig)
+	if err := updates.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	updates.Publish(rabbitmq.RouterUpdate{Exchange: "games", Tags: []string{"1", "2"}, FromClient: 5})
+	updates.Publish(rabbitmq.RouterUpdate{Exchange: "reviews", Tags: []string{"1", "2", "3"}, FromClient: 1})
+
+	// The marker of another router doesn't end the replay
+	other := memory.NewControlStream(broker, rabbitmq.ControlStreamConfig{Exchange: "router-control", Stream: "router-control.history", Marker: "other"})
+	other.Mark()
+	updates.Publish(rabbitmq.RouterUpdate{Exchange: "games", Tags: []string{"1", "2", "3"}, FromClient: 8})
+
+	controlConfig.Marker = "restarted"
+	control := memory.NewControlStream(broker, controlConfig)
+	publisher := memory.NewDirectPublisher(broker, rabbitmq.DirectPublisherConfig{Exchange: "games"})
+	router := rabbitmq.NewPartitionedRouter(publisher, "games", []string{"1"}, control)
+	if err := router.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	for client, want := range map[uint32]int{4: 1, 5: 2, 8: 3} {
+		if got := router.Partitions(dataOf(client)); got != want {
+			t.Errorf("client %d got %d partitions, want %d", client, got, want)
+		}
+	}
+}
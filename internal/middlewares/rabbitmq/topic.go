@@ -0,0 +1,181 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
+	"github.com/rabbitmq/amqp091-go"
+	"time"
+)
+
+type TopicPublisherConfig struct {
+	Exchange string
+	Timeout  uint8
+}
+
+// TopicPublisher writes every message with its tag as routing key, like
+// games.indie or reviews.en, subscribers pick them with patterns
+type TopicPublisher struct {
+	ch     *managedChannel
+	Config TopicPublisherConfig
+}
+
+func NewTopicPublisher(config TopicPublisherConfig) *TopicPublisher {
+	return &TopicPublisher{Config: config}
+}
+
+func (p *TopicPublisher) Connect(conn *Connection) error {
+	ch, err := conn.openChannel(p.setup)
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+
+	p.ch = ch
+	return nil
+}
+
+func (p *TopicPublisher) setup(ch *amqp091.Channel) (string, error) {
+	err := ch.ExchangeDeclare(
+		p.Config.Exchange,
+		"topic",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to declare exchange: %w", err)
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		return "", fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+	return "", nil
+}
+
+func (p *TopicPublisher) Write(msg []byte, topic string) error {
+	return p.WriteWithHeaders(msg, topic, nil)
+}
+
+func (p *TopicPublisher) WriteWithHeaders(msg []byte, topic string, headers middlewares.Headers) error {
+	err := p.ch.publish(
+		time.Second*time.Duration(p.Config.Timeout),
+		p.Config.Exchange,
+		topic,
+		amqp091.Publishing{
+			ContentType: "text/plain",
+			Body:        msg,
+			Headers:     amqp091.Table(headers),
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+	return nil
+}
+
+func (p *TopicPublisher) BeginBatch() {
+	p.ch.beginBatch()
+}
+
+// Flush waits until the broker confirms every write since BeginBatch
+func (p *TopicPublisher) Flush() error {
+	return p.ch.flush(time.Second * time.Duration(p.Config.Timeout))
+}
+
+func (p *TopicPublisher) Close() error {
+	return p.ch.close()
+}
+
+type TopicSubscriberConfig struct {
+	Exchange []string
+	Queue    string
+	// Patterns the queue is bound with, * stands for exactly one word
+	// of the topic and # for zero or more
+	Patterns      []string
+	PrefetchCount int
+	MaxRetries    int
+}
+
+type TopicSubscriber struct {
+	ch     *managedChannel
+	Config TopicSubscriberConfig
+}
+
+func NewTopicSubscriber(config TopicSubscriberConfig) *TopicSubscriber {
+	return &TopicSubscriber{Config: config}
+}
+
+func (s *TopicSubscriber) Connect(conn *Connection) error {
+	ch, err := conn.openChannel(s.setup)
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+
+	s.ch = ch
+	return nil
+}
+
+func (s *TopicSubscriber) setup(ch *amqp091.Channel) (string, error) {
+	if s.Config.PrefetchCount > 0 {
+		if err := ch.Qos(s.Config.PrefetchCount, 0, false); err != nil {
+			return "", fmt.Errorf("failed to set QoS: %w", err)
+		}
+	}
+
+	for _, exchange := range s.Config.Exchange {
+		err := ch.ExchangeDeclare(
+			exchange,
+			"topic",
+			true,
+			false,
+			false,
+			false,
+			nil,
+		)
+		if err != nil {
+			return "", fmt.Errorf("failed to declare exchange %s: %w", exchange, err)
+		}
+	}
+
+	q, err := declareQueue(ch, s.Config.Queue, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to declare queue: %w", err)
+	}
+
+	for _, pattern := range s.Config.Patterns {
+		for _, exchange := range s.Config.Exchange {
+			if err := ch.QueueBind(q.Name, pattern, exchange, false, nil); err != nil {
+				return "", fmt.Errorf("failed to bind queue %s to exchange %s: %w", q.Name, exchange, err)
+			}
+		}
+	}
+
+	return q.Name, nil
+}
+
+func (s *TopicSubscriber) GetConsumer() (<-chan middlewares.Delivery, error) {
+	consumer, err := s.ch.consume()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer: %w", err)
+	}
+	return consumer, nil
+}
+
+// Retry sends a message that couldn't be processed back to the queue
+func (s *TopicSubscriber) Retry(delivery middlewares.Delivery, headers middlewares.Headers) error {
+	return s.ch.retry(delivery, headers)
+}
+
+// Park moves a message that keeps failing to the dead letter queue
+func (s *TopicSubscriber) Park(delivery middlewares.Delivery, headers middlewares.Headers) error {
+	return s.ch.park(delivery, headers)
+}
+
+func (s *TopicSubscriber) MaxRetries() int {
+	return s.Config.MaxRetries
+}
+
+func (s *TopicSubscriber) Close() error {
+	return s.ch.close()
+}
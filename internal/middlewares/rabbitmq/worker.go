@@ -1,22 +1,29 @@
 package rabbitmq
 
 import (
-	"context"
 	"fmt"
-	"github.com/rabbitmq/amqp091-go"
+	"sync"
 	"time"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/middlewares"
+	"github.com/rabbitmq/amqp091-go"
 )
 
 type WorkerQueueConfig struct {
 	Name          string
 	Timeout       uint8
 	PrefetchCount int
+	MaxRetries    int
 }
 
 type WorkerQueue struct {
-	ch     *amqp091.Channel
-	q      *amqp091.Queue
+	ch     *managedChannel
 	Config WorkerQueueConfig
+
+	// inspect is the channel Depth runs on, it's opened on the first
+	// call and kept for the following ones
+	inspectMutex sync.Mutex
+	inspect      *amqp091.Channel
 }
 
 func NewWorkerQueue(config WorkerQueueConfig) *WorkerQueue {
@@ -24,43 +31,46 @@ func NewWorkerQueue(config WorkerQueueConfig) *WorkerQueue {
 }
 
 func (wq *WorkerQueue) Connect(conn *Connection) error {
-	ch, err := conn.GetConnection().Channel()
+	ch, err := conn.openChannel(wq.setup)
 	if err != nil {
-		return fmt.Errorf("failed to create channel: %w", err)
+		return err
 	}
 
-	q, err := ch.QueueDeclare(wq.Config.Name, true, false, false, false, nil)
+	wq.ch = ch
+	return nil
+}
+
+func (wq *WorkerQueue) setup(ch *amqp091.Channel) (string, error) {
+	q, err := declareQueue(ch, wq.Config.Name, false)
 	if err != nil {
-		return fmt.Errorf("failed to declare queue: %w", err)
+		return "", fmt.Errorf("failed to declare queue: %w", err)
 	}
 
 	err = ch.Qos(wq.Config.PrefetchCount, 0, false)
 	if err != nil {
-		return fmt.Errorf("failed to set QoS: %w", err)
+		return "", fmt.Errorf("failed to set QoS: %w", err)
 	}
 
-	wq.ch = ch
-	wq.q = &q
-	return nil
+	if err := ch.Confirm(false); err != nil {
+		return "", fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+	return q.Name, nil
 }
 
 func (wq *WorkerQueue) Write(p []byte, tag string) error {
-	ct, cancel := context.WithTimeout(
-		context.Background(),
-		time.Second*time.Duration(wq.Config.Timeout),
-	)
-	defer cancel()
+	return wq.WriteWithHeaders(p, tag, nil)
+}
 
-	err := wq.ch.PublishWithContext(
-		ct,
+func (wq *WorkerQueue) WriteWithHeaders(p []byte, tag string, headers middlewares.Headers) error {
+	err := wq.ch.publish(
+		time.Second*time.Duration(wq.Config.Timeout),
 		"",
 		wq.Config.Name,
-		false,
-		false,
 		amqp091.Publishing{
 			DeliveryMode: amqp091.Persistent,
 			ContentType:  "text/plain",
 			Body:         p,
+			Headers:      amqp091.Table(headers),
 		},
 	)
 	if err != nil {
@@ -70,24 +80,68 @@ func (wq *WorkerQueue) Write(p []byte, tag string) error {
 	return nil
 }
 
-// TODO(fede) - Handle panic
-func (wq *WorkerQueue) GetConsumer() <-chan amqp091.Delivery {
-	consumer, err := wq.ch.Consume(
-		wq.q.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
+func (wq *WorkerQueue) BeginBatch() {
+	wq.ch.beginBatch()
+}
+
+// Flush waits until the broker confirms every write since BeginBatch
+func (wq *WorkerQueue) Flush() error {
+	return wq.ch.flush(time.Second * time.Duration(wq.Config.Timeout))
+}
+
+func (wq *WorkerQueue) GetConsumer() (<-chan middlewares.Delivery, error) {
+	consumer, err := wq.ch.consume()
 	if err != nil {
-		panic("failed to create consumer")
+		return nil, fmt.Errorf("failed to create consumer: %w", err)
 	}
+	return consumer, nil
+}
 
-	return consumer
+// Depth inspects the queue on a channel of its own, a failed inspection
+// closes the channel it runs on and must not take the publishes with it.
+// The channel is reused, it's only opened again once a failure or a
+// reconnection closes it.
+func (wq *WorkerQueue) Depth() (int, error) {
+	wq.inspectMutex.Lock()
+	defer wq.inspectMutex.Unlock()
+
+	if wq.inspect == nil || wq.inspect.IsClosed() {
+		ch, err := wq.ch.conn.GetConnection().Channel()
+		if err != nil {
+			return 0, fmt.Errorf("failed to open channel to inspect queue: %w", err)
+		}
+		wq.inspect = ch
+	}
+
+	q, err := wq.inspect.QueueDeclarePassive(wq.Config.Name, true, false, false, false, nil)
+	if err != nil {
+		wq.inspect.Close()
+		wq.inspect = nil
+		return 0, fmt.Errorf("failed to inspect queue: %w", err)
+	}
+	return q.Messages, nil
+}
+
+// Retry sends a message that couldn't be processed back to the queue
+func (wq *WorkerQueue) Retry(delivery middlewares.Delivery, headers middlewares.Headers) error {
+	return wq.ch.retry(delivery, headers)
+}
+
+// Park moves a message that keeps failing to the dead letter queue
+func (wq *WorkerQueue) Park(delivery middlewares.Delivery, headers middlewares.Headers) error {
+	return wq.ch.park(delivery, headers)
+}
+
+func (wq *WorkerQueue) MaxRetries() int {
+	return wq.Config.MaxRetries
 }
 
 func (wq *WorkerQueue) Close() error {
-	return wq.ch.Close()
+	wq.inspectMutex.Lock()
+	if wq.inspect != nil {
+		wq.inspect.Close()
+		wq.inspect = nil
+	}
+	wq.inspectMutex.Unlock()
+	return wq.ch.close()
 }
@@ -0,0 +1,188 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+)
+
+// Genre is one of the genres of the games dataset, a game keeps the ones
+// it has in a GenreSet
+type Genre uint8
+
+const (
+	GenreAction Genre = iota
+	GenreAdventure
+	GenreCasual
+	GenreIndie
+	GenreMassivelyMultiplayer
+	GenreRacing
+	GenreRPG
+	GenreSimulation
+	GenreSports
+	GenreStrategy
+	GenreEarlyAccess
+	GenreFreeToPlay
+	GenreEducation
+	GenreUtilities
+	GenreAudioProduction
+	GenreVideoProduction
+	GenreWebPublishing
+	GenreSoftwareTraining
+	GenreDesignAndIllustration
+	GenreAnimationAndModeling
+	GenrePhotoEditing
+	GenreGameDevelopment
+	GenreAccounting
+	GenreMovie
+	GenreDocumentary
+	GenreEpisodic
+	GenreShort
+	GenreTutorial
+	Genre360Video
+	GenreViolent
+	GenreGore
+	GenreNudity
+	GenreSexualContent
+	genreCount
+)
+
+var genreNames = [genreCount]string{
+	GenreAction:                "Action",
+	GenreAdventure:             "Adventure",
+	GenreCasual:                "Casual",
+	GenreIndie:                 "Indie",
+	GenreMassivelyMultiplayer:  "Massively Multiplayer",
+	GenreRacing:                "Racing",
+	GenreRPG:                   "RPG",
+	GenreSimulation:            "Simulation",
+	GenreSports:                "Sports",
+	GenreStrategy:              "Strategy",
+	GenreEarlyAccess:           "Early Access",
+	GenreFreeToPlay:            "Free to Play",
+	GenreEducation:             "Education",
+	GenreUtilities:             "Utilities",
+	GenreAudioProduction:       "Audio Production",
+	GenreVideoProduction:       "Video Production",
+	GenreWebPublishing:         "Web Publishing",
+	GenreSoftwareTraining:      "Software Training",
+	GenreDesignAndIllustration: "Design & Illustration",
+	GenreAnimationAndModeling:  "Animation & Modeling",
+	GenrePhotoEditing:          "Photo Editing",
+	GenreGameDevelopment:       "Game Development",
+	GenreAccounting:            "Accounting",
+	GenreMovie:                 "Movie",
+	GenreDocumentary:           "Documentary",
+	GenreEpisodic:              "Episodic",
+	GenreShort:                 "Short",
+	GenreTutorial:              "Tutorial",
+	Genre360Video:              "360 Video",
+	GenreViolent:               "Violent",
+	GenreGore:                  "Gore",
+	GenreNudity:                "Nudity",
+	GenreSexualContent:         "Sexual Content",
+}
+
+// genresByName has the known genres by their lowercase name
+var genresByName = func() map[string]Genre {
+	genres := make(map[string]Genre, genreCount)
+	for genre, name := range genreNames {
+		genres[strings.ToLower(name)] = Genre(genre)
+	}
+	return genres
+}()
+
+func (g Genre) String() string {
+	return genreNames[g]
+}
+
+// LookupGenre returns the known genre called name, whatever its case
+func LookupGenre(name string) (Genre, bool) {
+	genre, ok := genresByName[strings.ToLower(name)]
+	return genre, ok
+}
+
+// GenreSet has the bit of every genre it contains set
+type GenreSet uint64
+
+func (s GenreSet) Has(genre Genre) bool {
+	return s&(1<<genre) != 0
+}
+
+func (s *GenreSet) Add(genre Genre) {
+	*s |= 1 << genre
+}
+
+// Genres are the genres of a game, the known ones are kept as a set and
+// the rest by name
+type Genres struct {
+	Known GenreSet
+	// Other are the genres that aren't known, in the order they appear
+	Other []string
+}
+
+// ParseGenres reads the comma separated genres of a csv line, the empty
+// and repeated ones are dropped
+func ParseGenres(raw string) Genres {
+	var genres Genres
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if genre, ok := LookupGenre(name); ok {
+			genres.Known.Add(genre)
+		} else if !genres.hasOther(name) {
+			genres.Other = append(genres.Other, name)
+		}
+	}
+	return genres
+}
+
+func (g Genres) hasOther(name string) bool {
+	for _, other := range g.Other {
+		if strings.EqualFold(other, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Has tells in constant time whether the game is of a known genre
+func (g Genres) Has(genre Genre) bool {
+	return g.Known.Has(genre)
+}
+
+// Names returns the known genres in the order they're declared followed
+// by the other ones
+func (g Genres) Names() []string {
+	var names []string
+	for genre := range genreCount {
+		if g.Known.Has(genre) {
+			names = append(names, genre.String())
+		}
+	}
+	return append(names, g.Other...)
+}
+
+// write writes the set of known genres and the names of the rest, most
+// games have none of those
+func (g Genres) write(builder *protocol.PayloadBuffer) {
+	builder.WriteUint64(uint64(g.Known))
+	builder.WriteUint32(uint32(len(g.Other)))
+	for _, name := range g.Other {
+		builder.WriteBytes([]byte(name))
+	}
+}
+
+func readGenres(r *elementReader) Genres {
+	genres := Genres{Known: GenreSet(r.uint64())}
+	others := r.uint32()
+	for range others {
+		if r.err != nil {
+			break
+		}
+		genres.Other = append(genres.Other, r.string())
+	}
+	return genres
+}
@@ -1,7 +1,5 @@
 package models
 
-// Position in the csv file counting from zero
-
 import (
 	"fmt"
 	"strconv"
@@ -13,19 +11,6 @@ import (
 const releaseDateFmtWithDay = "Jan 2, 2006"
 const releaseDateFmtOnlyMonthYear = "Jan 2006"
 
-const (
-	AppIDCSVPosition              = 0
-	NameCSVPosition               = 1
-	ReleaseDateCSVPosition        = 2
-	OSWindowsCSVPosition          = 17
-	OSMacCSVPosition              = 18
-	OSLinuxCSVPosition            = 19
-	AvgPlaytimeForeverCSVPosition = 29
-	GenresCSVPosition             = 36
-	ReviewTextCSVPosition         = 2
-	ReviewScoreCSVPosition        = 3
-)
-
 type OS byte
 
 const (
@@ -46,13 +31,106 @@ func (o OS) IsLinuxSupported() bool {
 	return (o & LinuxMask) == LinuxMask
 }
 
+// GameFields is a set of fields of a game, every stage declares the ones
+// it reads and the rest aren't sent
+type GameFields uint32
+
+const (
+	AppIDField GameFields = 1 << iota
+	NameField
+	GenresField
+	ReleaseYearField
+	AvgPlayTimeField
+	SupportedOSField
+	PriceField
+	DevelopersField
+	PublishersField
+	CategoriesField
+	TagsField
+	PositiveField
+	NegativeField
+	EstimatedOwnersField
+
+	AllGameFields GameFields = 1<<iota - 1
+)
+
+func (f GameFields) Has(field GameFields) bool {
+	return f&field == field
+}
+
 type Game struct {
-	AppID       string
-	Name        string
-	Genres      string
+	AppID string
+	Name  string
+	// Genres are parsed once by the projection, a genre is looked up in
+	// constant time
+	Genres      Genres
 	ReleaseYear uint32
 	AvgPlayTime float32
 	SupportedOS OS
+	Price       float32
+	// Developers, Publishers, Categories and Tags are comma separated
+	// lists
+	Developers string
+	Publishers string
+	Categories string
+	Tags       string
+	// Positive and Negative are the counts of reviews of each kind
+	Positive uint32
+	Negative uint32
+	// EstimatedOwners is a range, like "20000 - 50000"
+	EstimatedOwners string
+	// Fields are the fields set, the rest are zero
+	Fields GameFields
+}
+
+// Project keeps only the fields given, the rest are zeroed and aren't
+// written to the payload
+func (g *Game) Project(fields GameFields) {
+	fields &= g.Fields
+	projected := Game{Fields: fields}
+	if fields.Has(AppIDField) {
+		projected.AppID = g.AppID
+	}
+	if fields.Has(NameField) {
+		projected.Name = g.Name
+	}
+	if fields.Has(GenresField) {
+		projected.Genres = g.Genres
+	}
+	if fields.Has(ReleaseYearField) {
+		projected.ReleaseYear = g.ReleaseYear
+	}
+	if fields.Has(AvgPlayTimeField) {
+		projected.AvgPlayTime = g.AvgPlayTime
+	}
+	if fields.Has(SupportedOSField) {
+		projected.SupportedOS = g.SupportedOS
+	}
+	if fields.Has(PriceField) {
+		projected.Price = g.Price
+	}
+	if fields.Has(DevelopersField) {
+		projected.Developers = g.Developers
+	}
+	if fields.Has(PublishersField) {
+		projected.Publishers = g.Publishers
+	}
+	if fields.Has(CategoriesField) {
+		projected.Categories = g.Categories
+	}
+	if fields.Has(TagsField) {
+		projected.Tags = g.Tags
+	}
+	if fields.Has(PositiveField) {
+		projected.Positive = g.Positive
+	}
+	if fields.Has(NegativeField) {
+		projected.Negative = g.Negative
+	}
+	if fields.Has(EstimatedOwnersField) {
+		projected.EstimatedOwners = g.EstimatedOwners
+	}
+	*g = projected
 }
 
 type playableIn struct {
@@ -90,29 +168,49 @@ func ParseDate(data string) (time.Time, error) {
 	return time.Time{}, fmt.Errorf("error with release date format %s", data)
 }
 
-func GameFromCSVLine(csvLine []string) (*Game, error) {
-	releaseDate, err := ParseDate(csvLine[ReleaseDateCSVPosition])
+// FieldError is returned when a column of a csv line has a value that
+// can't be parsed
+type FieldError struct {
+	Column string
+	Err    error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("couldn't parse %s: %v", e.Column, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// GameFromCSVLine builds a game from a line of the file whose header is
+// schema
+func GameFromCSVLine(schema *CSVSchema, csvLine []string) (*Game, error) {
+	if err := schema.Check(csvLine); err != nil {
+		return nil, err
+	}
+	releaseDate, err := ParseDate(schema.Get(csvLine, ReleaseDateColumn))
 	if err != nil {
-		return nil, fmt.Errorf("couldn't parse release date: %w", err)
+		return nil, &FieldError{Column: ReleaseDateColumn, Err: err}
 	}
-	avgPlaytime, err := strconv.ParseFloat(csvLine[AvgPlaytimeForeverCSVPosition], 32)
+	avgPlaytime, err := strconv.ParseFloat(schema.Get(csvLine, AvgPlaytimeForeverColumn), 32)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't parse average playtime forever: %w", err)
+		return nil, &FieldError{Column: AvgPlaytimeForeverColumn, Err: err}
 	}
 
-	osWindows, err := strconv.ParseBool(csvLine[OSWindowsCSVPosition])
+	osWindows, err := strconv.ParseBool(schema.Get(csvLine, WindowsColumn))
 	if err != nil {
-		return nil, fmt.Errorf("couldn't parse windows flag: %w", err)
+		return nil, &FieldError{Column: WindowsColumn, Err: err}
 	}
 
-	osMac, err := strconv.ParseBool(csvLine[OSMacCSVPosition])
+	osMac, err := strconv.ParseBool(schema.Get(csvLine, MacColumn))
 	if err != nil {
-		return nil, fmt.Errorf("couldn't parse mac flag: %w", err)
+		return nil, &FieldError{Column: MacColumn, Err: err}
 	}
 
-	osLinux, err := strconv.ParseBool(csvLine[OSLinuxCSVPosition])
+	osLinux, err := strconv.ParseBool(schema.Get(csvLine, LinuxColumn))
 	if err != nil {
-		return nil, fmt.Errorf("couldn't parse linux flag: %w", err)
+		return nil, &FieldError{Column: LinuxColumn, Err: err}
 	}
 
 	supportedOS := getSupportedOSs(playableIn{
@@ -121,25 +219,87 @@ func GameFromCSVLine(csvLine []string) (*Game, error) {
 		linux:   osLinux,
 	})
 
+	price, err := strconv.ParseFloat(schema.Get(csvLine, PriceColumn), 32)
+	if err != nil {
+		return nil, &FieldError{Column: PriceColumn, Err: err}
+	}
+
+	positive, err := strconv.ParseUint(schema.Get(csvLine, PositiveColumn), 10, 32)
+	if err != nil {
+		return nil, &FieldError{Column: PositiveColumn, Err: err}
+	}
+
+	negative, err := strconv.ParseUint(schema.Get(csvLine, NegativeColumn), 10, 32)
+	if err != nil {
+		return nil, &FieldError{Column: NegativeColumn, Err: err}
+	}
+
 	return &Game{
-		AppID:       csvLine[AppIDCSVPosition],
-		Name:        csvLine[NameCSVPosition],
-		Genres:      csvLine[GenresCSVPosition],
-		ReleaseYear: uint32(releaseDate.Year()),
-		AvgPlayTime: float32(avgPlaytime),
-		SupportedOS: supportedOS,
+		AppID:           schema.Get(csvLine, AppIDColumn),
+		Name:            schema.Get(csvLine, NameColumn),
+		Genres:          ParseGenres(schema.Get(csvLine, GenresColumn)),
+		ReleaseYear:     uint32(releaseDate.Year()),
+		AvgPlayTime:     float32(avgPlaytime),
+		SupportedOS:     supportedOS,
+		Price:           float32(price),
+		Developers:      schema.Get(csvLine, DevelopersColumn),
+		Publishers:      schema.Get(csvLine, PublishersColumn),
+		Categories:      schema.Get(csvLine, CategoriesColumn),
+		Tags:            schema.Get(csvLine, TagsColumn),
+		Positive:        uint32(positive),
+		Negative:        uint32(negative),
+		EstimatedOwners: schema.Get(csvLine, EstimatedOwnersColumn),
+		Fields:          AllGameFields,
 	}, nil
 }
 
+// BuildPayload writes the set fields, preceded by which they are
 func (g *Game) BuildPayload(builder *protocol.PayloadBuffer) {
 	builder.BeginPayloadElement()
 
-	builder.WriteBytes([]byte(g.AppID))
-	builder.WriteBytes([]byte(g.Name))
-	builder.WriteBytes([]byte(g.Genres))
-	builder.WriteUint32(g.ReleaseYear)
-	builder.WriteFloat32(g.AvgPlayTime)
-	builder.WriteByte(byte(g.SupportedOS))
+	builder.WriteUint32(uint32(g.Fields))
+	if g.Fields.Has(AppIDField) {
+		builder.WriteBytes([]byte(g.AppID))
+	}
+	if g.Fields.Has(NameField) {
+		builder.WriteBytes([]byte(g.Name))
+	}
+	if g.Fields.Has(GenresField) {
+		g.Genres.write(builder)
+	}
+	if g.Fields.Has(ReleaseYearField) {
+		builder.WriteUint32(g.ReleaseYear)
+	}
+	if g.Fields.Has(AvgPlayTimeField) {
+		builder.WriteFloat32(g.AvgPlayTime)
+	}
+	if g.Fields.Has(SupportedOSField) {
+		builder.WriteByte(byte(g.SupportedOS))
+	}
+	if g.Fields.Has(PriceField) {
+		builder.WriteFloat32(g.Price)
+	}
+	if g.Fields.Has(DevelopersField) {
+		builder.WriteBytes([]byte(g.Developers))
+	}
+	if g.Fields.Has(PublishersField) {
+		builder.WriteBytes([]byte(g.Publishers))
+	}
+	if g.Fields.Has(CategoriesField) {
+		builder.WriteBytes([]byte(g.Categories))
+	}
+	if g.Fields.Has(TagsField) {
+		builder.WriteBytes([]byte(g.Tags))
+	}
+	if g.Fields.Has(PositiveField) {
+		builder.WriteUint32(g.Positive)
+	}
+	if g.Fields.Has(NegativeField) {
+		builder.WriteUint32(g.Negative)
+	}
+	if g.Fields.Has(EstimatedOwnersField) {
+		builder.WriteBytes([]byte(g.EstimatedOwners))
+	}
 
 	builder.EndPayloadElement()
 }
@@ -167,17 +327,28 @@ type Review struct {
 	Name  string
 	Text  string
 	Score ReviewScore
+	// Language is the name of the language the text is written in, empty
+	// until the review is classified
+	Language string
+	// Sentiment of the text from -1 to 1, zero until the review is
+	// analyzed
+	Sentiment float32
 }
 
-func ReviewFromCSVLine(csvLine []string) (*Review, error) {
-	reviewScore, err := reviewScoreFromString(csvLine[ReviewScoreCSVPosition])
+// ReviewFromCSVLine builds a review from a line of the file whose header
+// is schema
+func ReviewFromCSVLine(schema *CSVSchema, csvLine []string) (*Review, error) {
+	if err := schema.Check(csvLine); err != nil {
+		return nil, err
+	}
+	reviewScore, err := reviewScoreFromString(schema.Get(csvLine, ReviewScoreColumn))
 	if err != nil {
-		return nil, fmt.Errorf("couldn't parse review score: %w", err)
+		return nil, &FieldError{Column: ReviewScoreColumn, Err: err}
 	}
 	return &Review{
-		AppID: csvLine[AppIDCSVPosition],
-		Name:  csvLine[NameCSVPosition],
-		Text:  csvLine[ReviewTextCSVPosition],
+		AppID: schema.Get(csvLine, ReviewAppIDColumn),
+		Name:  schema.Get(csvLine, ReviewNameColumn),
+		Text:  schema.Get(csvLine, ReviewTextColumn),
 		Score: reviewScore,
 	}, nil
 }
@@ -189,30 +360,157 @@ func (r *Review) BuildPayload(builder *protocol.PayloadBuffer) {
 	builder.WriteBytes([]byte(r.Name))
 	builder.WriteBytes([]byte(r.Text))
 	builder.WriteByte(byte(r.Score))
+	builder.WriteBytes([]byte(r.Language))
+	builder.WriteFloat32(r.Sentiment)
 
 	builder.EndPayloadElement()
 }
 
-func ReadReview(element *protocol.Element) Review {
+// elementReader reads the fields of an element. Once a read fails the
+// following ones are skipped and err keeps the failure, so a whole model
+// is read before checking it.
+type elementReader struct {
+	element *protocol.Element
+	err     error
+}
+
+func (r *elementReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	var b []byte
+	b, r.err = r.element.ReadBytes()
+	return string(b)
+}
+
+func (r *elementReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	var b byte
+	b, r.err = r.element.ReadByte()
+	return b
+}
+
+func (r *elementReader) uint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	var v uint32
+	v, r.err = r.element.ReadUint32()
+	return v
+}
+
+func (r *elementReader) uint64() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	var v uint64
+	v, r.err = r.element.ReadUint64()
+	return v
+}
+
+func (r *elementReader) float32() float32 {
+	if r.err != nil {
+		return 0
+	}
+	var v float32
+	v, r.err = r.element.ReadFloat32()
+	return v
+}
+
+func ReadReview(element *protocol.Element) (Review, error) {
+	r := elementReader{element: element}
 	review := Review{
-		AppID: string(element.ReadBytes()),
-		Name:  string(element.ReadBytes()),
-		Text:  string(element.ReadBytes()),
-		Score: ReviewScore(int8(element.ReadByte())),
+		AppID:     r.string(),
+		Name:      r.string(),
+		Text:      r.string(),
+		Score:     ReviewScore(int8(r.byte())),
+		Language:  r.string(),
+		Sentiment: r.float32(),
 	}
-	return review
+	if r.err != nil {
+		return Review{}, fmt.Errorf("couldn't read review: %w", r.err)
+	}
+	return review, nil
 }
 
-func ReadGame(element *protocol.Element) Game {
-	game := Game{
-		AppID:       string(element.ReadBytes()),
-		Name:        string(element.ReadBytes()),
-		Genres:      string(element.ReadBytes()),
-		ReleaseYear: element.ReadUint32(),
-		AvgPlayTime: element.ReadFloat32(),
-		SupportedOS: OS(element.ReadByte()),
+func ReadGame(element *protocol.Element) (Game, error) {
+	r := elementReader{element: element}
+	game := Game{Fields: GameFields(r.uint32())}
+	if game.Fields.Has(AppIDField) {
+		game.AppID = r.string()
+	}
+	if game.Fields.Has(NameField) {
+		game.Name = r.string()
+	}
+	if game.Fields.Has(GenresField) {
+		game.Genres = readGenres(&r)
+	}
+	if game.Fields.Has(ReleaseYearField) {
+		game.ReleaseYear = r.uint32()
+	}
+	if game.Fields.Has(AvgPlayTimeField) {
+		game.AvgPlayTime = r.float32()
+	}
+	if game.Fields.Has(SupportedOSField) {
+		game.SupportedOS = OS(r.byte())
+	}
+	if game.Fields.Has(PriceField) {
+		game.Price = r.float32()
+	}
+	if game.Fields.Has(DevelopersField) {
+		game.Developers = r.string()
+	}
+	if game.Fields.Has(PublishersField) {
+		game.Publishers = r.string()
+	}
+	if game.Fields.Has(CategoriesField) {
+		game.Categories = r.string()
+	}
+	if game.Fields.Has(TagsField) {
+		game.Tags = r.string()
+	}
+	if game.Fields.Has(PositiveField) {
+		game.Positive = r.uint32()
+	}
+	if game.Fields.Has(NegativeField) {
+		game.Negative = r.uint32()
+	}
+	if game.Fields.Has(EstimatedOwnersField) {
+		game.EstimatedOwners = r.string()
+	}
+	if r.err != nil {
+		return Game{}, fmt.Errorf("couldn't read game: %w", r.err)
+	}
+	return game, nil
+}
+
+// ReadGames reads every game of the elements, a message is either
+// processed whole or not at all
+func ReadGames(elements *protocol.PayloadElements) ([]Game, error) {
+	var games []Game
+	for i, element := range elements.Iter() {
+		game, err := ReadGame(&element)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		games = append(games, game)
+	}
+	return games, nil
+}
+
+// ReadReviews reads every review of the elements, see ReadGames
+func ReadReviews(elements *protocol.PayloadElements) ([]Review, error) {
+	var reviews []Review
+	for i, element := range elements.Iter() {
+		review, err := ReadReview(&element)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		reviews = append(reviews, review)
 	}
-	return game
+	return reviews, nil
 }
 
 func (g Game) GetID() string {
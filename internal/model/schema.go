@@ -0,0 +1,183 @@
+package models
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strings"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
+)
+
+// ErrSchemaMismatch is returned when a csv file doesn't have the columns
+// expected
+var ErrSchemaMismatch = errors.New("csv schema mismatch")
+
+// Names of the columns of the games dataset
+const (
+	AppIDColumn              = "AppID"
+	NameColumn               = "Name"
+	ReleaseDateColumn        = "Release date"
+	EstimatedOwnersColumn    = "Estimated owners"
+	PriceColumn              = "Price"
+	WindowsColumn            = "Windows"
+	MacColumn                = "Mac"
+	LinuxColumn              = "Linux"
+	PositiveColumn           = "Positive"
+	NegativeColumn           = "Negative"
+	AvgPlaytimeForeverColumn = "Average playtime forever"
+	DevelopersColumn         = "Developers"
+	PublishersColumn         = "Publishers"
+	CategoriesColumn         = "Categories"
+	GenresColumn             = "Genres"
+	TagsColumn               = "Tags"
+)
+
+// Names of the columns of the reviews dataset
+const (
+	ReviewAppIDColumn = "app_id"
+	ReviewNameColumn  = "app_name"
+	ReviewTextColumn  = "review_text"
+	ReviewScoreColumn = "review_score"
+)
+
+var gameColumns = []string{
+	AppIDColumn,
+	NameColumn,
+	ReleaseDateColumn,
+	EstimatedOwnersColumn,
+	PriceColumn,
+	WindowsColumn,
+	MacColumn,
+	LinuxColumn,
+	PositiveColumn,
+	NegativeColumn,
+	AvgPlaytimeForeverColumn,
+	DevelopersColumn,
+	PublishersColumn,
+	CategoriesColumn,
+	GenresColumn,
+	TagsColumn,
+}
+
+var reviewColumns = []string{
+	ReviewAppIDColumn,
+	ReviewNameColumn,
+	ReviewTextColumn,
+	ReviewScoreColumn,
+}
+
+// CSVSchema has the position of every column of a csv file, read from its
+// header
+type CSVSchema struct {
+	positions map[string]int
+	columns   int
+}
+
+// NewGameSchema reads the header of a games file, it fails if a column
+// the games are built from is missing
+func NewGameSchema(header string) (*CSVSchema, error) {
+	names, err := parseHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	// The header of the games dataset lacks the comma between these two,
+	// the lines do have both values
+	if i := slices.Index(names, "DiscountDLC count"); i != -1 {
+		names = slices.Replace(names, i, i+1, "Discount", "DLC count")
+	}
+	return newCSVSchema(names, gameColumns)
+}
+
+// NewReviewSchema reads the header of a reviews file, it fails if a
+// column the reviews are built from is missing
+func NewReviewSchema(header string) (*CSVSchema, error) {
+	names, err := parseHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	return newCSVSchema(names, reviewColumns)
+}
+
+func parseHeader(header string) ([]string, error) {
+	reader := csv.NewReader(strings.NewReader(header))
+	reader.LazyQuotes = true
+	names, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't parse the header %q: %v", ErrSchemaMismatch, header, err)
+	}
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+	}
+	return names, nil
+}
+
+func newCSVSchema(names []string, required []string) (*CSVSchema, error) {
+	schema := &CSVSchema{positions: make(map[string]int, len(names))}
+	for _, name := range names {
+		schema.add(name)
+	}
+
+	var missing []string
+	for _, name := range required {
+		if _, ok := schema.positions[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%w: the header is missing the columns %s", ErrSchemaMismatch, strings.Join(missing, ", "))
+	}
+	return schema, nil
+}
+
+func (s *CSVSchema) add(name string) {
+	s.positions[name] = s.columns
+	s.columns++
+}
+
+// Check fails when line doesn't have a value for every column
+func (s *CSVSchema) Check(line []string) error {
+	if len(line) != s.columns {
+		return fmt.Errorf("%w: the line has %d fields but the header has %d columns", ErrSchemaMismatch, len(line), s.columns)
+	}
+	return nil
+}
+
+// Get returns the value of the column in line, the line must be checked
+// first and the column part of the schema
+func (s *CSVSchema) Get(line []string, column string) string {
+	return line[s.positions[column]]
+}
+
+// SchemaCache keeps the schemas of the last headers parsed, keyed by the
+// hash of the header. Every batch of a file carries the same one. It's
+// safe for concurrent use.
+type SchemaCache struct {
+	parse   func(header string) (*CSVSchema, error)
+	schemas *utils.LRU[uint64, *CSVSchema]
+}
+
+// NewSchemaCache keeps up to size schemas built with parse, like
+// NewGameSchema or NewReviewSchema
+func NewSchemaCache(size int, parse func(header string) (*CSVSchema, error)) *SchemaCache {
+	return &SchemaCache{parse: parse, schemas: utils.NewLRU[uint64, *CSVSchema](size)}
+}
+
+// Get returns the schema of header, it's only parsed the first time.
+// Headers that fail to parse aren't kept.
+func (c *SchemaCache) Get(header []byte) (*CSVSchema, error) {
+	hash := fnv.New64a()
+	hash.Write(header)
+	key := hash.Sum64()
+	if schema, ok := c.schemas.Get(key); ok {
+		return schema, nil
+	}
+	schema, err := c.parse(string(header))
+	if err != nil {
+		return nil, err
+	}
+	c.schemas.Put(key, schema)
+	return schema, nil
+}
@@ -2,12 +2,17 @@ package network
 
 import (
 	"bufio"
+	"errors"
 	"net"
+	"os"
+	"time"
 )
 
 const (
-	tpcNetwork = "tcp"
-	bufferSize = 4 * 1024
+	tpcNetwork      = "tcp"
+	bufferSize      = 4 * 1024
+	keepAlivePeriod = 15 * time.Second
+	noTimeout       = time.Duration(0)
 )
 
 type SocketTcp struct {
@@ -15,6 +20,9 @@ type SocketTcp struct {
 	connection     net.Conn
 	listener       net.Listener
 	bufferedReader *bufio.Reader
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
 }
 
 func NewSocketTcp(address string) (*SocketTcp, func()) {
@@ -49,6 +57,13 @@ func (s *SocketTcp) closeListener() error {
 	return s.listener.Close()
 }
 
+// SetTimeouts configures the deadlines applied to every Send and
+// Receive. A zero duration disables the corresponding deadline.
+func (s *SocketTcp) SetTimeouts(readTimeout time.Duration, writeTimeout time.Duration) {
+	s.readTimeout = readTimeout
+	s.writeTimeout = writeTimeout
+}
+
 func (s *SocketTcp) Connect() error {
 	connection, err := net.Dial(tpcNetwork, s.address)
 	if err != nil {
@@ -70,6 +85,12 @@ func (s *SocketTcp) Accept() (*SocketTcp, func(), error) {
 }
 
 func (s *SocketTcp) prepareConnection(connection net.Conn) {
+	if tcpConnection, ok := connection.(*net.TCPConn); ok {
+		// Let the kernel probe idle peers so half-open connections
+		// eventually surface as errors
+		tcpConnection.SetKeepAlive(true)
+		tcpConnection.SetKeepAlivePeriod(keepAlivePeriod)
+	}
 	s.connection = connection
 	s.bufferedReader = bufio.NewReaderSize(s.connection, bufferSize)
 }
@@ -84,6 +105,10 @@ func (s *SocketTcp) Listen() error {
 }
 
 func (s *SocketTcp) Send(data []byte) error {
+	if err := s.setWriteDeadline(); err != nil {
+		return err
+	}
+
 	remainingBytes := len(data)
 	for remainingBytes > 0 {
 		n, err := s.connection.Write(data)
@@ -98,6 +123,10 @@ func (s *SocketTcp) Send(data []byte) error {
 }
 
 func (s *SocketTcp) Receive(buffer []byte) error {
+	if err := s.setReadDeadline(); err != nil {
+		return err
+	}
+
 	remainingBytes := len(buffer)
 	for remainingBytes > 0 {
 		n, err := s.bufferedReader.Read(buffer)
@@ -111,6 +140,26 @@ func (s *SocketTcp) Receive(buffer []byte) error {
 	return nil
 }
 
+func (s *SocketTcp) setReadDeadline() error {
+	if s.readTimeout == noTimeout {
+		return nil
+	}
+	return s.connection.SetReadDeadline(time.Now().Add(s.readTimeout))
+}
+
+func (s *SocketTcp) setWriteDeadline() error {
+	if s.writeTimeout == noTimeout {
+		return nil
+	}
+	return s.connection.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+}
+
 func (s *SocketTcp) GetConnection() net.Conn {
 	return s.connection
 }
+
+// IsTimeout reports whether err was caused by an expired read or
+// write deadline
+func IsTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
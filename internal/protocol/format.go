@@ -3,6 +3,8 @@ package protocol
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"iter"
 	"math"
 )
@@ -52,6 +54,12 @@ func (p *PayloadBuffer) WriteUint32(v uint32) {
 	p.tmp.Write(p.fourBytesBuf[:])
 }
 
+func (p *PayloadBuffer) WriteUint64(v uint64) {
+	var eightBytesBuf [8]byte
+	binary.LittleEndian.PutUint64(eightBytesBuf[:], v)
+	p.tmp.Write(eightBytesBuf[:])
+}
+
 func (p *PayloadBuffer) WriteFloat32(v float32) {
 	binary.LittleEndian.PutUint32(p.fourBytesBuf[:], math.Float32bits(v))
 	p.tmp.Write(p.fourBytesBuf[:])
@@ -61,24 +69,47 @@ func (p *PayloadBuffer) Bytes() []byte {
 	return p.buf.Bytes()
 }
 
+// ErrShortElement is returned when a payload or an element has fewer
+// bytes left than what's read from it
+var ErrShortElement = errors.New("not enough bytes left")
+
 // TODO(juan): make it a method of the message
 type PayloadElements struct {
 	payloads [][]byte
 	pos      int
 }
 
-func newPayloadElements(p []byte) (*PayloadElements, int) {
+// newPayloadElements splits p into its elements, an empty payload has
+// none
+func newPayloadElements(p []byte) (*PayloadElements, error) {
+	if len(p) == 0 {
+		return &PayloadElements{}, nil
+	}
+	if len(p) < 4 {
+		return nil, fmt.Errorf("element count: %w", ErrShortElement)
+	}
 	cnt := binary.LittleEndian.Uint32(p[:4])
 	p = p[4:]
+	// Every element takes at least the four bytes of its length, a count
+	// bigger than that comes from a malformed payload
+	if uint64(cnt) > uint64(len(p)/4) {
+		return nil, fmt.Errorf("%d elements: %w", cnt, ErrShortElement)
+	}
 	payloads := make([][]byte, cnt)
 	for i := 0; i < int(cnt); i++ {
+		if len(p) < 4 {
+			return nil, fmt.Errorf("length of element %d: %w", i, ErrShortElement)
+		}
 		l := binary.LittleEndian.Uint32(p[:4])
 		p = p[4:]
+		if uint64(l) > uint64(len(p)) {
+			return nil, fmt.Errorf("element %d of %d bytes: %w", i, l, ErrShortElement)
+		}
 		payloads[i] = p[:l]
 		p = p[l:]
 
 	}
-	return &PayloadElements{payloads, 0}, int(cnt)
+	return &PayloadElements{payloads, 0}, nil
 }
 
 type Element []byte
@@ -102,28 +133,52 @@ func (p *PayloadElements) NextElement() (Element, bool) {
 	return Element(element), true
 }
 
-func (p *Element) ReadUint32() uint32 {
-	value := binary.LittleEndian.Uint32((*p)[:4])
-	*p = (*p)[4:]
-	return value
+// next consumes the following n bytes of the element
+func (p *Element) next(n uint64) ([]byte, error) {
+	if uint64(len(*p)) < n {
+		return nil, fmt.Errorf("reading %d bytes of %d: %w", n, len(*p), ErrShortElement)
+	}
+	b := (*p)[:n]
+	*p = (*p)[n:]
+	return b, nil
+}
+
+func (p *Element) ReadUint32() (uint32, error) {
+	b, err := p.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
 }
 
-func (p *Element) ReadFloat32() float32 {
-	value := binary.LittleEndian.Uint32((*p)[:4])
-	(*p) = (*p)[4:]
-	return math.Float32frombits(value)
+func (p *Element) ReadUint64() (uint64, error) {
+	b, err := p.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
 }
 
-func (p *Element) ReadByte() byte {
-	b := (*p)[0]
-	(*p) = (*p)[1:]
-	return b
+func (p *Element) ReadFloat32() (float32, error) {
+	value, err := p.ReadUint32()
+	if err != nil {
+		return 0, err
+	}
+	return math.Float32frombits(value), nil
 }
 
-func (p *Element) ReadBytes() []byte {
-	length := binary.LittleEndian.Uint32((*p)[:4])
-	(*p) = (*p)[4:]
-	data := (*p)[:length]
-	(*p) = (*p)[length:]
-	return data
+func (p *Element) ReadByte() (byte, error) {
+	b, err := p.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (p *Element) ReadBytes() ([]byte, error) {
+	length, err := p.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	return p.next(uint64(length))
 }
@@ -20,6 +20,8 @@ func (m MessageType) String() string {
 		return "end message"
 	case Results:
 		return "results message"
+	case Cancel:
+		return "cancel message"
 	default:
 		utils.Assertf(false, "unexpected protocol.MessageType: %#v", m)
 		return "[unknown message]"
@@ -35,16 +37,31 @@ const (
 	End     MessageType = 0 // 0b00
 	Data    MessageType = 1 // 0b01
 	Results MessageType = 2 // 0b10
+	Cancel  MessageType = 3 // 0b11
 )
 
+// The query number is kept in the five upper bits of the type, the lower
+// three are the kind and the data type
 const (
 	Query1 QueryNumber = (1 << 3)
-	Query2 QueryNumber = (1 << 4)
-	Query3 QueryNumber = (1 << 5)
-	Query4 QueryNumber = (1 << 6)
-	Query5 QueryNumber = (1 << 7)
+	Query2 QueryNumber = (2 << 3)
+	Query3 QueryNumber = (3 << 3)
+	Query4 QueryNumber = (4 << 3)
+	Query5 QueryNumber = (5 << 3)
+	Query6 QueryNumber = (6 << 3)
+	Query7 QueryNumber = (7 << 3)
+	Query8 QueryNumber = (8 << 3)
+	// Rejections carries the csv rows the projection couldn't parse, it
+	// isn't a query but travels to the results like one. It takes the
+	// last number so the queries can grow.
+	Rejections QueryNumber = (31 << 3)
 )
 
+// Number returns the number GetQueryNumber returns for q
+func (q QueryNumber) Number() int {
+	return int(q >> 3)
+}
+
 type Message struct {
 	messageType MessageType
 	messageID   uint32
@@ -60,6 +77,13 @@ type MessageOptions struct {
 	RequestID uint32
 }
 
+// ClientKey identifies a client request, controllers keep their state
+// separated by it
+type ClientKey struct {
+	ClientID  uint32
+	RequestID uint32
+}
+
 func NewEndMessage(d DataType, opts MessageOptions) Message {
 	messageType := End
 	if d == Games {
@@ -74,6 +98,19 @@ func NewEndMessage(d DataType, opts MessageOptions) Message {
 	}
 }
 
+// NewPartitionedEndMessage is the END of a stage whose data may be
+// spread over partitions. senders is how many ENDs of the request the
+// receiver must gather, receivers how many partitions get this END.
+func NewPartitionedEndMessage(d DataType, senders int, receivers int, opts MessageOptions) Message {
+	msg := NewEndMessage(d, opts)
+	if senders > 1 || receivers > 1 {
+		msg.payload = binary.LittleEndian.AppendUint32(nil, uint32(senders))
+		msg.payload = binary.LittleEndian.AppendUint32(msg.payload, uint32(receivers))
+		msg.payloadSize = uint32(len(msg.payload))
+	}
+	return msg
+}
+
 func NewDataMessage(d DataType, payload []byte, opts MessageOptions) Message {
 	messageType := Data
 	if d == Games {
@@ -89,6 +126,17 @@ func NewDataMessage(d DataType, payload []byte, opts MessageOptions) Message {
 	}
 }
 
+// NewCancelMessage tells every controller to drop the state of the
+// client request and stop processing it
+func NewCancelMessage(opts MessageOptions) Message {
+	return Message{
+		messageType: Cancel,
+		messageID:   opts.MessageID,
+		clientID:    opts.ClientID,
+		requestID:   opts.RequestID,
+	}
+}
+
 func NewResultsMessage(q QueryNumber, payload []byte, opts MessageOptions) Message {
 	messageType := Results
 	qb := byte(q)
@@ -128,35 +176,46 @@ func (m Message) GetRequestID() uint32 {
 	return m.requestID
 }
 
-func (m Message) HasGameData() bool {
-	utils.Assert(m.ExpectKind(Data) || m.ExpectKind(End), "the payload must be data")
-	return m.messageType>>2 == 1
+func (m Message) GetClientKey() ClientKey {
+	return ClientKey{ClientID: m.clientID, RequestID: m.requestID}
 }
 
-func (m Message) HasReviewData() bool {
-	utils.Assert(m.ExpectKind(Data) || m.ExpectKind(End), "the payload must be  data")
-	return m.messageType>>2 == 0
+// GetSenders returns how many ENDs close the data of the request, one
+// for every partition of the stage that sent them. Only ENDs can come
+// from more than one sender.
+func (m Message) GetSenders() int {
+	if !m.ExpectKind(End) || len(m.payload) < 8 {
+		return 1
+	}
+	return int(binary.LittleEndian.Uint32(m.payload[:4]))
 }
 
-func (m Message) GetQueryNumber() int {
-	b := byte(m.messageType)
-	if (b & byte(Query1)) == byte(Query1) {
+// GetReceivers returns how many partitions got the END, the ENDs they
+// send must be gathered from all of them
+func (m Message) GetReceivers() int {
+	if !m.ExpectKind(End) || len(m.payload) < 8 {
 		return 1
 	}
-	if (b & byte(Query2)) == byte(Query2) {
-		return 2
-	}
-	if (b & byte(Query3)) == byte(Query3) {
-		return 3
-	}
-	if (b & byte(Query4)) == byte(Query4) {
-		return 4
-	}
-	if (b & byte(Query5)) == byte(Query5) {
-		return 5
+	return int(binary.LittleEndian.Uint32(m.payload[4:8]))
+}
+
+// HasGameData reports whether a data message or an END is about games,
+// the other messages carry neither games nor reviews
+func (m Message) HasGameData() bool {
+	return (m.ExpectKind(Data) || m.ExpectKind(End)) && m.messageType>>2 == 1
+}
+
+func (m Message) HasReviewData() bool {
+	return (m.ExpectKind(Data) || m.ExpectKind(End)) && m.messageType>>2 == 0
+}
+
+// GetQueryNumber returns the query the results, or their END, belong to
+func (m Message) GetQueryNumber() (int, error) {
+	query := int(byte(m.messageType) >> 3)
+	if (query < 1 || query > Query8.Number()) && query != Rejections.Number() {
+		return 0, fmt.Errorf("malformed header type: unknown query %d", query)
 	}
-	utils.Assert(false, "malformed header type")
-	return -1
+	return query, nil
 }
 
 func (m Message) Marshal() []byte {
@@ -181,13 +240,29 @@ func (m Message) Marshal() []byte {
 	return buf.Bytes()
 }
 
+// PeekClientKey reads the request a marshaled message belongs to without
+// unmarshaling it
+func PeekClientKey(p []byte) (ClientKey, error) {
+	if len(p) < 17 {
+		return ClientKey{}, fmt.Errorf("invalid message: header too short")
+	}
+	return ClientKey{
+		ClientID:  binary.LittleEndian.Uint32(p[5:9]),
+		RequestID: binary.LittleEndian.Uint32(p[9:13]),
+	}, nil
+}
+
 func (m *Message) Unmarshal(p []byte) error {
 	if len(p) == 0 {
 		return fmt.Errorf("invalid message: empty")
 	}
 
+	if len(p) < 17 {
+		return fmt.Errorf("invalid message: header too short")
+	}
+
 	maskedMessageType := MessageType(p[0] & 0x3)
-	if maskedMessageType != Data && maskedMessageType != Results && maskedMessageType != End {
+	if maskedMessageType != Data && maskedMessageType != Results && maskedMessageType != End && maskedMessageType != Cancel {
 		return fmt.Errorf("invalid message: unknown message type")
 	}
 	m.messageType = MessageType(p[0])
@@ -196,12 +271,35 @@ func (m *Message) Unmarshal(p []byte) error {
 	m.requestID = binary.LittleEndian.Uint32(p[9:13])
 	m.payloadSize = binary.LittleEndian.Uint32(p[13:17])
 	m.payload = p[17:]
-	utils.Assertf(len(m.payload) == int(m.payloadSize), "the payload size should be equal to the len of the payload: %d != %d", len(m.payload), int(m.payloadSize))
+	if len(m.payload) != int(m.payloadSize) {
+		return fmt.Errorf("invalid message: the payload has %d bytes instead of %d", len(m.payload), m.payloadSize)
+	}
+
+	// The payload is checked here so that reading it can't go past its
+	// end, whatever the node that sent it
+	switch maskedMessageType {
+	case Data, Results:
+		if _, err := newPayloadElements(m.payload); err != nil {
+			return fmt.Errorf("invalid message: malformed payload: %w", err)
+		}
+	case End:
+		if len(m.payload) != 0 && len(m.payload) != 8 {
+			return fmt.Errorf("invalid message: end payload of %d bytes", len(m.payload))
+		}
+		if m.GetSenders() < 1 || m.GetReceivers() < 1 {
+			return fmt.Errorf("invalid message: end without senders or receivers")
+		}
+	}
 	return nil
 }
 
+// Elements returns the elements of the payload of a data or results
+// message, Unmarshal already checked they can be read
 func (m *Message) Elements() *PayloadElements {
-	elements, _ := newPayloadElements(m.payload)
+	elements, err := newPayloadElements(m.payload)
+	if err != nil {
+		return &PayloadElements{}
+	}
 	return elements
 }
 
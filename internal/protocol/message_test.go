@@ -1,6 +1,8 @@
 package protocol_test
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
@@ -98,31 +100,34 @@ func TestCreatingADataMessage(t *testing.T) {
 		}
 		elements := msg.Elements()
 		for i, element := range elements.Iter() {
-			b := element.ReadByte()
-			if b != tts[i].b {
-				t.Errorf("expected %d got %d", tts[i].b, b)
+			b, err := element.ReadByte()
+			if err != nil || b != tts[i].b {
+				t.Errorf("expected %d got %d (%v)", tts[i].b, b, err)
 			}
 
-			str := string(element.ReadBytes())
-			if str != string(tts[i].bs) {
-				t.Errorf("expected %#v, got %#v", string(tts[i].bs), str)
+			bs, err := element.ReadBytes()
+			if err != nil || string(bs) != string(tts[i].bs) {
+				t.Errorf("expected %#v, got %#v (%v)", string(tts[i].bs), string(bs), err)
 			}
 
-			u := element.ReadUint32()
-			if u != tts[i].u {
-				t.Errorf("expected %d got %d", tts[i].u, u)
+			u, err := element.ReadUint32()
+			if err != nil || u != tts[i].u {
+				t.Errorf("expected %d got %d (%v)", tts[i].u, u, err)
 			}
 
-			f := element.ReadFloat32()
-			if f != tts[i].f {
-				t.Errorf("expected %f got %f", tts[i].f, f)
+			f, err := element.ReadFloat32()
+			if err != nil || f != tts[i].f {
+				t.Errorf("expected %f got %f (%v)", tts[i].f, f, err)
+			}
+			if len(element) != 0 {
+				t.Errorf("expected the element to be read whole, %d bytes left", len(element))
 			}
 		}
 	})
 }
 
 func TestCreatingAResultsessage(t *testing.T) {
-	for i, query := range []protocol.QueryNumber{protocol.Query1, protocol.Query2, protocol.Query3, protocol.Query4, protocol.Query5} {
+	for i, query := range []protocol.QueryNumber{protocol.Query1, protocol.Query2, protocol.Query3, protocol.Query4, protocol.Query5, protocol.Query6, protocol.Query7, protocol.Query8} {
 		testName := fmt.Sprintf("create games query %d", i+1)
 		t.Run(testName, func(t *testing.T) {
 			msg := protocol.NewResultsMessage(query, []byte("elden ring results"), protocol.MessageOptions{
@@ -135,16 +140,72 @@ func TestCreatingAResultsessage(t *testing.T) {
 				t.Error("expected message kind results")
 			}
 			want := i + 1
-			got := msg.GetQueryNumber()
-			if got != want {
-				t.Errorf("got query number %d, want %d", got, want)
+			got, err := msg.GetQueryNumber()
+			if err != nil || got != want {
+				t.Errorf("got query number %d, want %d (%v)", got, want, err)
 			}
 		})
 	}
 }
 
+func TestCreatingACancelMessage(t *testing.T) {
+	msg := protocol.NewCancelMessage(protocol.MessageOptions{
+		MessageID: 8,
+		ClientID:  1,
+		RequestID: 2,
+	})
+	if !msg.ExpectKind(protocol.Cancel) {
+		t.Error("expected message kind cancel")
+	}
+
+	var unmarshaledMsg protocol.Message
+	if err := unmarshaledMsg.Unmarshal(msg.Marshal()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	want := protocol.ClientKey{ClientID: 1, RequestID: 2}
+	if got := unmarshaledMsg.GetClientKey(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCreatingAPartitionedEndMessage(t *testing.T) {
+	opts := protocol.MessageOptions{MessageID: 8, ClientID: 3, RequestID: 4}
+	end := protocol.NewEndMessage(protocol.Games, opts)
+	if end.GetSenders() != 1 || end.GetReceivers() != 1 {
+		t.Errorf("expected a single sender and receiver, got %d and %d", end.GetSenders(), end.GetReceivers())
+	}
+
+	msg := protocol.NewPartitionedEndMessage(protocol.Reviews, 3, 2, opts)
+	data := msg.Marshal()
+	var unmarshaledMsg protocol.Message
+	if err := unmarshaledMsg.Unmarshal(data); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !unmarshaledMsg.ExpectKind(protocol.End) || !unmarshaledMsg.HasReviewData() {
+		t.Error("expected a reviews end message")
+	}
+	if got := unmarshaledMsg.GetSenders(); got != 3 {
+		t.Errorf("expected 3 senders, got %d", got)
+	}
+	if got := unmarshaledMsg.GetReceivers(); got != 2 {
+		t.Errorf("expected 2 receivers, got %d", got)
+	}
+
+	key, err := protocol.PeekClientKey(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := (protocol.ClientKey{ClientID: 3, RequestID: 4}); key != want {
+		t.Errorf("got %v, want %v", key, want)
+	}
+}
+
 func TestMarshalAndUnmarshalOfMessage(t *testing.T) {
-	msg := protocol.NewDataMessage(protocol.Games, []byte("elden ring"), protocol.MessageOptions{
+	buffer := protocol.NewPayloadBuffer(1)
+	buffer.BeginPayloadElement()
+	buffer.WriteBytes([]byte("elden ring"))
+	buffer.EndPayloadElement()
+	msg := protocol.NewDataMessage(protocol.Games, buffer.Bytes(), protocol.MessageOptions{
 		MessageID: 8,
 		ClientID:  1,
 		RequestID: 1,
@@ -161,3 +222,78 @@ func TestMarshalAndUnmarshalOfMessage(t *testing.T) {
 		t.Errorf("got %#v, want %#v", unmarshaledMsg, msg)
 	}
 }
+
+func TestUnmarshalRejectsMalformedMessages(t *testing.T) {
+	opts := protocol.MessageOptions{MessageID: 8, ClientID: 1, RequestID: 1}
+	buffer := protocol.NewPayloadBuffer(1)
+	buffer.BeginPayloadElement()
+	buffer.WriteBytes([]byte("elden ring"))
+	buffer.EndPayloadElement()
+	elements := buffer.Bytes()
+	data := protocol.NewDataMessage(protocol.Games, elements, opts).Marshal()
+
+	// withPayload appends payload to the header of msg, which says the
+	// payload has size bytes
+	withPayload := func(msg protocol.Message, payload []byte, size int) []byte {
+		header := msg.Marshal()
+		binary.LittleEndian.PutUint32(header[13:17], uint32(size))
+		return append(header, payload...)
+	}
+	games := protocol.NewDataMessage(protocol.Games, nil, opts)
+	end := protocol.NewEndMessage(protocol.Games, opts)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated message", data[:len(data)-3]},
+		{"payload shorter than its size", withPayload(games, []byte{0, 0, 0, 0}, 8)},
+		{"truncated element count", withPayload(games, []byte{1, 0}, 2)},
+		{"element count without elements", withPayload(games, []byte{2, 0, 0, 0}, 4)},
+		{"element longer than the payload", withPayload(games, elements[:10], 10)},
+		{"end with a partial payload", withPayload(end, []byte{2, 0, 0, 0}, 4)},
+		{"end without senders", withPayload(end, []byte{0, 0, 0, 0, 1, 0, 0, 0}, 8)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg protocol.Message
+			if err := msg.Unmarshal(tt.data); err == nil {
+				t.Errorf("expected the message to be invalid")
+			}
+		})
+	}
+}
+
+func TestElementReadsPastItsEnd(t *testing.T) {
+	buffer := protocol.NewPayloadBuffer(1)
+	buffer.BeginPayloadElement()
+	buffer.WriteUint32(20)
+	buffer.WriteByte(1)
+	buffer.EndPayloadElement()
+	msg := protocol.NewDataMessage(protocol.Games, buffer.Bytes(), protocol.MessageOptions{})
+
+	element, ok := msg.Elements().NextElement()
+	if !ok {
+		t.Fatal("expected an element")
+	}
+	// The length says 20 bytes follow but there's only one
+	if _, err := element.ReadBytes(); !errors.Is(err, protocol.ErrShortElement) {
+		t.Errorf("expected a short element, got %v", err)
+	}
+	if _, err := element.ReadUint64(); !errors.Is(err, protocol.ErrShortElement) {
+		t.Errorf("expected a short element, got %v", err)
+	}
+	if b, err := element.ReadByte(); err != nil || b != 1 {
+		t.Errorf("expected to read the last byte, got %d (%v)", b, err)
+	}
+	if _, err := element.ReadFloat32(); !errors.Is(err, protocol.ErrShortElement) {
+		t.Errorf("expected a short element, got %v", err)
+	}
+}
+
+func TestGetQueryNumberOfAMessageWithoutQuery(t *testing.T) {
+	msg := protocol.NewEndMessage(protocol.Games, protocol.MessageOptions{})
+	if _, err := msg.GetQueryNumber(); err == nil {
+		t.Error("expected an end without query to have no query number")
+	}
+}
@@ -0,0 +1,75 @@
+package results
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/protocol"
+)
+
+// maxRejectionSamples is how many lines of every reason are shown to the
+// client
+const maxRejectionSamples = 3
+
+type rejectionCount struct {
+	lines   uint64
+	samples []string
+}
+
+// rejections counts the csv lines the projections dropped by reason
+type rejections map[string]*rejectionCount
+
+func (r rejections) add(reason string, line string) {
+	count, ok := r[reason]
+	if !ok {
+		count = &rejectionCount{}
+		r[reason] = count
+	}
+	count.lines++
+	if len(count.samples) < maxRejectionSamples {
+		count.samples = append(count.samples, line)
+	}
+}
+
+// addAll adds the rejected line of every element, which has its reason
+// and the line. None is added if any element can't be read.
+func (r rejections) addAll(elements *protocol.PayloadElements) error {
+	type row struct{ reason, line []byte }
+	var rows []row
+	for _, element := range elements.Iter() {
+		reason, err := element.ReadBytes()
+		if err != nil {
+			return err
+		}
+		line, err := element.ReadBytes()
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row{reason, line})
+	}
+	for _, row := range rows {
+		r.add(string(row.reason), string(row.line))
+	}
+	return nil
+}
+
+// summary has a line for every reason followed by its samples, like
+//
+//	games: invalid Release date: 2 lines
+//	  "20200,Galactic Bowling,not a date,..."
+func (r rejections) summary() string {
+	if len(r) == 0 {
+		return "no rejected lines"
+	}
+	var builder strings.Builder
+	for _, reason := range slices.Sorted(maps.Keys(r)) {
+		count := r[reason]
+		fmt.Fprintf(&builder, "%s: %d lines\n", reason, count.lines)
+		for _, sample := range count.samples {
+			fmt.Fprintf(&builder, "  %q\n", sample)
+		}
+	}
+	return strings.TrimSuffix(builder.String(), "\n")
+}
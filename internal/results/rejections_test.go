@@ -0,0 +1,25 @@
+package results
+
+import "testing"
+
+func TestRejectionsSummaryCapsTheSamples(t *testing.T) {
+	r := make(rejections)
+	if got := r.summary(); got != "no rejected lines" {
+		t.Errorf("unexpected summary without rejections: %q", got)
+	}
+
+	for _, line := range []string{"1,a", "2,b", "3,c", "4,d", "5,e"} {
+		r.add("reviews: wrong number of fields", line)
+	}
+	r.add("games: invalid Price", "10,free")
+
+	want := `games: invalid Price: 1 lines
+  "10,free"
+reviews: wrong number of fields: 5 lines
+  "1,a"
+  "2,b"
+  "3,c"`
+	if got := r.summary(); got != want {
+		t.Errorf("expected summary\n%s\ngot\n%s", want, got)
+	}
+}
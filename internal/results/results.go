@@ -2,6 +2,7 @@ package results
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"slices"
@@ -28,6 +29,12 @@ type query4 []string
 
 type query5 []string
 
+type query6 []string
+
+type query7 []string
+
+type query8 []string
+
 type receivedQuerys uint8
 
 const (
@@ -36,7 +43,10 @@ const (
 	query3Received    receivedQuerys = 1 << 2
 	query4Received    receivedQuerys = 1 << 3
 	query5Received    receivedQuerys = 1 << 4
-	allQuerysReceived receivedQuerys = query1Received | query2Received | query3Received | query4Received | query5Received
+	query6Received    receivedQuerys = 1 << 5
+	query7Received    receivedQuerys = 1 << 6
+	query8Received    receivedQuerys = 1 << 7
+	allQuerysReceived receivedQuerys = query1Received | query2Received | query3Received | query4Received | query5Received | query6Received | query7Received | query8Received
 )
 
 type results struct {
@@ -45,24 +55,94 @@ type results struct {
 	q3       query3
 	q4       query4
 	q5       query5
+	q6       query6
+	q7       query7
+	q8       query8
 	received receivedQuerys
+	// rejections are the csv lines the projections dropped
+	rejections rejections
+	// ENDs gathered for every query, partitioned stages send several
+	ends map[int]int
 }
 
+var ErrRequestCancelled = errors.New("request cancelled while waiting for results")
+
 type ResultsService struct {
 	client *communication.Protocol
 	io     *client.IOManager
+	store  *Store
 	done   chan struct{}
 	res    *results
+
+	clientId   uint32
+	requestId  uint32
+	clientGone bool
 }
 
 // I don't own the connection
-func NewResultsService(client *communication.Protocol, io *client.IOManager) *ResultsService {
+func NewResultsService(client *communication.Protocol, io *client.IOManager, store *Store) *ResultsService {
 	return &ResultsService{
-		client: client,
-		io:     io,
-		done:   make(chan struct{}),
-		res:    &results{},
+		client:    client,
+		io:        io,
+		store:     store,
+		done:      make(chan struct{}),
+		res:       &results{ends: make(map[int]int), rejections: make(rejections)},
+		clientId:  client.ClientId(),
+		requestId: client.RequestId(),
+	}
+}
+
+// publish stores the results of a query and sends them to the client.
+// Once the client is gone results are only stored, it can fetch them
+// later.
+func (r *ResultsService) publish(query message.ResultType, data []byte) error {
+	if err := r.store.Save(r.clientId, r.requestId, query, data); err != nil {
+		return err
+	}
+	if r.clientGone {
+		return nil
+	}
+
+	messageResult := &message.ResultMessageConfig{}
+	messageResult.ResultType = query
+	messageResult.Data = data
+	if err := r.client.SendResultMessage(messageResult); err != nil {
+		slog.Warn("client gone, storing the remaining results", "client", r.clientId, "request", r.requestId, "error", err)
+		r.clientGone = true
+	}
+	return nil
+}
+
+// readQuery1 reads the windows, mac and linux counts of the query 1
+func readQuery1(elements *protocol.PayloadElements) (query1, error) {
+	var q1 query1
+	for _, element := range elements.Iter() {
+		var err error
+		if q1.windows, err = element.ReadUint32(); err != nil {
+			return query1{}, err
+		}
+		if q1.mac, err = element.ReadUint32(); err != nil {
+			return query1{}, err
+		}
+		if q1.linux, err = element.ReadUint32(); err != nil {
+			return query1{}, err
+		}
+	}
+	return q1, nil
+}
+
+// appendLines appends a line for every element to lines, which are
+// returned unchanged if any element can't be read
+func appendLines[S ~[]string](lines S, elements *protocol.PayloadElements) (S, error) {
+	var read S
+	for _, element := range elements.Iter() {
+		line, err := element.ReadBytes()
+		if err != nil {
+			return lines, err
+		}
+		read = append(read, string(line))
 	}
+	return append(lines, read...), nil
 }
 
 func (r *ResultsService) Done() <-chan struct{} {
@@ -70,10 +150,13 @@ func (r *ResultsService) Done() <-chan struct{} {
 }
 
 func (r *ResultsService) Run(ctx context.Context) error {
-	consumerCh := r.io.Input.GetConsumer()
 	defer func() {
 		r.done <- struct{}{}
 	}()
+	consumerCh, err := r.io.Consume()
+	if err != nil {
+		return err
+	}
 
 	for {
 		select {
@@ -81,101 +164,145 @@ func (r *ResultsService) Run(ctx context.Context) error {
 			msgBytes := delivery.Body
 			var msg protocol.Message
 			if err := msg.Unmarshal(msgBytes); err != nil {
-				return fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				reason := fmt.Errorf("couldn't unmarshal protocol message: %w", err)
+				r.io.Reject(delivery, reason)
+				continue
+			}
+			if msg.GetClientID() != r.clientId || msg.GetRequestID() != r.requestId {
+				// Leftovers of a request that was cancelled
+				slog.Debug("dropping message of another request", "client", msg.GetClientID(), "request", msg.GetRequestID())
+				delivery.Ack()
+				continue
+			}
+			if msg.ExpectKind(protocol.Cancel) {
+				delivery.Ack()
+				return ErrRequestCancelled
 			}
 			if msg.ExpectKind(protocol.Results) {
-				queryNumber := msg.GetQueryNumber()
+				queryNumber, err := msg.GetQueryNumber()
+				if err != nil {
+					r.io.Reject(delivery, err)
+					continue
+				}
+				// A malformed message is rejected whole, the results
+				// are kept only once every element was read
 				elements := msg.Elements()
 				switch queryNumber {
 				case 1:
 					slog.Debug("query 1")
-					for _, element := range elements.Iter() {
-						r.res.q1 = query1{
-							windows: element.ReadUint32(),
-							mac:     element.ReadUint32(),
-							linux:   element.ReadUint32(),
-						}
+					q1, err := readQuery1(elements)
+					if err != nil {
+						r.io.Reject(delivery, fmt.Errorf("couldn't read query 1 results: %w", err))
+						continue
 					}
+					r.res.q1 = q1
 					r.res.received |= query1Received
 
-					messageResult := &message.ResultMessageConfig{}
-					messageResult.ResultType = message.Query1
-					messageResult.Data = []byte(fmt.Sprintf("%d,%d,%d", r.res.q1.windows, r.res.q1.mac, r.res.q1.linux))
-					if err := r.client.SendResultMessage(messageResult); err != nil {
-						return fmt.Errorf("couldn't write query 1: %w", err)
+					data := []byte(fmt.Sprintf("%d,%d,%d", r.res.q1.windows, r.res.q1.mac, r.res.q1.linux))
+					if err := r.publish(message.Query1, data); err != nil {
+						return err
 					}
 				case 2:
-					for _, element := range elements.Iter() {
-						r.res.q2 = append(r.res.q2, string(element.ReadBytes()))
-					}
+					r.res.q2, err = appendLines(r.res.q2, elements)
 				case 3:
-					for _, element := range elements.Iter() {
-						r.res.q3 = append(r.res.q3, string(element.ReadBytes()))
-					}
+					r.res.q3, err = appendLines(r.res.q3, elements)
 				case 4:
-					for _, element := range elements.Iter() {
-						r.res.q4 = append(r.res.q4, string(element.ReadBytes()))
-					}
+					r.res.q4, err = appendLines(r.res.q4, elements)
 				case 5:
-					for _, element := range elements.Iter() {
-						r.res.q5 = append(r.res.q5, string(element.ReadBytes()))
-					}
+					r.res.q5, err = appendLines(r.res.q5, elements)
+				case 6:
+					r.res.q6, err = appendLines(r.res.q6, elements)
+				case 7:
+					r.res.q7, err = appendLines(r.res.q7, elements)
+				case 8:
+					r.res.q8, err = appendLines(r.res.q8, elements)
+				case protocol.Rejections.Number():
+					err = r.res.rejections.addAll(elements)
 				default:
 					utils.Assertf(false, "query number %d should not happen", queryNumber)
 				}
+				if err != nil {
+					r.io.Reject(delivery, fmt.Errorf("couldn't read query %d results: %w", queryNumber, err))
+					continue
+				}
 			} else if msg.ExpectKind(protocol.End) {
-				queryNumber := msg.GetQueryNumber()
+				queryNumber, err := msg.GetQueryNumber()
+				if err != nil {
+					r.io.Reject(delivery, err)
+					continue
+				}
+				// The query 1 and the rejections don't end with an END
+				if queryNumber == 1 || queryNumber == protocol.Rejections.Number() {
+					r.io.Reject(delivery, fmt.Errorf("unexpected end of query %d", queryNumber))
+					continue
+				}
+				r.res.ends[queryNumber]++
+				if r.res.ends[queryNumber] < msg.GetSenders() {
+					slog.Debug("waiting for the ends of the other partitions", "query", queryNumber)
+					delivery.Ack()
+					continue
+				}
 				switch queryNumber {
 				case 2:
 					slog.Debug("query 2")
 					r.res.received |= query2Received
-					messageResult := &message.ResultMessageConfig{}
-					messageResult.ResultType = message.Query2
-					messageResult.Data = []byte(strings.Join(r.res.q2[:], "\n"))
-					if err := r.client.SendResultMessage(messageResult); err != nil {
-						return fmt.Errorf("couldn't write query 2: %w", err)
+					if err := r.publish(message.Query2, []byte(strings.Join(r.res.q2[:], "\n"))); err != nil {
+						return err
 					}
 				case 3:
 					slog.Debug("query 3")
 					r.res.received |= query3Received
-					messageResult := &message.ResultMessageConfig{}
-					messageResult.ResultType = message.Query3
-					messageResult.Data = []byte(strings.Join(r.res.q3[:], "\n"))
-					if err := r.client.SendResultMessage(messageResult); err != nil {
-						return fmt.Errorf("couldn't write query 3: %w", err)
+					if err := r.publish(message.Query3, []byte(strings.Join(r.res.q3[:], "\n"))); err != nil {
+						return err
 					}
 				case 4:
 					slog.Debug("query 4")
 					r.res.received |= query4Received
 					slices.Sort(r.res.q4)
-					messageResult := &message.ResultMessageConfig{}
-					messageResult.ResultType = message.Query4
-					messageResult.Data = []byte(strings.Join(r.res.q4, "\n"))
-					if err := r.client.SendResultMessage(messageResult); err != nil {
-						return fmt.Errorf("couldn't write query 4: %w", err)
+					if err := r.publish(message.Query4, []byte(strings.Join(r.res.q4, "\n"))); err != nil {
+						return err
 					}
 				case 5:
 					slog.Debug("query 5")
 					r.res.received |= query5Received
 					slices.Sort(r.res.q5)
-					messageResult := &message.ResultMessageConfig{}
-					messageResult.ResultType = message.Query5
-					messageResult.Data = []byte(strings.Join(r.res.q5, "\n"))
-					if err := r.client.SendResultMessage(messageResult); err != nil {
-						return fmt.Errorf("couldn't write query 5: %w", err)
+					if err := r.publish(message.Query5, []byte(strings.Join(r.res.q5, "\n"))); err != nil {
+						return err
+					}
+				case 6:
+					slog.Debug("query 6")
+					r.res.received |= query6Received
+					slices.Sort(r.res.q6)
+					if err := r.publish(message.Query6, []byte(strings.Join(r.res.q6, "\n"))); err != nil {
+						return err
+					}
+				case 7:
+					slog.Debug("query 7")
+					r.res.received |= query7Received
+					if err := r.publish(message.Query7, []byte(strings.Join(r.res.q7, "\n"))); err != nil {
+						return err
+					}
+				case 8:
+					slog.Debug("query 8")
+					r.res.received |= query8Received
+					if err := r.publish(message.Query8, []byte(strings.Join(r.res.q8, "\n"))); err != nil {
+						return err
 					}
 				default:
 					utils.Assertf(false, "query number %d should not happen in end", queryNumber)
 				}
 			} else {
-				return fmt.Errorf("unexpected message type: %s", msg.GetMessageType())
+				r.io.Reject(delivery, fmt.Errorf("unexpected message type: %s", msg.GetMessageType()))
+				continue
 			}
-			if err := delivery.Ack(false); err != nil {
+			if err := delivery.Ack(); err != nil {
 				slog.Error("acknowledge error", "error", err)
 			}
 			if r.res.received == allQuerysReceived {
 				slog.Debug("all querys received")
-				return nil
+				// The lines are rejected before the ENDs go through
+				// the projections, every report already arrived
+				return r.publish(message.Rejections, []byte(r.res.rejections.summary()))
 			}
 		case <-ctx.Done():
 			return ctx.Err()
@@ -0,0 +1,133 @@
+package results
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/communication/message"
+)
+
+const queryCount = 8
+
+// AllQueriesFinished is the finished mask of a request whose eight
+// queries are stored
+const AllQueriesFinished uint8 = 1<<queryCount - 1
+
+// Store keeps the results of every request on disk, one directory per
+// client request and one file per finished query. It's safe to use from
+// the goroutines that answer status and fetch requests.
+type Store struct {
+	dir   string
+	mutex sync.RWMutex
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("couldn't create results directory %s: %w", dir, err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) requestDir(clientId uint32, requestId uint32) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d-%d", clientId, requestId))
+}
+
+func queryFile(query message.ResultType) string {
+	if query == message.Rejections {
+		return "rejections.result"
+	}
+	return fmt.Sprintf("query%d.result", query+1)
+}
+
+// Save writes the results of a query. The file is renamed into place so
+// a crash never leaves a partially written result behind.
+func (s *Store) Save(clientId uint32, requestId uint32, query message.ResultType, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	dir := s.requestDir(clientId, requestId)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("couldn't create request directory: %w", err)
+	}
+
+	path := filepath.Join(dir, queryFile(query))
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("couldn't write query %d results: %w", query+1, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("couldn't store query %d results: %w", query+1, err)
+	}
+	return nil
+}
+
+func (s *Store) Load(clientId uint32, requestId uint32, query message.ResultType) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	path := filepath.Join(s.requestDir(clientId, requestId), queryFile(query))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read query %d results: %w", query+1, err)
+	}
+	return data, nil
+}
+
+// Finished returns a mask with the bit of every stored query set, and
+// whether anything was ever stored for the request
+func (s *Store) Finished(clientId uint32, requestId uint32) (uint8, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	dir := s.requestDir(clientId, requestId)
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	var finished uint8
+	for query := message.Query1; query <= message.Query8; query++ {
+		_, err := os.Stat(filepath.Join(dir, queryFile(query)))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, true, err
+		}
+		finished |= 1 << query
+	}
+	return finished, true, nil
+}
+
+// NextClientId returns a client id no stored request uses, so ids given
+// after a restart don't collide with the stored ones
+func (s *Store) NextClientId() (uint32, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var next uint32
+	for _, entry := range entries {
+		clientId, _, ok := strings.Cut(entry.Name(), "-")
+		if !ok || !entry.IsDir() {
+			continue
+		}
+		id, err := strconv.ParseUint(clientId, 10, 32)
+		if err != nil {
+			continue
+		}
+		next = max(next, uint32(id)+1)
+	}
+	return next, nil
+}
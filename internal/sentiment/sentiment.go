@@ -0,0 +1,129 @@
+// Package sentiment scores the sentiment of english texts with a word
+// lexicon. The lexicon is embedded, nothing is fetched over the network.
+package sentiment
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pemistahl/lingua-go"
+)
+
+// Language is the language of the lexicon, the texts in other languages
+// can't be scored
+const Language = lingua.English
+
+//go:embed lexicon.txt
+var lexiconFile string
+
+// negationScope is how many words after a negation it affects, a
+// punctuation mark ends it earlier
+const negationScope = 3
+
+// negationFactor is what the valence of a negated word is multiplied by,
+// "not good" is less negative than "bad"
+const negationFactor = -0.75
+
+// normalization makes the sum of the valences tend to one as it grows
+const normalization = 15
+
+var negations = map[string]bool{
+	"not":     true,
+	"no":      true,
+	"never":   true,
+	"nothing": true,
+	"without": true,
+	"hardly":  true,
+	"barely":  true,
+	"neither": true,
+	"nor":     true,
+}
+
+// lexicon has the valence of every word of lexicon.txt, it's only read
+// after init so it's safe for concurrent use
+var lexicon map[string]float64
+
+func init() {
+	var err error
+	lexicon, err = parseLexicon(lexiconFile)
+	if err != nil {
+		panic(fmt.Sprintf("couldn't parse the sentiment lexicon: %v", err))
+	}
+}
+
+func parseLexicon(file string) (map[string]float64, error) {
+	lexicon := make(map[string]float64)
+	scanner := bufio.NewScanner(strings.NewReader(file))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		word, value, ok := strings.Cut(text, " ")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected a word and its valence: %q", line, text)
+		}
+		valence, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid valence: %w", line, err)
+		}
+		lexicon[word] = valence
+	}
+	return lexicon, scanner.Err()
+}
+
+// Score returns the sentiment of text, from -1 (negative) to 1 (positive),
+// and how many of its words are in the lexicon. A text without any of
+// them scores 0 but it wasn't found neutral, it couldn't be scored. The
+// words after a negation, up to negationScope or the end of the clause,
+// count the other way.
+func Score(text string) (float32, int) {
+	var sum float64
+	hits := 0
+	negated := 0
+	word := strings.Builder{}
+	flush := func() {
+		if word.Len() == 0 {
+			return
+		}
+		w := strings.Trim(word.String(), "'")
+		word.Reset()
+		if isNegation(w) {
+			negated = negationScope
+			return
+		}
+		valence, ok := lexicon[w]
+		if ok {
+			hits++
+		}
+		if negated > 0 {
+			valence *= negationFactor
+			negated--
+		}
+		sum += valence
+	}
+
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(r) || r == '\'':
+			word.WriteRune(r)
+		case strings.ContainsRune(".,;:!?", r):
+			flush()
+			negated = 0
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	return float32(sum / math.Sqrt(sum*sum+normalization)), hits
+}
+
+func isNegation(word string) bool {
+	return negations[word] || strings.HasSuffix(word, "n't")
+}
@@ -0,0 +1,36 @@
+package sentiment_test
+
+import (
+	"testing"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/sentiment"
+)
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		text string
+		want func(float32) bool
+	}{
+		{"A great game, I loved it", func(s float32) bool { return s > 0.5 }},
+		{"Boring and buggy, a waste of money", func(s float32) bool { return s < -0.5 }},
+		{"It has a map and some levels", func(s float32) bool { return s == 0 }},
+		{"This is not good", func(s float32) bool { return s < 0 }},
+		{"I don't hate it", func(s float32) bool { return s > 0 }},
+		// The negation ends with the clause
+		{"Not cheap. But really fun", func(s float32) bool { return s > 0.5 }},
+	}
+	for _, tt := range tests {
+		if got, _ := sentiment.Score(tt.text); !tt.want(got) || got < -1 || got > 1 {
+			t.Errorf("unexpected score of %q: %f", tt.text, got)
+		}
+	}
+}
+
+func TestScoreCountsTheWordsOfTheLexicon(t *testing.T) {
+	if _, hits := sentiment.Score("It has a map and some levels"); hits != 0 {
+		t.Errorf("expected no lexicon words, got %d", hits)
+	}
+	if _, hits := sentiment.Score("Not cheap. But really fun"); hits != 2 {
+		t.Errorf("expected 2 lexicon words, got %d", hits)
+	}
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRU is a cache of at most capacity entries, adding one when it's full
+// evicts the least recently used. It's safe for concurrent use.
+type LRU[K comparable, V any] struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[K]*list.Element
+	// order has the most recently used entry at the front
+	order *list.List
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func NewLRU[K comparable, V any](capacity int) *LRU[K, V] {
+	return &LRU[K, V]{
+		capacity: capacity,
+		entries:  make(map[K]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(lruEntry[K, V]).value, true
+}
+
+func (c *LRU[K, V]) Put(key K, value V) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value = lruEntry[K, V]{key: key, value: value}
+		c.order.MoveToFront(element)
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(lruEntry[K, V]).key)
+	}
+	c.entries[key] = c.order.PushFront(lruEntry[K, V]{key: key, value: value})
+}
+
+func (c *LRU[K, V]) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,28 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/jab227/tp1-sistemas-distribuidos-2c/internal/utils"
+)
+
+func TestLRUEvictsTheLeastRecentlyUsed(t *testing.T) {
+	cache := utils.NewLRU[string, int](2)
+	cache.Put("a", 1)
+	cache.Put("b", 2)
+	// a becomes the most recently used, b is evicted
+	if value, ok := cache.Get("a"); !ok || value != 1 {
+		t.Fatalf("expected a=1, got %d %v", value, ok)
+	}
+	cache.Put("c", 3)
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("expected b to be evicted")
+	}
+	if value, ok := cache.Get("c"); !ok || value != 3 {
+		t.Errorf("expected c=3, got %d %v", value, ok)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("expected 2 entries, got %d", cache.Len())
+	}
+}